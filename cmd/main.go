@@ -3,15 +3,52 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/khaliullov/rtsp-proxy/rtspproxy"
 )
 
+// pinFlag collects repeated -upstream-pin host=sha256 values.
+type pinFlag map[string]string
+
+func (p pinFlag) String() string {
+	pins := make([]string, 0, len(p))
+	for host, fp := range p {
+		pins = append(pins, host+"="+fp)
+	}
+	return strings.Join(pins, ",")
+}
+
+func (p pinFlag) Set(value string) error {
+	host, fp, ok := strings.Cut(value, "=")
+	if !ok || host == "" || fp == "" {
+		return fmt.Errorf("expected host[:port]=sha256-fingerprint, got %q", value)
+	}
+	p[host] = fp
+	return nil
+}
+
+// listFlag collects repeated string values.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	if value == "" {
+		return fmt.Errorf("empty value")
+	}
+	*l = append(*l, value)
+	return nil
+}
+
 func main() {
 	var logFile string
 	var portNum int
@@ -21,6 +58,39 @@ func main() {
 	var bufferSize int
 	var dialTimeout time.Duration
 	var metricsPort int
+	var rtpPortMin int
+	var rtpPortMax int
+	var upstreamTransport string
+	var multicastInterface string
+	var multicastPublish string
+	var multicastPublishPort int
+	var multicastTTL int
+	var tlsPort int
+	var httpPort int
+	var hlsSegmentDuration time.Duration
+	var hlsSegmentCount int
+	var hlsPartDuration time.Duration
+	var webrtcPort int
+	var webrtcPublicIPs listFlag
+	var recordStreams listFlag
+	var recordDir string
+	var recordSegmentDuration time.Duration
+	var recordRetention time.Duration
+	var recordMaxSizeMB int64
+	var preEventBuffer time.Duration
+	var gopCache bool
+	var fallbackSlate string
+	var fallbackSlateFPS float64
+	var maxRedirects int
+	var tlsCert string
+	var tlsKey string
+	var tlsClientCA string
+	var usersFile string
+	var authRealm string
+	var upstreamCA string
+	var upstreamInsecure bool
+	upstreamPins := pinFlag{}
+	var upstreamTunnels listFlag
 
 	flag.StringVar(&logFile, "log", "-", "log file")
 	flag.IntVar(&portNum, "port", 554, "server port")
@@ -30,6 +100,39 @@ func main() {
 	flag.IntVar(&bufferSize, "buffer-size", 65536, "RTP/RTSP read buffer size in bytes")
 	flag.DurationVar(&dialTimeout, "dial-timeout", 5*time.Second, "upstream dial timeout")
 	flag.IntVar(&metricsPort, "metrics-port", 0, "Prometheus metrics HTTP port (0=disabled)")
+	flag.IntVar(&rtpPortMin, "rtp-port-min", 30000, "first UDP port for RTP/RTCP pairs")
+	flag.IntVar(&rtpPortMax, "rtp-port-max", 39999, "last UDP port for RTP/RTCP pairs")
+	flag.StringVar(&upstreamTransport, "upstream-transport", "tcp", "RTP transport towards cameras: tcp, udp or multicast")
+	flag.StringVar(&multicastInterface, "multicast-interface", "", "interface for joining upstream multicast groups")
+	flag.StringVar(&multicastPublish, "multicast-publish", "", "CIDR of groups for re-publishing streams to multicast clients (empty=disabled)")
+	flag.IntVar(&multicastPublishPort, "multicast-publish-port", 40000, "base UDP port of re-published tracks")
+	flag.IntVar(&multicastTTL, "multicast-ttl", 16, "TTL of re-published multicast packets")
+	flag.IntVar(&tlsPort, "tls-port", 0, "RTSPS server port (0=disabled, conventionally 322)")
+	flag.IntVar(&httpPort, "http-port", 0, "RTSP-over-HTTP tunnelling port (0=disabled, e.g. 80 or 8080)")
+	flag.DurationVar(&hlsSegmentDuration, "hls-segment-duration", 2*time.Second, "target HLS segment duration (cut at keyframes)")
+	flag.IntVar(&hlsSegmentCount, "hls-segment-count", 5, "segments listed in HLS playlists")
+	flag.DurationVar(&hlsPartDuration, "hls-part-duration", 200*time.Millisecond, "Low-Latency HLS part duration (0 disables LL-HLS)")
+	flag.IntVar(&webrtcPort, "webrtc-port", 0, "UDP port for WebRTC (WHEP) ICE and media (0=disabled)")
+	flag.Var(&webrtcPublicIPs, "webrtc-public-ip", "public IP announced in WebRTC ICE candidates, for 1:1 NAT (repeatable)")
+	flag.Var(&recordStreams, "record", "record a stream continuously: rtsp/[user:pass@]host[:port]/path[=dir] (repeatable)")
+	flag.StringVar(&recordDir, "record-dir", "recordings/{host}/{path}", "recording directory template ({scheme}, {host}, {path})")
+	flag.DurationVar(&recordSegmentDuration, "record-segment-duration", time.Minute, "recording segment duration (cut at keyframes)")
+	flag.DurationVar(&recordRetention, "record-retention", 0, "delete recordings older than this (0=keep forever)")
+	flag.Int64Var(&recordMaxSizeMB, "record-max-size-mb", 0, "delete the oldest recordings beyond this total size (0=unlimited)")
+	flag.DurationVar(&preEventBuffer, "pre-event-buffer", 0, "packets each connected stream keeps in memory for /clip/ export (0=disabled)")
+	flag.BoolVar(&gopCache, "gop-cache", true, "start new viewers at the last keyframe instead of waiting for the next one")
+	flag.StringVar(&fallbackSlate, "fallback-slate", "", "H.264 Annex-B file looped to viewers while their camera is unreachable")
+	flag.Float64Var(&fallbackSlateFPS, "fallback-slate-fps", 25, "frame rate of the fallback slate")
+	flag.IntVar(&maxRedirects, "max-redirects", 5, "3xx redirects followed when connecting to a camera (0=none)")
+	flag.StringVar(&tlsCert, "tls-cert", "", "RTSPS certificate file (PEM, reloaded on change)")
+	flag.StringVar(&tlsKey, "tls-key", "", "RTSPS private key file (PEM, reloaded on change)")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "CA bundle for verifying RTSPS client certificates (empty=no client auth)")
+	flag.StringVar(&usersFile, "users", "", "htpasswd/htdigest file of RTSP and HTTP client accounts, reloaded on change (empty=no client auth)")
+	flag.StringVar(&authRealm, "auth-realm", "RTSP-Proxy", "realm of the client authentication challenges")
+	flag.StringVar(&upstreamCA, "upstream-ca", "", "CA bundle for verifying rtsps cameras (empty=system roots)")
+	flag.Var(upstreamPins, "upstream-pin", "pin an rtsps camera certificate: host[:port]=sha256 fingerprint (repeatable)")
+	flag.BoolVar(&upstreamInsecure, "upstream-insecure-skip-verify", false, "do not verify rtsps camera certificates")
+	flag.Var(&upstreamTunnels, "upstream-http-tunnel", "reach a camera host[:port] through RTSP-over-HTTP tunnelling (repeatable)")
 	flag.Parse()
 
 	if logFile == "-" {
@@ -50,6 +153,37 @@ func main() {
 	cfg.BufferSize = bufferSize
 	cfg.DialTimeout = dialTimeout
 	cfg.MetricsPort = metricsPort
+	cfg.RTPPortMin = rtpPortMin
+	cfg.RTPPortMax = rtpPortMax
+	cfg.UpstreamTransport = upstreamTransport
+	cfg.MulticastInterface = multicastInterface
+	cfg.MulticastPublishRange = multicastPublish
+	cfg.MulticastPublishPort = multicastPublishPort
+	cfg.MulticastTTL = multicastTTL
+	cfg.TLSCert = tlsCert
+	cfg.TLSKey = tlsKey
+	cfg.TLSClientCA = tlsClientCA
+	cfg.UsersFile = usersFile
+	cfg.AuthRealm = authRealm
+	cfg.UpstreamCA = upstreamCA
+	cfg.UpstreamPins = upstreamPins
+	cfg.UpstreamInsecureSkipVerify = upstreamInsecure
+	cfg.UpstreamHTTPTunnelHosts = upstreamTunnels
+	cfg.HLSSegmentDuration = hlsSegmentDuration
+	cfg.HLSSegmentCount = hlsSegmentCount
+	cfg.HLSPartDuration = hlsPartDuration
+	cfg.WebRTCPublicIPs = webrtcPublicIPs
+	cfg.RecordStreams = recordStreams
+	cfg.RecordDir = recordDir
+	cfg.RecordSegmentDuration = recordSegmentDuration
+	cfg.RecordRetention = recordRetention
+	cfg.RecordMaxBytes = recordMaxSizeMB << 20
+	cfg.PreEventBuffer = preEventBuffer
+	cfg.GOPCache = gopCache
+	cfg.FallbackSlate = fallbackSlate
+	cfg.FallbackSlateFPS = fallbackSlateFPS
+	cfg.MaxRedirects = maxRedirects
+	cfg.Validate()
 
 	rtspproxy.SetVerbose(verbose)
 
@@ -65,6 +199,13 @@ func main() {
 
 	server := rtspproxy.NewServer(ctx)
 
+	if usersFile != "" {
+		if err := server.EnableAuth(); err != nil {
+			rtspproxy.LogCriticalf("Failed to enable client authentication: %v", err)
+			os.Exit(1)
+		}
+	}
+
 	err := server.Listen(portNum)
 	if err != nil {
 		rtspproxy.LogCriticalf("Failed to bind port: %d, error: %v", portNum, err)
@@ -72,6 +213,35 @@ func main() {
 	}
 	rtspproxy.LogCriticalf("Listening on port: %d", portNum)
 
+	if tlsPort > 0 {
+		if err := server.ListenTLS(tlsPort); err != nil {
+			rtspproxy.LogCriticalf("Failed to bind RTSPS port: %d, error: %v", tlsPort, err)
+			os.Exit(1)
+		}
+		rtspproxy.LogCriticalf("Listening for RTSPS on port: %d", tlsPort)
+	}
+
+	if httpPort > 0 {
+		if err := server.ListenHTTP(httpPort); err != nil {
+			rtspproxy.LogCriticalf("Failed to bind HTTP tunnel port: %d, error: %v", httpPort, err)
+			os.Exit(1)
+		}
+		rtspproxy.LogCriticalf("Listening for RTSP-over-HTTP on port: %d", httpPort)
+	}
+
+	if webrtcPort > 0 {
+		if err := server.ListenWebRTC(webrtcPort); err != nil {
+			rtspproxy.LogCriticalf("Failed to bind WebRTC UDP port: %d, error: %v", webrtcPort, err)
+			os.Exit(1)
+		}
+		rtspproxy.LogCriticalf("Listening for WebRTC on UDP port: %d", webrtcPort)
+	}
+
+	if err := server.StartRecording(); err != nil {
+		rtspproxy.LogCriticalf("Failed to start recording: %v", err)
+		os.Exit(1)
+	}
+
 	go server.Start()
 
 	select {
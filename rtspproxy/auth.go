@@ -0,0 +1,416 @@
+package rtspproxy
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Client authentication. With -users the proxy challenges RTSP clients
+// (plain, RTSPS, tunnelled and WebSocket alike) and the HTTP endpoints
+// (HLS, fMP4, WHEP, clips) with Digest and Basic and checks them against a
+// users file; an RTSP connection authenticates once, an HTTP request on its
+// own.
+// Proxy accounts have nothing to do with camera credentials: those still
+// come from the proxied URL (rtsp://proxy/rtsp/user:pass@camera/...) and
+// the client's Authorization header never reaches a camera.
+//
+// The users file takes htpasswd and htdigest lines:
+//
+//	alice:$2y$10$...                  bcrypt (htpasswd -B), Basic only
+//	bob:RTSP-Proxy:5f4dcc3b5aa765d6...  HA1 (htdigest), Digest or Basic
+//	carol:RTSP-Proxy:9f86d081...:SHA-512-256
+//
+// An HA1 is MD5 or, with 64 hex digits, SHA-256 unless an algorithm
+// follows it. Its realm has to be -auth-realm. Nonces carry their issue
+// time and an HMAC, so nothing is kept per challenge; an expired nonce
+// with good credentials gets a stale=true challenge. A Digest response
+// must name the request's URI and raise the nonce count of its nonce and
+// cnonce (without qop, use its nonce once), so a sniffed header cannot be
+// replayed.
+
+const (
+	// authNonceLifetime is how long a Digest nonce is accepted.
+	authNonceLifetime = 5 * time.Minute
+	// usersReloadInterval throttles how often the users file is stat'ed.
+	usersReloadInterval = time.Second
+)
+
+// userEntry is the stored secret of one account.
+type userEntry struct {
+	bcrypt    []byte // bcrypt hash, or
+	ha1       string // hex H(username:realm:password)
+	algorithm string // hash of ha1: MD5, SHA-256 or SHA-512-256
+}
+
+// userStore holds the proxy accounts and reloads them when the file changes.
+type userStore struct {
+	path   string
+	realm  string
+	secret []byte // nonce HMAC key
+
+	mu        sync.Mutex
+	users     map[string]userEntry
+	mod       time.Time
+	lastCheck time.Time
+	counts    map[string]nonceCount // by nonce and cnonce
+	lastPrune time.Time
+}
+
+// nonceCount is the highest nonce count a nonce and cnonce were used with.
+type nonceCount struct {
+	nc    uint64
+	first time.Time
+}
+
+func newUserStore(path, realm string) (*userStore, error) {
+	s := &userStore{path: path, realm: realm, secret: make([]byte, 32), counts: make(map[string]nonceCount)}
+	if _, err := rand.Read(s.secret); err != nil {
+		return nil, err
+	}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *userStore) reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	users, err := loadUsers(s.path, s.realm)
+	if err != nil {
+		return err
+	}
+	s.users = users
+	s.mod = info.ModTime()
+	return nil
+}
+
+// lookup returns the account of username, reloading a changed file first.
+// A failed reload keeps the previous accounts.
+func (s *userStore) lookup(username string) (userEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.lastCheck) >= usersReloadInterval {
+		s.lastCheck = time.Now()
+		if info, err := os.Stat(s.path); err == nil && !info.ModTime().Equal(s.mod) {
+			if err := s.reload(); err != nil {
+				LogCriticalf("⚠️ [AUTH] Users reload failed, keeping previous: %v", err)
+			} else {
+				LogCriticalf("🔐 [AUTH] Reloaded %d users from %s", len(s.users), s.path)
+			}
+		}
+	}
+	entry, ok := s.users[username]
+	return entry, ok
+}
+
+// algorithms returns the Digest algorithms of the HA1 entries, strongest first.
+func (s *userStore) algorithms() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var algorithms []string
+	for _, entry := range s.users {
+		if entry.ha1 != "" && !slices.Contains(algorithms, entry.algorithm) {
+			algorithms = append(algorithms, entry.algorithm)
+		}
+	}
+	slices.SortFunc(algorithms, func(a, b string) int { return digestStrength(b) - digestStrength(a) })
+	return algorithms
+}
+
+// loadUsers parses a users file. Lines it cannot use are logged and skipped.
+func loadUsers(path, realm string) (map[string]userEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]userEntry)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		var entry userEntry
+		switch {
+		case len(fields) == 2 && strings.HasPrefix(fields[1], "$2"):
+			if _, err := bcrypt.Cost([]byte(fields[1])); err != nil {
+				LogCriticalf("⚠️ [AUTH] %s:%d: %v", path, n, err)
+				continue
+			}
+			entry.bcrypt = []byte(fields[1])
+		case len(fields) == 3 || len(fields) == 4:
+			entry.ha1 = strings.ToLower(fields[2])
+			entry.algorithm = "MD5"
+			if len(entry.ha1) == 64 {
+				entry.algorithm = "SHA-256"
+			}
+			if len(fields) == 4 {
+				entry.algorithm = strings.ToUpper(fields[3])
+			}
+			if fields[1] != realm {
+				LogCriticalf("⚠️ [AUTH] %s:%d: realm %q is not %q", path, n, fields[1], realm)
+				continue
+			}
+			if _, err := hex.DecodeString(entry.ha1); err != nil || digestStrength(entry.algorithm) < 0 ||
+				strings.HasSuffix(entry.algorithm, "-SESS") || len(entry.ha1) != len(digestHash(entry.algorithm)("")) {
+				LogCriticalf("⚠️ [AUTH] %s:%d: not a %s HA1", path, n, entry.algorithm)
+				continue
+			}
+		default:
+			LogCriticalf("⚠️ [AUTH] %s:%d: unsupported entry (bcrypt or user:realm:HA1 expected)", path, n)
+			continue
+		}
+		users[fields[0]] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return users, nil
+}
+
+// nonce returns a Digest nonce issued at now. A random part keeps nonces
+// issued in the same second apart.
+func (s *userStore) nonce(now time.Time) string {
+	var salt [8]byte
+	rand.Read(salt[:])
+	issued := strconv.FormatInt(now.Unix(), 16) + "." + hex.EncodeToString(salt[:])
+	return issued + "." + s.nonceMAC(issued)
+}
+
+func (s *userStore) nonceMAC(issued string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(issued))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// checkNonce reports whether the proxy issued nonce and whether it expired.
+func (s *userStore) checkNonce(nonce string) (valid, expired bool) {
+	i := strings.LastIndexByte(nonce, '.')
+	if i < 0 || !hmac.Equal([]byte(nonce[i+1:]), []byte(s.nonceMAC(nonce[:i]))) {
+		return false, false
+	}
+	issued, _, _ := strings.Cut(nonce[:i], ".")
+	unix, err := strconv.ParseInt(issued, 16, 64)
+	if err != nil {
+		return false, false
+	}
+	return true, time.Since(time.Unix(unix, 0)) > authNonceLifetime
+}
+
+// countNonce records the nonce count of a verified Digest response and
+// reports whether it is above every count seen with its nonce and cnonce.
+// A response without qop has no count and may use its nonce once.
+func (s *userStore) countNonce(nonce, cnonce, nc string) bool {
+	var count uint64
+	if nc != "" {
+		var err error
+		if count, err = strconv.ParseUint(nc, 16, 32); err != nil || count == 0 {
+			return false
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.lastPrune) >= authNonceLifetime {
+		// A count outlives its nonce by checkNonce's expiry at most.
+		s.lastPrune = now
+		for key, c := range s.counts {
+			if now.Sub(c.first) > authNonceLifetime {
+				delete(s.counts, key)
+			}
+		}
+	}
+	key := nonce + " " + cnonce
+	c, seen := s.counts[key]
+	if seen && count <= c.nc {
+		return false
+	}
+	if !seen {
+		c.first = now
+	}
+	c.nc = count
+	s.counts[key] = c
+	return true
+}
+
+// challenges returns the WWW-Authenticate values for a 401: a Digest
+// challenge per algorithm in use, strongest first and sharing one nonce,
+// then Basic.
+func (s *userStore) challenges(stale bool) []string {
+	nonce := s.nonce(time.Now())
+	var challenges []string
+	for _, algorithm := range s.algorithms() {
+		c := fmt.Sprintf(`Digest realm="%s", nonce="%s", algorithm=%s, qop="auth"`, s.realm, nonce, algorithm)
+		if stale {
+			c += ", stale=true"
+		}
+		challenges = append(challenges, c)
+	}
+	return append(challenges, fmt.Sprintf(`Basic realm="%s"`, s.realm))
+}
+
+// challenge returns the challenges as one WWW-Authenticate value.
+func (s *userStore) challenge(stale bool) string {
+	return strings.Join(s.challenges(stale), ", ")
+}
+
+// sameURI reports whether the uri of a Digest response names the request
+// target raw, userinfo and the letter case of the host aside.
+func sameURI(uri, raw string) bool {
+	if uri == raw {
+		return true
+	}
+	a, errA := url.Parse(uri)
+	b, errB := url.Parse(raw)
+	if errA != nil || errB != nil {
+		return false
+	}
+	a.User, b.User = nil, nil
+	a.Host, b.Host = strings.ToLower(a.Host), strings.ToLower(b.Host)
+	return a.String() == b.String()
+}
+
+// authenticate checks the credentials of request and returns the account
+// name, or "" with stale set when only the Digest nonce was out of date.
+func (s *userStore) authenticate(request *Request) (username string, stale bool) {
+	auth := ParseAuthorizationHeader(headerGet(request.Headers, "Authorization"))
+	if auth == nil {
+		return "", false
+	}
+	entry, ok := s.lookup(auth.Username)
+	if !ok {
+		return "", false
+	}
+
+	if auth.Scheme == "Basic" {
+		if entry.bcrypt != nil {
+			if bcrypt.CompareHashAndPassword(entry.bcrypt, []byte(auth.Password)) != nil {
+				return "", false
+			}
+			return auth.Username, false
+		}
+		ha1 := digestHash(entry.algorithm)(fmt.Sprintf("%s:%s:%s", auth.Username, s.realm, auth.Password))
+		if subtle.ConstantTimeCompare([]byte(ha1), []byte(entry.ha1)) != 1 {
+			return "", false
+		}
+		return auth.Username, false
+	}
+
+	algorithm := auth.Algorithm
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+	if entry.ha1 == "" || auth.Realm != s.realm || !sameURI(auth.URI, request.RawURL) ||
+		!strings.EqualFold(strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS"), entry.algorithm) {
+		return "", false
+	}
+	valid, expired := s.checkNonce(auth.Nonce)
+	if !valid {
+		return "", false
+	}
+	qop := strings.ToLower(auth.Qop)
+	if qop != "" && qop != "auth" && qop != "auth-int" {
+		return "", false
+	}
+	response := digestResponse(algorithm, entry.ha1, auth.Nonce, auth.Nc, auth.Cnonce, qop, request.Method, auth.URI, request.Body)
+	if subtle.ConstantTimeCompare([]byte(response), []byte(strings.ToLower(auth.Response))) != 1 {
+		return "", false
+	}
+	if expired {
+		return "", true
+	}
+	if !s.countNonce(auth.Nonce, auth.Cnonce, auth.Nc) {
+		LogCriticalf("❌ [AUTH] Replayed Digest response for %q (nc=%s)", auth.Username, auth.Nc)
+		return "", false
+	}
+	return auth.Username, false
+}
+
+// EnableAuth makes RTSP and HTTP clients authenticate against
+// GlobalConfig.UsersFile.
+func (server *Server) EnableAuth() error {
+	users, err := newUserStore(GlobalConfig.UsersFile, GlobalConfig.AuthRealm)
+	if err != nil {
+		return fmt.Errorf("users file: %w", err)
+	}
+	server.users = users
+	LogCriticalf("🔐 [AUTH] Loaded %d users from %s", len(users.users), users.path)
+	return nil
+}
+
+// authorize answers request with a 401 unless the client has logged in,
+// and reports whether the request may proceed.
+func (client *Client) authorize(request *Request) bool {
+	users := client.server.users
+	if users == nil || client.authUser != "" {
+		return true
+	}
+	username, stale := users.authenticate(request)
+	if username != "" {
+		client.authUser = username
+		Logf("🔐 [AUTH] Client [%s:%s] logged in as %q", client.remoteAddr, client.remotePort, username)
+		return true
+	}
+	if headerGet(request.Headers, "Authorization") != "" && !stale {
+		LogCriticalf("❌ [AUTH] Client [%s:%s] failed to authenticate", client.remoteAddr, client.remotePort)
+		GlobalMetrics.ClientAuthFailures.Add(1)
+	}
+	response := client.responseUnauthorized(request)
+	response.Headers["WWW-Authenticate"] = users.challenge(stale)
+	response.Headers["CSeq"] = client.getHeader(request, "CSeq")
+	response.Headers["Server"] = "RTSP-Proxy/1.0"
+	client.ClientConn.Write([]byte(response.String()))
+	return false
+}
+
+// requireAuth puts the proxy accounts in front of an HTTP endpoint. CORS
+// preflights, which browsers send without credentials, pass.
+func (server *Server) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		users := server.users
+		if users == nil || r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+		request := &Request{
+			Method:  r.Method,
+			RawURL:  r.RequestURI,
+			URL:     r.URL,
+			Headers: map[string]string{"Authorization": r.Header.Get("Authorization")},
+		}
+		username, stale := users.authenticate(request)
+		if username != "" {
+			next(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "" && !stale {
+			LogCriticalf("❌ [AUTH] HTTP client [%s] failed to authenticate", r.RemoteAddr)
+			GlobalMetrics.ClientAuthFailures.Add(1)
+		}
+		for _, challenge := range users.challenges(stale) {
+			w.Header().Add("WWW-Authenticate", challenge)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}
+}
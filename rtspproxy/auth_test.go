@@ -0,0 +1,226 @@
+package rtspproxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestClientAuthentication(t *testing.T) {
+	oldUsers, oldRealm := GlobalConfig.UsersFile, GlobalConfig.AuthRealm
+	t.Cleanup(func() { GlobalConfig.UsersFile, GlobalConfig.AuthRealm = oldUsers, oldRealm })
+	hash, _ := bcrypt.GenerateFromPassword([]byte("wonderland"), bcrypt.MinCost)
+	GlobalConfig.UsersFile = filepath.Join(t.TempDir(), "users")
+	GlobalConfig.AuthRealm = "cams"
+	os.WriteFile(GlobalConfig.UsersFile, []byte(strings.Join([]string{
+		"# proxy accounts",
+		"alice:" + string(hash),
+		"bob:cams:" + md5Hex("bob:cams:builder"),
+		"carol:cams:" + digestHash("SHA-256")("carol:cams:secret"),
+		"dave:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		"erin:elsewhere:" + md5Hex("erin:elsewhere:x"),
+	}, "\n")), 0o600)
+
+	// The camera has an account of its own, given in the proxied URL.
+	cam := startMockCamera(t)
+	cam.handle = func(method, req string, conn net.Conn) string {
+		if headerGet(parseMockHeaders(req), "Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("admin:cam")) {
+			return "RTSP/1.0 401 Unauthorized\r\nWWW-Authenticate: Basic realm=\"camera\"\r\n\r\n"
+		}
+		return ""
+	}
+	server, addr := startTunnelServer(t)
+	if err := server.EnableAuth(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(server.users.users); n != 3 {
+		t.Errorf("%d users loaded, want 3", n)
+	}
+	url := fmt.Sprintf("rtsp://%s/rtsp/admin:cam@%s/mock", addr, cam.Addr())
+	basic := func(user, password string) string {
+		return "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password)) + "\r\n"
+	}
+	// digest answers the challenge for algorithm, without qop like live555.
+	digest := func(c *rtspConn, user, password, algorithm, qop string) string {
+		status, headers, _ := c.do("DESCRIBE", url, "")
+		if !strings.HasPrefix(status, "RTSP/1.0 401 ") {
+			t.Fatalf("no challenge: %s", status)
+		}
+		for _, challenge := range ParseChallenges(headerGet(headers, "WWW-Authenticate")) {
+			if challenge.IsDigest() && challenge.Params["algorithm"] == algorithm {
+				d := &Digest{Realm: challenge.Params["realm"], Nonce: challenge.Params["nonce"], Username: user, Password: password, Qop: qop, Algorithm: algorithm}
+				response, nc, cnonce := d.ComputeResponse("DESCRIBE", url, nil)
+				header := fmt.Sprintf(`Authorization: Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s", algorithm=%s`,
+					user, d.Realm, d.Nonce, url, response, algorithm)
+				if qop != "" {
+					header += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s"`, qop, nc, cnonce)
+				}
+				return header + "\r\n"
+			}
+		}
+		t.Fatalf("no %s challenge in %q", algorithm, headerGet(headers, "WWW-Authenticate"))
+		return ""
+	}
+
+	c := dialRTSP(t, addr)
+	status, headers, _ := c.do("OPTIONS", url, "")
+	challenges := ParseChallenges(headerGet(headers, "WWW-Authenticate"))
+	if !strings.HasPrefix(status, "RTSP/1.0 401 ") || len(challenges) != 3 ||
+		challenges[0].Params["algorithm"] != "SHA-256" || challenges[1].Params["algorithm"] != "MD5" || challenges[2].Scheme != "Basic" {
+		t.Errorf("unauthenticated OPTIONS: %s %q", status, headerGet(headers, "WWW-Authenticate"))
+	}
+	failures := GlobalMetrics.ClientAuthFailures.Load()
+	for _, header := range []string{basic("alice", "cam"), basic("admin", "cam"), basic("dave", "x"), basic("erin", "x")} {
+		if status, _, _ := c.do("DESCRIBE", url, header); !strings.HasPrefix(status, "RTSP/1.0 401 ") {
+			t.Errorf("%s: %s", header, status)
+		}
+	}
+	if n := GlobalMetrics.ClientAuthFailures.Load() - failures; n != 4 {
+		t.Errorf("%d client auth failures counted, want 4", n)
+	}
+	if methods := cam.Methods(); len(methods) != 0 {
+		t.Fatalf("camera contacted before authentication: %v", methods)
+	}
+
+	// A connection logs in once.
+	if status, _, _ := c.do("DESCRIBE", url, basic("alice", "wonderland")); status != "RTSP/1.0 200 OK" {
+		t.Errorf("alice: %s", status)
+	}
+	if status, _, _ := c.do("OPTIONS", url, ""); status != "RTSP/1.0 200 OK" {
+		t.Errorf("alice, second request: %s", status)
+	}
+
+	for _, tc := range []struct{ user, password, algorithm, qop, want string }{
+		{"bob", "builder", "MD5", "auth", "RTSP/1.0 200 OK"},
+		{"carol", "secret", "SHA-256", "", "RTSP/1.0 200 OK"},
+		{"carol", "wrong", "SHA-256", "auth", "RTSP/1.0 401 Unauthorized"},
+		{"bob", "builder", "SHA-256", "auth", "RTSP/1.0 401 Unauthorized"},
+	} {
+		c := dialRTSP(t, addr)
+		if status, _, _ := c.do("DESCRIBE", url, digest(c, tc.user, tc.password, tc.algorithm, tc.qop)); status != tc.want {
+			t.Errorf("%s/%s: %s, want %s", tc.user, tc.algorithm, status, tc.want)
+		}
+	}
+	if status, _, _ := dialRTSP(t, addr).do("DESCRIBE", url, basic("bob", "builder")); status != "RTSP/1.0 200 OK" {
+		t.Errorf("bob over Basic: %s", status)
+	}
+
+	// A proxy account in the URL is not passed to the camera.
+	before := len(cam.Methods())
+	fmt.Fprintf(dialRTSP(t, addr).conn, "DESCRIBE rtsp://alice:wonderland@%s/rtsp/%s/mock RTSP/1.0\r\nCSeq: 1\r\n%s\r\n", addr, cam.Addr(), basic("alice", "wonderland"))
+	deadline := time.Now().Add(3 * time.Second)
+	for len(cam.Methods()) == before {
+		if time.Now().After(deadline) {
+			t.Fatal("camera not contacted")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	cam.mu.Lock()
+	for _, req := range cam.requests {
+		if strings.Contains(req, base64.StdEncoding.EncodeToString([]byte("alice:wonderland"))) {
+			t.Errorf("proxy account sent to the camera: %q", req)
+		}
+	}
+	cam.mu.Unlock()
+
+	// Good credentials for an expired nonce get a stale challenge.
+	d := &Digest{Realm: "cams", Nonce: server.users.nonce(time.Now().Add(-time.Hour)), Username: "bob", Password: "builder"}
+	response, _, _ := d.ComputeResponse("DESCRIBE", url, nil)
+	status, headers, _ = dialRTSP(t, addr).do("DESCRIBE", url, fmt.Sprintf(
+		"Authorization: Digest username=\"bob\", realm=\"cams\", nonce=\"%s\", uri=\"%s\", response=\"%s\"\r\n", d.Nonce, url, response))
+	if c, _ := ParseWWWAuthenticate(headerGet(headers, "WWW-Authenticate")); !strings.HasPrefix(status, "RTSP/1.0 401 ") || !c.Stale() {
+		t.Errorf("expired nonce: %s %q", status, headerGet(headers, "WWW-Authenticate"))
+	}
+
+	// A sniffed Digest header is good for neither another connection nor
+	// another URL.
+	c = dialRTSP(t, addr)
+	header := digest(c, "bob", "builder", "MD5", "auth")
+	if status, _, _ := c.do("DESCRIBE", url, header); status != "RTSP/1.0 200 OK" {
+		t.Errorf("bob: %s", status)
+	}
+	if status, _, _ := dialRTSP(t, addr).do("DESCRIBE", url, header); !strings.HasPrefix(status, "RTSP/1.0 401 ") {
+		t.Errorf("replayed header: %s", status)
+	}
+	c = dialRTSP(t, addr)
+	header = digest(c, "carol", "secret", "SHA-256", "")
+	if status, _, _ := c.do("DESCRIBE", url+"/other", header); !strings.HasPrefix(status, "RTSP/1.0 401 ") {
+		t.Errorf("header for another URI: %s", status)
+	}
+}
+
+func TestHTTPAuthentication(t *testing.T) {
+	oldUsers, oldRealm := GlobalConfig.UsersFile, GlobalConfig.AuthRealm
+	t.Cleanup(func() { GlobalConfig.UsersFile, GlobalConfig.AuthRealm = oldUsers, oldRealm })
+	hash, _ := bcrypt.GenerateFromPassword([]byte("wonderland"), bcrypt.MinCost)
+	GlobalConfig.UsersFile = filepath.Join(t.TempDir(), "users")
+	GlobalConfig.AuthRealm = "cams"
+	os.WriteFile(GlobalConfig.UsersFile, []byte("alice:"+string(hash)+"\nbob:cams:"+md5Hex("bob:cams:builder")+"\n"), 0o600)
+	server, _ := startTunnelServer(t)
+	if err := server.EnableAuth(); err != nil {
+		t.Fatal(err)
+	}
+	handler := server.httpHandler()
+	// Not a proxy path: served with a 404 once past authentication.
+	const target = "/hls/nope/cam/index.m3u8"
+	get := func(method, target, authorization string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("GET", target, "")
+	challenges := w.Header().Values("WWW-Authenticate")
+	if w.Code != http.StatusUnauthorized || len(challenges) != 2 || !strings.HasPrefix(challenges[0], "Digest ") || !strings.HasPrefix(challenges[1], "Basic ") {
+		t.Errorf("unauthenticated GET: %d %q", w.Code, challenges)
+	}
+	for _, endpoint := range []string{"/whep/", "/fmp4/", "/clip/"} {
+		if w := get("GET", endpoint+"nope/cam", ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("unauthenticated %s: %d", endpoint, w.Code)
+		}
+	}
+	if w := get("OPTIONS", "/whep/nope/cam", ""); w.Code == http.StatusUnauthorized {
+		t.Error("CORS preflight challenged")
+	}
+	if w := get("GET", target, "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:wonderland"))); w.Code != http.StatusNotFound {
+		t.Errorf("alice: %d", w.Code)
+	}
+	if w := get("GET", target, "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:x"))); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password: %d", w.Code)
+	}
+
+	// Each HTTP request authenticates; Digest counts up per nonce.
+	challenge, _ := ParseWWWAuthenticate(challenges[0])
+	d := &Digest{Realm: "cams", Nonce: challenge.Params["nonce"], Username: "bob", Password: "builder", Qop: "auth", Algorithm: "MD5"}
+	authorization := func(uri string) string {
+		response, nc, cnonce := d.ComputeResponse("GET", uri, nil)
+		return fmt.Sprintf(`Digest username="bob", realm="cams", nonce="%s", uri="%s", response="%s", algorithm=MD5, qop=auth, nc=%s, cnonce="%s"`,
+			d.Nonce, uri, response, nc, cnonce)
+	}
+	first := authorization(target)
+	if w := get("GET", target, first); w.Code != http.StatusNotFound {
+		t.Errorf("bob: %d", w.Code)
+	}
+	if w := get("GET", target, first); w.Code != http.StatusUnauthorized {
+		t.Errorf("replayed header: %d", w.Code)
+	}
+	if w := get("GET", target, authorization(target)); w.Code != http.StatusNotFound {
+		t.Errorf("bob, nc=2: %d", w.Code)
+	}
+	if w := get("GET", "/hls/nope/other/index.m3u8", authorization(target)); w.Code != http.StatusUnauthorized {
+		t.Errorf("header for another URI: %d", w.Code)
+	}
+}
@@ -0,0 +1,150 @@
+package rtspproxy
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Requests from the camera. An RTSP server may send requests of its own on
+// the connection (RFC 2326 10): REDIRECT to move the stream elsewhere,
+// ANNOUNCE with a changed SDP, SET_PARAMETER, and OPTIONS or GET_PARAMETER
+// as keepalives. Each gets a response with the request's CSeq. A REDIRECT
+// ends the connection; the Stream reconnects to the Location (any Range
+// is ignored, the move happens at once) and DESCRIBEs it again. An SDP
+// ANNOUNCE replaces Stream.SDP and is passed on to the RTSP clients as an
+// ANNOUNCE of their own.
+
+// cameraRequestMethods are the requests answered by HandleUpstreamRequest.
+const cameraRequestMethods = "OPTIONS, ANNOUNCE, REDIRECT, GET_PARAMETER, SET_PARAMETER"
+
+// HandleUpstreamRequest answers a request sent by the camera. An error
+// means the connection has to be given up.
+func (remote *Remote) HandleUpstreamRequest(recv string) error {
+	request, err := NewRequestFromBuffer(recv)
+	if err != nil {
+		LogCriticalf("⚠️ [CAMERA] Unparseable request from [%s]: %v", remote.Host, err)
+		return nil
+	}
+	Logf("📩 [CAMERA] %s request from [%s]", request.Method, remote.Host)
+
+	response, _ := NewResponse(200, "OK")
+	var location *url.URL
+	switch request.Method {
+	case "OPTIONS":
+		response.Headers["Public"] = cameraRequestMethods
+	case "GET_PARAMETER":
+	case "SET_PARAMETER":
+		if len(request.Body) > 0 {
+			response, _ = NewResponse(451, "Parameter Not Understood")
+		}
+	case "REDIRECT":
+		location, err = url.Parse(headerGet(request.Headers, "Location"))
+		if err != nil || !isAbsoluteRTSPURL(location.String()) || location.Host == "" {
+			location = nil
+			response, _ = NewResponse(400, "Bad Request")
+		}
+	case "ANNOUNCE":
+		contentType := headerGet(request.Headers, "Content-Type")
+		if !strings.HasPrefix(contentType, "application/sdp") || len(request.Body) == 0 {
+			response, _ = NewResponse(415, "Unsupported Media Type")
+			response.Headers["Accept"] = "application/sdp"
+		} else if remote.stream != nil {
+			remote.stream.announceSDP(string(request.Body))
+		}
+	default:
+		response, _ = NewResponse(501, "Not Implemented")
+		response.Headers["Public"] = cameraRequestMethods
+	}
+	response.Headers["CSeq"] = headerGet(request.Headers, "CSeq")
+	if session := headerGet(request.Headers, "Session"); session != "" {
+		response.Headers["Session"] = session
+	}
+	if err := remote.sendResponse(response); err != nil {
+		return err
+	}
+
+	if location != nil && remote.stream != nil {
+		remote.stream.redirectTo(location)
+		return fmt.Errorf("camera redirected the stream to %s", location.Redacted())
+	}
+	return nil
+}
+
+// sendResponse writes a response to a camera request.
+func (remote *Remote) sendResponse(response *Response) error {
+	remote.connMutex.Lock()
+	defer remote.connMutex.Unlock()
+	if remote.RemoteConn == nil {
+		return fmt.Errorf("remote connection is closed")
+	}
+	conn := remote.RemoteConn
+	conn.SetWriteDeadline(time.Now().Add(GlobalConfig.WriteTimeout))
+	_, err := conn.Write([]byte(response.String()))
+	conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		remote.disconnectLocked()
+		return fmt.Errorf("failed to write to remote: %w", err)
+	}
+	return nil
+}
+
+// redirectTo makes later connections go to location. Host and Path, which
+// identify the stream to the proxy's clients, stay as they are.
+func (s *Stream) redirectTo(location *url.URL) {
+	s.mu.Lock()
+	s.location = location
+	s.sdpStale = true
+	s.mu.Unlock()
+	LogCriticalf("↪️ [REDIRECT] Stream [%s] moved to %s", s.Path, location.Redacted())
+}
+
+// announceSDP takes a new description of the stream from the camera and
+// announces it to the RTSP clients.
+func (s *Stream) announceSDP(sdp string) {
+	s.mu.Lock()
+	s.SDP = sdp
+	channels := s.channels // the camera keeps the tracks it set up
+	if s.gop != nil {
+		s.gop.reset(sdp, channels) // cached pictures belong to the old parameters
+	}
+	sessions := slices.Collect(maps.Values(s.clients))
+	s.mu.Unlock()
+	if s.preEvent != nil {
+		s.preEvent.setSDP(sdp, channels)
+	}
+
+	LogCriticalf("📢 [ANNOUNCE] Stream [%s] description changed, notifying %d clients", s.Path, len(sessions))
+	for _, cs := range sessions {
+		cs.client.announce(cs, sdp)
+	}
+}
+
+// announce sends the client an ANNOUNCE with a new description of its
+// stream, queued behind the packets already on their way.
+func (client *Client) announce(cs *ClientSession, sdp string) {
+	sdp = client.rewriteSDP(sdp)
+	scheme := client.scheme
+	if scheme == "" {
+		scheme = "rtsp"
+	}
+	URL := &url.URL{
+		Scheme: "rtsp",
+		Host:   net.JoinHostPort(client.localAddr, client.localPort),
+		Path:   "/" + scheme + "/" + client.host + client.basePath,
+	}
+	request, _ := NewRequest("ANNOUNCE", URL)
+	request.Headers["CSeq"] = strconv.Itoa(int(client.announceCSeq.Add(1)))
+	request.Headers["Session"] = cs.sessionID
+	request.Headers["Content-Type"] = "application/sdp"
+	request.Headers["Content-Length"] = strconv.Itoa(len(sdp))
+	request.Body = []byte(sdp)
+	if !cs.Push([]byte(request.String())) {
+		LogCriticalf("⚠️ [ANNOUNCE] Client [%s:%s] queue full, description change not sent", client.remoteAddr, client.remotePort)
+	}
+}
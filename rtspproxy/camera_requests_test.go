@@ -0,0 +1,111 @@
+package rtspproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCameraRequests(t *testing.T) {
+	oldBackoff := GlobalConfig.ReconnectBackoff
+	t.Cleanup(func() { GlobalConfig.ReconnectBackoff = oldBackoff })
+	GlobalConfig.ReconnectBackoff = []time.Duration{100 * time.Millisecond}
+
+	moved := startMockCamera(t)
+	cam := startMockCamera(t)
+	conns := make(chan net.Conn, 1)
+	replies := make(chan string, 10)
+	cam.handle = func(method, req string, conn net.Conn) string {
+		switch method {
+		case "PLAY":
+			conns <- conn
+		case "RTSP/1.0":
+			replies <- req
+			return "-"
+		}
+		return ""
+	}
+
+	_, addr := startTunnelServer(t)
+	base := fmt.Sprintf("rtsp://%s/rtsp/%s/mock", addr, cam.Addr())
+	c := dialRTSP(t, addr)
+	c.do("DESCRIBE", base, "")
+	_, headers, _ := c.do("SETUP", base+"/track1", "Transport: RTP/AVP/TCP;unicast;interleaved=0-1\r\n")
+	session, _, _ := strings.Cut(headerGet(headers, "Session"), ";")
+	c.do("PLAY", base, "Session: "+session+"\r\n")
+	camConn := <-conns
+
+	request := func(method, headers, body string) string {
+		fmt.Fprintf(camConn, "%s rtsp://%s/mock RTSP/1.0\r\n%s\r\n%s", method, cam.Addr(), headers, body)
+		select {
+		case reply := <-replies:
+			return reply
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: no reply", method)
+			return ""
+		}
+	}
+	for _, tc := range []struct{ method, headers, body, want string }{
+		{"SET_PARAMETER", "CSeq: 100\r\nSession: 1234\r\n", "", "RTSP/1.0 200 OK"},
+		{"SET_PARAMETER", "CSeq: 101\r\nContent-Length: 6\r\n", "foo: 1", "RTSP/1.0 451 "},
+		{"FLY", "CSeq: 102\r\n", "", "RTSP/1.0 501 "},
+		{"REDIRECT", "CSeq: 103\r\nLocation: nowhere\r\n", "", "RTSP/1.0 400 "},
+	} {
+		reply := request(tc.method, tc.headers, tc.body)
+		if !strings.HasPrefix(reply, tc.want) || headerGet(parseMockHeaders(reply), "CSeq") != tc.headers[6:9] {
+			t.Errorf("%s: reply %q", tc.method, reply)
+		}
+	}
+
+	// An SDP change reaches the client as an ANNOUNCE.
+	sdp := strings.Replace(mockSDP, "s=Mock", "s=Changed", 1)
+	if reply := request("ANNOUNCE", fmt.Sprintf("CSeq: 104\r\nContent-Type: application/sdp\r\nContent-Length: %d\r\n", len(sdp)), sdp); !strings.HasPrefix(reply, "RTSP/1.0 200 OK") {
+		t.Errorf("ANNOUNCE: reply %q", reply)
+	}
+	reader := newRTSPReader(c.reader, rtspBufferSize)
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		frame, err := reader.next()
+		if err != nil {
+			t.Fatalf("no ANNOUNCE for the client: %v", err)
+		}
+		if frame.channel >= 0 {
+			continue
+		}
+		announce, err := NewRequestFromBuffer(string(frame.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if announce.Method != "ANNOUNCE" || headerGet(announce.Headers, "Session") != session || !strings.Contains(string(announce.Body), "s=Changed") {
+			t.Errorf("client got %q", frame.data)
+		}
+		fmt.Fprintf(c.conn, "RTSP/1.0 200 OK\r\nCSeq: %s\r\n\r\n", headerGet(announce.Headers, "CSeq"))
+		break
+	}
+
+	// REDIRECT moves the stream to the other camera; the client stays.
+	if reply := request("REDIRECT", fmt.Sprintf("CSeq: 105\r\nLocation: rtsp://%s/moved\r\n", moved.Addr()), ""); !strings.HasPrefix(reply, "RTSP/1.0 200 OK") {
+		t.Errorf("REDIRECT: reply %q", reply)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for !strings.Contains(strings.Join(moved.Methods(), " "), "PLAY") {
+		if time.Now().After(deadline) {
+			t.Fatalf("redirected camera got %v", moved.Methods())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	moved.mu.Lock()
+	first := moved.requests[0]
+	moved.mu.Unlock()
+	if !strings.HasPrefix(first, fmt.Sprintf("DESCRIBE rtsp://%s/moved ", moved.Addr())) {
+		t.Errorf("redirected camera got %q first", first)
+	}
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for i := 0; i < 20; i++ {
+		if _, err := reader.next(); err != nil {
+			t.Fatalf("client stalled after the redirect: %v", err)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package rtspproxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const mockSDP = "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=Mock\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\nm=video 0 RTP/AVP 96\r\na=control:track1\r\n"
+
+// mockCamera is a minimal RTSP server answering the proxy's connect sequence
+// and streaming interleaved RTP on channel 0 after PLAY.
+type mockCamera struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	requests []string
+	// handle may override the reply for a request; returning "" falls back to the default.
+	handle func(method, req string, conn net.Conn) string
+}
+
+func startMockCamera(t *testing.T) *mockCamera {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveMockCamera(t, ln)
+}
+
+// serveMockCamera runs the mock on an existing listener (e.g. a TLS one).
+func serveMockCamera(t *testing.T, ln net.Listener) *mockCamera {
+	cam := &mockCamera{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go cam.serve(conn)
+		}
+	}()
+	return cam
+}
+
+func (cam *mockCamera) Addr() string {
+	return cam.ln.Addr().String()
+}
+
+// Methods returns the request methods received so far, in order.
+func (cam *mockCamera) Methods() []string {
+	cam.mu.Lock()
+	defer cam.mu.Unlock()
+	methods := make([]string, 0, len(cam.requests))
+	for _, req := range cam.requests {
+		methods = append(methods, strings.SplitN(req, " ", 2)[0])
+	}
+	return methods
+}
+
+func (cam *mockCamera) serve(c net.Conn) {
+	defer c.Close()
+	buf := make([]byte, 0, 8192)
+	tmp := make([]byte, 4096)
+	for {
+		n, err := c.Read(tmp)
+		if err != nil {
+			return
+		}
+		buf = append(buf, tmp[:n]...)
+		for len(buf) > 0 {
+			if buf[0] == '$' {
+				if len(buf) < 4 || len(buf) < 4+(int(buf[2])<<8|int(buf[3])) {
+					break
+				}
+				buf = buf[4+(int(buf[2])<<8|int(buf[3])):]
+				continue
+			}
+			eol := bytes.Index(buf, []byte("\r\n\r\n"))
+			if eol == -1 {
+				break
+			}
+			req := string(buf[:eol+4])
+			buf = buf[eol+4:]
+
+			cam.mu.Lock()
+			cam.requests = append(cam.requests, req)
+			cam.mu.Unlock()
+
+			method := strings.SplitN(req, " ", 2)[0]
+			cseq := headerGet(parseMockHeaders(req), "CSeq")
+			reply := ""
+			if cam.handle != nil {
+				reply = cam.handle(method, req, c)
+			}
+			if reply == "" {
+				reply = cam.defaultReply(method, c)
+			}
+			if reply == "-" {
+				continue
+			}
+			c.Write([]byte(strings.Replace(reply, "\r\n\r\n", fmt.Sprintf("\r\nCSeq: %s\r\n\r\n", cseq), 1)))
+		}
+	}
+}
+
+func (cam *mockCamera) defaultReply(method string, c net.Conn) string {
+	switch method {
+	case "OPTIONS":
+		return "RTSP/1.0 200 OK\r\nPublic: OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN\r\n\r\n"
+	case "DESCRIBE":
+		return fmt.Sprintf("RTSP/1.0 200 OK\r\nContent-Type: application/sdp\r\nContent-Length: %d\r\n\r\n%s", len(mockSDP), mockSDP)
+	case "SETUP":
+		return "RTSP/1.0 200 OK\r\nTransport: RTP/AVP/TCP;unicast;interleaved=0-1;ssrc=12345678\r\nSession: 1234\r\n\r\n"
+	case "PLAY":
+		go func() {
+			for i := 0; ; i++ {
+				if _, err := c.Write([]byte{'$', 0, 0, 4, 0x80, 96, 0, byte(i)}); err != nil {
+					return
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		}()
+		return "RTSP/1.0 200 OK\r\nSession: 1234\r\n\r\n"
+	}
+	return "RTSP/1.0 200 OK\r\nSession: 1234\r\n\r\n"
+}
+
+func parseMockHeaders(req string) map[string]string {
+	headers := make(map[string]string)
+	for _, line := range strings.Split(req, "\r\n")[1:] {
+		if key, value, err := sharedParseHeader(line); err == nil {
+			headers[key] = value
+		}
+	}
+	return headers
+}
+
+// newTestClient wires a Client to one end of a loopback TCP connection and
+// returns the peer end.
+func newTestClient(t *testing.T, server *Server) (*Client, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	peer, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	return NewClient(server, conn), peer
+}
@@ -2,6 +2,7 @@ package rtspproxy
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"path/filepath"
 	"regexp"
@@ -27,14 +28,24 @@ type Client struct {
 	currentCSeq    string
 	responseBuffer string
 	host           string
+	scheme         string // proxy URL prefix, see proxySchemes
 	basePath       string // 🔥 ДОБАВИТЬ: Базовый путь потока
-	username       string
+	username       string // camera credentials from the URL
 	password       string
+	authUser       string // proxy account, see authorize
 	server         *Server
 	writeChan      chan []byte
 	currentStream  *Stream
 	wg             sync.WaitGroup
 	destroyed      atomic.Bool
+
+	// Playback of a recording (see playback.go) instead of a live stream.
+	playbackDir     string
+	recording       *recording
+	playbackSession *playbackSession
+	afterResponse   func() // run once the response has been written
+
+	announceCSeq atomic.Int32 // CSeq of the last request sent to the client
 }
 
 // NewClient creates a new Client instance.
@@ -116,11 +127,13 @@ func (client *Client) incomingRequestHandler() {
 		if client.currentStream != nil {
 			client.currentStream.RemoveClient(client)
 		}
+		if client.playbackSession != nil {
+			client.playbackSession.stop()
+		}
 		client.Destroy()
 	}()
 
-	buffer := make([]byte, rtspBufferSize)
-	length := 0
+	reader := newRTSPReader(client.ClientConn, rtspBufferSize)
 
 	for {
 		select {
@@ -129,73 +142,23 @@ func (client *Client) incomingRequestHandler() {
 			return
 		default:
 			client.ClientConn.SetReadDeadline(time.Now().Add(GlobalConfig.ReadTimeout))
-			recvLen, err := client.ClientConn.Read(buffer[length:])
+			frame, err := reader.next()
 			client.ClientConn.SetReadDeadline(time.Time{}) // Clear deadline
 
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					continue // Timeout, check context again
 				}
-				if err.Error() != "EOF" {
+				if err != io.EOF {
 					LogCriticalf("Client read error [%s:%s]: %v", client.remoteAddr, client.remotePort, err)
 				}
 				return
 			}
-			length += recvLen
-			if length == 0 {
-				continue
-			}
 
-			if buffer[0] == '$' {
-				// Process interleaved binary data (RTP/RTCP from client)
-				for length < streamHeaderLength {
-					select {
-					case <-client.server.ctx.Done():
-						Logf("Client reader for [%s:%s] stopping during stream header read due to server shutdown.", client.remoteAddr, client.remotePort)
-						return
-					default:
-						client.ClientConn.SetReadDeadline(time.Now().Add(GlobalConfig.ReadTimeout))
-						recvLen, err := client.ClientConn.Read(buffer[length:])
-						client.ClientConn.SetReadDeadline(time.Time{})
-						if err != nil {
-							if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-								continue
-							}
-							LogCriticalf("Client read error during stream header [%s:%s]: %v", client.remoteAddr, client.remotePort, err)
-							return
-						}
-						length += recvLen
-					}
-				}
-
-				tcpChannel := int(buffer[1])
-				streamDataLength := ((int(buffer[2]) << 8) | int(buffer[3]))
-				streamDataRecvLength := length - streamHeaderLength
-
-				for streamDataRecvLength < streamDataLength {
-					select {
-					case <-client.server.ctx.Done():
-						Logf("Client reader for [%s:%s] stopping during stream data read due to server shutdown.", client.remoteAddr, client.remotePort)
-						return
-					default:
-						client.ClientConn.SetReadDeadline(time.Now().Add(GlobalConfig.ReadTimeout))
-						recvLen, err := client.ClientConn.Read(buffer[length:])
-						client.ClientConn.SetReadDeadline(time.Time{})
-						if err != nil {
-							if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-								continue
-							}
-							LogCriticalf("Client read error during stream data [%s:%s]: %v", client.remoteAddr, client.remotePort, err)
-							return
-						}
-						length += recvLen
-						streamDataRecvLength = length - streamHeaderLength
-					}
-				}
-
-				dataBuffer := make([]byte, streamDataLength)
-				copy(dataBuffer, buffer[streamHeaderLength:streamHeaderLength+streamDataLength])
-				length = copy(buffer, buffer[streamHeaderLength+streamDataLength:length])
+			if frame.channel >= 0 {
+				// Interleaved binary data (RTP/RTCP from client)
+				tcpChannel := frame.channel
+				dataBuffer := frame.data[streamHeaderLength:]
 
 				if client.currentStream != nil && client.currentStream.remote != nil {
 					remote := client.currentStream.remote
@@ -213,14 +176,19 @@ func (client *Client) incomingRequestHandler() {
 					}
 					client.currentStream.mu.RUnlock()
 
-					Logf("📥 Received binary data from client on channel %d, forwarding to remote channel %d, len %d", tcpChannel, upstreamChannel, streamDataLength)
+					Logf("📥 Received binary data from client on channel %d, forwarding to remote channel %d, len %d", tcpChannel, upstreamChannel, len(dataBuffer))
 					_ = remote.SendBinary(upstreamChannel, dataBuffer)
 				}
 				continue
 			}
 
-			reqStr := string(buffer[:length])
-			length = 0
+			if strings.HasPrefix(string(frame.data), "RTSP/") {
+				// The client's reply to an ANNOUNCE; nothing waits for it.
+				Logf("📩 Response from client [%s:%s]: %s", client.remoteAddr, client.remotePort, strings.SplitN(string(frame.data), "\r\n", 2)[0])
+				continue
+			}
+
+			reqStr := string(frame.data)
 
 			// 🔥 ДЕТАЛЬНОЕ ЛОГИРОВАНИЕ СЫРОГО ЗАПРОСА
 			Logf("📩 RAW REQUEST from [%s:%s]:\n%s", client.remoteAddr, client.remotePort, reqStr)
@@ -232,14 +200,24 @@ func (client *Client) incomingRequestHandler() {
 			}
 			Logf("DEBUG: Client received request with URL: %+v", request.URL)
 
+			if !client.authorize(request) {
+				continue
+			}
+
 			if client.host == "" {
 				client.username = request.URL.User.Username()
 				client.password, _ = request.URL.User.Password()
 
 				trimmedPath := strings.TrimPrefix(request.URL.Path, "/")
+				trimmedPath, playback := strings.CutPrefix(trimmedPath, playbackPrefix+"/")
 				parts := strings.SplitN(trimmedPath, "/", 3)
 
-				if len(parts) >= 2 && parts[0] == "rtsp" {
+				if len(parts) >= 2 && isProxyScheme(parts[0]) {
+					if client.server.users != nil {
+						// The URL's user is the proxy account, not the camera's.
+						client.username, client.password = "", ""
+					}
+					client.scheme = parts[0]
 					client.host = parts[1]
 					if len(parts) == 3 {
 						request.URL.Path = "/" + parts[2]
@@ -257,6 +235,9 @@ func (client *Client) incomingRequestHandler() {
 						return
 					}
 					client.host = request.URL.Host
+					if isProxyScheme(request.URL.Scheme) {
+						client.scheme = request.URL.Scheme
+					}
 				}
 
 				if strings.Contains(client.host, "@") {
@@ -273,38 +254,55 @@ func (client *Client) incomingRequestHandler() {
 				client.basePath = request.URL.Path
 
 				LogCriticalf("✅ Resolved client target: host=%s, path=%s, user=%s", client.host, client.basePath, client.username)
-			}
 
-			// 🔥 ИСПОЛЬЗУЕМ basePath для поиска потока, а не request.URL.Path
-			stream := client.server.LookupStream(client.host, client.username, client.password, client.basePath)
-			client.currentStream = stream
-			if stream == nil {
-				LogCriticalf("❌ Failed to create or find stream for host: %s", client.host)
-				response := client.responseNotFound(request)
-				client.ClientConn.Write([]byte(response.String()))
-				return
+				if playback {
+					dir, err := recordingDir(client.scheme, client.host, client.username, client.password, client.basePath)
+					if err != nil {
+						LogCriticalf("❌ [PLAYBACK] %s%s: %v", client.host, client.basePath, err)
+						response := client.responseNotFound(request)
+						if err == errPlaybackUnauthorized {
+							response = client.responseUnauthorized(request)
+						}
+						response.Headers["CSeq"] = client.getHeader(request, "CSeq")
+						client.ClientConn.Write([]byte(response.String()))
+						return
+					}
+					client.playbackDir = dir
+				}
 			}
 
-			response := client.responseBadRequest(request)
-			switch request.Method {
-			case "OPTIONS":
-				response = client.handleOptions(stream, request)
-			case "DESCRIBE":
-				response = client.handleDescribe(stream, request)
-			case "SETUP":
-				transport := client.getHeader(request, "Transport")
-				if transport != "" && strings.Contains(transport, "RTP/AVP") && !strings.Contains(transport, "RTP/AVP/TCP") {
-					LogCriticalf("⚠️ Client requested UDP (%s), but proxy only supports TCP. Sending 461 Unsupported Transport.", transport)
-					response = client.responseUnsupportedTransport(request)
-				} else {
+			var response *Response
+			if client.playbackDir != "" {
+				response = client.handlePlayback(request)
+			} else {
+				// 🔥 ИСПОЛЬЗУЕМ basePath для поиска потока, а не request.URL.Path
+				stream := client.server.LookupStreamScheme(client.scheme, client.host, client.username, client.password, client.basePath)
+				client.currentStream = stream
+				if stream == nil {
+					LogCriticalf("❌ Failed to create or find stream for host: %s", client.host)
+					response := client.responseNotFound(request)
+					client.ClientConn.Write([]byte(response.String()))
+					return
+				}
+
+				response = client.responseBadRequest(request)
+				switch request.Method {
+				case "OPTIONS":
+					response = client.handleOptions(stream, request)
+				case "DESCRIBE":
+					response = client.handleDescribe(stream, request)
+				case "SETUP":
 					response = client.handleSetup(stream, request)
+				case "PLAY":
+					response = client.handlePlay(stream, request)
+				case "PAUSE":
+					// Live streams cannot be paused; recordings can.
+					response, _ = NewResponse(455, "Method Not Valid in This State")
+				case "TEARDOWN":
+					response = client.handleTeardown(stream, request)
+				case "GET_PARAMETER":
+					response = client.handleGetParameter(stream, request)
 				}
-			case "PLAY":
-				response = client.handlePlay(stream, request)
-			case "TEARDOWN":
-				response = client.handleTeardown(stream, request)
-			case "GET_PARAMETER":
-				response = client.handleGetParameter(stream, request)
 			}
 
 			response.Headers["Via"] = "RTSP-Proxy"
@@ -323,15 +321,19 @@ func (client *Client) incomingRequestHandler() {
 			Logf("📤 RAW RESPONSE to [%s:%s]:\n%s", client.remoteAddr, client.remotePort, respStr)
 
 			client.ClientConn.Write([]byte(respStr))
+			if client.afterResponse != nil {
+				client.afterResponse()
+				client.afterResponse = nil
+			}
 		}
 	}
 }
 
 func (client *Client) responseUnsupportedTransport(request *Request) *Response {
 	response, _ := NewResponse(461, "Unsupported Transport")
-	// Явно указываем клиенту, что мы поддерживаем только TCP Interleaved
+	// Hint the transports we can actually serve
 	response.Headers["Transport"] = "RTP/AVP/TCP;unicast;interleaved=0-1"
-	response.Headers["Supported"] = "RTP/AVP/TCP"
+	response.Headers["Supported"] = "RTP/AVP/TCP, RTP/AVP"
 	return response
 }
 
@@ -389,6 +391,20 @@ func (client *Client) handleSetup(stream *Stream, request *Request) *Response {
 	transport := client.getHeader(request, "Transport")
 
 	protocol, comType, params := stream.remote.parseTransport(transport)
+	udp := isUDPProtocol(protocol)
+	multicast := comType == "multicast"
+	if multicast && !udp {
+		LogCriticalf("⚠️ [SETUP] Multicast requires RTP/AVP over UDP: %s", transport)
+		return client.responseUnsupportedTransport(request)
+	}
+	if udp && !multicast && params["client_port"] == "" {
+		LogCriticalf("⚠️ [SETUP] UDP transport without client_port: %s", transport)
+		return client.responseUnsupportedTransport(request)
+	}
+	if !udp && protocol != "" && !strings.EqualFold(protocol, "RTP/AVP/TCP") {
+		LogCriticalf("⚠️ [SETUP] Unsupported transport requested: %s", transport)
+		return client.responseUnsupportedTransport(request)
+	}
 
 	// Гарантируем, что процесс подключения запущен
 	stream.Start()
@@ -409,16 +425,27 @@ func (client *Client) handleSetup(stream *Stream, request *Request) *Response {
 		}
 	}
 
-	upstreamTransport := stream.LookupTransport(substreamName, protocol, comType)
+	// Client and camera transports are independent: match by track only
+	upstreamTransport := stream.LookupTransport(substreamName, "", "")
 	if upstreamTransport == nil {
 		LogCriticalf("❌ [SETUP] Failed to find upstream transport for %s", substreamName)
 		return client.responseBadRequest(request)
 	}
 
 	sessionID := upstreamTransport.Session.Session
+	upstreamRTP := upstreamTransport.RTPChannel()
+	if upstreamRTP < 0 {
+		LogCriticalf("❌ [SETUP] Upstream transport for %s has no channel", substreamName)
+		return client.responseUnsupportedTransport(request)
+	}
 
 	// 🔥 КРИТИЧЕСКИ ВАЖНО: Добавляем клиента в поток ЗДЕСЬ, чтобы MapChannel сработал!
-	stream.AddClient(client, sessionID)
+	cs := stream.AddClient(client, sessionID)
+	stream.setTrackURL(cs, upstreamRTP, request.RawURL)
+
+	if multicast {
+		return client.setupMulticast(stream, request, upstreamTransport, upstreamRTP)
+	}
 
 	response, _ := NewResponse(200, "OK")
 	proxyIP := client.localAddr
@@ -426,6 +453,10 @@ func (client *Client) handleSetup(stream *Stream, request *Request) *Response {
 		proxyIP = "127.0.0.1"
 	}
 
+	if udp {
+		return client.setupUDP(stream, request, upstreamTransport, params, proxyIP)
+	}
+
 	// Interleaved channels for client
 	clientInterleaved := params["interleaved"]
 	if clientInterleaved != "" {
@@ -433,21 +464,122 @@ func (client *Client) handleSetup(stream *Stream, request *Request) *Response {
 		ch1, _ := strconv.Atoi(channels[0])
 
 		// Теперь MapChannel найдет клиента в s.clients и корректно сохранит маппинг!
-		stream.MapChannel(client, upstreamTransport.Substreams[0].Channel, ch1)
-		if len(channels) > 1 {
+		stream.MapChannel(client, upstreamRTP, ch1)
+		upstreamTransport.mu.RLock()
+		rtcp, ok := upstreamTransport.Substreams[1]
+		upstreamTransport.mu.RUnlock()
+		if len(channels) > 1 && ok {
 			ch2, _ := strconv.Atoi(channels[1])
-			stream.MapChannel(client, upstreamTransport.Substreams[1].Channel, ch2)
+			stream.MapChannel(client, rtcp.Channel, ch2)
 		}
 	}
 
 	cleanTransport := regexp.MustCompile(`;?(destination|source)=[^;]+`).ReplaceAllString(transport, "")
-	response.Headers["Transport"] = fmt.Sprintf("%s;ssrc=%s;destination=%s;source=%s", cleanTransport, upstreamTransport.Ssrc, client.remoteAddr, proxyIP)
+	response.Headers["Transport"] = fmt.Sprintf("%s;ssrc=%s;destination=%s;source=%s", cleanTransport, stream.downstreamSSRC(upstreamRTP, upstreamTransport.Ssrc), client.remoteAddr, proxyIP)
+	response.Headers["Cache-Control"] = "must-revalidate"
+	response.Headers["Session"] = sessionID + ";timeout=60"
+	response.Headers["Server"] = stream.Server
+	return response
+}
+
+// setupUDP allocates a server RTP/RTCP port pair for the client and binds it
+// to the upstream channels of the track.
+func (client *Client) setupUDP(stream *Stream, request *Request, upstreamTransport *Transport, params map[string]string, proxyIP string) *Response {
+	rtpPort, rtcpPort, err := parsePortRange(params["client_port"])
+	if err != nil {
+		LogCriticalf("⚠️ [SETUP] %v", err)
+		return client.responseUnsupportedTransport(request)
+	}
+
+	upstreamTransport.mu.RLock()
+	var upstreamRTP, upstreamRTCP int
+	if sub, ok := upstreamTransport.Substreams[0]; ok {
+		upstreamRTP = sub.Channel
+		upstreamRTCP = sub.Channel + 1
+	}
+	if sub, ok := upstreamTransport.Substreams[1]; ok {
+		upstreamRTCP = sub.Channel
+	}
+	ssrc := upstreamTransport.Ssrc
+	upstreamTransport.mu.RUnlock()
+	ssrc = stream.downstreamSSRC(upstreamRTP, ssrc)
+
+	pair, err := ListenUDPPair("")
+	if err != nil {
+		LogCriticalf("❌ [SETUP] UDP allocation failed: %v", err)
+		response, _ := NewResponse(453, "Not Enough Bandwidth")
+		return response
+	}
+
+	clientIP := net.ParseIP(client.remoteAddr)
+	if !stream.MapUDP(client, upstreamRTP, upstreamRTCP, pair,
+		&net.UDPAddr{IP: clientIP, Port: rtpPort}, &net.UDPAddr{IP: clientIP, Port: rtcpPort}) {
+		pair.Close()
+		return client.responseBadRequest(request)
+	}
+	serverRTP, serverRTCP := pair.Ports()
+	LogCriticalf("✅ [SETUP] UDP client [%s] ports %d-%d <- proxy ports %d-%d", client.remoteAddr, rtpPort, rtcpPort, serverRTP, serverRTCP)
+
+	sessionID := upstreamTransport.Session.Session
+	response, _ := NewResponse(200, "OK")
+	transport := fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d", rtpPort, rtcpPort, serverRTP, serverRTCP)
+	if ssrc != "" {
+		transport += ";ssrc=" + ssrc
+	}
+	response.Headers["Transport"] = fmt.Sprintf("%s;destination=%s;source=%s", transport, client.remoteAddr, proxyIP)
 	response.Headers["Cache-Control"] = "must-revalidate"
 	response.Headers["Session"] = sessionID + ";timeout=60"
 	response.Headers["Server"] = stream.Server
 	return response
 }
 
+// setupMulticast answers a multicast SETUP with the stream's published group
+// instead of a per-client delivery; upstreamRTP is the track's channel.
+func (client *Client) setupMulticast(stream *Stream, request *Request, upstreamTransport *Transport, upstreamRTP int) *Response {
+	sessionID := upstreamTransport.Session.Session
+	published, err := stream.PublishMulticast(client, sessionID, upstreamTransport)
+	if err != nil {
+		LogCriticalf("⚠️ [SETUP] Multicast not available for [%s]: %v", client.remoteAddr, err)
+		return client.responseUnsupportedTransport(request)
+	}
+
+	published.mu.RLock()
+	rtp := published.Substreams[0]
+	rtcpPort := rtp.Port + 1
+	if sub, ok := published.Substreams[1]; ok {
+		rtcpPort = sub.Port
+	}
+	transport := fmt.Sprintf("RTP/AVP;multicast;destination=%s;port=%d-%d;ttl=%d", rtp.Host, rtp.Port, rtcpPort, GlobalConfig.MulticastTTL)
+	published.mu.RUnlock()
+
+	upstreamTransport.mu.RLock()
+	ssrc := upstreamTransport.Ssrc
+	upstreamTransport.mu.RUnlock()
+	if ssrc = stream.downstreamSSRC(upstreamRTP, ssrc); ssrc != "" {
+		transport += ";ssrc=" + ssrc
+	}
+
+	response, _ := NewResponse(200, "OK")
+	response.Headers["Transport"] = transport
+	response.Headers["Cache-Control"] = "must-revalidate"
+	response.Headers["Session"] = sessionID + ";timeout=60"
+	response.Headers["Server"] = stream.Server
+	return response
+}
+
+// urlScheme returns "rtsps" for clients connected through the TLS listener.
+func (client *Client) urlScheme() string {
+	if isTLSConn(client.ClientConn) {
+		return "rtsps"
+	}
+	return "rtsp"
+}
+
+// isUDPProtocol reports whether a Transport protocol spec asks for RTP over UDP.
+func isUDPProtocol(protocol string) bool {
+	return strings.EqualFold(protocol, "RTP/AVP") || strings.EqualFold(protocol, "RTP/AVP/UDP")
+}
+
 func (client *Client) handleDescribe(stream *Stream, request *Request) *Response {
 	stream.Start()
 
@@ -471,18 +603,22 @@ func (client *Client) handleDescribe(stream *Stream, request *Request) *Response
 	response.Headers["Content-Type"] = "application/sdp"
 	response.Headers["Server"] = stream.Server
 
-	proxyIP := client.localAddr
-	if proxyIP == "0.0.0.0" || proxyIP == "127.0.0.1" {
-		proxyIP = "127.0.0.1"
-	}
-
-	rewrittenSDP := strings.ReplaceAll(stream.GetSDP(), "0.0.0.0", proxyIP)
+	rewrittenSDP := client.rewriteSDP(stream.GetSDP())
 
 	response.Headers["Content-Length"] = strconv.Itoa(len(rewrittenSDP))
 	response.Body = rewrittenSDP
 	return response
 }
 
+// rewriteSDP adapts the camera's SDP to what the client is served.
+func (client *Client) rewriteSDP(sdp string) string {
+	proxyIP := client.localAddr
+	if proxyIP == "0.0.0.0" || proxyIP == "127.0.0.1" {
+		proxyIP = "127.0.0.1"
+	}
+	return strings.ReplaceAll(sdp, "0.0.0.0", proxyIP)
+}
+
 func (client *Client) handlePlay(stream *Stream, request *Request) *Response {
 	sessionID := headerGet(request.Headers, "Session")
 
@@ -491,17 +627,12 @@ func (client *Client) handlePlay(stream *Stream, request *Request) *Response {
 	response.Headers["Session"] = sessionID
 	response.Headers["Server"] = stream.Server
 
-	proxyIP := client.localAddr
-	if proxyIP == "0.0.0.0" || proxyIP == "127.0.0.1" {
-		proxyIP = "127.0.0.1"
+	// Sequence number and timestamp of the first packet of each track, as
+	// rewritten for this client; tracks without packets yet are left out.
+	if parts := stream.rtpInfo(client); len(parts) > 0 {
+		response.Headers["RTP-Info"] = strings.Join(parts, ",")
 	}
 
-	// 🔥 ИСПРАВЛЕНИЕ: Избегаем двойного слеша (//) в URL
-	parts := []string{}
-	parts = append(parts, fmt.Sprintf("url=rtsp://%s%s;seq=0;rtptime=0", proxyIP, stream.Path))
-
-	response.Headers["RTP-Info"] = strings.Join(parts, ",")
-
 	return response
 }
 
@@ -1,10 +1,17 @@
 package rtspproxy
 
 import (
+	"net"
 	"sync"
 	"time"
 )
 
+// udpSink delivers one client channel over UDP instead of interleaved TCP.
+type udpSink struct {
+	conn *net.UDPConn
+	addr *net.UDPAddr
+}
+
 // ClientSession represents a client's active subscription to a stream.
 type ClientSession struct {
 	client    *Client
@@ -18,6 +25,15 @@ type ClientSession struct {
 
 	// Channels mapping: upstream channel -> client channel
 	channels map[int]int
+
+	// RTP-Info per upstream RTP channel: the SETUP URL and the first packet
+	// queued; guarded by Stream.mu
+	trackURLs map[int]string
+	rtpStart  map[int]rtpPosition
+
+	// UDP delivery: client channel -> destination (empty for TCP clients)
+	udp   map[int]*udpSink
+	pairs []*UDPPair
 }
 
 // NewClientSession creates a new ClientSession.
@@ -29,6 +45,9 @@ func NewClientSession(client *Client, stream *Stream, sessionID string) *ClientS
 		queue:     make(chan []byte, GlobalConfig.PacketQueueSize), // Buffered queue for fanout
 		quit:      make(chan struct{}),
 		channels:  make(map[int]int),
+		udp:       make(map[int]*udpSink),
+		trackURLs: make(map[int]string),
+		rtpStart:  make(map[int]rtpPosition),
 	}
 }
 
@@ -72,6 +91,9 @@ func (cs *ClientSession) run() {
 			if !ok {
 				return
 			}
+			if cs.sendUDP(packet) {
+				continue
+			}
 			// Forward packet to client's main write channel
 			select {
 			case cs.client.writeChan <- packet:
@@ -97,10 +119,77 @@ func (cs *ClientSession) Stop() {
 	}
 	cs.active = false
 	close(cs.quit)
+	pairs := cs.pairs
+	cs.pairs = nil
 	cs.mu.Unlock()
+	for _, pair := range pairs {
+		pair.Close() // unblocks readUDP
+	}
 	cs.wg.Wait()
 }
 
+// AddUDP binds a server-side RTP/RTCP pair to the client's ports. Packets for
+// clientChannel (RTP) and clientChannel+1 (RTCP) are then sent as datagrams.
+// Anything the client sends to the pair from rtpAddr's IP is passed to
+// onPacket with the channel it arrived on; other senders are ignored.
+func (cs *ClientSession) AddUDP(pair *UDPPair, clientChannel int, rtpAddr, rtcpAddr *net.UDPAddr, onPacket func(channel int, data []byte)) {
+	cs.mu.Lock()
+	if !cs.active {
+		cs.mu.Unlock()
+		pair.Close()
+		return
+	}
+	cs.udp[clientChannel] = &udpSink{conn: pair.RTP, addr: rtpAddr}
+	cs.udp[clientChannel+1] = &udpSink{conn: pair.RTCP, addr: rtcpAddr}
+	cs.pairs = append(cs.pairs, pair)
+	cs.mu.Unlock()
+
+	cs.wg.Add(2)
+	go cs.readUDP(pair.RTP, clientChannel, rtpAddr.IP, onPacket)
+	go cs.readUDP(pair.RTCP, clientChannel+1, rtpAddr.IP, onPacket)
+}
+
+func (cs *ClientSession) readUDP(conn *net.UDPConn, clientChannel int, clientIP net.IP, onPacket func(channel int, data []byte)) {
+	defer cs.wg.Done()
+	buf := make([]byte, GlobalConfig.BufferSize)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if clientIP != nil && !from.IP.Equal(clientIP) {
+			Logf("⚠️ [UDP] Ignoring datagram from unexpected source %s", from)
+			continue
+		}
+		if onPacket != nil && n > 0 {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			onPacket(clientChannel, data)
+		}
+	}
+}
+
+// sendUDP writes an interleaved-framed packet as a datagram when its channel
+// is bound to a UDP sink. Returns false if the packet must go over TCP.
+func (cs *ClientSession) sendUDP(packet []byte) bool {
+	if len(packet) < streamHeaderLength || packet[0] != '$' {
+		return false
+	}
+	cs.mu.Lock()
+	sink, ok := cs.udp[int(packet[1])]
+	cs.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if _, err := sink.conn.WriteToUDP(packet[streamHeaderLength:], sink.addr); err != nil {
+		Logf("UDP write to client [%s] failed: %v", sink.addr, err)
+	}
+	if cap(packet) == GlobalConfig.BufferSize {
+		packetPool.Put(packet[:cap(packet)])
+	}
+	return true
+}
+
 // Push adds a packet to the client's queue.
 // Returns false if the queue is full (slow client).
 func (cs *ClientSession) Push(packet []byte) bool {
@@ -0,0 +1,161 @@
+package rtspproxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Clip export from the pre-event buffer:
+//
+//	GET /clip/<scheme>/[user:pass@]host[:port]/path?pre=10s&post=5s&at=<time>&format=mp4
+//
+// returns the footage from at-pre to at+post, starting at the keyframe at
+// or before at-pre. "at" is RFC 3339 or Unix seconds and defaults to now;
+// pre defaults to (and is capped at) GlobalConfig.PreEventBuffer; post
+// defaults to 0. The response is sent once the post-roll has been
+// received. "format" is mp4 (fragmented MP4, H.264/AAC) or ts (MPEG-TS,
+// H.264/H.265/AAC).
+
+const maxClipPostRoll = 5 * time.Minute
+
+// clipParams parses the query of a clip request.
+func clipParams(r *http.Request, window time.Duration, now time.Time) (at time.Time, pre, post time.Duration, format string, err error) {
+	q := r.URL.Query()
+	at, pre, format = now, window, "mp4"
+	if v := q.Get("at"); v != "" {
+		if at, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			secs, perr := strconv.ParseFloat(v, 64)
+			if perr != nil {
+				return at, 0, 0, "", fmt.Errorf("invalid at %q", v)
+			}
+			at, err = time.Unix(0, int64(secs*float64(time.Second))), nil
+		}
+		if at.After(now) {
+			return at, 0, 0, "", fmt.Errorf("at %s is in the future", v)
+		}
+	}
+	if v := q.Get("pre"); v != "" {
+		if pre, err = time.ParseDuration(v); err != nil || pre < 0 {
+			return at, 0, 0, "", fmt.Errorf("invalid pre %q", v)
+		}
+		pre = min(pre, window)
+	}
+	if v := q.Get("post"); v != "" {
+		if post, err = time.ParseDuration(v); err != nil || post < 0 || post > maxClipPostRoll {
+			return at, 0, 0, "", fmt.Errorf("invalid post %q (0 to %s)", v, maxClipPostRoll)
+		}
+	}
+	if v := q.Get("format"); v != "" {
+		format = v
+	}
+	if format != "mp4" && format != "ts" {
+		return at, 0, 0, "", fmt.Errorf("unsupported format %q", format)
+	}
+	return at, pre, post, format, nil
+}
+
+// serveClip handles GET /clip/<scheme>/<host>/<path>.
+func (server *Server) serveClip(w http.ResponseWriter, r *http.Request) {
+	scheme, host, username, password, streamPath, ok := parseProxyPath(strings.TrimPrefix(r.URL.Path, "/clip"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	window := GlobalConfig.PreEventBuffer
+	if window <= 0 {
+		http.Error(w, "pre-event buffering is disabled", http.StatusNotFound)
+		return
+	}
+	at, pre, post, format, err := clipParams(r, window, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stream := server.LookupStreamScheme(scheme, host, username, password, streamPath)
+	if stream == nil || stream.preEvent == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	LogCriticalf("🎬 [CLIP] Stream [%s] exporting %s from %s to %s", stream.Path, format, at.Add(-pre).Format(time.RFC3339), at.Add(post).Format(time.RFC3339))
+	sdp, channels, packets := stream.preEvent.collect(r.Context(), at.Add(-pre), at.Add(post))
+	if r.Context().Err() != nil {
+		return
+	}
+	var data []byte
+	if len(packets) > 0 {
+		if format == "ts" {
+			data = muxClipTS(stream, sdp, channels, packets)
+		} else {
+			data = muxClipMP4(stream, sdp, channels, packets)
+		}
+	}
+	if len(data) == 0 {
+		http.Error(w, "no buffered footage for this stream", http.StatusNotFound)
+		return
+	}
+
+	contentType := "video/mp4"
+	if format == "ts" {
+		contentType = "video/mp2t"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q",
+		strings.ReplaceAll(host, ":", "_")+"-"+at.UTC().Format(recordTimeFormat)+"."+format))
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(data)
+}
+
+// clipOrigin places a buffered packet at its arrival offset on the replay
+// timeline, so tracks keep the sync they had live.
+func clipOrigin(first, at time.Time) time.Time {
+	return time.Now().Add(-at.Sub(first))
+}
+
+// muxClipTS remuxes buffered packets into MPEG-TS, from the first random
+// access point.
+func muxClipTS(stream *Stream, sdp string, channels map[int]int, packets []preEventPacket) []byte {
+	var buf bytes.Buffer
+	var src *tsSource
+	src = newTSSource("🎬 [CLIP]", stream.Path, sdp, channels, time.Now(), func(pts int64, randomAccess bool) *bytes.Buffer {
+		if buf.Len() == 0 {
+			if !randomAccess {
+				return nil
+			}
+			src.muxer.WriteTables(&buf)
+		}
+		return &buf
+	})
+	for _, pkt := range packets {
+		src.origin = clipOrigin(packets[0].at, pkt.at)
+		src.push(pkt.channel, pkt.data)
+	}
+	return buf.Bytes()
+}
+
+// muxClipMP4 remuxes buffered packets into a fragmented MP4 file.
+func muxClipMP4(stream *Stream, sdp string, channels map[int]int, packets []preEventPacket) []byte {
+	var buf bytes.Buffer
+	fs := newFMP4Session(stream, func(msg any) error {
+		if data, ok := msg.([]byte); ok { // the MIME type is for MSE only
+			buf.Write(data)
+		}
+		return nil
+	})
+	fs.sdp, fs.channels = sdp, channels
+	for _, pkt := range packets {
+		fs.origin = clipOrigin(packets[0].at, pkt.at)
+		fs.Consume(pkt.channel, pkt.data)
+	}
+	fs.finish()
+	return buf.Bytes()
+}
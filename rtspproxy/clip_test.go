@@ -0,0 +1,162 @@
+package rtspproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// nopConsumer holds a stream open without reading it.
+type nopConsumer struct{}
+
+func (nopConsumer) Consume(int, []byte) {}
+
+// pushGOPs feeds b 10 fps video with a keyframe (SPS packet, then IDR)
+// every 10 frames, and one audio packet per frame, ending at end.
+func pushGOPs(b *preEventBuffer, frames int, end time.Time) {
+	seq := uint16(0)
+	push := func(at time.Time, channel int, pkt []byte) {
+		b.push(at, channel, append([]byte{'$', byte(channel), 0, 0}, pkt...))
+	}
+	for i := 0; i < frames; i++ {
+		at := end.Add(-time.Duration(frames-1-i) * 100 * time.Millisecond)
+		ts := uint32(i * 9000)
+		if i%10 == 0 {
+			push(at, 0, rtpPacketBytes(96, seq, ts, false, testSPS))
+			seq++
+			push(at, 0, rtpPacketBytes(96, seq, ts, true, []byte{0x65, 0x88}))
+		} else {
+			push(at, 0, rtpPacketBytes(96, seq, ts, true, []byte{0x41, 0x9a}))
+		}
+		seq++
+		push(at, 1, []byte{0x80, 0xc8, 0, 1}) // RTCP is not buffered
+		push(at, 2, rtpPacketBytes(97, uint16(i), uint32(i*4410), true, []byte{0x00, 0x10, 0x00, 0x08, 0x01}))
+	}
+}
+
+func TestPreEventBuffer(t *testing.T) {
+	b := newPreEventBuffer(1500 * time.Millisecond)
+	b.push(time.Now(), 0, []byte{'$', 0, 0, 0, 0x80}) // before DESCRIBE: ignored
+	b.setSDP(h264SDP, h264Channels)
+
+	end := time.Date(2025, 10, 18, 12, 0, 0, 0, time.UTC)
+	pushGOPs(b, 51, end)
+
+	// The buffer starts at the SPS of the last keyframe at least 1.5s old.
+	first := b.packets[0]
+	if first.at != end.Add(-2*time.Second) || first.channel != 0 || first.data[12] != testSPS[0] {
+		t.Errorf("buffer starts at %v channel %d, want the keyframe at %v", first.at, first.channel, end.Add(-2*time.Second))
+	}
+	for _, pkt := range b.packets {
+		if pkt.channel%2 != 0 {
+			t.Fatal("RTCP was buffered")
+		}
+	}
+
+	// A clip from 0.5s ago starts at the keyframe 1s ago and stops at until.
+	sdp, _, packets := b.collect(context.Background(), end.Add(-500*time.Millisecond), end.Add(-200*time.Millisecond))
+	if sdp != h264SDP || len(packets) == 0 {
+		t.Fatalf("empty clip")
+	}
+	if packets[0].at != end.Add(-time.Second) || packets[0].data[12] != testSPS[0] {
+		t.Errorf("clip starts at %v, want the keyframe at %v", packets[0].at, end.Add(-time.Second))
+	}
+	if last := packets[len(packets)-1].at; last != end.Add(-200*time.Millisecond) {
+		t.Errorf("clip ends at %v", last)
+	}
+
+	// A new description drops packets of the old one.
+	b.setSDP(mockSDP, map[int]int{0: 0})
+	if len(b.packets) != 0 || len(b.keyframes) != 0 {
+		t.Error("buffer kept packets across a changed SDP")
+	}
+}
+
+func TestClipParams(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	parse := func(query string) (time.Time, time.Duration, time.Duration, string, error) {
+		return clipParams(httptest.NewRequest("GET", "/clip/rtsp/cam/live?"+query, nil), 30*time.Second, now)
+	}
+
+	at, pre, post, format, err := parse("")
+	if err != nil || !at.Equal(now) || pre != 30*time.Second || post != 0 || format != "mp4" {
+		t.Errorf("defaults: %v %v %v %q %v", at, pre, post, format, err)
+	}
+	at, pre, post, format, err = parse("at=2026-10-18T11:59:00Z&pre=1m&post=10s&format=ts")
+	if err != nil || !at.Equal(now.Add(-time.Minute)) || pre != 30*time.Second || post != 10*time.Second || format != "ts" {
+		t.Errorf("explicit: %v %v %v %q %v", at, pre, post, format, err)
+	}
+	if at, _, _, _, err = parse(fmt.Sprintf("at=%d.5", now.Unix()-10)); err != nil || !at.Equal(now.Add(-9500*time.Millisecond)) {
+		t.Errorf("unix at: %v %v", at, err)
+	}
+	for _, bad := range []string{"at=tomorrow", "at=2026-10-18T13:00:00Z", "pre=-1s", "post=1h", "format=avi"} {
+		if _, _, _, _, err := parse(bad); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
+
+func TestClipExport(t *testing.T) {
+	oldBuffer := GlobalConfig.PreEventBuffer
+	t.Cleanup(func() { GlobalConfig.PreEventBuffer = oldBuffer })
+	GlobalConfig.PreEventBuffer = time.Second
+
+	server, addr := startTunnelServer(t)
+	cam := startH264Camera(t)
+	stream := server.LookupStreamScheme("rtsp", cam.Addr(), "", "", "/mock")
+	stream.AddConsumer(nopConsumer{})
+	t.Cleanup(func() { stream.RemoveConsumer(nopConsumer{}) })
+	time.Sleep(1500 * time.Millisecond) // fill the buffer
+
+	get := func(query string) (*http.Response, []byte) {
+		t.Helper()
+		resp, err := http.Get(fmt.Sprintf("http://%s/clip/rtsp/%s/mock?%s", addr, cam.Addr(), query))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	started := time.Now()
+	resp, body := get("pre=500ms&post=400ms")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "video/mp4" {
+		t.Fatalf("mp4 clip: %s %q", resp.Status, body)
+	}
+	if waited := time.Since(started); waited < 400*time.Millisecond {
+		t.Errorf("clip returned after %v, before the post-roll", waited)
+	}
+	boxes := mp4Children(t, body)
+	if len(boxes) < 4 || mp4Types(boxes[:4]) != "ftyp,moov,moof,mdat" {
+		t.Fatalf("unexpected MP4 layout")
+	}
+	// Video is written one access unit late: find its first fragment.
+	for i := 2; i+1 < len(boxes); i += 2 {
+		traf := mp4Children(t, mp4Children(t, boxes[i].payload)[1].payload)
+		if binary.BigEndian.Uint32(traf[0].payload[4:]) != 1 {
+			continue
+		}
+		if sample := boxes[i+1].payload; len(sample) < 5 || sample[4]&0x1f != 5 {
+			t.Errorf("clip does not start at an IDR: % x", sample[:min(len(sample), 5)])
+		}
+		break
+	}
+
+	resp, body = get("pre=500ms&format=ts")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "video/mp2t" {
+		t.Fatalf("ts clip: %s %q", resp.Status, body)
+	}
+	if len(body) == 0 || len(body)%tsPacketSize != 0 || body[0] != 0x47 {
+		t.Errorf("ts clip is not MPEG-TS (%d bytes)", len(body))
+	}
+
+	if resp, _ := get("format=avi"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad format: %s", resp.Status)
+	}
+}
@@ -15,11 +15,85 @@ type Config struct {
 	// Stream lifecycle
 	IdleTimeout      time.Duration
 	ReconnectBackoff []time.Duration
+	// 3xx redirects followed in one connection attempt (0 = none)
+	MaxRedirects int
 
 	// Buffers and Queues
 	PacketQueueSize int
 	BufferSize      int
 
+	// UDP port range for RTP/RTCP pairs (RTP on even ports)
+	RTPPortMin int
+	RTPPortMax int
+
+	// Upstream RTP lower transport: "tcp" (interleaved), "udp" or "multicast"
+	UpstreamTransport string
+	// Interface name used to join upstream multicast groups and to publish
+	// downstream ("" = routing table)
+	MulticastInterface string
+
+	// Downstream multicast re-publishing: one group per stream from this CIDR
+	// ("" = disabled), track ports at MulticastPublishPort + channel
+	MulticastPublishRange string
+	MulticastPublishPort  int
+	MulticastTTL          int
+	// Reconnect when no UDP packet arrived from the camera for this long
+	UDPTimeout time.Duration
+
+	// RTSPS listener: certificate/key (reloaded on change) and an optional
+	// CA bundle; when set, clients must present a certificate signed by it
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+
+	// RTSP and HTTP client accounts: htpasswd/htdigest users file ("" = no
+	// authentication, reloaded on change) and the realm of the challenges
+	UsersFile string
+	AuthRealm string
+
+	// rtsps:// cameras: CA bundle ("" = system roots), per-camera SHA-256
+	// certificate pins keyed by host[:port], and a global verification bypass
+	UpstreamCA                 string
+	UpstreamPins               map[string]string
+	UpstreamInsecureSkipVerify bool
+
+	// Cameras (host[:port]) reached through RTSP-over-HTTP tunnelling, in
+	// addition to those requested with the rtsp+http proxy scheme
+	UpstreamHTTPTunnelHosts []string
+
+	// HLS output: target segment duration, segments per playlist, and how
+	// long a stream keeps being segmented after the last viewer request
+	HLSSegmentDuration time.Duration
+	HLSSegmentCount    int
+	HLSViewerTimeout   time.Duration
+	// Low-Latency HLS part duration; 0 serves plain HLS
+	HLSPartDuration time.Duration
+
+	// Public addresses announced as WebRTC ICE candidates instead of the
+	// interface addresses (1:1 NAT)
+	WebRTCPublicIPs []string
+
+	// Continuous recording: streams to record ("rtsp/host/path[=dir]"),
+	// the directory template ({scheme}, {host}, {path}), segment length,
+	// and retention by age and total size (0 = unlimited)
+	RecordStreams         []string
+	RecordDir             string
+	RecordSegmentDuration time.Duration
+	RecordRetention       time.Duration
+	RecordMaxBytes        int64
+
+	// Seconds of packets every connected stream keeps in memory for clip
+	// export (0 = disabled)
+	PreEventBuffer time.Duration
+
+	// Replay the packets since the last keyframe to new viewers
+	GOPCache bool
+
+	// H.264 Annex-B file looped to clients while the camera is
+	// unreachable ("" = disabled), and its frame rate
+	FallbackSlate    string
+	FallbackSlateFPS float64
+
 	// Metrics HTTP endpoint (0 = disabled)
 	MetricsPort int
 }
@@ -40,10 +114,33 @@ func DefaultConfig() *Config {
 			10 * time.Second,
 			30 * time.Second,
 		},
+		MaxRedirects: 5,
 
 		PacketQueueSize: 1000,
 		BufferSize:      65536,
-		MetricsPort:     0,
+		RTPPortMin:      30000,
+		RTPPortMax:      39999,
+
+		UpstreamTransport: "tcp",
+		AuthRealm:         "RTSP-Proxy",
+		UDPTimeout:        10 * time.Second,
+
+		MulticastPublishPort: 40000,
+		MulticastTTL:         16,
+
+		HLSSegmentDuration: 2 * time.Second,
+		HLSSegmentCount:    5,
+		HLSViewerTimeout:   20 * time.Second,
+		HLSPartDuration:    200 * time.Millisecond,
+
+		RecordDir:             defaultRecordDir,
+		RecordSegmentDuration: time.Minute,
+
+		GOPCache: true,
+
+		FallbackSlateFPS: 25,
+
+		MetricsPort: 0,
 	}
 }
 
@@ -61,11 +158,63 @@ func (c *Config) Validate() error {
 	if c.WriteTimeout <= 0 {
 		c.WriteTimeout = 5 * time.Second
 	}
+	if c.MaxRedirects < 0 {
+		c.MaxRedirects = 5
+	}
 	if c.PacketQueueSize <= 0 {
 		c.PacketQueueSize = 1000
 	}
 	if c.BufferSize < 4096 {
 		c.BufferSize = 65536
 	}
+	if c.RTPPortMin <= 0 || c.RTPPortMax <= c.RTPPortMin {
+		c.RTPPortMin = 30000
+		c.RTPPortMax = 39999
+	}
+	if c.AuthRealm == "" {
+		c.AuthRealm = "RTSP-Proxy"
+	}
+	if c.UpstreamTransport != "udp" && c.UpstreamTransport != "multicast" {
+		c.UpstreamTransport = "tcp"
+	}
+	if c.UDPTimeout <= 0 {
+		c.UDPTimeout = 10 * time.Second
+	}
+	if c.MulticastPublishPort <= 0 || c.MulticastPublishPort > 65000 {
+		c.MulticastPublishPort = 40000
+	}
+	if c.MulticastTTL <= 0 || c.MulticastTTL > 255 {
+		c.MulticastTTL = 16
+	}
+	if c.HLSSegmentDuration < 100*time.Millisecond {
+		c.HLSSegmentDuration = 2 * time.Second
+	}
+	if c.HLSSegmentCount < 3 {
+		c.HLSSegmentCount = 5
+	}
+	if c.HLSViewerTimeout <= 0 {
+		c.HLSViewerTimeout = 20 * time.Second
+	}
+	if c.HLSPartDuration < 0 || c.HLSPartDuration >= c.HLSSegmentDuration {
+		c.HLSPartDuration = 0
+	}
+	if c.RecordDir == "" {
+		c.RecordDir = defaultRecordDir
+	}
+	if c.RecordSegmentDuration < time.Second {
+		c.RecordSegmentDuration = time.Minute
+	}
+	if c.RecordRetention < 0 {
+		c.RecordRetention = 0
+	}
+	if c.RecordMaxBytes < 0 {
+		c.RecordMaxBytes = 0
+	}
+	if c.PreEventBuffer < 0 {
+		c.PreEventBuffer = 0
+	}
+	if c.FallbackSlateFPS <= 0 || c.FallbackSlateFPS > 120 {
+		c.FallbackSlateFPS = 25
+	}
 	return nil
 }
@@ -0,0 +1,126 @@
+package rtspproxy
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Consumer receives the packets of a Stream outside of an RTSP session:
+// HLS segmenters, browser players, recorders. It counts as a viewer, so the
+// camera connection is held open (and IdleTimeout suspended) while any
+// consumer is attached.
+type Consumer interface {
+	// Consume is called from a per-consumer goroutine with the upstream
+	// channel (the RTP channel of a media, see Stream.mediaChannels, or the
+	// odd channel after it for RTCP) and the bare RTP/RTCP packet. The slice is only valid for the duration of the call.
+	Consume(channel int, packet []byte)
+}
+
+// consumerSession queues packets for one Consumer so a slow consumer never
+// stalls Stream.dispatch; packets that do not fit the queue are dropped.
+type consumerSession struct {
+	consumer Consumer
+	queue    chan []byte
+	quit     chan struct{}
+	wg       sync.WaitGroup
+	stopped  atomic.Bool
+}
+
+func newConsumerSession(consumer Consumer) *consumerSession {
+	cs := &consumerSession{
+		consumer: consumer,
+		queue:    make(chan []byte, GlobalConfig.PacketQueueSize),
+		quit:     make(chan struct{}),
+	}
+	cs.wg.Add(1)
+	go cs.run()
+	return cs
+}
+
+func (cs *consumerSession) run() {
+	defer cs.wg.Done()
+	defer func() {
+		for {
+			select {
+			case data := <-cs.queue:
+				packetPool.Put(data[:cap(data)])
+			default:
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-cs.quit:
+			return
+		case packet := <-cs.queue:
+			cs.consumer.Consume(int(packet[1]), packet[streamHeaderLength:])
+			packetPool.Put(packet[:cap(packet)])
+		}
+	}
+}
+
+// Push copies an interleaved-framed packet into the queue.
+func (cs *consumerSession) Push(packet []byte) bool {
+	if cs.stopped.Load() || len(packet) > GlobalConfig.BufferSize {
+		return false
+	}
+	buf := packetPool.Get().([]byte)
+	data := buf[:len(packet)]
+	copy(data, packet)
+	select {
+	case cs.queue <- data:
+		return true
+	default:
+		packetPool.Put(buf)
+		return false
+	}
+}
+
+func (cs *consumerSession) Stop() {
+	if cs.stopped.Swap(true) {
+		return
+	}
+	close(cs.quit)
+	cs.wg.Wait()
+}
+
+// AddConsumer attaches a consumer and starts the upstream connection if needed.
+func (s *Stream) AddConsumer(consumer Consumer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopIdleTimer()
+	if _, ok := s.consumers[consumer]; ok || s.state == StateDestroyed {
+		return
+	}
+	s.consumers[consumer] = newConsumerSession(consumer)
+
+	if s.state == StateDisconnected {
+		s.startConnectLoop()
+	}
+}
+
+// RemoveConsumer detaches a consumer; the stream goes idle once no client or
+// consumer is left.
+func (s *Stream) RemoveConsumer(consumer Consumer) {
+	s.mu.Lock()
+	cs, ok := s.consumers[consumer]
+	delete(s.consumers, consumer)
+	if s.viewersLocked() == 0 && s.state != StateDestroyed {
+		s.lastClient = time.Now()
+		s.resetIdleTimer()
+	}
+	s.mu.Unlock()
+
+	if ok {
+		cs.Stop()
+	}
+}
+
+// viewersLocked counts RTSP clients and consumers. Caller holds s.mu.
+func (s *Stream) viewersLocked() int {
+	return len(s.clients) + len(s.consumers)
+}
@@ -3,10 +3,13 @@ package rtspproxy
 import (
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
-	"regexp"
 	"strings"
 	"sync/atomic"
 )
@@ -14,16 +17,20 @@ import (
 var nonceCounter uint64
 
 // Digest holds parameters for HTTP Digest (and Basic) authentication.
-// Supports qop=auth (RFC 2617).
+// Supports MD5, SHA-256 and SHA-512-256, their -sess variants and
+// qop=auth or auth-int (RFC 7616).
 type Digest struct {
 	Realm     string
 	Nonce     string
 	Username  string
 	Password  string
-	Qop       string // "auth" or empty
+	Qop       string // "auth", "auth-int" or empty
 	Opaque    string
 	Algorithm string
 	Nc        uint32 // nonce count (client-side)
+	Cnonce    string // client nonce, kept for the whole server nonce
+
+	cnonceNonce string // the nonce Cnonce was chosen for
 }
 
 // NewDigest returns a pointer to a new Digest instance.
@@ -54,145 +61,243 @@ func md5Hex(data string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-// ComputeResponse generates the Digest response for the given method and URI.
-// When Qop == "auth" the response includes nc and cnonce (RFC 2617).
-func (d *Digest) ComputeResponse(cmd, uri string) (response, ncStr, cnonce string) {
-	ha1 := md5Hex(fmt.Sprintf("%s:%s:%s", d.Username, d.Realm, d.Password))
-	ha2 := md5Hex(fmt.Sprintf("%s:%s", cmd, uri))
+// digestHash returns the hex hash function of a Digest algorithm, with or
+// without the -sess suffix. Unknown algorithms fall back to MD5.
+func digestHash(algorithm string) func(string) string {
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "SHA-256":
+		newHash = sha256.New
+	case "SHA-512-256":
+		newHash = sha512.New512_256
+	default:
+		return md5Hex
+	}
+	return func(data string) string {
+		h := newHash()
+		io.WriteString(h, data)
+		return hex.EncodeToString(h.Sum(nil))
+	}
+}
 
-	if strings.EqualFold(d.Qop, "auth") {
+// ComputeResponse generates the Digest response for the given method, URI
+// and request body (RFC 7616). With a qop the response includes nc and
+// cnonce; -sess algorithms use one cnonce for the whole nonce.
+func (d *Digest) ComputeResponse(cmd, uri string, body []byte) (response, ncStr, cnonce string) {
+	if d.Cnonce == "" || d.cnonceNonce != d.Nonce {
+		d.Cnonce, d.cnonceNonce = randomCnonce(), d.Nonce
+	}
+	if d.Qop != "" {
 		d.Nc++
 		ncStr = fmt.Sprintf("%08x", d.Nc)
-		cnonce = randomCnonce()
-		response = md5Hex(fmt.Sprintf("%s:%s:%s:%s:%s:%s", ha1, d.Nonce, ncStr, cnonce, "auth", ha2))
-		return response, ncStr, cnonce
+		cnonce = d.Cnonce
+	} else if strings.HasSuffix(strings.ToLower(d.Algorithm), "-sess") {
+		cnonce = d.Cnonce
 	}
+	ha1 := digestHash(d.Algorithm)(fmt.Sprintf("%s:%s:%s", d.Username, d.Realm, d.Password))
+	response = digestResponse(d.Algorithm, ha1, d.Nonce, ncStr, d.Cnonce, d.Qop, cmd, uri, body)
+	return response, ncStr, cnonce
+}
 
-	response = md5Hex(fmt.Sprintf("%s:%s:%s", ha1, d.Nonce, ha2))
-	return response, "", ""
+// digestResponse computes a Digest response from HA1, the hash of
+// username:realm:password (RFC 7616 3.4.1). Servers keep only HA1.
+func digestResponse(algorithm, ha1, nonce, nc, cnonce, qop, method, uri string, body []byte) string {
+	h := digestHash(algorithm)
+	if strings.HasSuffix(strings.ToLower(algorithm), "-sess") {
+		ha1 = h(fmt.Sprintf("%s:%s:%s", ha1, nonce, cnonce))
+	}
+	ha2 := h(fmt.Sprintf("%s:%s", method, uri))
+	if strings.EqualFold(qop, "auth-int") {
+		ha2 = h(fmt.Sprintf("%s:%s:%s", method, uri, h(string(body))))
+	}
+	if qop != "" {
+		return h(fmt.Sprintf("%s:%s:%s:%s:%s:%s", ha1, nonce, nc, cnonce, strings.ToLower(qop), ha2))
+	}
+	return h(fmt.Sprintf("%s:%s:%s", ha1, nonce, ha2))
 }
 
 // AuthorizationHeader stores parsed fields from an Authorization header.
 type AuthorizationHeader struct {
-	URI      string
-	Realm    string
-	Nonce    string
-	Username string
-	Response string
+	Scheme    string // "Digest" or "Basic"
+	URI       string
+	Realm     string
+	Nonce     string
+	Username  string
+	Password  string // Basic only
+	Response  string
+	Algorithm string
+	Qop       string
+	Nc        string
+	Cnonce    string
+	Opaque    string
 }
 
-// ParseAuthorizationHeader parses an "Authorization: Digest ..." line.
+// ParseAuthorizationHeader parses Basic or Digest credentials, given as the
+// header value or as a message containing an "Authorization:" line. It
+// returns nil for anything else.
 func ParseAuthorizationHeader(buf string) *AuthorizationHeader {
-	if buf == "" {
-		return nil
-	}
-	index := strings.Index(buf, "Authorization: Digest ")
-	if index < 0 {
-		return nil
+	value := strings.TrimSpace(buf)
+	for rest := buf; rest != ""; {
+		var line string
+		rest, line = sharedLineSplit(rest)
+		if key, v, err := sharedParseHeader(line); err == nil && key == "Authorization" {
+			value = v
+			break
+		}
 	}
 
-	var username, realm, nonce, uri, response string
-	fields := buf[index+22:]
-	for fields != "" {
-		var parameter, value string
-		n1, _ := fmt.Sscanf(fields, "%[^=]=\"%[^\"]\"", &parameter, &value)
-		n2, _ := fmt.Sscanf(fields, "%[^=]=\"\"", &parameter)
-		if n1 != 2 && n2 != 1 {
-			break
+	scheme, credentials, _ := strings.Cut(value, " ")
+	switch {
+	case strings.EqualFold(scheme, "Basic"):
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+		if err != nil {
+			return nil
 		}
-		switch strings.ToLower(parameter) {
-		case "username":
-			username = value
-		case "realm":
-			realm = value
-		case "nonce":
-			nonce = value
-		case "uri":
-			uri = value
-		case "response":
-			response = value
+		username, password, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return nil
 		}
-		advance := len(parameter) + 2 + len(value) + 1
-		if advance > len(fields) {
-			break
+		return &AuthorizationHeader{Scheme: "Basic", Username: username, Password: password}
+	case strings.EqualFold(scheme, "Digest"):
+		challenges := ParseChallenges(value)
+		if len(challenges) == 0 {
+			return nil
 		}
-		fields = fields[advance:]
-		for len(fields) > 0 && (fields[0] == ' ' || fields[0] == ',') {
-			fields = fields[1:]
+		p := challenges[0].Params
+		return &AuthorizationHeader{
+			Scheme:    "Digest",
+			URI:       p["uri"],
+			Realm:     p["realm"],
+			Nonce:     p["nonce"],
+			Username:  p["username"],
+			Response:  p["response"],
+			Algorithm: p["algorithm"],
+			Qop:       p["qop"],
+			Nc:        p["nc"],
+			Cnonce:    p["cnonce"],
+			Opaque:    p["opaque"],
 		}
-		if fields == "" || fields[0] == '\r' || fields[0] == '\n' {
-			break
-		}
-	}
-
-	return &AuthorizationHeader{
-		URI:      uri,
-		Realm:    realm,
-		Nonce:    nonce,
-		Username: username,
-		Response: response,
 	}
+	return nil
 }
 
-var (
-	digestRe = regexp.MustCompile(`(?i)Digest\s+`)
-	basicRe  = regexp.MustCompile(`(?i)Basic\s+realm="([^"]+)"`)
-
-	// Precompiled extractors for common Digest params (quoted + unquoted forms).
-	reRealmQ     = regexp.MustCompile(`(?i)realm="([^"]*)"`)
-	reRealmU     = regexp.MustCompile(`(?i)realm=([^,\s]+)`)
-	reNonceQ     = regexp.MustCompile(`(?i)nonce="([^"]*)"`)
-	reNonceU     = regexp.MustCompile(`(?i)nonce=([^,\s]+)`)
-	reQopQ       = regexp.MustCompile(`(?i)qop="([^"]*)"`)
-	reQopU       = regexp.MustCompile(`(?i)qop=([^,\s]+)`)
-	reOpaqueQ    = regexp.MustCompile(`(?i)opaque="([^"]*)"`)
-	reOpaqueU    = regexp.MustCompile(`(?i)opaque=([^,\s]+)`)
-	reAlgorithmQ = regexp.MustCompile(`(?i)algorithm="([^"]*)"`)
-	reAlgorithmU = regexp.MustCompile(`(?i)algorithm=([^,\s]+)`)
-)
+// Challenge is one challenge of a WWW-Authenticate header (RFC 7235 4.1).
+type Challenge struct {
+	Scheme string            // "Digest", "Basic", ... as sent
+	Params map[string]string // lower-case names, unquoted values
+}
 
-func extractParam(quoted, unquoted *regexp.Regexp, s string) string {
-	if m := quoted.FindStringSubmatch(s); len(m) == 2 {
-		return m[1]
+// ParseChallenges splits a WWW-Authenticate value into its challenges. One
+// header may carry several, separated by commas; ParseResponse joins
+// repeated WWW-Authenticate headers the same way.
+func ParseChallenges(header string) []Challenge {
+	var challenges []Challenge
+	i := 0
+	token := func() string {
+		start := i
+		for i < len(header) && !strings.ContainsRune(" \t,=", rune(header[i])) {
+			i++
+		}
+		return header[start:i]
 	}
-	if m := unquoted.FindStringSubmatch(s); len(m) == 2 {
-		return m[1]
+	skip := func(chars string) {
+		for i < len(header) && strings.ContainsRune(chars, rune(header[i])) {
+			i++
+		}
+	}
+	for {
+		skip(" \t,")
+		if i >= len(header) {
+			return challenges
+		}
+		name := token()
+		if name == "" {
+			i++ // stray '='
+			continue
+		}
+		skip(" \t")
+		if i >= len(header) || header[i] != '=' || len(challenges) == 0 {
+			challenges = append(challenges, Challenge{Scheme: name, Params: map[string]string{}})
+			continue
+		}
+		i++
+		skip(" \t")
+		var value strings.Builder
+		if i < len(header) && header[i] == '"' {
+			for i++; i < len(header) && header[i] != '"'; i++ {
+				if header[i] == '\\' && i+1 < len(header) {
+					i++
+				}
+				value.WriteByte(header[i])
+			}
+			i++
+		} else {
+			value.WriteString(token())
+		}
+		challenges[len(challenges)-1].Params[strings.ToLower(name)] = value.String()
 	}
-	return ""
 }
 
-// ParseWWWAuthenticate extracts Digest/Basic parameters from a WWW-Authenticate header value.
-func ParseWWWAuthenticate(paramsStr string) (realm, nonce, qop, opaque, algorithm string, isDigest bool) {
-	if paramsStr == "" {
-		return
-	}
+// digestAlgorithms are the supported Digest algorithms, strongest first.
+var digestAlgorithms = []string{"SHA-512-256", "SHA-512-256-sess", "SHA-256", "SHA-256-sess", "MD5", "MD5-sess"}
 
-	if !digestRe.MatchString(paramsStr) {
-		if m := basicRe.FindStringSubmatch(paramsStr); len(m) == 2 {
-			realm = m[1]
+// digestStrength ranks a Digest algorithm; -1 if unsupported.
+func digestStrength(algorithm string) int {
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+	for i, a := range digestAlgorithms {
+		if strings.EqualFold(a, algorithm) {
+			return len(digestAlgorithms) - i
 		}
-		return
-	}
-	isDigest = true
-
-	realm = extractParam(reRealmQ, reRealmU, paramsStr)
-	nonce = extractParam(reNonceQ, reNonceU, paramsStr)
-	qop = extractParam(reQopQ, reQopU, paramsStr)
-	if strings.Contains(qop, ",") {
-		for _, part := range strings.Split(qop, ",") {
-			part = strings.TrimSpace(part)
-			if part == "auth" {
-				qop = "auth"
-				break
+	}
+	return -1
+}
+
+// ParseWWWAuthenticate picks the challenge to answer from a WWW-Authenticate
+// value: the Digest challenge with the strongest supported algorithm, else
+// the Basic one. ok is false when there is nothing to answer.
+func ParseWWWAuthenticate(header string) (challenge Challenge, ok bool) {
+	best := 0
+	for _, c := range ParseChallenges(header) {
+		switch {
+		case strings.EqualFold(c.Scheme, "Digest"):
+			if strength := digestStrength(c.Params["algorithm"]); strength > best && c.Params["nonce"] != "" {
+				challenge, best, ok = c, strength, true
+			}
+		case strings.EqualFold(c.Scheme, "Basic"):
+			if !ok {
+				challenge, ok = c, true
 			}
 		}
 	}
-	opaque = extractParam(reOpaqueQ, reOpaqueU, paramsStr)
-	algorithm = extractParam(reAlgorithmQ, reAlgorithmU, paramsStr)
-	if algorithm == "" {
-		algorithm = "MD5"
+	return challenge, ok
+}
+
+// IsDigest reports whether the challenge asks for Digest authentication.
+func (c Challenge) IsDigest() bool {
+	return strings.EqualFold(c.Scheme, "Digest")
+}
+
+// Stale reports whether a Digest challenge only replaces an expired nonce
+// (RFC 7616 3.3): the credentials were right.
+func (c Challenge) Stale() bool {
+	return strings.EqualFold(c.Params["stale"], "true")
+}
+
+// Qop picks the quality of protection from the challenge's qop list:
+// "auth" when offered, else "auth-int", else none (RFC 2069 mode).
+func (c Challenge) Qop() string {
+	qop := ""
+	for _, option := range strings.Split(c.Params["qop"], ",") {
+		switch strings.ToLower(strings.TrimSpace(option)) {
+		case "auth":
+			return "auth"
+		case "auth-int":
+			qop = "auth-int"
+		}
 	}
-	return
+	return qop
 }
 
 // NcString formats a nonce-count as 8-digit hex.
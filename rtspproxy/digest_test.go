@@ -0,0 +1,175 @@
+package rtspproxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseWWWAuthenticate(t *testing.T) {
+	for _, tc := range []struct{ header, scheme, algorithm, qop string }{
+		{`Digest realm="cam", nonce="1", algorithm=MD5, Digest realm="cam", nonce="2", algorithm=SHA-256, qop="auth,auth-int"`, "Digest", "SHA-256", "auth"},
+		{`Basic realm="cam", Digest realm="a, b", nonce="1", qop="auth-int"`, "Digest", "", "auth-int"},
+		{`Digest realm="cam", nonce="1", algorithm=SHA-512-256-sess, Digest realm="cam", nonce="2", algorithm=SHA-256`, "Digest", "SHA-512-256-sess", ""},
+		{`Digest realm="cam", nonce="1", algorithm=SHA3, Basic realm="cam"`, "Basic", "", ""},
+	} {
+		c, ok := ParseWWWAuthenticate(tc.header)
+		if !ok || c.Scheme != tc.scheme || c.Params["algorithm"] != tc.algorithm || c.Qop() != tc.qop {
+			t.Errorf("%s: got %v %+v qop %q", tc.header, ok, c, c.Qop())
+		}
+	}
+	if c, _ := ParseWWWAuthenticate(`Digest realm="a \"b\", c", nonce=x, stale=TRUE`); c.Params["realm"] != `a "b", c` || !c.Stale() {
+		t.Errorf("quoted realm: %+v", c)
+	}
+	if _, ok := ParseWWWAuthenticate(`Negotiate abc==`); ok {
+		t.Error("answered an unsupported scheme")
+	}
+
+	response, _ := NewResponseFromBuffer("RTSP/1.0 401 Unauthorized\r\nCSeq: 1\r\nWWW-Authenticate: Digest realm=\"r\", nonce=\"1\"\r\nWWW-Authenticate: Digest realm=\"r\", nonce=\"2\", algorithm=SHA-256\r\n\r\n")
+	if c, _ := ParseWWWAuthenticate(headerGet(response.Headers, "WWW-Authenticate")); c.Params["nonce"] != "2" {
+		t.Errorf("repeated headers: %q", headerGet(response.Headers, "WWW-Authenticate"))
+	}
+}
+
+func TestDigestComputeResponse(t *testing.T) {
+	// RFC 7616 3.9.1.
+	for algorithm, want := range map[string]string{
+		"MD5":     "8ca523f5e9506fed4657c9700eebdbec",
+		"SHA-256": "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1",
+	} {
+		d := &Digest{
+			Realm:     "http-auth@example.org",
+			Nonce:     "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+			Username:  "Mufasa",
+			Password:  "Circle of Life",
+			Qop:       "auth",
+			Algorithm: algorithm,
+			Cnonce:    "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+		}
+		d.cnonceNonce = d.Nonce
+		if response, nc, _ := d.ComputeResponse("GET", "/dir/index.html", nil); response != want || nc != "00000001" {
+			t.Errorf("%s: response %s nc %s, want %s", algorithm, response, nc, want)
+		}
+	}
+
+	d := &Digest{Realm: "r", Nonce: "n", Username: "u", Password: "p", Qop: "auth-int", Algorithm: "SHA-256-sess"}
+	r1, _, c1 := d.ComputeResponse("SET_PARAMETER", "rtsp://cam/", []byte("a: 1"))
+	r2, _, c2 := d.ComputeResponse("SET_PARAMETER", "rtsp://cam/", []byte("a: 2"))
+	if c1 == "" || c1 != c2 || r1 == r2 || len(r1) != 64 {
+		t.Errorf("auth-int -sess: %s/%s, %s/%s", r1, c1, r2, c2)
+	}
+}
+
+func TestUpstreamDigestChallenges(t *testing.T) {
+	authFailures := GlobalMetrics.AuthFailures.Load()
+	cam := startMockCamera(t)
+	var mu sync.Mutex
+	nonce, stale := "first", 0
+	var authorizations []string
+	cam.handle = func(method, req string, conn net.Conn) string {
+		mu.Lock()
+		defer mu.Unlock()
+		auth := headerGet(parseMockHeaders(req), "Authorization")
+		authorizations = append(authorizations, method+" "+auth)
+		c, _ := ParseWWWAuthenticate(auth)
+		nc, _ := strconv.ParseUint(c.Params["nc"], 16, 32)
+		expected := &Digest{Realm: "cam", Nonce: nonce, Username: "admin", Password: "secret",
+			Qop: "auth-int", Algorithm: "SHA-256", Nc: uint32(nc) - 1, Cnonce: c.Params["cnonce"], cnonceNonce: nonce}
+		response, _, _ := expected.ComputeResponse(method, c.Params["uri"], nil)
+		challenge := func(stale bool) string {
+			return fmt.Sprintf("RTSP/1.0 401 Unauthorized\r\n"+
+				"WWW-Authenticate: Digest realm=\"cam\", nonce=\"%[1]s\", algorithm=MD5, qop=\"auth\", stale=%[2]v\r\n"+
+				"WWW-Authenticate: Digest realm=\"cam\", nonce=\"%[1]s\", algorithm=SHA-256, qop=\"auth-int\", stale=%[2]v\r\n\r\n", nonce, stale)
+		}
+		if c.Params["nonce"] != nonce || c.Params["response"] != response || c.Params["algorithm"] != "SHA-256" {
+			return challenge(false)
+		}
+		if method == "PLAY" && stale < 2 {
+			// Twice, so the retry of PLAY meets one too.
+			stale++
+			nonce = fmt.Sprint("rotated", stale)
+			return challenge(true)
+		}
+		return ""
+	}
+
+	server, _ := startTunnelServer(t)
+	stream := server.LookupStreamScheme("rtsp", cam.Addr(), "admin", "secret", "/mock")
+	stream.AddConsumer(nopConsumer{})
+	t.Cleanup(func() { stream.RemoveConsumer(nopConsumer{}) })
+	deadline := time.Now().Add(5 * time.Second)
+	for stream.GetState() != StatePlaying {
+		if time.Now().After(deadline) {
+			mu.Lock()
+			defer mu.Unlock()
+			t.Fatalf("stream did not start: %q", authorizations)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if stale != 2 {
+		t.Errorf("%d stale challenges sent: %q", stale, authorizations)
+	}
+	if n := GlobalMetrics.AuthFailures.Load() - authFailures; n != 0 || atomic.LoadUint64(&stream.ReconnectCount) != 0 {
+		t.Errorf("%d auth failures counted, %d reconnects", n, atomic.LoadUint64(&stream.ReconnectCount))
+	}
+}
+
+func TestUpstreamAuthRefused(t *testing.T) {
+	cam := startMockCamera(t)
+	cam.handle = func(method, req string, conn net.Conn) string {
+		if method != "GET_PARAMETER" {
+			return ""
+		}
+		if headerGet(parseMockHeaders(req), "Authorization") == "" {
+			return "RTSP/1.0 401 Unauthorized\r\nWWW-Authenticate: Basic realm=\"cam\"\r\n\r\n"
+		}
+		return "RTSP/1.0 401 Unauthorized\r\n\r\n" // wrong password, no new challenge
+	}
+	server, _ := startTunnelServer(t)
+	stream := server.LookupStreamScheme("rtsp", cam.Addr(), "admin", "wrong", "/mock")
+	stream.AddConsumer(nopConsumer{})
+	t.Cleanup(func() { stream.RemoveConsumer(nopConsumer{}) })
+	select {
+	case <-stream.ReadyCh():
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not start")
+	}
+	stream.mu.RLock()
+	remote := stream.remote
+	stream.mu.RUnlock()
+
+	authFailures := GlobalMetrics.AuthFailures.Load()
+	request, _ := NewRequest("GET_PARAMETER", &url.URL{Scheme: "rtsp", Host: cam.Addr(), Path: "/mock"})
+	if err := remote.SendRequestSync(request); err == nil || err.Error() != "unauthorized" {
+		t.Errorf("refused request: %v", err)
+	}
+	if n := GlobalMetrics.AuthFailures.Load() - authFailures; n != 1 {
+		t.Errorf("%d auth failures counted", n)
+	}
+	if n := strings.Count(strings.Join(cam.Methods(), " "), "GET_PARAMETER"); n != 2 {
+		t.Errorf("%d GET_PARAMETERs sent, want 2", n)
+	}
+}
+
+func TestParseAuthorizationHeader(t *testing.T) {
+	a := ParseAuthorizationHeader("DESCRIBE rtsp://cam/ RTSP/1.0\r\nCSeq: 2\r\nauthorization: Digest username=\"u\", realm=\"r\", nonce=\"n\", uri=\"rtsp://cam:554/a,b\", response=\"x\", qop=auth, nc=00000001, cnonce=\"c\", algorithm=SHA-256\r\n\r\n")
+	if a == nil || a.Scheme != "Digest" || a.URI != "rtsp://cam:554/a,b" || a.Qop != "auth" || a.Nc != "00000001" || a.Algorithm != "SHA-256" {
+		t.Errorf("Digest: %+v", a)
+	}
+	if a := ParseAuthorizationHeader("Basic dTpwOnc="); a == nil || a.Username != "u" || a.Password != "p:w" {
+		t.Errorf("Basic: %+v", a)
+	}
+	for _, value := range []string{"", "Basic !!", "Basic dXNlcg==", "Bearer abc"} {
+		if a := ParseAuthorizationHeader(value); a != nil {
+			t.Errorf("%q: %+v", value, a)
+		}
+	}
+}
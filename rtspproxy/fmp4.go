@@ -0,0 +1,322 @@
+package rtspproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Minimal fragmented MP4 (ISO/IEC 14496-12) writer for Media Source
+// Extensions players: an init segment (ftyp+moov) describing at most one
+// H.264 and one AAC track, then one moof+mdat fragment per sample.
+
+// fmp4Track describes one track of the init segment.
+type fmp4Track struct {
+	id        uint32
+	timescale uint32
+	// video
+	sps, pps      []byte
+	width, height int
+	// audio
+	asc        []byte
+	sampleRate int
+	channels   int
+}
+
+func (t *fmp4Track) isVideo() bool {
+	return t.sps != nil
+}
+
+// codec returns the RFC 6381 codecs parameter of the track.
+func (t *fmp4Track) codec() string {
+	if t.isVideo() {
+		return fmt.Sprintf("avc1.%02x%02x%02x", t.sps[1], t.sps[2], t.sps[3])
+	}
+	return fmt.Sprintf("mp4a.40.%d", t.asc[0]>>3)
+}
+
+// fmp4MimeType returns the MediaSource.addSourceBuffer type for the tracks.
+func fmp4MimeType(tracks []*fmp4Track) string {
+	codecs := make([]string, len(tracks))
+	for i, t := range tracks {
+		codecs[i] = t.codec()
+	}
+	return fmt.Sprintf("video/mp4; codecs=\"%s\"", strings.Join(codecs, ","))
+}
+
+func mp4Box(typ string, parts ...[]byte) []byte {
+	size := 8
+	for _, p := range parts {
+		size += len(p)
+	}
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	copy(b[4:], typ)
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func mp4FullBox(typ string, version byte, flags uint32, parts ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return mp4Box(typ, append([][]byte{header}, parts...)...)
+}
+
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func u64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+var mp4Matrix = bytes.Join([][]byte{
+	u32(0x00010000), u32(0), u32(0),
+	u32(0), u32(0x00010000), u32(0),
+	u32(0), u32(0), u32(0x40000000),
+}, nil)
+
+// fmp4Init builds the init segment.
+func fmp4Init(tracks []*fmp4Track) []byte {
+	ftyp := mp4Box("ftyp", []byte("iso5"), u32(0x200), []byte("iso5iso6mp41"))
+
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		u32(0), u32(0), u32(1000), u32(0), // times, timescale, duration
+		u32(0x00010000), u16(0x0100), make([]byte, 10), // rate, volume, reserved
+		mp4Matrix, make([]byte, 24), u32(uint32(len(tracks)+1)))
+	moov := [][]byte{mvhd}
+	var trex [][]byte
+	for _, t := range tracks {
+		moov = append(moov, fmp4Trak(t))
+		trex = append(trex, mp4FullBox("trex", 0, 0, u32(t.id), u32(1), u32(0), u32(0), u32(0)))
+	}
+	moov = append(moov, mp4Box("mvex", trex...))
+	return append(ftyp, mp4Box("moov", moov...)...)
+}
+
+func fmp4Trak(t *fmp4Track) []byte {
+	volume, handler, name := uint16(0x0100), "soun", "SoundHandler"
+	var mediaHeader, entry []byte
+	if t.isVideo() {
+		volume, handler, name = 0, "vide", "VideoHandler"
+		mediaHeader = mp4FullBox("vmhd", 0, 1, u16(0), u16(0), u16(0), u16(0))
+		avcC := mp4Box("avcC",
+			[]byte{1, t.sps[1], t.sps[2], t.sps[3], 0xff, 0xe1}, u16(uint16(len(t.sps))), t.sps,
+			[]byte{1}, u16(uint16(len(t.pps))), t.pps)
+		entry = mp4Box("avc1",
+			make([]byte, 6), u16(1), // reserved, data_reference_index
+			make([]byte, 16), // pre_defined, reserved
+			u16(uint16(t.width)), u16(uint16(t.height)),
+			u32(0x00480000), u32(0x00480000), u32(0), u16(1), // resolution, reserved, frame_count
+			make([]byte, 32), u16(0x0018), u16(0xffff), // compressorname, depth, pre_defined
+			avcC)
+	} else {
+		mediaHeader = mp4FullBox("smhd", 0, 0, u16(0), u16(0))
+		entry = mp4Box("mp4a",
+			make([]byte, 6), u16(1),
+			make([]byte, 8), u16(uint16(t.channels)), u16(16), u16(0), u16(0),
+			u32(uint32(t.sampleRate)<<16),
+			fmp4Esds(t))
+	}
+
+	tkhd := mp4FullBox("tkhd", 0, 3,
+		u32(0), u32(0), u32(t.id), u32(0), u32(0), // times, track_ID, reserved, duration
+		make([]byte, 8), u16(0), u16(0), u16(volume), u16(0), // reserved, layer, group, volume, reserved
+		mp4Matrix, u32(uint32(t.width)<<16), u32(uint32(t.height)<<16))
+	mdhd := mp4FullBox("mdhd", 0, 0, u32(0), u32(0), u32(t.timescale), u32(0), u16(0x55c4), u16(0))
+	hdlr := mp4FullBox("hdlr", 0, 0, u32(0), []byte(handler), make([]byte, 12), []byte(name+"\x00"))
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, u32(1), mp4FullBox("url ", 0, 1)))
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, u32(1), entry),
+		mp4FullBox("stts", 0, 0, u32(0)),
+		mp4FullBox("stsc", 0, 0, u32(0)),
+		mp4FullBox("stsz", 0, 0, u32(0), u32(0)),
+		mp4FullBox("stco", 0, 0, u32(0)))
+	minf := mp4Box("minf", mediaHeader, dinf, stbl)
+	return mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, minf))
+}
+
+// fmp4Esds wraps the AudioSpecificConfig in an MPEG-4 ES descriptor.
+func fmp4Esds(t *fmp4Track) []byte {
+	descriptor := func(tag byte, parts ...[]byte) []byte {
+		body := bytes.Join(parts, nil)
+		return append([]byte{tag, byte(len(body))}, body...)
+	}
+	decSpecific := descriptor(0x05, t.asc)
+	decConfig := descriptor(0x04, []byte{0x40, 0x15, 0, 0, 0}, u32(0), u32(0), decSpecific)
+	es := descriptor(0x03, u16(uint16(t.id)), []byte{0}, decConfig, descriptor(0x06, []byte{0x02}))
+	return mp4FullBox("esds", 0, 0, es)
+}
+
+// fmp4Fragment builds a moof+mdat carrying a single sample.
+func fmp4Fragment(seq uint32, t *fmp4Track, decodeTime uint64, duration uint32, keyframe bool, data []byte) []byte {
+	flags := uint32(0x02000000) // sample_depends_on=2 (intra)
+	if t.isVideo() && !keyframe {
+		flags = 0x01010000 // sample_depends_on=1, non-sync
+	}
+	moof := func(offset uint32) []byte {
+		trun := mp4FullBox("trun", 0, 0x000701, u32(1), u32(offset), u32(duration), u32(uint32(len(data))), u32(flags))
+		traf := mp4Box("traf",
+			mp4FullBox("tfhd", 0, 0x020000, u32(t.id)), // default-base-is-moof
+			mp4FullBox("tfdt", 1, 0, u64(decodeTime)),
+			trun)
+		return mp4Box("moof", mp4FullBox("mfhd", 0, 0, u32(seq)), traf)
+	}
+	m := moof(0)
+	m = moof(uint32(len(m) + 8))
+	return append(m, mp4Box("mdat", data)...)
+}
+
+// avccSample converts an access unit to length-prefixed NAL units, leaving
+// out delimiters and parameter sets (they are in the init segment).
+func avccSample(au *accessUnit) []byte {
+	var b []byte
+	for _, nalu := range au.NALUs {
+		if typ := naluType(false, nalu); typ == 9 || isParameterSetNALU(false, nalu) {
+			continue
+		}
+		b = binary.BigEndian.AppendUint32(b, uint32(len(nalu)))
+		b = append(b, nalu...)
+	}
+	return b
+}
+
+// h264SPSSize returns the picture size coded in an H.264 SPS.
+func h264SPSSize(sps []byte) (width, height int, ok bool) {
+	if len(sps) < 4 {
+		return 0, 0, false
+	}
+	r := &bitReader{data: unescapeRBSP(sps[1:])}
+	profile := r.bits(8)
+	r.bits(16) // constraint flags, level
+	r.ue()     // seq_parameter_set_id
+	chroma := 1
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chroma = r.ue()
+		if chroma == 3 {
+			r.bits(1) // separate_colour_plane_flag
+		}
+		r.ue()              // bit_depth_luma_minus8
+		r.ue()              // bit_depth_chroma_minus8
+		r.bits(1)           // qpprime_y_zero_transform_bypass_flag
+		if r.bits(1) == 1 { // seq_scaling_matrix_present_flag
+			lists := 8
+			if chroma == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bits(1) == 0 {
+					continue
+				}
+				size, last, next := 16, 8, 8
+				if i >= 6 {
+					size = 64
+				}
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bits(1)
+		r.se()
+		r.se()
+		for n := r.ue(); n > 0 && !r.failed; n-- {
+			r.se()
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.bits(1) // gaps_in_frame_num_value_allowed_flag
+	widthMbs := r.ue() + 1
+	heightMaps := r.ue() + 1
+	frameMbsOnly := r.bits(1)
+	if frameMbsOnly == 0 {
+		r.bits(1) // mb_adaptive_frame_field_flag
+	}
+	r.bits(1) // direct_8x8_inference_flag
+	var cropLeft, cropRight, cropTop, cropBottom int
+	if r.bits(1) == 1 {
+		cropLeft, cropRight, cropTop, cropBottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+	if r.failed {
+		return 0, 0, false
+	}
+
+	unitX, unitY := 1, 2-frameMbsOnly
+	switch chroma {
+	case 1:
+		unitX, unitY = 2, 2*(2-frameMbsOnly)
+	case 2:
+		unitX = 2
+	}
+	width = widthMbs*16 - (cropLeft+cropRight)*unitX
+	height = (2-frameMbsOnly)*heightMaps*16 - (cropTop+cropBottom)*unitY
+	return width, height, width > 0 && height > 0
+}
+
+// unescapeRBSP removes emulation prevention bytes (00 00 03).
+func unescapeRBSP(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		out = append(out, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// bitReader reads MSB-first bits and Exp-Golomb codes; reading past the
+// end sets failed and returns zeros.
+type bitReader struct {
+	data   []byte
+	pos    int
+	failed bool
+}
+
+func (r *bitReader) bits(n int) int {
+	if r.pos+n > len(r.data)*8 {
+		r.failed = true
+		r.pos = len(r.data) * 8
+		return 0
+	}
+	v := readBits(r.data, r.pos, n)
+	r.pos += n
+	return v
+}
+
+func (r *bitReader) ue() int {
+	zeros := 0
+	for r.bits(1) == 0 {
+		if r.failed || zeros > 31 {
+			r.failed = true
+			return 0
+		}
+		zeros++
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+func (r *bitReader) se() int {
+	v := r.ue()
+	if v%2 == 1 {
+		return (v + 1) / 2
+	}
+	return -v / 2
+}
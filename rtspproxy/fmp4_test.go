@@ -0,0 +1,205 @@
+package rtspproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+type mp4TestBox struct {
+	typ     string
+	payload []byte
+}
+
+// mp4Children splits b into boxes; it fails the test on a malformed size.
+func mp4Children(t *testing.T, b []byte) []mp4TestBox {
+	t.Helper()
+	var boxes []mp4TestBox
+	for len(b) > 0 {
+		if len(b) < 8 {
+			t.Fatalf("truncated box header % x", b)
+		}
+		size := int(binary.BigEndian.Uint32(b))
+		if size < 8 || size > len(b) {
+			t.Fatalf("bad %q box size %d (have %d)", b[4:8], size, len(b))
+		}
+		boxes = append(boxes, mp4TestBox{string(b[4:8]), b[8:size]})
+		b = b[size:]
+	}
+	return boxes
+}
+
+func mp4Types(boxes []mp4TestBox) string {
+	types := make([]string, len(boxes))
+	for i, b := range boxes {
+		types[i] = b.typ
+	}
+	return strings.Join(types, ",")
+}
+
+// 1280x720 High profile SPS as written by x264.
+var testSPS720p = []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0xc8, 0xf1, 0x83, 0x19, 0x60}
+
+func TestH264SPSSize(t *testing.T) {
+	w, h, ok := h264SPSSize(testSPS720p)
+	if !ok || w != 1280 || h != 720 {
+		t.Errorf("got %dx%d ok=%v, want 1280x720", w, h, ok)
+	}
+	if _, _, ok := h264SPSSize([]byte{0x67, 0x64}); ok {
+		t.Error("truncated SPS accepted")
+	}
+}
+
+func TestFMP4MalformedSPS(t *testing.T) {
+	var mime string
+	fs := newFMP4Session(NewStream(&Server{ctx: context.Background()}, "cam", "", "", "/a"), func(msg any) error {
+		if s, ok := msg.(string); ok {
+			mime = s
+		}
+		return nil
+	})
+	// The SDP carries a truncated SPS, and so do the first keyframes.
+	fs.sdp = strings.Replace(h264SDP, base64.StdEncoding.EncodeToString(testSPS), "Zw==", 1)
+	fs.channels = h264Channels
+	seq := uint16(0)
+	keyframe := func(ts uint32, sps []byte) {
+		for _, nalu := range [][]byte{sps, testPPS} {
+			fs.Consume(0, rtpPacketBytes(96, seq, ts, false, nalu))
+			seq++
+		}
+		fs.Consume(0, rtpPacketBytes(96, seq, ts, true, []byte{0x65, 0x88}))
+		seq++
+	}
+	keyframe(0, []byte{0x67, 0x64, 0x00})
+	keyframe(3000, []byte{0x67, 0x64, 0x00, 0x1f})
+	if mime != "" {
+		t.Fatalf("started with a malformed SPS: %s", mime)
+	}
+	keyframe(6000, testSPS720p)
+	if !strings.Contains(mime, "avc1.64001f") {
+		t.Errorf("MIME type %q", mime)
+	}
+}
+
+func TestFMP4Boxes(t *testing.T) {
+	video := &fmp4Track{id: 1, timescale: 90000, sps: testSPS720p, pps: testPPS, width: 1280, height: 720}
+	audio := &fmp4Track{id: 2, timescale: 44100, asc: []byte{0x12, 0x10}, sampleRate: 44100, channels: 2}
+	if mime := fmp4MimeType([]*fmp4Track{video, audio}); mime != `video/mp4; codecs="avc1.64001f,mp4a.40.2"` {
+		t.Errorf("unexpected MIME type %s", mime)
+	}
+
+	init := mp4Children(t, fmp4Init([]*fmp4Track{video, audio}))
+	if mp4Types(init) != "ftyp,moov" {
+		t.Fatalf("init segment boxes: %s", mp4Types(init))
+	}
+	moov := mp4Children(t, init[1].payload)
+	if mp4Types(moov) != "mvhd,trak,trak,mvex" {
+		t.Fatalf("moov boxes: %s", mp4Types(moov))
+	}
+	if !bytes.Contains(moov[1].payload, append(u16(uint16(len(testSPS720p))), testSPS720p...)) {
+		t.Error("avcC lacks the SPS")
+	}
+	if !bytes.Contains(moov[2].payload, []byte("esds")) {
+		t.Error("audio track lacks esds")
+	}
+
+	data := []byte{0, 0, 0, 2, 0x65, 0x88}
+	fragment := fmp4Fragment(7, video, 123456, 3000, true, data)
+	boxes := mp4Children(t, fragment)
+	if mp4Types(boxes) != "moof,mdat" || !bytes.Equal(boxes[1].payload, data) {
+		t.Fatalf("fragment boxes: %s", mp4Types(boxes))
+	}
+	traf := mp4Children(t, mp4Children(t, boxes[0].payload)[1].payload)
+	if mp4Types(traf) != "tfhd,tfdt,trun" {
+		t.Fatalf("traf boxes: %s", mp4Types(traf))
+	}
+	if dt := binary.BigEndian.Uint64(traf[1].payload[4:]); dt != 123456 {
+		t.Errorf("baseMediaDecodeTime %d", dt)
+	}
+	trun := traf[2].payload
+	offset := int(binary.BigEndian.Uint32(trun[8:]))
+	if !bytes.Equal(fragment[offset:], data) {
+		t.Errorf("trun data_offset %d does not point at the sample", offset)
+	}
+	if flags := binary.BigEndian.Uint32(trun[20:]); flags != 0x02000000 {
+		t.Errorf("keyframe sample flags %#x", flags)
+	}
+}
+
+func TestFMP4WebSocket(t *testing.T) {
+	server, addr := startTunnelServer(t)
+	cam := startH264Camera(t)
+
+	ws, err := websocket.Dial(fmt.Sprintf("ws://%s/fmp4/rtsp/%s/mock", addr, cam.Addr()), "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	var mime string
+	if err := websocket.Message.Receive(ws, &mime); err != nil {
+		t.Fatal(err)
+	}
+	if mime != `video/mp4; codecs="avc1.42c01e,mp4a.40.2"` {
+		t.Errorf("unexpected MIME type %q", mime)
+	}
+	var init []byte
+	if err := websocket.Message.Receive(ws, &init); err != nil {
+		t.Fatal(err)
+	}
+	if mp4Types(mp4Children(t, init)) != "ftyp,moov" {
+		t.Fatal("second message is not an init segment")
+	}
+
+	// The first video fragment is the keyframe the session started on.
+	sawVideo, sawAudio := false, false
+	for i := 0; i < 20 && !(sawVideo && sawAudio); i++ {
+		var fragment []byte
+		if err := websocket.Message.Receive(ws, &fragment); err != nil {
+			t.Fatal(err)
+		}
+		boxes := mp4Children(t, fragment)
+		if mp4Types(boxes) != "moof,mdat" {
+			t.Fatalf("unexpected fragment boxes %s", mp4Types(boxes))
+		}
+		traf := mp4Children(t, mp4Children(t, boxes[0].payload)[1].payload)
+		switch binary.BigEndian.Uint32(traf[0].payload[4:]) {
+		case 1:
+			if !sawVideo {
+				sample := boxes[1].payload
+				if len(sample) < 5 || sample[4]&0x1f != 5 {
+					t.Errorf("first video sample is not an IDR: % x", sample[:min(len(sample), 5)])
+				}
+			}
+			sawVideo = true
+		case 2:
+			sawAudio = true
+		}
+	}
+	if !sawVideo || !sawAudio {
+		t.Errorf("missing fragments: video=%v audio=%v", sawVideo, sawAudio)
+	}
+
+	stream := server.LookupStreamScheme("rtsp", cam.Addr(), "", "", "/mock")
+	ws.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stream.mu.RLock()
+		consumers := len(stream.consumers)
+		stream.mu.RUnlock()
+		if consumers == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("viewer still attached after closing the WebSocket")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
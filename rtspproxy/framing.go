@@ -0,0 +1,162 @@
+package rtspproxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// RTSP connection framing. An RTSP connection carries RTSP messages and,
+// with RTP over TCP, interleaved binary packets ('$', channel, 16-bit
+// length, data; RFC 2326 10.12) on one byte stream, in both directions.
+// rtspReader splits such a stream into frames however the bytes arrive:
+// several frames in one read, one frame over many reads, message bodies
+// announced by Content-Length. Client.incomingRequestHandler and
+// Stream.readLoop both read through it.
+
+// maxRTSPMessage limits an RTSP message, headers and body.
+const maxRTSPMessage = rtspBufferSize
+
+var (
+	errRTSPMessageTooLarge  = errors.New("RTSP message too large")
+	errRTSPBadContentLength = errors.New("invalid Content-Length")
+)
+
+// rtspFrame is an interleaved packet (channel >= 0, data with its 4-byte
+// header) or an RTSP message (channel -1, data with headers and body).
+type rtspFrame struct {
+	channel int
+	data    []byte
+}
+
+// rtspReader reads rtspFrames from a connection.
+type rtspReader struct {
+	r          io.Reader
+	buf        []byte
+	start, end int // unread bytes
+	scanned    int // bytes of an incomplete header block searched for its end
+}
+
+func newRTSPReader(r io.Reader, size int) *rtspReader {
+	return &rtspReader{r: r, buf: make([]byte, max(size, streamHeaderLength))}
+}
+
+// next returns the next frame. Read errors are returned as is and the
+// bytes received so far are kept, so next can be called again after a
+// timeout. Framing errors are final: the stream cannot be resynchronized.
+func (r *rtspReader) next() (rtspFrame, error) {
+	for {
+		frame, need, err := r.parse()
+		if err != nil || frame.data != nil {
+			return frame, err
+		}
+		if err := r.fill(need); err != nil {
+			return rtspFrame{}, err
+		}
+	}
+}
+
+// parse takes the next frame from the buffer. Without a complete frame it
+// returns the number of unread bytes needed to make progress.
+func (r *rtspReader) parse() (frame rtspFrame, need int, err error) {
+	// Empty lines between messages are tolerated.
+	for r.scanned == 0 && r.start < r.end && (r.buf[r.start] == '\r' || r.buf[r.start] == '\n') {
+		r.start++
+	}
+	b := r.buf[r.start:r.end]
+	if len(b) == 0 {
+		return rtspFrame{}, 1, nil
+	}
+
+	if b[0] == '$' {
+		if len(b) < streamHeaderLength {
+			return rtspFrame{}, streamHeaderLength, nil
+		}
+		size := streamHeaderLength + (int(b[2])<<8 | int(b[3]))
+		if len(b) < size {
+			return rtspFrame{}, size, nil
+		}
+		r.start += size
+		return rtspFrame{channel: int(b[1]), data: bytes.Clone(b[:size])}, 0, nil
+	}
+
+	header := headerEnd(b, r.scanned)
+	if header < 0 {
+		if len(b) >= maxRTSPMessage {
+			return rtspFrame{}, 0, errRTSPMessageTooLarge
+		}
+		r.scanned = len(b)
+		return rtspFrame{}, len(b) + 1, nil
+	}
+	length, err := contentLength(b[:header])
+	if err != nil {
+		return rtspFrame{}, 0, err
+	}
+	size := header + length
+	if size > maxRTSPMessage {
+		return rtspFrame{}, 0, errRTSPMessageTooLarge
+	}
+	if len(b) < size {
+		return rtspFrame{}, size, nil
+	}
+	r.start += size
+	r.scanned = 0
+	return rtspFrame{channel: -1, data: bytes.Clone(b[:size])}, 0, nil
+}
+
+// fill reads once, after making room for need unread bytes.
+func (r *rtspReader) fill(need int) error {
+	if r.start > 0 {
+		r.end = copy(r.buf, r.buf[r.start:r.end])
+		r.start = 0
+	}
+	if need > len(r.buf) {
+		r.buf = append(r.buf, make([]byte, max(need, 2*len(r.buf))-len(r.buf))...)
+	}
+	n, err := r.r.Read(r.buf[r.end:])
+	r.end += n
+	if n > 0 {
+		return nil // a persistent error comes back with the next read
+	}
+	return err
+}
+
+// headerEnd returns the length of the header block of b up to and
+// including the empty line ending it, or -1. The first from bytes are
+// known not to contain the end.
+func headerEnd(b []byte, from int) int {
+	from = max(from-3, 0)
+	crlf := bytes.Index(b[from:], []byte("\r\n\r\n"))
+	lf := bytes.Index(b[from:], []byte("\n\n"))
+	switch {
+	case lf >= 0 && (crlf < 0 || lf < crlf):
+		return from + lf + 2
+	case crlf >= 0:
+		return from + crlf + 4
+	}
+	return -1
+}
+
+// contentLength returns the Content-Length of a header block, 0 if absent.
+func contentLength(header []byte) (int, error) {
+	rest, _ := sharedLineSplit(string(header))
+	for rest != "" {
+		var line string
+		rest, line = sharedLineSplit(rest)
+		key, value, err := sharedParseHeader(line)
+		if err != nil || key != "Content-Length" {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || n < 0 {
+			return 0, errRTSPBadContentLength
+		}
+		if n > maxRTSPMessage {
+			return 0, errRTSPMessageTooLarge
+		}
+		return n, nil
+	}
+	return 0, nil
+}
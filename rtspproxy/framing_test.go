@@ -0,0 +1,156 @@
+package rtspproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// readFrames reads r to the end; err is nil at a clean EOF.
+func readFrames(r io.Reader) (frames []rtspFrame, err error) {
+	reader := newRTSPReader(r, 16)
+	for {
+		frame, err := reader.next()
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return frames, err
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func TestRTSPReader(t *testing.T) {
+	rtcp := []byte{'$', 1, 0, 8, 0x80, 0xc9, 0, 1, 0, 0, 0, 1}
+	announce := "ANNOUNCE rtsp://cam/a RTSP/1.0\r\nCSeq: 2\r\ncontent-length: 11\r\n\r\nv=0\r\n$x\r\n\r\n\r\n"
+	input := string(rtcp) + "OPTIONS * RTSP/1.0\r\nCSeq: 1\r\n\r\n" + "\r\n" + announce +
+		"GET_PARAMETER * RTSP/1.0\nCSeq: 3\n\n" + string(rtcp)
+	want := []rtspFrame{
+		{channel: 1, data: rtcp},
+		{channel: -1, data: []byte("OPTIONS * RTSP/1.0\r\nCSeq: 1\r\n\r\n")},
+		{channel: -1, data: []byte(announce[:len(announce)-2])},
+		{channel: -1, data: []byte("GET_PARAMETER * RTSP/1.0\nCSeq: 3\n\n")},
+		{channel: 1, data: rtcp},
+	}
+	for name, r := range map[string]io.Reader{
+		"one read":     strings.NewReader(input),
+		"byte by byte": iotest.OneByteReader(strings.NewReader(input)),
+		"timeouts":     iotest.TimeoutReader(iotest.OneByteReader(strings.NewReader(input))),
+	} {
+		reader := newRTSPReader(r, 16)
+		var frames []rtspFrame
+		for len(frames) < len(want) {
+			frame, err := reader.next()
+			if err == iotest.ErrTimeout {
+				continue // the reader resumes where it stopped
+			}
+			if err != nil {
+				t.Fatalf("%s: %v after %d frames", name, err, len(frames))
+			}
+			frames = append(frames, frame)
+		}
+		for i := range want {
+			if frames[i].channel != want[i].channel || !bytes.Equal(frames[i].data, want[i].data) {
+				t.Errorf("%s: frame %d is %d %q, want %d %q", name, i, frames[i].channel, frames[i].data, want[i].channel, want[i].data)
+			}
+		}
+	}
+
+	for input, want := range map[string]error{
+		"SETUP * RTSP/1.0\r\nContent-Length: -1\r\n\r\n":                errRTSPBadContentLength,
+		"SETUP * RTSP/1.0\r\nContent-Length: 0x10\r\n\r\n":              errRTSPBadContentLength,
+		"SETUP * RTSP/1.0\r\nContent-Length: 99999\r\n\r\n":             errRTSPMessageTooLarge,
+		"SETUP * RTSP/1.0\r\nX: " + strings.Repeat("a", maxRTSPMessage): errRTSPMessageTooLarge,
+	} {
+		if _, err := readFrames(strings.NewReader(input)); err != want {
+			t.Errorf("%.40q: error %v, want %v", input, err, want)
+		}
+	}
+}
+
+// chunkReader returns at most n bytes per Read.
+type chunkReader struct {
+	data []byte
+	n    int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p[:min(len(p), r.n)], r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func FuzzRTSPReader(f *testing.F) {
+	f.Add([]byte("OPTIONS * RTSP/1.0\r\nCSeq: 1\r\n\r\n$\x00\x00\x02ab"), uint8(1))
+	f.Add([]byte("$\x01\x00\x04abcdDESCRIBE x RTSP/1.0\r\nContent-Length: 3\r\n\r\nabc\r\n\r\n"), uint8(3))
+	f.Add([]byte("RTSP/1.0 200 OK\nContent-Length: 5\n\n$\x00\x00\x01$"), uint8(7))
+	f.Add([]byte("X\r\nContent-Length:\r\nContent-Length: 2\r\n\r"), uint8(2))
+	f.Fuzz(func(t *testing.T, data []byte, chunk uint8) {
+		whole, wholeErr := readFrames(bytes.NewReader(data))
+		chunked, chunkedErr := readFrames(&chunkReader{data: data, n: int(chunk%16) + 1})
+		if wholeErr != chunkedErr || len(whole) != len(chunked) {
+			t.Fatalf("one read: %d frames, %v; chunked: %d frames, %v", len(whole), wholeErr, len(chunked), chunkedErr)
+		}
+		consumed := 0
+		for i, frame := range whole {
+			if frame.channel != chunked[i].channel || !bytes.Equal(frame.data, chunked[i].data) {
+				t.Fatalf("frame %d differs between reads", i)
+			}
+			if frame.channel >= 0 {
+				if frame.data[0] != '$' || int(frame.data[1]) != frame.channel ||
+					len(frame.data) != streamHeaderLength+int(frame.data[2])<<8+int(frame.data[3]) {
+					t.Fatalf("bad interleaved frame % x", frame.data[:streamHeaderLength])
+				}
+			} else if len(frame.data) > maxRTSPMessage || headerEnd(frame.data, 0) < 0 {
+				t.Fatalf("bad message %q", frame.data)
+			}
+			consumed += len(frame.data)
+		}
+		if consumed > len(data) {
+			t.Fatalf("%d bytes of frames from %d bytes", consumed, len(data))
+		}
+	})
+}
+
+func TestClientPipelinedRequests(t *testing.T) {
+	_, addr := startTunnelServer(t)
+	cam := startH264Camera(t)
+	base := fmt.Sprintf("rtsp://%s/rtsp/%s/mock", addr, cam.Addr())
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// An RTCP report, a request with a body and two more requests in one write.
+	fmt.Fprintf(conn, "$\x01\x00\x08\x80\xc9\x00\x01\x00\x00\x00\x01"+
+		"OPTIONS %[1]s RTSP/1.0\r\nCSeq: 1\r\n\r\n"+
+		"GET_PARAMETER %[1]s RTSP/1.0\r\nCSeq: 2\r\nContent-Type: text/parameters\r\nContent-Length: 9\r\n\r\nposition\n"+
+		"DESCRIBE %[1]s RTSP/1.0\r\nCSeq: 3\r\n\r\n", base)
+
+	reader := newRTSPReader(conn, rtspBufferSize)
+	for cseq := 1; cseq <= 3; cseq++ {
+		frame, err := reader.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := NewResponseFromBuffer(string(frame.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Code != 200 || headerGet(response.Headers, "CSeq") != fmt.Sprint(cseq) {
+			t.Errorf("reply %d: %d %s, CSeq %s", cseq, response.Code, response.Status, headerGet(response.Headers, "CSeq"))
+		}
+		if cseq == 3 && !strings.Contains(response.Body, "H264") {
+			t.Errorf("DESCRIBE body %q", response.Body)
+		}
+	}
+}
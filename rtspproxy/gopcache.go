@@ -0,0 +1,85 @@
+package rtspproxy
+
+import "slices"
+
+// GOP cache. With GlobalConfig.GOPCache set, a Stream keeps the RTP packets
+// received since the last video keyframe. When a client's track is mapped
+// (MapChannel, MapUDP) the cached packets of that channel are queued ahead
+// of the live ones, timestamps intact, so its decoder starts at once
+// instead of waiting for the next IDR. The cache is guarded by Stream.mu and
+// updated in dispatch under the same lock as the fanout snapshot, so every
+// packet reaches a new client exactly once.
+
+// gopCache holds interleaved-framed packets as dispatched; they are shared,
+// not modified.
+type gopCache struct {
+	video   int // RTP channel of the first H.264/H.265 track, -1 without
+	hevc    bool
+	limit   int // packets; longer GOPs are not cached
+	packets [][]byte
+	keyed   bool // packets start at a keyframe
+	auStart int  // index of the first packet of the current video access unit
+	auTS    uint32
+	auKey   bool // the current access unit is a keyframe, or cannot start the cache
+	inAU    bool
+}
+
+func newGOPCache(limit int) *gopCache {
+	return &gopCache{video: -1, limit: limit}
+}
+
+// reset empties the cache for a new upstream session described by sdp,
+// whose media arrive on channels (see Stream.mediaChannels).
+func (c *gopCache) reset(sdp string, channels map[int]int) {
+	c.video, c.hevc = -1, false
+	for i, media := range parseSDPMedia(sdp) {
+		channel, ok := channels[i]
+		if ok && (media.Codec == "H264" || media.Codec == "H265") {
+			c.video, c.hevc = channel, media.Codec == "H265"
+			break
+		}
+	}
+	c.packets, c.keyed, c.inAU = nil, false, false
+}
+
+// push records a dispatched packet. RTCP is not cached.
+func (c *gopCache) push(channel int, packet []byte) {
+	if c.video < 0 || channel%2 != 0 || len(packet) <= streamHeaderLength {
+		return
+	}
+	if channel == c.video {
+		if p, err := parseRTP(packet[streamHeaderLength:]); err == nil {
+			if !c.inAU || p.Timestamp != c.auTS {
+				c.auStart, c.auTS, c.auKey, c.inAU = len(c.packets), p.Timestamp, false, true
+			}
+			// Parameter sets sent ahead of the IDR share its timestamp, so
+			// the GOP starts at the first packet of the access unit.
+			if !c.auKey && rtpHasKeyframe(c.hevc, p.Payload) {
+				c.auKey = true
+				c.packets = slices.Clone(c.packets[c.auStart:])
+				c.auStart, c.keyed = 0, true
+			}
+		}
+	}
+	if len(c.packets) >= c.limit {
+		// Wait for the next keyframe; the current access unit is not one.
+		c.packets, c.keyed, c.auStart, c.auKey = nil, false, 0, true
+		return
+	}
+	c.packets = append(c.packets, packet)
+}
+
+// replay returns the cached packets of an upstream channel, or nothing when
+// the cache does not start at a keyframe.
+func (c *gopCache) replay(channel int) [][]byte {
+	if !c.keyed {
+		return nil
+	}
+	var packets [][]byte
+	for _, packet := range c.packets {
+		if int(packet[1]) == channel {
+			packets = append(packets, packet)
+		}
+	}
+	return packets
+}
@@ -0,0 +1,100 @@
+package rtspproxy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestGOPCache(t *testing.T) {
+	c := newGOPCache(20)
+	c.reset(h264SDP, h264Channels)
+	push := func(channel int, pkt []byte) {
+		c.push(channel, append([]byte{'$', byte(channel), 0, 0}, pkt...))
+	}
+	frame := func(i int, seq uint16) uint16 {
+		ts := uint32(i * 3600)
+		if i%5 == 0 {
+			push(0, rtpPacketBytes(96, seq, ts, false, testSPS))
+			seq++
+			push(0, rtpPacketBytes(96, seq, ts, true, []byte{0x65, 0x88}))
+		} else {
+			push(0, rtpPacketBytes(96, seq, ts, true, []byte{0x41, 0x9a}))
+		}
+		push(1, []byte{0x80, 0xc8, 0, 1})
+		push(2, rtpPacketBytes(97, uint16(i), uint32(i*1024), true, []byte{0x00, 0x10, 0x00, 0x08, 0x01}))
+		return seq + 1
+	}
+
+	push(0, rtpPacketBytes(96, 0, 0, true, []byte{0x41, 0x9a}))
+	if len(c.replay(0)) != 0 {
+		t.Fatal("replay before the first keyframe")
+	}
+	seq := uint16(1)
+	for i := 1; i < 13; i++ {
+		seq = frame(i, seq)
+	}
+	// Frames 10-12 since the keyframe: SPS, IDR and two P frames.
+	video := c.replay(0)
+	if len(video) != 4 || video[0][streamHeaderLength+12] != testSPS[0] {
+		t.Fatalf("video replay has %d packets", len(video))
+	}
+	if audio := c.replay(2); len(audio) != 3 {
+		t.Errorf("audio replay has %d packets, want 3", len(audio))
+	}
+	if len(c.replay(1)) != 0 {
+		t.Error("RTCP was cached")
+	}
+
+	// A GOP beyond the limit is dropped until the next keyframe.
+	for i := 13; i < 21; i++ {
+		seq = frame(i, seq)
+	}
+	if len(c.replay(0)) != 2 {
+		t.Errorf("cache kept %d video packets after overflow and a new keyframe", len(c.replay(0)))
+	}
+	c.limit = 5
+	for i := 21; i < 24; i++ {
+		seq = frame(i, seq)
+	}
+	if len(c.replay(0)) != 0 {
+		t.Error("cache replays after overflowing")
+	}
+
+	c.reset(mockSDP, map[int]int{0: 0})
+	if c.video != -1 || len(c.packets) != 0 {
+		t.Error("reset kept packets")
+	}
+}
+
+func TestGOPCacheReplay(t *testing.T) {
+	server, addr := startTunnelServer(t)
+	cam := startH264Camera(t)
+	stream := server.LookupStreamScheme("rtsp", cam.Addr(), "", "", "/mock")
+	stream.AddConsumer(nopConsumer{})
+	t.Cleanup(func() { stream.RemoveConsumer(nopConsumer{}) })
+	time.Sleep(300 * time.Millisecond)
+
+	base := fmt.Sprintf("rtsp://%s/rtsp/%s/mock", addr, cam.Addr())
+	// Keyframes come every 200ms; join at different points of the GOP.
+	for _, delay := range []time.Duration{0, 70 * time.Millisecond, 130 * time.Millisecond} {
+		time.Sleep(delay)
+		c := dialRTSP(t, addr)
+		c.do("DESCRIBE", base, "")
+		_, headers, _ := c.do("SETUP", base+"/track1", "Transport: RTP/AVP/TCP;unicast;interleaved=0-1\r\n")
+		c.do("PLAY", base, "Session: "+headerGet(headers, "Session")+"\r\n")
+
+		first := c.frames
+		if len(first) == 0 {
+			frame, err := c.frame(time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			first = [][]byte{frame}
+		}
+		if payload := first[0][2+12:]; first[0][1] != 0 || payload[0] != 0x7c || payload[1] != 0x85 {
+			t.Errorf("joined after %v: first packet % x is not the start of an IDR", delay, payload[:2])
+		}
+		c.conn.Close()
+	}
+}
@@ -0,0 +1,527 @@
+package rtspproxy
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HLS output: http://proxy/hls/<scheme>/[user:pass@]host[:port]/path/index.m3u8
+// A per-stream hlsMuxer is attached to the Stream as a Consumer on the first
+// request and detached once no viewer asked for anything during
+// GlobalConfig.HLSViewerTimeout, so the camera is only pulled while watched.
+//
+// With GlobalConfig.HLSPartDuration set the playlist is Low-Latency HLS:
+// segments are published part by part (EXT-X-PART) as they are written,
+// the next part is announced with EXT-X-PRELOAD-HINT, and playlist and part
+// requests for media that does not exist yet are held until it does.
+
+const hlsPlaylistName = "index.m3u8"
+
+// hlsPartSegments is how many finished segments keep their parts listed.
+const hlsPartSegments = 2
+
+// hlsSegment is a finished MPEG-TS segment.
+type hlsSegment struct {
+	seq      int
+	duration time.Duration
+	data     []byte
+	parts    []*hlsPart // LL-HLS only; dropped once the segment leaves the part window
+}
+
+// hlsPart is a finished partial segment. Its data is also part of the
+// segment's data.
+type hlsPart struct {
+	index       int
+	duration    time.Duration
+	data        []byte
+	independent bool // starts with a keyframe
+}
+
+// hlsMuxer segments one Stream.
+type hlsMuxer struct {
+	stream     *Stream
+	origin     time.Time
+	lastAccess atomic.Int64
+	done       chan struct{}
+	closeOnce  sync.Once
+
+	// Segmenting settings, fixed when the muxer is created.
+	segmentDuration time.Duration
+	segmentCount    int
+	partDuration    time.Duration // 0 disables LL-HLS
+
+	mu       sync.Mutex
+	source   *tsSource // nil until the SDP is known
+	segments []*hlsSegment
+	current  *bytes.Buffer // nil until the first keyframe
+	segStart int64
+	lastPTS  int64
+	nextSeq  int           // sequence number of the segment being written
+	updated  chan struct{} // closed and replaced whenever a segment or part is added
+
+	part            *bytes.Buffer // part being written
+	partStart       int64
+	partIndependent bool
+	parts           []*hlsPart // finished parts of the current segment
+	partTarget      int64      // 90 kHz; fixed from the first sample interval, 0 until then
+	partInterval    int64      // the sample interval partTarget was rounded up to
+}
+
+func newHLSMuxer(stream *Stream) *hlsMuxer {
+	m := &hlsMuxer{
+		stream:          stream,
+		origin:          time.Now(),
+		done:            make(chan struct{}),
+		segmentDuration: GlobalConfig.HLSSegmentDuration,
+		segmentCount:    GlobalConfig.HLSSegmentCount,
+		partDuration:    GlobalConfig.HLSPartDuration,
+		updated:         make(chan struct{}),
+	}
+	m.touch()
+	return m
+}
+
+func (m *hlsMuxer) touch() {
+	m.lastAccess.Store(time.Now().UnixNano())
+}
+
+func (m *hlsMuxer) idle() bool {
+	return time.Since(time.Unix(0, m.lastAccess.Load())) > GlobalConfig.HLSViewerTimeout
+}
+
+// Consume implements Consumer.
+func (m *hlsMuxer) Consume(channel int, packet []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.source == nil {
+		sdp := m.stream.GetSDP()
+		if sdp == "" {
+			return
+		}
+		m.source = newTSSource("🎞️ [HLS]", m.stream.Path, sdp, m.stream.mediaChannels(), m.origin, func(pts int64, randomAccess bool) *bytes.Buffer {
+			if !m.cut(pts, randomAccess) {
+				return nil
+			}
+			return m.part
+		})
+	}
+	m.source.push(channel, packet)
+}
+
+// cut starts the first segment on a random access point and rolls segments
+// over at random access points once the target duration is reached; in
+// between, parts are cut at any sample that would take the part past the
+// part target. It reports whether the sample belongs in the current segment.
+func (m *hlsMuxer) cut(pts int64, randomAccess bool) bool {
+	if m.current == nil {
+		if !randomAccess {
+			return false
+		}
+		m.startSegment(pts)
+		return true
+	}
+	if m.partDuration > 0 && m.partTarget == 0 && m.source.interval > 0 {
+		// PART-TARGET must not change, so it is fixed once: the part
+		// duration rounded up to whole sample intervals.
+		m.partInterval = m.source.interval
+		m.partTarget = (int64(m.partDuration*90000/time.Second) + m.partInterval - 1) / m.partInterval * m.partInterval
+	}
+	target := int64(m.segmentDuration * 90000 / time.Second)
+	if randomAccess && pts-m.segStart >= target {
+		m.finishSegment(pts)
+		m.startSegment(pts)
+	} else if m.partTarget > 0 && pts-m.partStart+m.partInterval > m.partTarget {
+		m.finishPart(pts)
+		m.startPart(pts, randomAccess)
+	}
+	if pts > m.lastPTS {
+		m.lastPTS = pts
+	}
+	return true
+}
+
+func (m *hlsMuxer) startSegment(pts int64) {
+	m.current = &bytes.Buffer{}
+	m.segStart = pts
+	m.lastPTS = pts
+	m.startPart(pts, true)
+}
+
+// startPart begins a part; parts starting with a keyframe repeat PAT/PMT
+// so players can join there.
+func (m *hlsMuxer) startPart(pts int64, independent bool) {
+	m.part = &bytes.Buffer{}
+	m.partStart = pts
+	m.partIndependent = independent
+	if independent {
+		m.source.muxer.WriteTables(m.part)
+	}
+}
+
+// finishPart ends the part at end, the PTS of the next sample. After a gap
+// in the timestamps the part ends one interval after its last sample, so no
+// part runs past the part target.
+func (m *hlsMuxer) finishPart(end int64) {
+	m.current.Write(m.part.Bytes())
+	if m.partDuration > 0 {
+		if m.partInterval > 0 {
+			end = min(end, m.lastPTS+m.partInterval)
+		}
+		part := &hlsPart{
+			index:       len(m.parts),
+			duration:    time.Duration(max(end-m.partStart, 0)) * time.Second / 90000,
+			data:        m.part.Bytes(),
+			independent: m.partIndependent,
+		}
+		m.parts = append(m.parts, part)
+		m.notify()
+	}
+	m.part = nil
+}
+
+func (m *hlsMuxer) finishSegment(end int64) {
+	m.finishPart(end)
+	segment := &hlsSegment{
+		seq:      m.nextSeq,
+		duration: time.Duration(end-m.segStart) * time.Second / 90000,
+		data:     m.current.Bytes(),
+		parts:    m.parts,
+	}
+	m.nextSeq++
+	m.parts = nil
+	m.segments = append(m.segments, segment)
+	// Keep two segments beyond the playlist window for in-flight downloads.
+	if keep := m.segmentCount + 2; len(m.segments) > keep {
+		m.segments = append([]*hlsSegment(nil), m.segments[len(m.segments)-keep:]...)
+	}
+	// Parts are only listed for the last few segments.
+	if n := len(m.segments) - hlsPartSegments - 1; n >= 0 {
+		m.segments[n].parts = nil
+	}
+	m.notify()
+	Logf("🎞️ [HLS] Stream [%s] segment %d (%v, %d bytes)", m.stream.Path, segment.seq, segment.duration.Truncate(time.Millisecond), len(segment.data))
+}
+
+func (m *hlsMuxer) notify() {
+	close(m.updated)
+	m.updated = make(chan struct{})
+}
+
+// waitSegments blocks until at least one segment exists.
+func (m *hlsMuxer) waitSegments(timeout time.Duration) bool {
+	return m.wait(timeout, func() bool { return len(m.segments) > 0 })
+}
+
+// waitPart blocks until the playlist lists part index of segment seq, or
+// the whole segment when index is negative (_HLS_msn/_HLS_part).
+func (m *hlsMuxer) waitPart(timeout time.Duration, seq, index int) bool {
+	return m.wait(timeout, func() bool {
+		return seq < m.nextSeq || seq == m.nextSeq && index >= 0 && index < len(m.parts)
+	})
+}
+
+// wait blocks until ready, evaluated under m.mu, reports true.
+func (m *hlsMuxer) wait(timeout time.Duration, ready func() bool) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		m.mu.Lock()
+		ok := ready()
+		updated := m.updated
+		m.mu.Unlock()
+		if ok {
+			return true
+		}
+		select {
+		case <-updated:
+		case <-deadline.C:
+			return false
+		case <-m.done:
+			return false
+		}
+	}
+}
+
+// playlist renders the live media playlist.
+func (m *hlsMuxer) playlist() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	segments := m.segments
+	if len(segments) > m.segmentCount {
+		segments = segments[len(segments)-m.segmentCount:]
+	}
+	target := m.segmentDuration
+	for _, s := range segments {
+		if s.duration > target {
+			target = s.duration
+		}
+	}
+
+	var b strings.Builder
+	if m.partDuration > 0 {
+		b.WriteString("#EXTM3U\n#EXT-X-VERSION:6\n")
+	} else {
+		b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	}
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target.Seconds())))
+	if m.partDuration > 0 {
+		partTarget := float64(m.partTarget) / 90000
+		if m.partTarget == 0 {
+			partTarget = m.partDuration.Seconds() // no parts cut yet
+		}
+		fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget)
+		fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget)
+	}
+	if len(segments) > 0 {
+		fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", segments[0].seq)
+	}
+	for _, s := range segments {
+		writeHLSParts(&b, s.seq, s.parts)
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\nseg%d.ts\n", s.duration.Seconds(), s.seq)
+	}
+	if m.partDuration > 0 {
+		writeHLSParts(&b, m.nextSeq, m.parts)
+		fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part%d.%d.ts\"\n", m.nextSeq, len(m.parts))
+	}
+	return b.String()
+}
+
+func writeHLSParts(b *strings.Builder, seq int, parts []*hlsPart) {
+	for _, p := range parts {
+		fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.3f,URI=\"part%d.%d.ts\"", p.duration.Seconds(), seq, p.index)
+		if p.independent {
+			b.WriteString(",INDEPENDENT=YES")
+		}
+		b.WriteString("\n")
+	}
+}
+
+func (m *hlsMuxer) segment(seq int) *hlsSegment {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.segments {
+		if s.seq == seq {
+			return s
+		}
+	}
+	return nil
+}
+
+// partAt returns part index of segment seq, whether finished or not yet.
+func (m *hlsMuxer) partAt(seq, index int) *hlsPart {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	parts := m.parts
+	if seq != m.nextSeq {
+		parts = nil
+		for _, s := range m.segments {
+			if s.seq == seq {
+				parts = s.parts
+			}
+		}
+	}
+	if index < 0 || index >= len(parts) {
+		return nil
+	}
+	return parts[index]
+}
+
+func (m *hlsMuxer) close() {
+	m.closeOnce.Do(func() { close(m.done) })
+}
+
+// hlsRegistry keeps one muxer per Stream and detaches idle ones.
+type hlsRegistry struct {
+	mu      sync.Mutex
+	muxers  map[*Stream]*hlsMuxer
+	reaping bool
+}
+
+func newHLSRegistry() *hlsRegistry {
+	return &hlsRegistry{muxers: make(map[*Stream]*hlsMuxer)}
+}
+
+// get returns the stream's muxer, attaching a new one as a consumer.
+func (reg *hlsRegistry) get(server *Server, stream *Stream) *hlsMuxer {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if m, ok := reg.muxers[stream]; ok {
+		m.touch()
+		return m
+	}
+	m := newHLSMuxer(stream)
+	reg.muxers[stream] = m
+	stream.AddConsumer(m)
+	LogCriticalf("🎞️ [HLS] Started segmenting stream [%s]", stream.Path)
+	if !reg.reaping {
+		reg.reaping = true
+		go reg.reap(server)
+	}
+	return m
+}
+
+// reap detaches muxers without viewers, and those of destroyed streams.
+func (reg *hlsRegistry) reap(server *Server) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-server.ctx.Done():
+			reg.mu.Lock()
+			for stream, m := range reg.muxers {
+				m.close()
+				delete(reg.muxers, stream)
+			}
+			reg.reaping = false
+			reg.mu.Unlock()
+			return
+		case <-ticker.C:
+		}
+		reg.mu.Lock()
+		for stream, m := range reg.muxers {
+			if m.idle() || stream.ctx.Err() != nil {
+				delete(reg.muxers, stream)
+				m.close()
+				go stream.RemoveConsumer(m)
+				LogCriticalf("🎞️ [HLS] No viewers left, stopped segmenting stream [%s]", stream.Path)
+			}
+		}
+		if len(reg.muxers) == 0 {
+			reg.reaping = false
+			reg.mu.Unlock()
+			return
+		}
+		reg.mu.Unlock()
+	}
+}
+
+// serveHLS handles /hls/<scheme>/<host>/<path>/{index.m3u8,segN.ts,partN.I.ts}.
+func (server *Server) serveHLS(w http.ResponseWriter, r *http.Request) {
+	dir, file := path.Split(strings.TrimPrefix(r.URL.Path, "/hls"))
+	scheme, host, username, password, streamPath, ok := parseProxyPath(strings.TrimSuffix(dir, "/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	seq, index, ok := parseHLSMediaName(file)
+	if file != hlsPlaylistName && !ok {
+		http.NotFound(w, r)
+		return
+	}
+	stream := server.LookupStreamScheme(scheme, host, username, password, streamPath)
+	if stream == nil {
+		http.NotFound(w, r)
+		return
+	}
+	m := server.hls.get(server, stream)
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if file == hlsPlaylistName {
+		m.servePlaylist(w, r)
+		return
+	}
+
+	var data []byte
+	if index < 0 {
+		segment := m.segment(seq)
+		if segment == nil {
+			http.NotFound(w, r)
+			return
+		}
+		data = segment.data
+	} else {
+		part := m.partAt(seq, index)
+		if part == nil && m.partDuration > 0 && m.isNextPart(seq, index) {
+			// The preload hint: hold the request until the part is written.
+			m.waitPart(3*m.segmentDuration, seq, index)
+			part = m.partAt(seq, index)
+		}
+		if part == nil {
+			http.NotFound(w, r)
+			return
+		}
+		data = part.data
+	}
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// servePlaylist answers playlist requests, blocking on _HLS_msn/_HLS_part
+// until the requested segment or part is available.
+func (m *hlsMuxer) servePlaylist(w http.ResponseWriter, r *http.Request) {
+	if !m.waitSegments(GlobalConfig.DialTimeout + 3*m.segmentDuration) {
+		http.Error(w, "stream not available", http.StatusServiceUnavailable)
+		return
+	}
+	query := r.URL.Query()
+	if m.partDuration > 0 && (query.Has("_HLS_msn") || query.Has("_HLS_part")) {
+		msn, err := strconv.Atoi(query.Get("_HLS_msn"))
+		part := -1
+		if err == nil && query.Has("_HLS_part") {
+			part, err = strconv.Atoi(query.Get("_HLS_part"))
+		}
+		if err != nil || msn < 0 || part < -1 {
+			http.Error(w, "invalid _HLS_msn/_HLS_part", http.StatusBadRequest)
+			return
+		}
+		m.mu.Lock()
+		tooFar := msn > m.nextSeq+1 // more than two segments past the last finished one
+		m.mu.Unlock()
+		if tooFar {
+			http.Error(w, "_HLS_msn too far in the future", http.StatusBadRequest)
+			return
+		}
+		if !m.waitPart(3*m.segmentDuration, msn, part) {
+			http.Error(w, "stream not available", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(m.playlist()))
+}
+
+// isNextPart reports whether part index of segment seq is the one being
+// written, as announced by the preload hint.
+func (m *hlsMuxer) isNextPart(seq, index int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return seq == m.nextSeq && index == len(m.parts)
+}
+
+// parseHLSMediaName parses "segN.ts" (index -1) and "partN.I.ts".
+func parseHLSMediaName(name string) (seq, index int, ok bool) {
+	base, found := strings.CutSuffix(name, ".ts")
+	if !found {
+		return 0, 0, false
+	}
+	var err error
+	if rest, found := strings.CutPrefix(base, "seg"); found {
+		seq, err = strconv.Atoi(rest)
+		return seq, -1, err == nil && seq >= 0
+	}
+	rest, found := strings.CutPrefix(base, "part")
+	if !found {
+		return 0, 0, false
+	}
+	seqStr, indexStr, found := strings.Cut(rest, ".")
+	if !found {
+		return 0, 0, false
+	}
+	if seq, err = strconv.Atoi(seqStr); err != nil || seq < 0 {
+		return 0, 0, false
+	}
+	if index, err = strconv.Atoi(indexStr); err != nil || index < 0 {
+		return 0, 0, false
+	}
+	return seq, index, true
+}
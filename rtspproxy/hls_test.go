@@ -0,0 +1,414 @@
+package rtspproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1e, 0xd9, 0x00, 0xa0, 0x47, 0xfe, 0xc8}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+)
+
+// h264SDP describes an H.264 track1 and an AAC track2 (44.1 kHz stereo).
+var h264SDP = "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=Mock\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\n" +
+	"m=video 0 RTP/AVP 96\r\na=rtpmap:96 H264/90000\r\n" +
+	"a=fmtp:96 packetization-mode=1;sprop-parameter-sets=" + base64.StdEncoding.EncodeToString(testSPS) + "," + base64.StdEncoding.EncodeToString(testPPS) + "\r\n" +
+	"a=control:track1\r\n" +
+	"m=audio 0 RTP/AVP 97\r\na=rtpmap:97 MPEG4-GENERIC/44100/2\r\n" +
+	"a=fmtp:97 streamtype=5;profile-level-id=15;mode=AAC-hbr;config=1210;sizelength=13;indexlength=3;indexdeltalength=3\r\n" +
+	"a=control:track2\r\n"
+
+// h264Channels are the channels the mock camera sets up h264SDP's tracks on.
+var h264Channels = map[int]int{0: 0, 1: 2}
+
+func rtpPacketBytes(pt byte, seq uint16, ts uint32, marker bool, payload []byte) []byte {
+	b := []byte{0x80, pt, byte(seq >> 8), byte(seq), byte(ts >> 24), byte(ts >> 16), byte(ts >> 8), byte(ts), 0, 0, 0, 1}
+	if marker {
+		b[1] |= 0x80
+	}
+	return append(b, payload...)
+}
+
+// startH264Camera answers DESCRIBE with h264SDP and streams 25 fps video
+// with an IDR every 5 frames (fragmented with FU-A) after PLAY.
+func startH264Camera(t *testing.T) *mockCamera {
+	cam := startMockCamera(t)
+	cam.handle = func(method, req string, conn net.Conn) string {
+		switch method {
+		case "DESCRIBE":
+			return fmt.Sprintf("RTSP/1.0 200 OK\r\nContent-Type: application/sdp\r\nContent-Length: %d\r\n\r\n%s", len(h264SDP), h264SDP)
+		case "SETUP":
+			if strings.Contains(req, "track2") {
+				return "RTSP/1.0 200 OK\r\nTransport: RTP/AVP/TCP;unicast;interleaved=2-3\r\nSession: 1234\r\n\r\n"
+			}
+		case "PLAY":
+			go func() {
+				seq := uint16(0)
+				write := func(channel byte, pkt []byte) error {
+					_, err := conn.Write(append([]byte{'$', channel, byte(len(pkt) >> 8), byte(len(pkt))}, pkt...))
+					return err
+				}
+				for frame := 0; ; frame++ {
+					ts := uint32(frame * 3600)
+					var err error
+					if frame%5 == 0 {
+						idr := append([]byte{0x65}, bytes.Repeat([]byte{0xab}, 2000)...)
+						err = write(0, rtpPacketBytes(96, seq, ts, false, append([]byte{0x7c, 0x85}, idr[1:1000]...)))
+						seq++
+						if err == nil {
+							err = write(0, rtpPacketBytes(96, seq, ts, true, append([]byte{0x7c, 0x45}, idr[1000:]...)))
+							seq++
+						}
+					} else {
+						err = write(0, rtpPacketBytes(96, seq, ts, true, []byte{0x41, 0x9a, 0x00, 0x01}))
+						seq++
+					}
+					if err == nil {
+						// Two AAC frames of 1024 samples each.
+						err = write(2, rtpPacketBytes(97, uint16(frame), uint32(frame*2048), true,
+							[]byte{0x00, 0x20, 0x00, 0x20, 0x00, 0x20, 0x21, 0x00, 0x21, 0x00, 0x01, 0x02, 0x03, 0x04}))
+					}
+					if err != nil {
+						return
+					}
+					time.Sleep(40 * time.Millisecond)
+				}
+			}()
+			return "RTSP/1.0 200 OK\r\nSession: 1234\r\n\r\n"
+		}
+		return ""
+	}
+	return cam
+}
+
+func TestVideoDepacketizer(t *testing.T) {
+	var aus []*accessUnit
+	d := newVideoDepacketizer("H264", func(au *accessUnit) { aus = append(aus, au) })
+
+	stap := []byte{0x78, 0x00, byte(len(testSPS))}
+	stap = append(stap, testSPS...)
+	stap = append(stap, 0x00, byte(len(testPPS)))
+	stap = append(stap, testPPS...)
+	d.push(rtpPacket{Seq: 1, Timestamp: 100, Payload: stap})
+	d.push(rtpPacket{Seq: 2, Timestamp: 100, Payload: []byte{0x7c, 0x85, 0x01, 0x02}})
+	d.push(rtpPacket{Seq: 3, Timestamp: 100, Payload: []byte{0x7c, 0x05, 0x03}})
+	d.push(rtpPacket{Seq: 4, Timestamp: 100, Marker: true, Payload: []byte{0x7c, 0x45, 0x04}})
+
+	if len(aus) != 1 {
+		t.Fatalf("expected 1 access unit, got %d", len(aus))
+	}
+	au := aus[0]
+	if !au.Keyframe || len(au.NALUs) != 3 {
+		t.Fatalf("unexpected access unit: keyframe=%v nalus=%d", au.Keyframe, len(au.NALUs))
+	}
+	if !bytes.Equal(au.NALUs[2], []byte{0x65, 0x01, 0x02, 0x03, 0x04}) {
+		t.Errorf("FU-A reassembly wrong: % x", au.NALUs[2])
+	}
+
+	// A lost middle fragment drops the NAL unit; a timestamp change without
+	// marker still flushes the picture.
+	aus = nil
+	d.push(rtpPacket{Seq: 5, Timestamp: 200, Payload: []byte{0x7c, 0x81, 0x01}})
+	d.push(rtpPacket{Seq: 7, Timestamp: 200, Payload: []byte{0x7c, 0x41, 0x03}})
+	d.push(rtpPacket{Seq: 8, Timestamp: 200, Payload: []byte{0x41, 0x01}})
+	d.push(rtpPacket{Seq: 9, Timestamp: 300, Marker: true, Payload: []byte{0x41, 0x02}})
+	if len(aus) != 2 || len(aus[0].NALUs) != 1 || aus[0].Keyframe {
+		t.Errorf("unexpected access units after loss: %+v", aus)
+	}
+}
+
+func TestAACDepacketizer(t *testing.T) {
+	media := parseSDPMedia(h264SDP)[1]
+	var aus []*accessUnit
+	d := newAACDepacketizer(media, func(au *accessUnit) { aus = append(aus, au) })
+
+	// Two AU headers (13-bit size, 3-bit index): sizes 2 and 3.
+	d.push(rtpPacket{Timestamp: 1000, Payload: []byte{0x00, 0x20, 0x00, 0x10, 0x00, 0x18, 0xa1, 0xa2, 0xb1, 0xb2, 0xb3}})
+	if len(aus) != 2 || !bytes.Equal(aus[0].Data, []byte{0xa1, 0xa2}) || !bytes.Equal(aus[1].Data, []byte{0xb1, 0xb2, 0xb3}) {
+		t.Fatalf("unexpected frames: %+v", aus)
+	}
+	if aus[1].Timestamp != 1000+1024 {
+		t.Errorf("second frame timestamp %d", aus[1].Timestamp)
+	}
+
+	// One AU of 4 bytes fragmented over two packets.
+	aus = nil
+	d.push(rtpPacket{Timestamp: 5000, Payload: []byte{0x00, 0x10, 0x00, 0x20, 0x01, 0x02}})
+	d.push(rtpPacket{Timestamp: 5000, Marker: true, Payload: []byte{0x00, 0x10, 0x00, 0x20, 0x03, 0x04}})
+	if len(aus) != 1 || !bytes.Equal(aus[0].Data, []byte{1, 2, 3, 4}) {
+		t.Errorf("fragmented AU not reassembled: %+v", aus)
+	}
+}
+
+func TestParseSDPMedia(t *testing.T) {
+	medias := parseSDPMedia(h264SDP)
+	if len(medias) != 2 {
+		t.Fatalf("expected 2 medias, got %d", len(medias))
+	}
+	video, audio := medias[0], medias[1]
+	if video.Codec != "H264" || video.ClockRate != 90000 || video.Control != "track1" {
+		t.Errorf("unexpected video media: %+v", video)
+	}
+	if sets := video.parameterSets(); len(sets) != 2 || !bytes.Equal(sets[0], testSPS) {
+		t.Errorf("unexpected parameter sets: %x", sets)
+	}
+	if audio.Codec != "MPEG4-GENERIC" || audio.ClockRate != 44100 || audio.Channels != 2 {
+		t.Errorf("unexpected audio media: %+v", audio)
+	}
+	if asc := audio.audioSpecificConfig(); !bytes.Equal(asc, []byte{0x12, 0x10}) {
+		t.Errorf("unexpected AudioSpecificConfig: % x", asc)
+	}
+}
+
+func TestTSMuxer(t *testing.T) {
+	m := newTSMuxer(tsStreamTypeH264, tsStreamTypeAAC)
+	var buf bytes.Buffer
+	m.WriteTables(&buf)
+	m.WriteVideo(&buf, 90000, true, bytes.Repeat([]byte{0x11}, 1000))
+	m.WriteAudio(&buf, 90000, adtsHeader([]byte{0x12, 0x10}, 10))
+
+	data := buf.Bytes()
+	if len(data)%tsPacketSize != 0 {
+		t.Fatalf("output is not a whole number of packets: %d", len(data))
+	}
+	for i := 0; i < len(data); i += tsPacketSize {
+		if data[i] != 0x47 {
+			t.Fatalf("packet %d lacks sync byte", i/tsPacketSize)
+		}
+	}
+	// A PSI section followed by its CRC checks to zero.
+	pat := data[5 : 5+3+13]
+	if crc32MPEG(pat) != 0 {
+		t.Errorf("PAT CRC mismatch")
+	}
+	// The first video packet carries PCR and the random access indicator.
+	video := data[2*tsPacketSize:]
+	if pid := int(video[1]&0x1f)<<8 | int(video[2]); pid != tsPIDVideo || video[1]&0x40 == 0 {
+		t.Fatalf("third packet is not the video PES start (pid %#x)", pid)
+	}
+	if video[3]&0x20 == 0 || video[5]&0x50 != 0x50 {
+		t.Errorf("missing PCR/random access flags: % x", video[:12])
+	}
+	adts := adtsHeader([]byte{0x12, 0x10}, 10)
+	if adts[0] != 0xff || adts[1] != 0xf1 || (int(adts[3]&0x03)<<11|int(adts[4])<<3|int(adts[5]>>5)) != 17 {
+		t.Errorf("bad ADTS header % x", adts)
+	}
+}
+
+func TestHLSOutput(t *testing.T) {
+	oldDuration, oldTimeout := GlobalConfig.HLSSegmentDuration, GlobalConfig.HLSViewerTimeout
+	t.Cleanup(func() { GlobalConfig.HLSSegmentDuration, GlobalConfig.HLSViewerTimeout = oldDuration, oldTimeout })
+	GlobalConfig.HLSSegmentDuration = 300 * time.Millisecond
+	GlobalConfig.HLSViewerTimeout = time.Second
+
+	server, addr := startTunnelServer(t)
+	cam := startH264Camera(t)
+	base := fmt.Sprintf("http://%s/hls/rtsp/%s/mock/", addr, cam.Addr())
+
+	resp, err := http.Get(base + "index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	playlist, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "application/vnd.apple.mpegurl" {
+		t.Fatalf("playlist request failed: %d\n%s", resp.StatusCode, playlist)
+	}
+	if !strings.Contains(string(playlist), "#EXTINF:") || !strings.Contains(string(playlist), "seg0.ts") {
+		t.Fatalf("unexpected playlist:\n%s", playlist)
+	}
+
+	resp, err = http.Get(base + "seg0.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || len(segment) == 0 || len(segment)%tsPacketSize != 0 || segment[0] != 0x47 {
+		t.Fatalf("bad segment: status %d, %d bytes", resp.StatusCode, len(segment))
+	}
+	// The segment opens with a keyframe carrying the SDP parameter sets.
+	if !bytes.Contains(segment, append([]byte{0, 0, 0, 1}, testSPS...)) {
+		t.Error("segment lacks SPS before the first keyframe")
+	}
+	if !bytes.Contains(segment, []byte{0xff, 0xf1}) {
+		t.Error("segment lacks ADTS audio")
+	}
+
+	stream := server.LookupStreamScheme("rtsp", cam.Addr(), "", "", "/mock")
+	stream.mu.RLock()
+	consumers := len(stream.consumers)
+	stream.mu.RUnlock()
+	if consumers != 1 {
+		t.Fatalf("expected the segmenter to be attached, got %d consumers", consumers)
+	}
+
+	// Without viewers the segmenter detaches and the stream may go idle.
+	deadline := time.Now().Add(4 * time.Second)
+	for time.Now().Before(deadline) {
+		stream.mu.RLock()
+		consumers = len(stream.consumers)
+		stream.mu.RUnlock()
+		if consumers == 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if consumers != 0 {
+		t.Error("segmenter still attached after viewer timeout")
+	}
+}
+
+func TestParseProxyPath(t *testing.T) {
+	scheme, host, user, pass, path, ok := parseProxyPath("/rtsp+tcp/admin:secret@10.0.0.5:554/Streaming/Channels/101")
+	if !ok || scheme != "rtsp+tcp" || host != "10.0.0.5:554" || user != "admin" || pass != "secret" || path != "/Streaming/Channels/101" {
+		t.Errorf("unexpected parse: %q %q %q %q %q %v", scheme, host, user, pass, path, ok)
+	}
+	if _, _, _, _, _, ok := parseProxyPath("/ftp/host/x"); ok {
+		t.Error("unknown scheme accepted")
+	}
+}
+
+func TestLowLatencyHLS(t *testing.T) {
+	oldDuration, oldPart := GlobalConfig.HLSSegmentDuration, GlobalConfig.HLSPartDuration
+	t.Cleanup(func() { GlobalConfig.HLSSegmentDuration, GlobalConfig.HLSPartDuration = oldDuration, oldPart })
+	GlobalConfig.HLSSegmentDuration = 300 * time.Millisecond
+	GlobalConfig.HLSPartDuration = 100 * time.Millisecond
+
+	_, addr := startTunnelServer(t)
+	cam := startH264Camera(t)
+	base := fmt.Sprintf("http://%s/hls/rtsp/%s/mock/", addr, cam.Addr())
+	get := func(name string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(base + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	status, playlist := get("index.m3u8")
+	if status != 200 {
+		t.Fatalf("playlist request failed: %d", status)
+	}
+	for _, tag := range []string{"#EXT-X-PART-INF:PART-TARGET=", "CAN-BLOCK-RELOAD=YES", "#EXT-X-PART:DURATION=", "INDEPENDENT=YES", "#EXT-X-PRELOAD-HINT:TYPE=PART"} {
+		if !strings.Contains(playlist, tag) {
+			t.Fatalf("playlist lacks %s:\n%s", tag, playlist)
+		}
+	}
+
+	// The preload hint names the part being written; fetching it blocks
+	// until the part is complete.
+	var seq, index int
+	hint := playlist[strings.Index(playlist, "#EXT-X-PRELOAD-HINT"):]
+	if _, err := fmt.Sscanf(hint[strings.Index(hint, "URI=")+5:], "part%d.%d.ts", &seq, &index); err != nil {
+		t.Fatalf("bad preload hint %q: %v", hint, err)
+	}
+	status, part := get(fmt.Sprintf("part%d.%d.ts", seq, index))
+	if status != 200 || len(part) == 0 || len(part)%tsPacketSize != 0 {
+		t.Fatalf("preload hint part: status %d, %d bytes", status, len(part))
+	}
+
+	// A blocking reload for the part after it returns once it is listed.
+	status, playlist = get(fmt.Sprintf("index.m3u8?_HLS_msn=%d&_HLS_part=%d", seq, index+1))
+	if status != 200 {
+		t.Fatalf("blocking reload failed: %d", status)
+	}
+	if !strings.Contains(playlist, fmt.Sprintf("part%d.%d.ts\"", seq, index+1)) && !strings.Contains(playlist, fmt.Sprintf("seg%d.ts", seq)) {
+		t.Errorf("blocking reload returned before part %d.%d:\n%s", seq, index+1, playlist)
+	}
+
+	if status, _ := get(fmt.Sprintf("index.m3u8?_HLS_msn=%d", seq+10)); status != http.StatusBadRequest {
+		t.Errorf("far future _HLS_msn: expected 400, got %d", status)
+	}
+	if status, _ := get("index.m3u8?_HLS_part=1"); status != http.StatusBadRequest {
+		t.Errorf("_HLS_part without _HLS_msn: expected 400, got %d", status)
+	}
+}
+
+func TestHLSPartTarget(t *testing.T) {
+	oldDuration, oldPart := GlobalConfig.HLSSegmentDuration, GlobalConfig.HLSPartDuration
+	t.Cleanup(func() { GlobalConfig.HLSSegmentDuration, GlobalConfig.HLSPartDuration = oldDuration, oldPart })
+	GlobalConfig.HLSSegmentDuration = time.Second
+	GlobalConfig.HLSPartDuration = 100 * time.Millisecond
+
+	m := newHLSMuxer(NewStream(&Server{ctx: context.Background()}, "cam", "", "", "/a"))
+	m.source = newTSSource("test", "/a", h264SDP, h264Channels, m.origin, func(pts int64, randomAccess bool) *bytes.Buffer {
+		if !m.cut(pts, randomAccess) {
+			return nil
+		}
+		return m.part
+	})
+	video, audio := m.source.tracks[0], m.source.tracks[2]
+
+	// 25 fps with a keyframe every second and AAC in between; the camera
+	// skips half a second before frame 60.
+	at := func(frame int) float64 {
+		if frame >= 60 {
+			return float64(frame)*0.04 + 0.5
+		}
+		return float64(frame) * 0.04
+	}
+	aac := 0
+	for frame := 0; frame < 90; frame++ {
+		m.source.writeVideo(video, &accessUnit{Timestamp: uint32(at(frame) * 90000), Keyframe: frame%25 == 0, NALUs: [][]byte{{0x65, 0x88}}})
+		for ; float64(aac)*1024/44100 < at(frame+1); aac++ {
+			if sec := float64(aac) * 1024 / 44100; sec >= at(frame)+0.04 {
+				continue // lost with the video
+			}
+			m.source.writeAudio(audio, &accessUnit{Timestamp: uint32(aac * 1024), Data: []byte{0x21}})
+		}
+	}
+
+	// 100ms rounded up to whole 40ms frames.
+	if m.partTarget != 10800 {
+		t.Fatalf("part target %v, want 120ms", time.Duration(m.partTarget)*time.Second/90000)
+	}
+	parts := 0
+	for _, segment := range append(m.segments, &hlsSegment{parts: m.parts}) {
+		for _, part := range segment.parts {
+			parts++
+			if part.duration > 120*time.Millisecond {
+				t.Errorf("segment %d part %d lasts %v", segment.seq, part.index, part.duration)
+			}
+		}
+	}
+	if parts < 20 {
+		t.Errorf("only %d parts cut", parts)
+	}
+	if playlist := m.playlist(); !strings.Contains(playlist, "PART-TARGET=0.120\n") || !strings.Contains(playlist, "PART-HOLD-BACK=0.360\n") {
+		t.Errorf("playlist:\n%s", playlist)
+	}
+}
+
+func TestParseHLSMediaName(t *testing.T) {
+	cases := []struct {
+		name       string
+		seq, index int
+		ok         bool
+	}{
+		{"seg12.ts", 12, -1, true},
+		{"part12.3.ts", 12, 3, true},
+		{"part12.ts", 0, 0, false},
+		{"seg-1.ts", 0, 0, false},
+		{"seg1.mp4", 0, 0, false},
+		{"index.m3u8", 0, 0, false},
+	}
+	for _, tc := range cases {
+		seq, index, ok := parseHLSMediaName(tc.name)
+		if ok != tc.ok || ok && (seq != tc.seq || index != tc.index) {
+			t.Errorf("%s: got %d.%d %v", tc.name, seq, index, ok)
+		}
+	}
+}
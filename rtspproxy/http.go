@@ -0,0 +1,116 @@
+package rtspproxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// HTTP shares the RTSP listeners: sniffConn hands connections that open
+// with an HTTP request to one net/http server, which routes tunnel halves
+// (x-sessioncookie) to the RTSP-over-HTTP code and everything else to the
+// web endpoints below.
+
+// connListener feeds already-accepted connections to http.Server.Serve.
+type connListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// serveHTTP passes a sniffed HTTP connection to the shared http.Server,
+// starting it on first use.
+func (server *Server) serveHTTP(conn net.Conn) {
+	server.httpOnce.Do(func() {
+		server.httpConns = newConnListener()
+		server.httpServer = &http.Server{
+			Handler:           server.httpHandler(),
+			ReadHeaderTimeout: GlobalConfig.DialTimeout,
+			ConnContext:       httpConnContext,
+		}
+		go func() {
+			if err := server.httpServer.Serve(server.httpConns); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+				LogCriticalf("HTTP server stopped: %v", err)
+			}
+		}()
+	})
+	if server.httpConns == nil {
+		conn.Close() // shut down before the first HTTP request
+		return
+	}
+	select {
+	case server.httpConns.conns <- conn:
+	case <-server.httpConns.done:
+		conn.Close()
+	case <-server.ctx.Done():
+		conn.Close()
+	}
+}
+
+// shutdownHTTP stops the shared http.Server; later HTTP connections are refused.
+func (server *Server) shutdownHTTP() {
+	server.httpOnce.Do(func() {})
+	if server.httpServer != nil {
+		server.httpServer.Close()
+	}
+}
+
+func (server *Server) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hls/", server.requireAuth(server.serveHLS))
+	mux.HandleFunc("/whep/", server.requireAuth(server.serveWHEP))
+	mux.HandleFunc("/fmp4/", server.requireAuth(server.serveFMP4))
+	mux.HandleFunc("/clip/", server.requireAuth(server.serveClip))
+	mux.HandleFunc("/ws", server.serveRTSPWebSocket)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-sessioncookie") != "" {
+			server.serveHTTPTunnel(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// parseProxyPath splits the part of a web URL after its endpoint prefix,
+// "<scheme>/[user:pass@]host[:port]/path", the same layout as RTSP proxy
+// URLs. The scheme must be one of proxySchemes.
+func parseProxyPath(p string) (scheme, host, username, password, path string, ok bool) {
+	parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 3)
+	if len(parts) < 2 || !isProxyScheme(parts[0]) || parts[1] == "" {
+		return "", "", "", "", "", false
+	}
+	scheme, host = parts[0], parts[1]
+	path = "/"
+	if len(parts) == 3 {
+		path += parts[2]
+	}
+	if auth, h, found := strings.Cut(host, "@"); found {
+		host = h
+		username, password, _ = strings.Cut(auth, ":")
+	}
+	return scheme, host, username, password, path, true
+}
@@ -0,0 +1,415 @@
+package rtspproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RTSP-over-HTTP tunnelling (the QuickTime/Apple scheme): the client opens
+// a GET connection that carries server->client RTSP and interleaved RTP, and
+// a POST connection whose body is base64-encoded client->server RTSP. Both
+// carry the same x-sessioncookie; once paired they are served as a single
+// Client through httpTunnelConn.
+
+const tunnelContentType = "application/x-rtsp-tunnelled"
+
+// sniffedConn is a connection whose first bytes were peeked to pick the
+// protocol; reads drain the peeked bytes first.
+type sniffedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *sniffedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// NetConn returns the wrapped connection, like tls.Conn.NetConn.
+func (c *sniffedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// sniffConn waits for the first bytes of a new connection and reports
+// whether it opens an HTTP request. "GET_PARAMETER" is told apart from an
+// HTTP GET by the character after the method.
+func sniffConn(ctx context.Context, conn net.Conn) (*sniffedConn, bool, error) {
+	sc := &sniffedConn{Conn: conn, r: bufio.NewReader(conn)}
+	for {
+		if ctx.Err() != nil {
+			return nil, false, ctx.Err()
+		}
+		conn.SetReadDeadline(time.Now().Add(GlobalConfig.ReadTimeout))
+		head, err := sc.r.Peek(4)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			return nil, false, err
+		}
+		switch string(head) {
+		case "GET ", "POST", "HEAD":
+			return sc, true, nil
+		}
+		return sc, false, nil
+	}
+}
+
+// pendingTunnel is a GET connection waiting for its POST half.
+type pendingTunnel struct {
+	get  *sniffedConn
+	done chan struct{} // closed when the tunnel is paired and finished
+}
+
+// tunnelRegistry pairs tunnel halves by x-sessioncookie.
+type tunnelRegistry struct {
+	mu      sync.Mutex
+	pending map[string]*pendingTunnel
+}
+
+func newTunnelRegistry() *tunnelRegistry {
+	return &tunnelRegistry{pending: make(map[string]*pendingTunnel)}
+}
+
+func (reg *tunnelRegistry) add(cookie string, tunnel *pendingTunnel) {
+	reg.mu.Lock()
+	old := reg.pending[cookie]
+	reg.pending[cookie] = tunnel
+	reg.mu.Unlock()
+	if old != nil {
+		old.get.Close()
+		close(old.done)
+	}
+}
+
+// take removes and returns the GET half registered under cookie.
+func (reg *tunnelRegistry) take(cookie string) *pendingTunnel {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	tunnel := reg.pending[cookie]
+	delete(reg.pending, cookie)
+	return tunnel
+}
+
+// remove drops tunnel if it is still waiting; reports whether it was.
+func (reg *tunnelRegistry) remove(cookie string, tunnel *pendingTunnel) bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if reg.pending[cookie] != tunnel {
+		return false
+	}
+	delete(reg.pending, cookie)
+	return true
+}
+
+// serveHTTPTunnel serves one half of a tunnel. The GET half answers the
+// HTTP request and parks until the POST half arrives; the POST half then
+// runs the RTSP session over both connections.
+func (server *Server) serveHTTPTunnel(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "tunnelling unsupported", http.StatusInternalServerError)
+		return
+	}
+	raw, rw, err := hijacker.Hijack()
+	if err != nil {
+		LogCriticalf("❌ [TUNNEL] Hijack failed for [%s]: %v", r.RemoteAddr, err)
+		return
+	}
+	server.clients.Add(1)
+	defer server.clients.Done()
+
+	// The http.Server may already have buffered the start of a POST body.
+	conn := &sniffedConn{Conn: raw, r: rw.Reader}
+	cookie := r.Header.Get("x-sessioncookie")
+	switch r.Method {
+	case http.MethodGet:
+		server.handleTunnelGet(conn, cookie)
+	case http.MethodPost:
+		server.handleTunnelPost(conn, cookie)
+	default:
+		writeHTTPStatus(conn, http.StatusMethodNotAllowed)
+		conn.Close()
+	}
+}
+
+func (server *Server) handleTunnelGet(conn *sniffedConn, cookie string) {
+	header := "HTTP/1.0 200 OK\r\n" +
+		"Server: RTSP-Proxy/1.0\r\n" +
+		"Connection: close\r\n" +
+		"Date: " + time.Now().UTC().Format(http.TimeFormat) + "\r\n" +
+		"Cache-Control: no-store\r\n" +
+		"Pragma: no-cache\r\n" +
+		"Content-Type: " + tunnelContentType + "\r\n\r\n"
+	conn.SetWriteDeadline(time.Now().Add(GlobalConfig.WriteTimeout))
+	_, err := conn.Write([]byte(header))
+	conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	tunnel := &pendingTunnel{get: conn, done: make(chan struct{})}
+	server.tunnels.add(cookie, tunnel)
+	Logf("🚇 [TUNNEL] GET from [%s] waiting for POST (cookie %s)", conn.RemoteAddr(), cookie)
+
+	select {
+	case <-tunnel.done:
+	case <-time.After(GlobalConfig.DialTimeout):
+		if server.tunnels.remove(cookie, tunnel) {
+			LogCriticalf("⏱️ [TUNNEL] No POST for cookie %s from [%s]", cookie, conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+		<-tunnel.done
+	case <-server.ctx.Done():
+		if server.tunnels.remove(cookie, tunnel) {
+			conn.Close()
+			return
+		}
+		<-tunnel.done
+	}
+}
+
+func (server *Server) handleTunnelPost(conn *sniffedConn, cookie string) {
+	tunnel := server.tunnels.take(cookie)
+	if tunnel == nil {
+		LogCriticalf("❌ [TUNNEL] POST from [%s] for unknown cookie %s", conn.RemoteAddr(), cookie)
+		writeHTTPStatus(conn, http.StatusNotFound)
+		conn.Close()
+		return
+	}
+	defer close(tunnel.done)
+
+	LogCriticalf("🚇 [TUNNEL] RTSP-over-HTTP session from [%s] (cookie %s)", tunnel.get.RemoteAddr(), cookie)
+	client := NewClient(server, &httpTunnelConn{sniffedConn: tunnel.get, post: conn})
+	if client != nil {
+		client.incomingRequestHandler()
+	}
+}
+
+func writeHTTPStatus(conn net.Conn, code int) {
+	conn.SetWriteDeadline(time.Now().Add(GlobalConfig.WriteTimeout))
+	fmt.Fprintf(conn, "HTTP/1.0 %d %s\r\nConnection: close\r\n\r\n", code, http.StatusText(code))
+}
+
+// httpTunnelConn joins the two halves of a tunnel: writes and addresses go
+// to the GET connection, reads come base64-decoded from the POST body.
+type httpTunnelConn struct {
+	*sniffedConn // GET half
+	post         *sniffedConn
+
+	raw     []byte
+	pending []byte // base64 characters not yet forming a full quantum
+	decoded []byte
+	once    sync.Once
+}
+
+func (t *httpTunnelConn) Read(p []byte) (int, error) {
+	if t.raw == nil {
+		t.raw = make([]byte, 4096)
+	}
+	for len(t.decoded) == 0 {
+		n, err := t.post.Read(t.raw)
+		if n > 0 {
+			if decodeErr := t.decode(t.raw[:n]); decodeErr != nil {
+				return 0, decodeErr
+			}
+		}
+		if len(t.decoded) > 0 {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, t.decoded)
+	t.decoded = t.decoded[n:]
+	return n, nil
+}
+
+// decode appends complete base64 quanta to t.decoded. Clients encode each
+// message separately, so padding may appear mid-stream and every quantum is
+// decoded on its own.
+func (t *httpTunnelConn) decode(data []byte) error {
+	for _, b := range data {
+		switch b {
+		case '\r', '\n', ' ', '\t':
+			continue
+		}
+		t.pending = append(t.pending, b)
+	}
+	var out [3]byte
+	i := 0
+	for ; i+4 <= len(t.pending); i += 4 {
+		n, err := base64.StdEncoding.Decode(out[:], t.pending[i:i+4])
+		if err != nil {
+			return fmt.Errorf("tunnel: invalid base64: %w", err)
+		}
+		t.decoded = append(t.decoded, out[:n]...)
+	}
+	t.pending = append(t.pending[:0], t.pending[i:]...)
+	return nil
+}
+
+func (t *httpTunnelConn) SetReadDeadline(deadline time.Time) error {
+	return t.post.SetReadDeadline(deadline)
+}
+
+func (t *httpTunnelConn) SetDeadline(deadline time.Time) error {
+	return errors.Join(t.sniffedConn.SetDeadline(deadline), t.post.SetReadDeadline(deadline))
+}
+
+func (t *httpTunnelConn) Close() error {
+	var err error
+	t.once.Do(func() {
+		err = errors.Join(t.sniffedConn.Close(), t.post.Close())
+	})
+	return err
+}
+
+// upstreamTunnelled reports whether a camera is configured to be reached
+// through an HTTP tunnel, matching host:port first and then the bare host.
+func upstreamTunnelled(hostPort string) bool {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = hostPort
+	}
+	for _, entry := range GlobalConfig.UpstreamHTTPTunnelHosts {
+		if entry == hostPort || entry == host {
+			return true
+		}
+	}
+	return false
+}
+
+// dialHTTPTunnel opens the GET/POST pair towards a camera (or the HTTP
+// reverse proxy in front of it) and returns it as one connection.
+func dialHTTPTunnel(ctx context.Context, dialer *net.Dialer, host, path string) (net.Conn, error) {
+	var raw [11]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return nil, err
+	}
+	cookie := hex.EncodeToString(raw[:])
+	if path == "" {
+		path = "/"
+	}
+
+	getConn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	get := &sniffedConn{Conn: getConn, r: bufio.NewReader(getConn)}
+	getConn.SetDeadline(time.Now().Add(GlobalConfig.DialTimeout))
+	_, err = fmt.Fprintf(getConn, "GET %s HTTP/1.0\r\n"+
+		"Host: %s\r\n"+
+		"User-Agent: RTSP-Proxy/1.0\r\n"+
+		"x-sessioncookie: %s\r\n"+
+		"Accept: %s\r\n"+
+		"Pragma: no-cache\r\n"+
+		"Cache-Control: no-cache\r\n\r\n", path, host, cookie, tunnelContentType)
+	if err == nil {
+		var resp *http.Response
+		resp, err = http.ReadResponse(get.r, nil)
+		if err == nil && resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("tunnel GET answered %s", resp.Status)
+		}
+	}
+	if err != nil {
+		getConn.Close()
+		return nil, err
+	}
+	getConn.SetDeadline(time.Time{})
+
+	post, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		getConn.Close()
+		return nil, err
+	}
+	post.SetWriteDeadline(time.Now().Add(GlobalConfig.DialTimeout))
+	_, err = fmt.Fprintf(post, "POST %s HTTP/1.0\r\n"+
+		"Host: %s\r\n"+
+		"User-Agent: RTSP-Proxy/1.0\r\n"+
+		"x-sessioncookie: %s\r\n"+
+		"Content-Type: %s\r\n"+
+		"Pragma: no-cache\r\n"+
+		"Cache-Control: no-cache\r\n"+
+		"Content-Length: 32767\r\n"+
+		"Expires: Sun, 9 Jan 1972 00:00:00 GMT\r\n\r\n", path, host, cookie, tunnelContentType)
+	post.SetWriteDeadline(time.Time{})
+	if err != nil {
+		getConn.Close()
+		post.Close()
+		return nil, err
+	}
+	return &upstreamTunnelConn{sniffedConn: get, post: post}, nil
+}
+
+// upstreamTunnelConn is the camera side of a tunnel: reads come from the GET
+// response body, writes go base64-encoded into the POST body.
+type upstreamTunnelConn struct {
+	*sniffedConn // GET half
+	post         net.Conn
+	once         sync.Once
+}
+
+// Write sends p at once as complete base64, so nothing waits for the next
+// Write. An RTSP message ending off a quantum is completed with empty lines,
+// which RTSP, like HTTP, ignores where a request is expected, and needs no
+// padding. An interleaved frame, written whole by SendBinary, is encoded as
+// a padded unit of its own, as tunnelling clients encode each message.
+func (t *upstreamTunnelConn) Write(p []byte) (int, error) {
+	data := p
+	if len(p) > 0 && p[0] != '$' && len(p)%3 != 0 {
+		data = append(data[:len(data):len(data)], "\r\n\r\n"[:2*(len(p)%3)]...)
+	}
+	if _, err := t.post.Write([]byte(base64.StdEncoding.EncodeToString(data))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (t *upstreamTunnelConn) SetWriteDeadline(deadline time.Time) error {
+	return t.post.SetWriteDeadline(deadline)
+}
+
+func (t *upstreamTunnelConn) SetReadDeadline(deadline time.Time) error {
+	return t.sniffedConn.SetReadDeadline(deadline)
+}
+
+func (t *upstreamTunnelConn) SetDeadline(deadline time.Time) error {
+	return errors.Join(t.sniffedConn.SetReadDeadline(deadline), t.post.SetWriteDeadline(deadline))
+}
+
+func (t *upstreamTunnelConn) Close() error {
+	var err error
+	t.once.Do(func() {
+		err = errors.Join(t.sniffedConn.Close(), t.post.Close())
+	})
+	return err
+}
+
+// isTLSConn reports whether conn, or a connection it wraps, is TLS.
+func isTLSConn(conn net.Conn) bool {
+	for conn != nil {
+		if _, ok := conn.(*tls.Conn); ok {
+			return true
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return false
+		}
+		conn = wrapper.NetConn()
+	}
+	return false
+}
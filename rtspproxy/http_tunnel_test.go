@@ -0,0 +1,267 @@
+package rtspproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startTunnelServer(t *testing.T) (*Server, string) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	server := NewServer(ctx)
+	if err := server.ListenHTTP(0); err != nil {
+		t.Fatal(err)
+	}
+	go server.acceptLoop(server.httpListener)
+	t.Cleanup(func() {
+		cancel()
+		server.httpListener.Close()
+	})
+	return server, fmt.Sprintf("127.0.0.1:%d", server.httpListener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestHTTPTunnelDecode(t *testing.T) {
+	tunnel := &httpTunnelConn{}
+	// Two separately encoded messages: padding appears mid-stream, and the
+	// input is split across quanta and line breaks.
+	input := base64.StdEncoding.EncodeToString([]byte("ab")) + "\r\n" + base64.StdEncoding.EncodeToString([]byte("cdef"))
+	for i := 0; i < len(input); i += 3 {
+		end := min(i+3, len(input))
+		if err := tunnel.decode([]byte(input[i:end])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(tunnel.decoded) != "abcdef" || len(tunnel.pending) != 0 {
+		t.Errorf("decoded %q, pending %q", tunnel.decoded, tunnel.pending)
+	}
+	if err := (&httpTunnelConn{}).decode([]byte("!!!!")); err == nil {
+		t.Error("expected error for invalid base64")
+	}
+}
+
+func TestHTTPTunnelSession(t *testing.T) {
+	_, addr := startTunnelServer(t)
+	cam := startMockCamera(t)
+
+	get, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer get.Close()
+	fmt.Fprintf(get, "GET /rtsp/%s/mock HTTP/1.0\r\nx-sessioncookie: abc123\r\nAccept: %s\r\n\r\n", cam.Addr(), tunnelContentType)
+
+	reader := bufio.NewReader(get)
+	get.SetReadDeadline(time.Now().Add(3 * time.Second))
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != tunnelContentType {
+		t.Fatalf("unexpected GET reply: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	post, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer post.Close()
+	fmt.Fprintf(post, "POST /rtsp/%s/mock HTTP/1.0\r\nx-sessioncookie: abc123\r\nContent-Type: %s\r\nContent-Length: 32767\r\n\r\n", cam.Addr(), tunnelContentType)
+
+	base := fmt.Sprintf("rtsp://%s/rtsp/%s/mock", addr, cam.Addr())
+	send := func(req string) {
+		encoded := base64.StdEncoding.EncodeToString([]byte(req))
+		// Split the message so the server must reassemble partial quanta.
+		half := len(encoded)/2 + 1
+		post.Write([]byte(encoded[:half]))
+		time.Sleep(10 * time.Millisecond)
+		post.Write([]byte(encoded[half:]))
+	}
+	expect := func(cseq string) string {
+		t.Helper()
+		var reply bytes.Buffer
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("reading reply %s: %v", cseq, err)
+			}
+			reply.WriteString(line)
+			if line == "\r\n" {
+				break
+			}
+		}
+		headers := parseMockHeaders(reply.String())
+		if length := headerGet(headers, "Content-Length"); length != "" {
+			var n int
+			fmt.Sscan(length, &n)
+			io.CopyN(&reply, reader, int64(n))
+		}
+		if !strings.HasPrefix(reply.String(), "RTSP/1.0 200") || headerGet(headers, "CSeq") != cseq {
+			t.Fatalf("unexpected reply to CSeq %s:\n%s", cseq, reply.String())
+		}
+		return reply.String()
+	}
+
+	send(fmt.Sprintf("OPTIONS %s RTSP/1.0\r\nCSeq: 1\r\n\r\n", base))
+	expect("1")
+	send(fmt.Sprintf("DESCRIBE %s RTSP/1.0\r\nCSeq: 2\r\nAccept: application/sdp\r\n\r\n", base))
+	if sdp := expect("2"); !strings.Contains(sdp, "m=video") {
+		t.Errorf("DESCRIBE reply has no SDP:\n%s", sdp)
+	}
+	send(fmt.Sprintf("SETUP %s/track1 RTSP/1.0\r\nCSeq: 3\r\nTransport: RTP/AVP/TCP;unicast;interleaved=0-1\r\n\r\n", base))
+	setup := expect("3")
+	session := strings.SplitN(headerGet(parseMockHeaders(setup), "Session"), ";", 2)[0]
+	send(fmt.Sprintf("PLAY %s RTSP/1.0\r\nCSeq: 4\r\nSession: %s\r\n\r\n", base, session))
+	expect("4")
+
+	// Interleaved RTP now flows back over the GET connection.
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		t.Fatalf("no interleaved data on GET connection: %v", err)
+	}
+	if header[0] != '$' || header[1] != 0 {
+		t.Errorf("unexpected interleaved header % x", header)
+	}
+}
+
+func TestHTTPTunnelUnknownCookie(t *testing.T) {
+	_, addr := startTunnelServer(t)
+	post, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer post.Close()
+	fmt.Fprintf(post, "POST /x HTTP/1.0\r\nx-sessioncookie: nope\r\nContent-Type: %s\r\n\r\n", tunnelContentType)
+	post.SetReadDeadline(time.Now().Add(3 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(post), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestSniffGetParameter(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go a.Write([]byte("GET_PARAMETER rtsp://x/ RTSP/1.0\r\n\r\n"))
+	sc, tunnel, err := sniffConn(context.Background(), b)
+	if err != nil || tunnel {
+		t.Fatalf("GET_PARAMETER taken for HTTP: tunnel=%v err=%v", tunnel, err)
+	}
+	buf := make([]byte, 3)
+	io.ReadFull(sc, buf)
+	if string(buf) != "GET" {
+		t.Errorf("peeked bytes lost, read %q", buf)
+	}
+}
+
+func TestHTTPTunnelUpstream(t *testing.T) {
+	// The camera sits behind a second proxy that only accepts the tunnel on
+	// its HTTP port, as a reverse-proxied site would.
+	cam := startMockCamera(t)
+	_, tunnelAddr := startTunnelServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := NewServer(ctx)
+	stream := server.LookupStreamScheme("rtsp+http", tunnelAddr, "", "", "/rtsp/"+cam.Addr()+"/mock")
+	if stream.lowerTransport() != "tcp" {
+		t.Errorf("tunnelled stream must use interleaved TCP, got %s", stream.lowerTransport())
+	}
+	client, peer := newTestClient(t, server)
+	defer client.Destroy()
+	stream.AddClient(client, "1234")
+	stream.MapChannel(client, 0, 0)
+
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, err := peer.Read(buf)
+	if err != nil {
+		t.Fatalf("no packet relayed through the tunnel: %v", err)
+	}
+	if buf[0] != '$' || buf[1] != 0 {
+		t.Errorf("unexpected interleaved packet: % x", buf[:n])
+	}
+	if _, ok := stream.remote.RemoteConn.(*upstreamTunnelConn); !ok {
+		t.Errorf("remote is not tunnelled: %T", stream.remote.RemoteConn)
+	}
+}
+
+func TestUpstreamTunnelledHosts(t *testing.T) {
+	old := GlobalConfig.UpstreamHTTPTunnelHosts
+	defer func() { GlobalConfig.UpstreamHTTPTunnelHosts = old }()
+	GlobalConfig.UpstreamHTTPTunnelHosts = []string{"127.0.0.1", "127.0.0.2:8080"}
+
+	cases := map[string]bool{"127.0.0.1": true, "127.0.0.1:80": true, "127.0.0.2:8080": true, "127.0.0.2": false, "127.0.0.3": false}
+	for host, want := range cases {
+		if got := upstreamTunnelled(host); got != want {
+			t.Errorf("upstreamTunnelled(%q) = %v, want %v", host, got, want)
+		}
+	}
+
+	server := &Server{ctx: context.Background()}
+	stream := NewStream(server, "127.0.0.1", "", "", "/a")
+	stream.Scheme = "rtsp"
+	if remote := NewRemote(stream); remote == nil || !remote.tunnel || remote.Host != "127.0.0.1:80" {
+		t.Errorf("configured camera not tunnelled on port 80: %+v", remote)
+	}
+}
+
+// postBody collects what is written to the POST half of an upstream tunnel.
+type postBody struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (b *postBody) Write(p []byte) (int, error)        { return b.buf.Write(p) }
+func (b *postBody) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestUpstreamTunnelBody(t *testing.T) {
+	body := &postBody{}
+	tunnel := &upstreamTunnelConn{post: body}
+	remote := &Remote{RemoteConn: tunnel}
+	// sent decodes the body as the proxy's own tunnel end does, quantum by
+	// quantum.
+	sent := func() string {
+		t.Helper()
+		decoder := &httpTunnelConn{}
+		if err := decoder.decode(body.buf.Bytes()); err != nil || len(decoder.pending) != 0 {
+			t.Fatalf("POST body %q: %v, %d characters left over", body.buf.String(), err, len(decoder.pending))
+		}
+		return string(decoder.decoded)
+	}
+
+	// A request is sent whole even when it ends off a base64 quantum.
+	options := "OPTIONS rtsp://cam/a RTSP/1.0\r\nCSeq: 12\r\n\r\n"
+	tunnel.Write([]byte(options))
+	if got := sent(); !strings.HasPrefix(got, options) {
+		t.Fatalf("request not flushed: %q", got)
+	}
+	// So is a lone receiver report, with nothing written after it.
+	remote.SendBinary(1, []byte("rtcp"))
+	if got := sent(); !strings.HasSuffix(got, "$\x01\x00\x04rtcp") {
+		t.Fatalf("frame not flushed: %q", got)
+	}
+	remote.SendBinary(1, []byte("report"))
+	keepalive := "GET_PARAMETER rtsp://cam/a RTSP/1.0\r\nCSeq: 13\r\n\r\n"
+	tunnel.Write([]byte(keepalive))
+
+	reader := newRTSPReader(strings.NewReader(sent()), 1024)
+	for _, want := range []string{options, "$\x01\x00\x04rtcp", "$\x01\x00\x06report", keepalive} {
+		frame, err := reader.next()
+		if err != nil || string(frame.data) != want {
+			t.Fatalf("got %q, %v; want %q", frame.data, err, want)
+		}
+	}
+}
@@ -8,12 +8,12 @@ import (
 // Ipc represents an Inter-Process Communication mechanism.
 type Ipc struct {
 	Channel chan string
-	timeout int
+	timeout time.Duration
 }
 
 // NewIPC creates a new Ipc instance.
-func NewIPC(timeout ...int) *Ipc {
-	defautlTimeout := 10
+func NewIPC(timeout ...time.Duration) *Ipc {
+	defautlTimeout := 10 * time.Second
 	if len(timeout) > 0 {
 		defautlTimeout = timeout[0]
 	}
@@ -27,8 +27,7 @@ func NewIPC(timeout ...int) *Ipc {
 
 // GetResponse waits for a response on the IPC channel or times out/cancels.
 func (ipc *Ipc) GetResponse(ctx context.Context) string {
-	toSleep := time.Duration(ipc.timeout) * time.Second
-	timer := time.NewTimer(toSleep)
+	timer := time.NewTimer(ipc.timeout)
 	defer timer.Stop()
 	defer close(ipc.Channel)
 
@@ -2,7 +2,6 @@ package rtspproxy
 
 import (
 	"errors"
-	"strconv"
 	"strings"
 )
 
@@ -99,57 +98,3 @@ func sharedParseHeader(line string) (key, value string, err error) {
 	}
 	return key, b.String(), nil
 }
-
-// sharedParseContentLength extracts Content-Length from a header block (bytes).
-// Optimized to avoid allocations.
-func sharedParseContentLength(headerPart []byte) int {
-	needle := []byte("content-length:")
-	nLen := len(needle)
-
-	for i := 0; i+nLen <= len(headerPart); i++ {
-		// Case-insensitive match for "content-length:"
-		match := true
-		for j := 0; j < nLen; j++ {
-			c1 := headerPart[i+j]
-			c2 := needle[j]
-			if c1 >= 'A' && c1 <= 'Z' {
-				c1 += 32
-			}
-			if c1 != c2 {
-				match = false
-				break
-			}
-		}
-
-		if match {
-			rest := headerPart[i+nLen:]
-			lineEnd := indexBytes(rest, []byte("\r\n"))
-			if lineEnd < 0 {
-				lineEnd = len(rest)
-			}
-			clStr := strings.TrimSpace(string(rest[:lineEnd]))
-			n, _ := strconv.Atoi(clStr)
-			return n
-		}
-	}
-	return 0
-}
-
-func indexBytes(haystack, needle []byte) int {
-	if len(needle) == 0 {
-		return 0
-	}
-	for i := 0; i+len(needle) <= len(haystack); i++ {
-		match := true
-		for j := 0; j < len(needle); j++ {
-			if haystack[i+j] != needle[j] {
-				match = false
-				break
-			}
-		}
-		if match {
-			return i
-		}
-	}
-	return -1
-}
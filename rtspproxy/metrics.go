@@ -13,15 +13,16 @@ import (
 // Metrics holds process-wide counters exposed in Prometheus text format.
 // No external dependencies — pure stdlib.
 type Metrics struct {
-	PacketsForwarded atomic.Uint64
-	PacketsDropped   atomic.Uint64
-	BytesForwarded   atomic.Uint64
-	Reconnects       atomic.Uint64
-	ActiveStreams    atomic.Int64
-	ActiveClients    atomic.Int64
-	AuthFailures     atomic.Uint64
-	ConnectErrors    atomic.Uint64
-	startTime        time.Time
+	PacketsForwarded   atomic.Uint64
+	PacketsDropped     atomic.Uint64
+	BytesForwarded     atomic.Uint64
+	Reconnects         atomic.Uint64
+	ActiveStreams      atomic.Int64
+	ActiveClients      atomic.Int64
+	AuthFailures       atomic.Uint64
+	ClientAuthFailures atomic.Uint64
+	ConnectErrors      atomic.Uint64
+	startTime          time.Time
 }
 
 // GlobalMetrics is the singleton metrics registry.
@@ -65,6 +66,10 @@ func (m *Metrics) Handler() http.Handler {
 		fmt.Fprintf(w, "# TYPE rtsp_proxy_auth_failures_total counter\n")
 		fmt.Fprintf(w, "rtsp_proxy_auth_failures_total %d\n", m.AuthFailures.Load())
 
+		fmt.Fprintf(w, "# HELP rtsp_proxy_client_auth_failures_total Clients rejected by the proxy's own authentication.\n")
+		fmt.Fprintf(w, "# TYPE rtsp_proxy_client_auth_failures_total counter\n")
+		fmt.Fprintf(w, "rtsp_proxy_client_auth_failures_total %d\n", m.ClientAuthFailures.Load())
+
 		fmt.Fprintf(w, "# HELP rtsp_proxy_connect_errors_total Upstream connect/dial errors.\n")
 		fmt.Fprintf(w, "# TYPE rtsp_proxy_connect_errors_total counter\n")
 		fmt.Fprintf(w, "rtsp_proxy_connect_errors_total %d\n", m.ConnectErrors.Load())
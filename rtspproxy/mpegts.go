@@ -0,0 +1,388 @@
+package rtspproxy
+
+import (
+	"bytes"
+	"time"
+)
+
+// Minimal MPEG-2 transport stream muxer (ISO/IEC 13818-1) for HLS segments:
+// one program with at most one video (H.264/H.265) and one AAC audio stream.
+
+const (
+	tsPacketSize = 188
+	tsPIDPAT     = 0x0000
+	tsPIDPMT     = 0x1000
+	tsPIDVideo   = 0x0100
+	tsPIDAudio   = 0x0101
+
+	tsStreamTypeH264 = 0x1b
+	tsStreamTypeH265 = 0x24
+	tsStreamTypeAAC  = 0x0f
+
+	// tsPTSDelay keeps PTS ahead of the PCR so decoders have time to buffer.
+	tsPTSDelay = 9000
+)
+
+// tsTrack maps one SDP media to a TS elementary stream.
+type tsTrack struct {
+	hevc     bool
+	params   [][]byte // out-of-band parameter sets
+	asc      []byte   // AAC AudioSpecificConfig
+	vdepack  *videoDepacketizer
+	adepack  *aacDepacketizer
+	timeline rtpTimeline
+}
+
+// tsSource turns the RTP packets of a stream into TS-muxed samples, for the
+// HLS segmenter and the recorder. It uses the first H.264/H.265 and the
+// first AAC media of the SDP. Before each sample, cut is called with its
+// 90 kHz PTS and whether it is a random access point; it returns the
+// buffer that receives the sample, or nil to drop it.
+type tsSource struct {
+	origin   time.Time
+	tracks   map[int]*tsTrack // channel -> track
+	muxer    *tsMuxer
+	hasVideo bool
+	cut      func(pts int64, randomAccess bool) *bytes.Buffer
+
+	// The sample interval of the video, or of the audio without video, in
+	// 90 kHz units; 0 until two samples were seen.
+	interval int64
+	lastPTS  int64
+	sampled  bool
+}
+
+func newTSSource(tag, streamPath, sdp string, channels map[int]int, origin time.Time, cut func(int64, bool) *bytes.Buffer) *tsSource {
+	src := &tsSource{origin: origin, tracks: make(map[int]*tsTrack), cut: cut}
+	var videoType, audioType byte
+	for i, media := range parseSDPMedia(sdp) {
+		channel, ok := channels[i]
+		if !ok {
+			continue // not set up
+		}
+		track := &tsTrack{timeline: rtpTimeline{clock: int64(media.ClockRate)}}
+		if track.timeline.clock <= 0 {
+			continue
+		}
+		switch {
+		case videoType == 0 && (media.Codec == "H264" || media.Codec == "H265"):
+			track.hevc = media.Codec == "H265"
+			track.params = media.parameterSets()
+			videoType = tsStreamTypeH264
+			if track.hevc {
+				videoType = tsStreamTypeH265
+			}
+			track.vdepack = newVideoDepacketizer(media.Codec, func(au *accessUnit) { src.writeVideo(track, au) })
+		case audioType == 0 && media.Codec == "MPEG4-GENERIC" && media.audioSpecificConfig() != nil:
+			track.asc = media.audioSpecificConfig()
+			audioType = tsStreamTypeAAC
+			track.adepack = newAACDepacketizer(media, func(au *accessUnit) { src.writeAudio(track, au) })
+		default:
+			Logf("%s Stream [%s] skipping unsupported %s track %q", tag, streamPath, media.Type, media.Codec)
+			continue
+		}
+		src.tracks[channel] = track
+	}
+	if len(src.tracks) == 0 {
+		LogCriticalf("❌ %s Stream [%s] has no H.264/H.265/AAC track", tag, streamPath)
+	}
+	src.hasVideo = videoType != 0
+	src.muxer = newTSMuxer(videoType, audioType)
+	return src
+}
+
+// push feeds one RTP packet of the given upstream channel.
+func (src *tsSource) push(channel int, packet []byte) {
+	track, ok := src.tracks[channel]
+	if !ok {
+		return // RTCP or unsupported track
+	}
+	p, err := parseRTP(packet)
+	if err != nil {
+		return
+	}
+	if track.vdepack != nil {
+		track.vdepack.push(p)
+	} else {
+		track.adepack.push(p)
+	}
+}
+
+// pts converts an RTP timestamp into the 90 kHz timeline of the source.
+func (src *tsSource) pts(track *tsTrack, ts uint32) int64 {
+	return track.timeline.at(ts, src.origin) * 90000 / track.timeline.clock
+}
+
+// tick measures the sample interval from consecutive samples of the track
+// that paces the stream.
+func (src *tsSource) tick(pts int64) {
+	if src.sampled && pts > src.lastPTS {
+		src.interval = pts - src.lastPTS
+	}
+	src.lastPTS, src.sampled = pts, true
+}
+
+func (src *tsSource) writeVideo(track *tsTrack, au *accessUnit) {
+	pts := src.pts(track, au.Timestamp)
+	src.tick(pts)
+	if w := src.cut(pts, au.Keyframe); w != nil {
+		src.muxer.WriteVideo(w, pts, au.Keyframe, annexB(track.hevc, au, track.params))
+	}
+}
+
+func (src *tsSource) writeAudio(track *tsTrack, au *accessUnit) {
+	pts := src.pts(track, au.Timestamp)
+	if !src.hasVideo {
+		src.tick(pts)
+	}
+	if w := src.cut(pts, !src.hasVideo); w != nil {
+		src.muxer.WriteAudio(w, pts, append(adtsHeader(track.asc, len(au.Data)), au.Data...))
+	}
+}
+
+type tsMuxer struct {
+	videoType byte // 0 if there is no video
+	audioType byte // 0 if there is no audio
+	cc        map[uint16]byte
+}
+
+func newTSMuxer(videoType, audioType byte) *tsMuxer {
+	return &tsMuxer{videoType: videoType, audioType: audioType, cc: make(map[uint16]byte)}
+}
+
+func (m *tsMuxer) pcrPID() uint16 {
+	if m.videoType != 0 {
+		return tsPIDVideo
+	}
+	return tsPIDAudio
+}
+
+// WriteTables writes PAT and PMT; every segment starts with them.
+func (m *tsMuxer) WriteTables(w *bytes.Buffer) {
+	pat := []byte{
+		0x00,       // table_id
+		0xb0, 0x0d, // section_syntax_indicator, section_length=13
+		0x00, 0x01, // transport_stream_id
+		0xc1,       // version 0, current_next
+		0x00, 0x00, // section_number, last_section_number
+		0x00, 0x01, // program_number 1
+		0xe0 | byte(tsPIDPMT>>8), byte(tsPIDPMT & 0xff),
+	}
+	m.writeSection(w, tsPIDPAT, pat)
+
+	pcr := m.pcrPID()
+	pmt := []byte{
+		0x02,       // table_id
+		0xb0, 0x00, // section_length patched below
+		0x00, 0x01, // program_number
+		0xc1,
+		0x00, 0x00,
+		0xe0 | byte(pcr>>8), byte(pcr & 0xff),
+		0xf0, 0x00, // program_info_length
+	}
+	if m.videoType != 0 {
+		pmt = append(pmt, m.videoType, 0xe0|byte(tsPIDVideo>>8), byte(tsPIDVideo&0xff), 0xf0, 0x00)
+	}
+	if m.audioType != 0 {
+		pmt = append(pmt, m.audioType, 0xe0|byte(tsPIDAudio>>8), byte(tsPIDAudio&0xff), 0xf0, 0x00)
+	}
+	length := len(pmt) - 3 + 4 // after the length field, including CRC
+	pmt[1] = 0xb0 | byte(length>>8)
+	pmt[2] = byte(length)
+	m.writeSection(w, tsPIDPMT, pmt)
+}
+
+func (m *tsMuxer) writeSection(w *bytes.Buffer, pid uint16, section []byte) {
+	crc := crc32MPEG(section)
+	packet := make([]byte, 0, tsPacketSize)
+	packet = append(packet, 0x47, 0x40|byte(pid>>8), byte(pid), 0x10|m.nextCC(pid), 0x00)
+	packet = append(packet, section...)
+	packet = append(packet, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	for len(packet) < tsPacketSize {
+		packet = append(packet, 0xff)
+	}
+	w.Write(packet)
+}
+
+// WriteVideo writes one access unit in Annex-B form. pts is in 90 kHz units.
+func (m *tsMuxer) WriteVideo(w *bytes.Buffer, pts int64, keyframe bool, annexB []byte) {
+	m.writePES(w, tsPIDVideo, 0xe0, pts, annexB, keyframe)
+}
+
+// WriteAudio writes one or more ADTS frames.
+func (m *tsMuxer) WriteAudio(w *bytes.Buffer, pts int64, adts []byte) {
+	m.writePES(w, tsPIDAudio, 0xc0, pts, adts, m.videoType == 0)
+}
+
+func (m *tsMuxer) writePES(w *bytes.Buffer, pid uint16, streamID byte, pts int64, payload []byte, randomAccess bool) {
+	ptsField := pts + tsPTSDelay
+	pes := make([]byte, 0, 14+len(payload))
+	pes = append(pes, 0x00, 0x00, 0x01, streamID)
+	length := 3 + 5 + len(payload)
+	if length > 0xffff {
+		length = 0 // allowed for video
+	}
+	pes = append(pes, byte(length>>8), byte(length), 0x80, 0x80, 0x05)
+	pes = append(pes,
+		0x21|byte(ptsField>>29)&0x0e,
+		byte(ptsField>>22),
+		0x01|byte(ptsField>>14)&0xfe,
+		byte(ptsField>>7),
+		0x01|byte(ptsField<<1)&0xfe,
+	)
+	pes = append(pes, payload...)
+
+	pcr := int64(-1)
+	if pid == m.pcrPID() {
+		pcr = pts
+	}
+	m.writePackets(w, pid, pes, pcr, randomAccess)
+}
+
+// writePackets splits a PES packet into transport packets; the first one
+// carries the PCR and random-access flag, the last one is padded through
+// adaptation-field stuffing.
+func (m *tsMuxer) writePackets(w *bytes.Buffer, pid uint16, pes []byte, pcr int64, randomAccess bool) {
+	first := true
+	for len(pes) > 0 {
+		var af []byte // adaptation field after its length byte
+		if first && (pcr >= 0 || randomAccess) {
+			flags := byte(0)
+			if randomAccess {
+				flags |= 0x40
+			}
+			af = []byte{flags}
+			if pcr >= 0 {
+				af[0] |= 0x10
+				af = append(af,
+					byte(pcr>>25), byte(pcr>>17), byte(pcr>>9), byte(pcr>>1),
+					byte(pcr<<7)|0x7e, 0x00)
+			}
+		}
+		space := tsPacketSize - 4
+		if af != nil {
+			space -= 1 + len(af)
+		}
+		if len(pes) < space {
+			stuffing := space - len(pes)
+			if af == nil {
+				af = []byte{}
+				stuffing-- // the length byte itself
+				if stuffing > 0 {
+					af = append(af, 0x00)
+					stuffing--
+				}
+			}
+			for ; stuffing > 0; stuffing-- {
+				af = append(af, 0xff)
+			}
+			space = len(pes)
+		}
+
+		control := byte(0x10)
+		if af != nil {
+			control |= 0x20
+		}
+		pusi := byte(0)
+		if first {
+			pusi = 0x40
+		}
+		w.Write([]byte{0x47, pusi | byte(pid>>8), byte(pid), control | m.nextCC(pid)})
+		if af != nil {
+			w.WriteByte(byte(len(af)))
+			w.Write(af)
+		}
+		w.Write(pes[:space])
+		pes = pes[space:]
+		first = false
+	}
+}
+
+func (m *tsMuxer) nextCC(pid uint16) byte {
+	cc := m.cc[pid]
+	m.cc[pid] = (cc + 1) & 0x0f
+	return cc
+}
+
+var crc32MPEGTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc32MPEG is the non-reflected CRC-32 used by PSI sections.
+func crc32MPEG(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc = crc<<8 ^ crc32MPEGTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// annexB joins NAL units with start codes behind an access unit delimiter.
+// Keyframes get the SDP parameter sets when the camera sends them only
+// out of band.
+func annexB(hevc bool, au *accessUnit, parameterSets [][]byte) []byte {
+	var buf bytes.Buffer
+	if hevc {
+		buf.Write([]byte{0, 0, 0, 1, 0x46, 0x01, 0x50})
+	} else {
+		buf.Write([]byte{0, 0, 0, 1, 0x09, 0xf0})
+	}
+	if au.Keyframe {
+		inBand := false
+		for _, nalu := range au.NALUs {
+			if isParameterSetNALU(hevc, nalu) {
+				inBand = true
+				break
+			}
+		}
+		if !inBand {
+			for _, ps := range parameterSets {
+				buf.Write([]byte{0, 0, 0, 1})
+				buf.Write(ps)
+			}
+		}
+	}
+	for _, nalu := range au.NALUs {
+		typ := naluType(hevc, nalu)
+		if (!hevc && typ == 9) || (hevc && typ == 35) {
+			continue // we wrote our own delimiter
+		}
+		buf.Write([]byte{0, 0, 0, 1})
+		buf.Write(nalu)
+	}
+	return buf.Bytes()
+}
+
+// adtsHeader builds the 7-byte ADTS header for one raw AAC frame from the
+// AudioSpecificConfig of the track.
+func adtsHeader(asc []byte, frameLength int) []byte {
+	objectType := asc[0] >> 3
+	freqIndex := (asc[0]&0x07)<<1 | asc[1]>>7
+	channels := (asc[1] >> 3) & 0x0f
+	profile := objectType - 1
+	if objectType == 0 || objectType > 4 {
+		profile = 1 // AAC-LC for extended object types (SBR/PS signal implicitly)
+	}
+	total := frameLength + 7
+	return []byte{
+		0xff,
+		0xf1, // MPEG-4, layer 0, no CRC
+		profile<<6 | freqIndex<<2 | channels>>2,
+		(channels&0x03)<<6 | byte(total>>11),
+		byte(total >> 3),
+		byte(total&0x07)<<5 | 0x1f,
+		0xfc,
+	}
+}
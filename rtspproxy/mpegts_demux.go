@@ -0,0 +1,225 @@
+package rtspproxy
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Minimal MPEG-2 transport stream demuxer for recorded segments: follows the
+// PAT and PMT and reassembles the PES packets of H.264/H.265/AAC streams.
+
+var errNotTS = errors.New("mpegts: not a transport stream")
+
+// tsSample is one PES payload: an Annex-B access unit or ADTS frames.
+type tsSample struct {
+	streamType byte
+	pts        int64 // 90 kHz, as muxed (including tsPTSDelay)
+	keyframe   bool
+	data       []byte
+}
+
+type tsDemuxer struct {
+	pmtPID  int
+	streams map[uint16]byte // elementary PID -> stream type
+	pes     map[uint16]*bytes.Buffer
+	onPES   func(tsSample)
+}
+
+func newTSDemuxer(onPES func(tsSample)) *tsDemuxer {
+	return &tsDemuxer{
+		pmtPID:  -1,
+		streams: make(map[uint16]byte),
+		pes:     make(map[uint16]*bytes.Buffer),
+		onPES:   onPES,
+	}
+}
+
+// demuxTS returns the samples of a complete transport stream.
+func demuxTS(data []byte) ([]tsSample, error) {
+	if len(data) < tsPacketSize || data[0] != 0x47 {
+		return nil, errNotTS
+	}
+	var samples []tsSample
+	d := newTSDemuxer(func(s tsSample) { samples = append(samples, s) })
+	for len(data) >= tsPacketSize {
+		d.push(data[:tsPacketSize])
+		data = data[tsPacketSize:]
+	}
+	d.flush()
+	return samples, nil
+}
+
+// push feeds one 188-byte transport packet.
+func (d *tsDemuxer) push(packet []byte) {
+	if packet[0] != 0x47 {
+		return
+	}
+	pusi := packet[1]&0x40 != 0
+	pid := uint16(packet[1]&0x1f)<<8 | uint16(packet[2])
+	payload := packet[4:]
+	if packet[3]&0x20 != 0 { // adaptation field
+		if len(payload) < 1 || int(payload[0]) >= len(payload) {
+			return
+		}
+		payload = payload[1+int(payload[0]):]
+	}
+	if packet[3]&0x10 == 0 {
+		return
+	}
+
+	switch {
+	case pid == tsPIDPAT:
+		d.parsePAT(section(payload, pusi))
+	case int(pid) == d.pmtPID:
+		d.parsePMT(section(payload, pusi))
+	default:
+		if _, ok := d.streams[pid]; !ok {
+			return
+		}
+		buf := d.pes[pid]
+		if pusi {
+			d.emit(pid)
+			buf = &bytes.Buffer{}
+			d.pes[pid] = buf
+		}
+		if buf != nil {
+			buf.Write(payload)
+		}
+	}
+}
+
+// flush emits the PES packets still being reassembled.
+func (d *tsDemuxer) flush() {
+	for pid := range d.pes {
+		d.emit(pid)
+	}
+}
+
+// section returns a PSI section starting in this packet.
+func section(payload []byte, pusi bool) []byte {
+	if !pusi || len(payload) < 1 || int(payload[0])+1 > len(payload) {
+		return nil
+	}
+	s := payload[1+int(payload[0]):]
+	if len(s) < 3 {
+		return nil
+	}
+	length := int(s[1]&0x0f)<<8 | int(s[2])
+	if 3+length > len(s) || length < 4 {
+		return nil
+	}
+	return s[:3+length-4] // without CRC
+}
+
+func (d *tsDemuxer) parsePAT(s []byte) {
+	if len(s) < 8 || s[0] != 0x00 {
+		return
+	}
+	for p := s[8:]; len(p) >= 4; p = p[4:] {
+		if program := int(p[0])<<8 | int(p[1]); program != 0 {
+			d.pmtPID = int(p[2]&0x1f)<<8 | int(p[3])
+			return
+		}
+	}
+}
+
+func (d *tsDemuxer) parsePMT(s []byte) {
+	if len(s) < 12 || s[0] != 0x02 {
+		return
+	}
+	infoLength := int(s[10]&0x0f)<<8 | int(s[11])
+	if 12+infoLength > len(s) {
+		return
+	}
+	for p := s[12+infoLength:]; len(p) >= 5; {
+		streamType := p[0]
+		pid := uint16(p[1]&0x1f)<<8 | uint16(p[2])
+		esInfo := int(p[3]&0x0f)<<8 | int(p[4])
+		switch streamType {
+		case tsStreamTypeH264, tsStreamTypeH265, tsStreamTypeAAC:
+			d.streams[pid] = streamType
+		}
+		if 5+esInfo > len(p) {
+			return
+		}
+		p = p[5+esInfo:]
+	}
+}
+
+func (d *tsDemuxer) emit(pid uint16) {
+	buf := d.pes[pid]
+	if buf == nil {
+		return
+	}
+	delete(d.pes, pid)
+	pes := buf.Bytes()
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return
+	}
+	headerLength := int(pes[8])
+	if 9+headerLength > len(pes) || pes[7]&0x80 == 0 || headerLength < 5 {
+		return // no PTS
+	}
+	p := pes[9:]
+	pts := int64(p[0]>>1&0x07)<<30 | int64(p[1])<<22 | int64(p[2]>>1)<<15 | int64(p[3])<<7 | int64(p[4]>>1)
+	sample := tsSample{streamType: d.streams[pid], pts: pts, data: pes[9+headerLength:]}
+	if sample.streamType != tsStreamTypeAAC {
+		hevc := sample.streamType == tsStreamTypeH265
+		for _, nalu := range splitAnnexB(sample.data) {
+			if isKeyframeNALU(hevc, nalu) {
+				sample.keyframe = true
+				break
+			}
+		}
+	}
+	d.onPES(sample)
+}
+
+// splitAnnexB returns the NAL units of an Annex-B byte stream.
+func splitAnnexB(b []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(b); i++ {
+		if b[i] != 0 || b[i+1] != 0 || b[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			for end > start && b[end-1] == 0 { // 4-byte start code / trailing zeros
+				end--
+			}
+			if end > start {
+				nalus = append(nalus, b[start:end])
+			}
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(b) {
+		nalus = append(nalus, b[start:])
+	}
+	return nalus
+}
+
+// adtsFrames splits ADTS frames and derives their AudioSpecificConfig.
+func adtsFrames(b []byte) (frames [][]byte, asc []byte) {
+	for len(b) >= 7 && b[0] == 0xff && b[1]&0xf0 == 0xf0 {
+		headerLength := 7
+		if b[1]&0x01 == 0 { // CRC present
+			headerLength = 9
+		}
+		frameLength := int(b[3]&0x03)<<11 | int(b[4])<<3 | int(b[5])>>5
+		if frameLength < headerLength || frameLength > len(b) {
+			break
+		}
+		if asc == nil {
+			objectType := b[2]>>6 + 1
+			freqIndex := b[2] >> 2 & 0x0f
+			channels := (b[2]&0x01)<<2 | b[3]>>6
+			asc = []byte{objectType<<3 | freqIndex>>1, freqIndex<<7 | channels<<3}
+		}
+		frames = append(frames, b[headerLength:frameLength])
+		b = b[frameLength:]
+	}
+	return frames, asc
+}
@@ -0,0 +1,280 @@
+package rtspproxy
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// fMP4 over WebSocket for Media Source Extensions players:
+//
+//	ws://proxy/fmp4/<scheme>/[user:pass@]host[:port]/path
+//
+// The first message is text: the MIME type for MediaSource.addSourceBuffer.
+// It is followed by binary messages: the init segment, then one moof+mdat
+// per access unit, starting at a keyframe. Each connection is a Consumer of
+// the Stream with its own packet queue.
+
+// fmp4Source is one track of the stream as the session depacketizes it.
+type fmp4Source struct {
+	track    *fmp4Track
+	vdepack  *videoDepacketizer
+	adepack  *aacDepacketizer
+	timeline rtpTimeline
+}
+
+type fmp4Session struct {
+	stream    *Stream
+	sdp       string              // fixed description (clips); empty uses the stream's
+	channels  map[int]int         // media channels of the fixed description
+	write     func(msg any) error // text (string) or binary ([]byte) message
+	origin    time.Time
+	done      chan struct{} // closed when the socket fails or the peer leaves
+	closeOnce sync.Once
+
+	// Only touched from Consume.
+	sources      map[int]*fmp4Source // channel -> source
+	video        *fmp4Source
+	started      bool // MIME type and init segment sent
+	seq          uint32
+	pending      *accessUnit // video is sent one access unit late to know its duration
+	pendingTime  int64
+	lastDuration int64
+}
+
+func newFMP4Session(stream *Stream, write func(msg any) error) *fmp4Session {
+	return &fmp4Session{stream: stream, write: write, origin: time.Now(), done: make(chan struct{})}
+}
+
+func (fs *fmp4Session) close() {
+	fs.closeOnce.Do(func() { close(fs.done) })
+}
+
+// Consume implements Consumer.
+func (fs *fmp4Session) Consume(channel int, packet []byte) {
+	if channel%2 != 0 {
+		return
+	}
+	if fs.sources == nil && !fs.setupSources() {
+		return
+	}
+	source, ok := fs.sources[channel]
+	if !ok {
+		return
+	}
+	p, err := parseRTP(packet)
+	if err != nil {
+		return
+	}
+	if source.vdepack != nil {
+		source.vdepack.push(p)
+	} else {
+		source.adepack.push(p)
+	}
+}
+
+// setupSources picks the first H.264 and the first AAC media of the SDP.
+func (fs *fmp4Session) setupSources() bool {
+	sdp, channels := fs.sdp, fs.channels
+	if sdp == "" {
+		sdp, channels = fs.stream.GetSDP(), fs.stream.mediaChannels()
+	}
+	if sdp == "" {
+		return false
+	}
+	fs.sources = make(map[int]*fmp4Source)
+	var audio *fmp4Source
+	for i, media := range parseSDPMedia(sdp) {
+		channel, ok := channels[i]
+		if !ok {
+			continue // not set up
+		}
+		source := &fmp4Source{timeline: rtpTimeline{clock: int64(media.ClockRate)}}
+		if source.timeline.clock <= 0 {
+			continue
+		}
+		switch {
+		case fs.video == nil && media.Codec == "H264":
+			source.track = &fmp4Track{timescale: uint32(media.ClockRate)}
+			for _, ps := range media.parameterSets() {
+				fs.setParameterSet(source.track, ps)
+			}
+			source.vdepack = newVideoDepacketizer(media.Codec, func(au *accessUnit) { fs.writeVideo(source, au) })
+			fs.video = source
+		case audio == nil && media.Codec == "MPEG4-GENERIC" && media.audioSpecificConfig() != nil:
+			channels := media.Channels
+			if channels == 0 {
+				channels = 2
+			}
+			source.track = &fmp4Track{
+				timescale:  uint32(media.ClockRate),
+				asc:        media.audioSpecificConfig(),
+				sampleRate: media.ClockRate,
+				channels:   channels,
+			}
+			source.adepack = newAACDepacketizer(media, func(au *accessUnit) { fs.writeAudio(source, au) })
+			audio = source
+		default:
+			Logf("📺 [fMP4] Stream [%s] skipping unsupported %s track %q", fs.stream.Path, media.Type, media.Codec)
+			continue
+		}
+		fs.sources[channel] = source
+	}
+	if len(fs.sources) == 0 {
+		LogCriticalf("❌ [fMP4] Stream [%s] has no H.264/AAC track", fs.stream.Path)
+		fs.close()
+	}
+	// Track IDs follow the init segment order: video first.
+	id := uint32(1)
+	for _, source := range []*fmp4Source{fs.video, audio} {
+		if source != nil {
+			source.track.id = id
+			id++
+		}
+	}
+	return true
+}
+
+// setParameterSet keeps an SPS or PPS for the init segment. An SPS that
+// cannot be parsed is dropped: avcC and the codecs string are built from it.
+func (fs *fmp4Session) setParameterSet(track *fmp4Track, nalu []byte) {
+	switch naluType(false, nalu) {
+	case 7:
+		width, height, ok := h264SPSSize(nalu)
+		if !ok {
+			Logf("⚠️ [fMP4] Stream [%s] ignoring malformed SPS (%d bytes)", fs.stream.Path, len(nalu))
+			return
+		}
+		track.sps = append([]byte(nil), nalu...)
+		track.width, track.height = width, height
+	case 8:
+		track.pps = append([]byte(nil), nalu...)
+	}
+}
+
+// start sends the MIME type and init segment at the first keyframe.
+func (fs *fmp4Session) start() bool {
+	var tracks []*fmp4Track
+	if fs.video != nil {
+		tracks = append(tracks, fs.video.track)
+	}
+	for _, source := range fs.sources {
+		if source != fs.video {
+			tracks = append(tracks, source.track)
+		}
+	}
+	if !fs.send(fmp4MimeType(tracks)) || !fs.send(fmp4Init(tracks)) {
+		return false
+	}
+	fs.started = true
+	LogCriticalf("📺 [fMP4] Stream [%s] streaming %s", fs.stream.Path, fmp4MimeType(tracks))
+	return true
+}
+
+func (fs *fmp4Session) writeVideo(source *fmp4Source, au *accessUnit) {
+	t := source.timeline.at(au.Timestamp, fs.origin)
+	if !fs.started {
+		for _, nalu := range au.NALUs {
+			if isParameterSetNALU(false, nalu) {
+				fs.setParameterSet(source.track, nalu)
+			}
+		}
+		if !au.Keyframe || source.track.sps == nil || source.track.pps == nil || !fs.start() {
+			return
+		}
+	}
+	if fs.pending != nil {
+		duration := t - fs.pendingTime
+		if duration <= 0 {
+			duration = 1
+		}
+		fs.seq++
+		fs.send(fmp4Fragment(fs.seq, source.track, uint64(fs.pendingTime), uint32(duration), fs.pending.Keyframe, avccSample(fs.pending)))
+		fs.lastDuration = duration
+	}
+	fs.pending, fs.pendingTime = au, t
+}
+
+// finish sends the access unit held back by writeVideo, lasting as long as
+// the one before it.
+func (fs *fmp4Session) finish() {
+	if fs.pending == nil || fs.video == nil {
+		return
+	}
+	fs.seq++
+	fs.send(fmp4Fragment(fs.seq, fs.video.track, uint64(fs.pendingTime), uint32(max(fs.lastDuration, 1)), fs.pending.Keyframe, avccSample(fs.pending)))
+	fs.pending = nil
+}
+
+func (fs *fmp4Session) writeAudio(source *fmp4Source, au *accessUnit) {
+	t := source.timeline.at(au.Timestamp, fs.origin)
+	if !fs.started && (fs.video != nil || !fs.start()) {
+		return
+	}
+	fs.seq++
+	fs.send(fmp4Fragment(fs.seq, source.track, uint64(t), 1024, true, au.Data))
+}
+
+// send writes a text (string) or binary ([]byte) message.
+func (fs *fmp4Session) send(msg any) bool {
+	select {
+	case <-fs.done:
+		return false
+	default:
+	}
+	if err := fs.write(msg); err != nil {
+		Logf("📺 [fMP4] Stream [%s] write error: %v", fs.stream.Path, err)
+		fs.close()
+		return false
+	}
+	return true
+}
+
+// serveFMP4 handles WebSocket upgrades on /fmp4/<scheme>/<host>/<path>.
+func (server *Server) serveFMP4(w http.ResponseWriter, r *http.Request) {
+	scheme, host, username, password, streamPath, ok := parseProxyPath(strings.TrimPrefix(r.URL.Path, "/fmp4"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		http.Error(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	stream := server.LookupStreamScheme(scheme, host, username, password, streamPath)
+	if stream == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// No Handshake: browsers on any origin (dashboards) may connect.
+	websocket.Server{Handler: func(ws *websocket.Conn) {
+		session := newFMP4Session(stream, func(msg any) error {
+			ws.SetWriteDeadline(time.Now().Add(GlobalConfig.WriteTimeout))
+			return websocket.Message.Send(ws, msg)
+		})
+		GlobalMetrics.ActiveClients.Add(1)
+		defer GlobalMetrics.ActiveClients.Add(-1)
+		LogCriticalf("📺 [fMP4] Viewer %s joined stream [%s]", r.RemoteAddr, stream.Path)
+
+		stream.AddConsumer(session)
+		// Players send nothing; reading only detects the close.
+		go func() {
+			var msg []byte
+			for websocket.Message.Receive(ws, &msg) == nil {
+			}
+			session.close()
+		}()
+		select {
+		case <-session.done:
+		case <-stream.ctx.Done():
+		case <-server.ctx.Done():
+		}
+		stream.RemoveConsumer(session)
+		ws.Close()
+		LogCriticalf("📺 [fMP4] Viewer %s left stream [%s]", r.RemoteAddr, stream.Path)
+	}}.ServeHTTP(w, r)
+}
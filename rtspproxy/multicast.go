@@ -0,0 +1,60 @@
+package rtspproxy
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// multicastInterface resolves GlobalConfig.MulticastInterface; nil lets the
+// kernel pick the interface from the routing table.
+func multicastInterface() (*net.Interface, error) {
+	if GlobalConfig.MulticastInterface == "" {
+		return nil, nil
+	}
+	ifi, err := net.InterfaceByName(GlobalConfig.MulticastInterface)
+	if err != nil {
+		return nil, fmt.Errorf("multicast interface %q: %w", GlobalConfig.MulticastInterface, err)
+	}
+	return ifi, nil
+}
+
+// listenMulticast opens a socket bound to group:port and joins the group.
+// With a non-nil source the join is source-specific (SSM, IPv4 only), so
+// only packets from that sender are delivered.
+func listenMulticast(group net.IP, port int, source net.IP) (*net.UDPConn, error) {
+	if !group.IsMulticast() {
+		return nil, fmt.Errorf("%s is not a multicast address", group)
+	}
+	ifi, err := multicastInterface()
+	if err != nil {
+		return nil, err
+	}
+
+	network := "udp4"
+	if group.To4() == nil {
+		network = "udp6"
+	}
+	// ListenMulticastUDP sets SO_REUSEADDR, so several streams (or processes)
+	// can consume the same group.
+	conn, err := net.ListenMulticastUDP(network, ifi, &net.UDPAddr{IP: group, Port: port})
+	if err != nil {
+		return nil, fmt.Errorf("join %s:%d: %w", group, port, err)
+	}
+	conn.SetReadBuffer(GlobalConfig.BufferSize * 16)
+
+	if source != nil && group.To4() != nil {
+		p := ipv4.NewPacketConn(conn)
+		groupAddr := &net.UDPAddr{IP: group}
+		if err := p.LeaveGroup(ifi, groupAddr); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("leave any-source %s: %w", group, err)
+		}
+		if err := p.JoinSourceSpecificGroup(ifi, groupAddr, &net.UDPAddr{IP: source}); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("join (%s, %s): %w", source, group, err)
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,170 @@
+package rtspproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+)
+
+// MulticastPublisher re-sends the packets of one Stream to a multicast group,
+// so any number of LAN viewers cost the same bandwidth as one. Each published
+// track is described by a Transport with ComType "multicast" whose substreams
+// carry the group ports (basePort + upstream channel).
+type MulticastPublisher struct {
+	mu         sync.RWMutex
+	group      net.IP
+	conn       *net.UDPConn
+	tracks     map[int]*Substream    // upstream channel -> group port
+	transports map[string]*Transport // substream name -> published transport
+	members    map[*Client]struct{}
+}
+
+var (
+	multicastGroupsMu sync.Mutex
+	multicastGroups   = make(map[string]bool) // allocated publish groups
+)
+
+// allocateMulticastGroup hands out the next unused address of
+// GlobalConfig.MulticastPublishRange, one per published stream.
+func allocateMulticastGroup() (net.IP, error) {
+	if GlobalConfig.MulticastPublishRange == "" {
+		return nil, errors.New("multicast publishing is disabled")
+	}
+	_, ipNet, err := net.ParseCIDR(GlobalConfig.MulticastPublishRange)
+	if err != nil {
+		return nil, fmt.Errorf("multicast publish range: %w", err)
+	}
+	base := ipNet.IP.To4()
+	if base == nil || !base.IsMulticast() {
+		return nil, fmt.Errorf("multicast publish range %s is not IPv4 multicast", ipNet)
+	}
+
+	multicastGroupsMu.Lock()
+	defer multicastGroupsMu.Unlock()
+	ones, bits := ipNet.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	start := uint32(base[0])<<24 | uint32(base[1])<<16 | uint32(base[2])<<8 | uint32(base[3])
+	for i := uint32(1); i < size; i++ {
+		n := start + i
+		ip := net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n)).To4()
+		if !multicastGroups[ip.String()] {
+			multicastGroups[ip.String()] = true
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("multicast publish range %s exhausted", ipNet)
+}
+
+func releaseMulticastGroup(ip net.IP) {
+	multicastGroupsMu.Lock()
+	delete(multicastGroups, ip.String())
+	multicastGroupsMu.Unlock()
+}
+
+// NewMulticastPublisher allocates a group and a sending socket.
+func NewMulticastPublisher() (*MulticastPublisher, error) {
+	group, err := allocateMulticastGroup()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		releaseMulticastGroup(group)
+		return nil, err
+	}
+	p := ipv4.NewPacketConn(conn)
+	if err := p.SetMulticastTTL(GlobalConfig.MulticastTTL); err != nil {
+		LogCriticalf("⚠️ [MULTICAST] Failed to set TTL %d: %v", GlobalConfig.MulticastTTL, err)
+	}
+	if ifi, err := multicastInterface(); err != nil {
+		LogCriticalf("⚠️ [MULTICAST] %v", err)
+	} else if ifi != nil {
+		p.SetMulticastInterface(ifi)
+	}
+	return &MulticastPublisher{
+		group:      group,
+		conn:       conn,
+		tracks:     make(map[int]*Substream),
+		transports: make(map[string]*Transport),
+		members:    make(map[*Client]struct{}),
+	}, nil
+}
+
+// AddTrack publishes the track carried by upstream (if not yet published)
+// and registers client as a viewer. Returns the published transport, or nil
+// if the upstream track has no channels yet.
+func (pub *MulticastPublisher) AddTrack(client *Client, upstream *Transport) *Transport {
+	upstream.mu.RLock()
+	name := upstream.SubstreamName
+	channels := make([]int, 0, 2)
+	for idx := 0; idx < 2; idx++ {
+		if sub, ok := upstream.Substreams[idx]; ok {
+			channels = append(channels, sub.Channel)
+		}
+	}
+	upstream.mu.RUnlock()
+
+	if len(channels) == 0 {
+		return nil
+	}
+
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+	pub.members[client] = struct{}{}
+	if transport, ok := pub.transports[name]; ok {
+		return transport
+	}
+
+	transport := NewTransport(upstream.Session, name, "RTP/AVP", "multicast")
+	for idx, channel := range channels {
+		sub := NewSubstream(transport, name)
+		sub.Channel = channel
+		sub.Host = pub.group.String()
+		sub.Port = GlobalConfig.MulticastPublishPort + channel
+		sub.Conn = pub.conn
+		transport.Substreams[idx] = sub
+		pub.tracks[channel] = sub
+	}
+	pub.transports[name] = transport
+	LogCriticalf("📡 [MULTICAST] Publishing track %s to %s:%d (ttl %d)", name, pub.group, GlobalConfig.MulticastPublishPort+channels[0], GlobalConfig.MulticastTTL)
+	return transport
+}
+
+// RemoveMember unregisters a viewer and returns how many remain.
+func (pub *MulticastPublisher) RemoveMember(client *Client) int {
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+	delete(pub.members, client)
+	return len(pub.members)
+}
+
+// HasMember reports whether client joined through multicast.
+func (pub *MulticastPublisher) HasMember(client *Client) bool {
+	pub.mu.RLock()
+	defer pub.mu.RUnlock()
+	_, ok := pub.members[client]
+	return ok
+}
+
+// Send writes an interleaved-framed packet to the group port of its channel.
+func (pub *MulticastPublisher) Send(channel int, packet []byte) {
+	pub.mu.RLock()
+	sub, ok := pub.tracks[channel]
+	pub.mu.RUnlock()
+	if !ok || len(packet) < streamHeaderLength {
+		return
+	}
+	if _, err := pub.conn.WriteToUDP(packet[streamHeaderLength:], &net.UDPAddr{IP: pub.group, Port: sub.Port}); err != nil {
+		Logf("⚠️ [MULTICAST] Send to %s:%d failed: %v", pub.group, sub.Port, err)
+	}
+}
+
+// Close stops publishing and returns the group to the pool.
+func (pub *MulticastPublisher) Close() {
+	pub.conn.Close()
+	releaseMulticastGroup(pub.group)
+	LogCriticalf("📡 [MULTICAST] Stopped publishing to %s", pub.group)
+}
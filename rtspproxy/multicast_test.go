@@ -0,0 +1,168 @@
+package rtspproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// loopbackMulticast points group joins at the loopback interface for the test.
+func loopbackMulticast(t *testing.T) *net.Interface {
+	t.Helper()
+	ifaces, _ := net.Interfaces()
+	for i := range ifaces {
+		if ifaces[i].Flags&net.FlagLoopback != 0 && ifaces[i].Flags&net.FlagUp != 0 {
+			old := GlobalConfig.MulticastInterface
+			GlobalConfig.MulticastInterface = ifaces[i].Name
+			t.Cleanup(func() { GlobalConfig.MulticastInterface = old })
+			return &ifaces[i]
+		}
+	}
+	t.Skip("no loopback interface for multicast")
+	return nil
+}
+
+func TestParseTransportMulticast(t *testing.T) {
+	protocol, comType, params := (*Remote)(nil).parseTransport("RTP/AVP;multicast;destination=232.1.2.3;port=5000-5001;ttl=16;source=10.0.0.5")
+	if protocol != "RTP/AVP" || comType != "multicast" {
+		t.Errorf("got protocol=%q comType=%q", protocol, comType)
+	}
+	if params["destination"] != "232.1.2.3" || params["port"] != "5000-5001" || params["ttl"] != "16" || params["source"] != "10.0.0.5" {
+		t.Errorf("unexpected params %v", params)
+	}
+
+	_, comType, params = (*Remote)(nil).parseTransport("RTP/AVP/TCP;interleaved=0-1")
+	if comType != "unicast" || params["interleaved"] != "0-1" {
+		t.Errorf("delivery type must default to unicast without eating parameters: %q %v", comType, params)
+	}
+}
+
+func TestMulticastUpstream(t *testing.T) {
+	lo := loopbackMulticast(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := NewServer(ctx)
+	cam := startMockCamera(t)
+
+	group := net.IPv4(239, 255, 77, 1)
+	groupPort := 25000 + time.Now().Nanosecond()%1000*2
+
+	sender, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	p := ipv4.NewPacketConn(sender)
+	p.SetMulticastInterface(lo)
+	p.SetMulticastLoopback(true)
+
+	cam.handle = func(method, req string, conn net.Conn) string {
+		switch method {
+		case "SETUP":
+			if !strings.Contains(req, "RTP/AVP;multicast") {
+				t.Errorf("expected multicast SETUP, got %q", req)
+			}
+			return fmt.Sprintf("RTSP/1.0 200 OK\r\nTransport: RTP/AVP;multicast;destination=%s;port=%d-%d;ttl=1;source=127.0.0.1\r\nSession: 1234\r\n\r\n",
+				group, groupPort, groupPort+1)
+		case "PLAY":
+			go func() {
+				for i := 0; i < 100; i++ {
+					sender.WriteToUDP([]byte{0x80, 96, 0, byte(i)}, &net.UDPAddr{IP: group, Port: groupPort})
+					time.Sleep(20 * time.Millisecond)
+				}
+			}()
+			return "RTSP/1.0 200 OK\r\nSession: 1234\r\n\r\n"
+		}
+		return ""
+	}
+
+	stream := server.LookupStreamScheme("rtsp+multicast", cam.Addr(), "", "", "/mock")
+	client, peer := newTestClient(t, server)
+	defer client.Destroy()
+	stream.AddClient(client, "1234")
+	stream.MapChannel(client, 0, 0)
+
+	peer.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 64)
+	n, err := peer.Read(buf)
+	if err != nil {
+		t.Fatalf("no packet relayed from multicast upstream: %v", err)
+	}
+	if n < 8 || buf[0] != '$' || buf[1] != 0 || buf[4] != 0x80 {
+		t.Errorf("unexpected interleaved packet: % x", buf[:n])
+	}
+}
+
+func TestMulticastRepublish(t *testing.T) {
+	loopbackMulticast(t)
+	oldRange := GlobalConfig.MulticastPublishRange
+	GlobalConfig.MulticastPublishRange = "239.255.78.0/28"
+	defer func() { GlobalConfig.MulticastPublishRange = oldRange }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := NewServer(ctx)
+	cam := startMockCamera(t)
+	stream := server.LookupStream(cam.Addr(), "", "", "/mock")
+
+	setup := func(client *Client) *Response {
+		request, _ := NewRequest("SETUP", &url.URL{Scheme: "rtsp", Host: cam.Addr(), Path: "/mock/track1"})
+		request.Headers["Transport"] = "RTP/AVP;multicast"
+		return client.handleSetup(stream, request)
+	}
+
+	viewer1, _ := newTestClient(t, server)
+	defer viewer1.Destroy()
+	viewer2, _ := newTestClient(t, server)
+	defer viewer2.Destroy()
+
+	resp1, resp2 := setup(viewer1), setup(viewer2)
+	if resp1.Code != 200 || resp2.Code != 200 {
+		t.Fatalf("expected 200/200, got %d/%d", resp1.Code, resp2.Code)
+	}
+	transport := resp1.Headers["Transport"]
+	if transport != resp2.Headers["Transport"] {
+		t.Errorf("viewers should share one group: %q vs %q", transport, resp2.Headers["Transport"])
+	}
+	_, comType, params := (*Remote)(nil).parseTransport(transport)
+	if comType != "multicast" || params["destination"] != "239.255.78.1" {
+		t.Fatalf("unexpected multicast reply: %s", transport)
+	}
+
+	port, _, _ := parsePortRange(params["port"])
+	conn, err := listenMulticast(net.ParseIP(params["destination"]), port, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no packet on published group: %v", err)
+	}
+	if n != 4 || buf[0] != 0x80 {
+		t.Errorf("unexpected multicast payload: % x", buf[:n])
+	}
+
+	stream.RemoveClient(viewer1)
+	stream.mu.RLock()
+	running := stream.publisher != nil
+	stream.mu.RUnlock()
+	if !running {
+		t.Error("publisher stopped while a viewer remains")
+	}
+	stream.RemoveClient(viewer2)
+	stream.mu.RLock()
+	running = stream.publisher != nil
+	stream.mu.RUnlock()
+	if running {
+		t.Error("publisher should stop after the last multicast viewer leaves")
+	}
+}
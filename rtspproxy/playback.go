@@ -0,0 +1,718 @@
+package rtspproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Playback of recordings (see recording.go) through the RTSP listener:
+//
+//	rtsp://proxy/playback/<scheme>/[user:pass@]host[:port]/path
+//
+// Streams listed in GlobalConfig.RecordStreams can be played back with the
+// credentials they are recorded with. DESCRIBE builds the SDP from the
+// segments themselves; PLAY honours Range (npt= or clock=) and Scale, and
+// PAUSE keeps the position for the next PLAY. Every session has its own
+// reader that demuxes segments and paces RTP onto the client connection;
+// the live fanout is not involved.
+
+const (
+	playbackPrefix   = "playback"
+	playbackMTU      = 1400
+	playbackMaxScale = 16
+	// playbackMaxGap is the longest pause in the recording played in real
+	// time; holes between recording runs are skipped.
+	playbackMaxGap = 2 * time.Second
+)
+
+var aacSampleRates = []int64{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// recordingTrack is an elementary stream of a recording.
+type recordingTrack struct {
+	streamType byte
+	clock      int64
+	params     [][]byte // video parameter sets from the first keyframe
+	asc        []byte   // AAC AudioSpecificConfig
+	channels   int
+}
+
+func (t *recordingTrack) audio() bool { return t.streamType == tsStreamTypeAAC }
+func (t *recordingTrack) hevc() bool  { return t.streamType == tsStreamTypeH265 }
+
+// recording is the segment catalog of a recording directory; npt 0 is the
+// start of its first segment.
+type recording struct {
+	dir      string
+	segments []recordedSegment
+	start    time.Time
+	end      time.Time
+	tracks   []*recordingTrack // video first
+}
+
+// playbackSample is a demuxed sample placed on the wall-clock timeline.
+type playbackSample struct {
+	at       time.Time
+	track    int
+	keyframe bool
+	data     []byte
+}
+
+// playbackCursor is a position in a loaded segment.
+type playbackCursor struct {
+	segment time.Time // start of the segment
+	samples []playbackSample
+	index   int
+}
+
+// openRecording lists the segments of dir and probes the first one for its
+// tracks.
+func openRecording(dir string) (*recording, error) {
+	rec := &recording{dir: dir}
+	if !rec.refresh() {
+		return nil, fmt.Errorf("no recordings in %s", dir)
+	}
+	rec.start = rec.segments[0].start
+	data, err := os.ReadFile(rec.segments[0].path)
+	if err != nil {
+		return nil, err
+	}
+	samples, err := demuxTS(data)
+	if err != nil {
+		return nil, err
+	}
+	var video, audio *recordingTrack
+	for _, s := range samples {
+		switch {
+		case s.streamType == tsStreamTypeAAC && audio == nil:
+			if _, asc := adtsFrames(s.data); asc != nil {
+				freqIndex := int(asc[0]&0x07)<<1 | int(asc[1]>>7)
+				if freqIndex >= len(aacSampleRates) {
+					continue
+				}
+				audio = &recordingTrack{streamType: s.streamType, asc: asc, clock: aacSampleRates[freqIndex], channels: int(asc[1]>>3) & 0x0f}
+			}
+		case s.streamType != tsStreamTypeAAC && video == nil && s.keyframe:
+			video = &recordingTrack{streamType: s.streamType, clock: 90000}
+			for _, nalu := range splitAnnexB(s.data) {
+				if isParameterSetNALU(video.hevc(), nalu) {
+					video.params = append(video.params, nalu)
+				}
+			}
+		}
+	}
+	for _, track := range []*recordingTrack{video, audio} {
+		if track != nil {
+			rec.tracks = append(rec.tracks, track)
+		}
+	}
+	if len(rec.tracks) == 0 {
+		return nil, fmt.Errorf("%s: no H.264/H.265/AAC track", rec.segments[0].path)
+	}
+	return rec, nil
+}
+
+// refresh picks up segments written or deleted since the last listing.
+func (rec *recording) refresh() bool {
+	segments := listRecordedSegments(rec.dir)
+	if len(segments) == 0 {
+		return false
+	}
+	rec.segments = segments
+	rec.end = segments[len(segments)-1].mtime
+	return true
+}
+
+func (rec *recording) trackIndex(streamType byte) int {
+	for i, track := range rec.tracks {
+		if track.streamType == streamType {
+			return i
+		}
+	}
+	return -1
+}
+
+// load demuxes a segment. Sample times are the segment start plus the PTS
+// distance from its first sample.
+func (rec *recording) load(seg recordedSegment) []playbackSample {
+	data, err := os.ReadFile(seg.path)
+	if err != nil {
+		Logf("▶️ [PLAYBACK] %v", err)
+		return nil
+	}
+	samples, err := demuxTS(data)
+	if err != nil {
+		Logf("▶️ [PLAYBACK] %s: %v", seg.path, err)
+		return nil
+	}
+	out := make([]playbackSample, 0, len(samples))
+	base := int64(-1)
+	for _, s := range samples {
+		track := rec.trackIndex(s.streamType)
+		if track < 0 {
+			continue
+		}
+		if base < 0 {
+			base = s.pts
+		}
+		at := seg.start.Add(time.Duration((s.pts - base) * int64(time.Second) / 90000))
+		out = append(out, playbackSample{at: at, track: track, keyframe: s.keyframe, data: s.data})
+	}
+	return out
+}
+
+// seek returns where playback of target starts: the last video keyframe at
+// or before it (the first audio sample at or after it without video), or
+// the start of the next segment when target falls between segments.
+func (rec *recording) seek(target time.Time) (playbackCursor, bool) {
+	first := 0
+	for i, seg := range rec.segments {
+		if !seg.start.After(target) {
+			first = i
+		}
+	}
+	video := !rec.tracks[0].audio()
+	for _, seg := range rec.segments[first:] {
+		samples := rec.load(seg)
+		index := -1
+		for i, s := range samples {
+			if video {
+				if s.track == 0 && s.keyframe && (index < 0 || !s.at.After(target)) {
+					index = i
+				}
+			} else if index < 0 && !s.at.Before(target) {
+				index = i
+			}
+		}
+		if index >= 0 && !samples[len(samples)-1].at.Before(target) {
+			return playbackCursor{segment: seg.start, samples: samples, index: index}, true
+		}
+		target = seg.start // only reached for the segment after target
+	}
+	return playbackCursor{}, false
+}
+
+// next loads the segment after the cursor's.
+func (rec *recording) next(cursor playbackCursor) (playbackCursor, bool) {
+	rec.refresh()
+	for _, seg := range rec.segments {
+		if seg.start.After(cursor.segment) {
+			return playbackCursor{segment: seg.start, samples: rec.load(seg)}, true
+		}
+	}
+	return playbackCursor{}, false
+}
+
+// npt returns the normal play time of a wall-clock instant.
+func (rec *recording) npt(at time.Time) float64 {
+	return max(at.Sub(rec.start).Seconds(), 0)
+}
+
+// sdp describes the recording; track i has control "trackID=i" and payload
+// type 96+i.
+func (rec *recording) sdp(proxyIP string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "v=0\r\no=- %d 1 IN IP4 %s\r\ns=Recording\r\nc=IN IP4 0.0.0.0\r\nt=0 0\r\n", rec.start.Unix(), proxyIP)
+	fmt.Fprintf(&b, "a=control:*\r\na=range:npt=0-%.3f\r\n", rec.npt(rec.end))
+	for i, track := range rec.tracks {
+		pt := 96 + i
+		switch track.streamType {
+		case tsStreamTypeAAC:
+			fmt.Fprintf(&b, "m=audio 0 RTP/AVP %d\r\na=rtpmap:%d MPEG4-GENERIC/%d/%d\r\n", pt, pt, track.clock, track.channels)
+			fmt.Fprintf(&b, "a=fmtp:%d streamtype=5;profile-level-id=15;mode=AAC-hbr;config=%s;sizelength=13;indexlength=3;indexdeltalength=3\r\n", pt, hex.EncodeToString(track.asc))
+		case tsStreamTypeH265:
+			fmt.Fprintf(&b, "m=video 0 RTP/AVP %d\r\na=rtpmap:%d H265/90000\r\n", pt, pt)
+			var fmtp []string
+			for _, ps := range track.params {
+				key := map[int]string{32: "sprop-vps", 33: "sprop-sps", 34: "sprop-pps"}[naluType(true, ps)]
+				fmtp = append(fmtp, key+"="+base64.StdEncoding.EncodeToString(ps))
+			}
+			if len(fmtp) > 0 {
+				fmt.Fprintf(&b, "a=fmtp:%d %s\r\n", pt, strings.Join(fmtp, ";"))
+			}
+		default:
+			fmt.Fprintf(&b, "m=video 0 RTP/AVP %d\r\na=rtpmap:%d H264/90000\r\n", pt, pt)
+			fmtp := "packetization-mode=1"
+			var sets []string
+			for _, ps := range track.params {
+				if naluType(false, ps) == 7 && len(ps) >= 4 {
+					fmtp += fmt.Sprintf(";profile-level-id=%02X%02X%02X", ps[1], ps[2], ps[3])
+				}
+				sets = append(sets, base64.StdEncoding.EncodeToString(ps))
+			}
+			if len(sets) > 0 {
+				fmtp += ";sprop-parameter-sets=" + strings.Join(sets, ",")
+			}
+			fmt.Fprintf(&b, "a=fmtp:%d %s\r\n", pt, fmtp)
+		}
+		fmt.Fprintf(&b, "a=control:trackID=%d\r\n", i)
+	}
+	return b.String()
+}
+
+// parsePlaybackRange parses "npt=<start>-[<end>]" (seconds or h:mm:ss) or
+// "clock=<start>-[<end>]" (RFC 2326 absolute time). An omitted start is
+// the zero Time; npt is relative to origin.
+func parsePlaybackRange(value string, origin time.Time) (start, end time.Time, clock bool, err error) {
+	spec, _, _ := strings.Cut(value, ";")
+	unit, times, ok := strings.Cut(strings.TrimSpace(spec), "=")
+	from, to, dash := strings.Cut(times, "-")
+	if !ok || !dash {
+		return start, end, false, fmt.Errorf("invalid range %q", value)
+	}
+	var parse func(string) (time.Time, error)
+	switch strings.ToLower(unit) {
+	case "npt":
+		parse = func(s string) (time.Time, error) {
+			d, err := parseNPT(s)
+			return origin.Add(d), err
+		}
+	case "clock":
+		clock = true
+		parse = func(s string) (time.Time, error) {
+			t, err := time.Parse("20060102T150405Z", s)
+			if err != nil {
+				t, err = time.Parse("20060102T150405.999999999Z", s)
+			}
+			return t, err
+		}
+	default:
+		return start, end, false, fmt.Errorf("unsupported range unit %q", unit)
+	}
+	if from = strings.TrimSpace(from); from != "" {
+		if start, err = parse(from); err != nil {
+			return start, end, clock, err
+		}
+	}
+	if to = strings.TrimSpace(to); to != "" {
+		if end, err = parse(to); err != nil {
+			return start, end, clock, err
+		}
+		if !start.IsZero() && !end.After(start) {
+			return start, end, clock, fmt.Errorf("empty range %q", value)
+		}
+	}
+	return start, end, clock, nil
+}
+
+// parseNPT parses an npt time: seconds ("12.5") or "h:mm:ss[.frac]". "now"
+// has no meaning for a recording.
+func parseNPT(s string) (time.Duration, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) != 1 && len(fields) != 3 {
+		return 0, fmt.Errorf("invalid npt %q", s)
+	}
+	seconds, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid npt %q", s)
+	}
+	if len(fields) == 3 {
+		hours, err1 := strconv.Atoi(fields[0])
+		minutes, err2 := strconv.Atoi(fields[1])
+		if err1 != nil || err2 != nil || hours < 0 || minutes < 0 || minutes > 59 {
+			return 0, fmt.Errorf("invalid npt %q", s)
+		}
+		seconds += float64(hours*3600 + minutes*60)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// playbackSession is the playback state of one RTSP session.
+type playbackSession struct {
+	id          string
+	client      *Client
+	rec         *recording
+	channels    map[int]int // track -> client RTP channel
+	packetizers []*rtpPacketizer
+	offsets     []uint32 // random initial RTP timestamps
+
+	// Written by the reader before it closes done; read by request
+	// handlers only after stop.
+	cursor   *playbackCursor // resume point after PAUSE, nil to start over
+	position time.Time       // next sample time, for Range replies
+	end      time.Time       // Range end of the current PLAY, zero for none
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+func newPlaybackSession(client *Client, rec *recording) (*playbackSession, error) {
+	raw := make([]byte, 8+8*len(rec.tracks))
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	ps := &playbackSession{
+		id:       strings.ToUpper(hex.EncodeToString(raw[:8])),
+		client:   client,
+		rec:      rec,
+		channels: make(map[int]int),
+		position: rec.start,
+	}
+	for i := range rec.tracks {
+		r := raw[8+8*i:]
+		ps.packetizers = append(ps.packetizers, &rtpPacketizer{
+			payloadType: uint8(96 + i),
+			ssrc:        binary.BigEndian.Uint32(r),
+			seq:         binary.BigEndian.Uint16(r[4:]),
+			mtu:         playbackMTU,
+		})
+		ps.offsets = append(ps.offsets, binary.BigEndian.Uint32(r[4:])>>16|uint32(r[6])<<16|uint32(r[7])<<24)
+	}
+	return ps, nil
+}
+
+// rtpTime is the RTP timestamp of a track at a wall-clock instant.
+func (ps *playbackSession) rtpTime(track int, at time.Time) uint32 {
+	d := at.Sub(ps.rec.start)
+	clock := ps.rec.tracks[track].clock
+	ticks := int64(d/time.Second)*clock + int64(d%time.Second)*clock/int64(time.Second)
+	return ps.offsets[track] + uint32(ticks)
+}
+
+// play starts the reader at cursor. The caller has stopped the previous one.
+func (ps *playbackSession) play(cursor playbackCursor, scale float64) {
+	ctx, cancel := context.WithCancel(ps.client.server.ctx)
+	ps.cancel, ps.done = cancel, make(chan struct{})
+	go ps.run(ctx, cursor, scale)
+}
+
+// stop halts the reader, keeping its position.
+func (ps *playbackSession) stop() {
+	if ps.cancel == nil {
+		return
+	}
+	ps.cancel()
+	<-ps.done
+	ps.cancel = nil
+}
+
+// wanted filters samples for fast playback: audio is dropped off normal
+// speed, and only keyframes are sent from 4x on.
+func (ps *playbackSession) wanted(s playbackSample, scale float64) bool {
+	if _, ok := ps.channels[s.track]; !ok {
+		return false
+	}
+	if scale == 1 {
+		return true
+	}
+	if ps.rec.tracks[s.track].audio() {
+		return len(ps.rec.tracks) == 1
+	}
+	return scale < 4 || s.keyframe
+}
+
+func (ps *playbackSession) run(ctx context.Context, cursor playbackCursor, scale float64) {
+	defer close(ps.done)
+	pause := func() {
+		ps.cursor = &cursor
+		if cursor.index < len(cursor.samples) {
+			ps.position = cursor.samples[cursor.index].at
+		}
+	}
+
+	wallStart := time.Now()
+	mediaStart := cursor.samples[cursor.index].at
+	last := mediaStart
+	for {
+		for ; cursor.index < len(cursor.samples); cursor.index++ {
+			s := cursor.samples[cursor.index]
+			if !ps.end.IsZero() && s.at.After(ps.end) {
+				ps.cursor, ps.position = nil, ps.end
+				return
+			}
+			if !ps.wanted(s, scale) {
+				continue
+			}
+			if gap := s.at.Sub(last); gap > playbackMaxGap || gap < -playbackMaxGap {
+				wallStart, mediaStart = time.Now(), s.at
+			}
+			last = s.at
+			if wait := time.Duration(float64(s.at.Sub(mediaStart))/scale) - time.Since(wallStart); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					pause()
+					return
+				case <-timer.C:
+				}
+			}
+			if !ps.send(ctx, s) {
+				cursor.index++ // the sample was partly sent
+				pause()
+				return
+			}
+		}
+		next, ok := ps.rec.next(cursor)
+		if !ok {
+			Logf("▶️ [PLAYBACK] Session %s reached the end of %s", ps.id, ps.rec.dir)
+			ps.cursor, ps.position = nil, last
+			return
+		}
+		cursor = next
+	}
+}
+
+// send packetizes a sample onto the client's interleaved channel.
+func (ps *playbackSession) send(ctx context.Context, s playbackSample) bool {
+	track := ps.rec.tracks[s.track]
+	packetizer := ps.packetizers[s.track]
+	ts := ps.rtpTime(s.track, s.at)
+	var packets [][]byte
+	if track.audio() {
+		frames, _ := adtsFrames(s.data)
+		for i, frame := range frames {
+			packets = append(packets, packetizer.aac(ts+uint32(i*1024), frame)...)
+		}
+	} else {
+		hevc := track.hevc()
+		var nalus [][]byte
+		for _, nalu := range splitAnnexB(s.data) {
+			if typ := naluType(hevc, nalu); (!hevc && typ == 9) || (hevc && typ == 35) {
+				continue // access unit delimiter
+			}
+			nalus = append(nalus, nalu)
+		}
+		packets = packetizer.video(hevc, ts, nalus)
+	}
+
+	channel := ps.channels[s.track]
+	for _, packet := range packets {
+		frame := append([]byte{'$', byte(channel), byte(len(packet) >> 8), byte(len(packet))}, packet...)
+		select {
+		case ps.client.writeChan <- frame:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// recordingDir returns the recording directory of a stream listed in
+// GlobalConfig.RecordStreams. Playback requires the recorded credentials.
+func recordingDir(scheme, host, username, password, streamPath string) (string, error) {
+	for _, spec := range GlobalConfig.RecordStreams {
+		s, h, u, p, sp, template, err := parseRecordSpec(spec)
+		if err != nil || s != scheme || !strings.EqualFold(h, host) || sp != streamPath {
+			continue
+		}
+		if u != username || p != password {
+			return "", errPlaybackUnauthorized
+		}
+		return expandRecordDir(template, s, h, sp), nil
+	}
+	return "", errPlaybackNotRecorded
+}
+
+var (
+	errPlaybackUnauthorized = errors.New("wrong credentials for recording")
+	errPlaybackNotRecorded  = errors.New("stream is not recorded")
+)
+
+// handlePlayback answers the requests of a client on a /playback/ URL.
+func (client *Client) handlePlayback(request *Request) *Response {
+	switch request.Method {
+	case "OPTIONS":
+		response, _ := NewResponse(200, "OK")
+		response.Headers["Public"] = "OPTIONS, DESCRIBE, SETUP, PLAY, PAUSE, TEARDOWN, GET_PARAMETER"
+		return response
+	case "DESCRIBE":
+		return client.handlePlaybackDescribe(request)
+	case "SETUP":
+		return client.handlePlaybackSetup(request)
+	case "PLAY":
+		return client.handlePlaybackPlay(request)
+	case "PAUSE":
+		return client.handlePlaybackPause(request)
+	case "TEARDOWN":
+		if client.playbackSession != nil {
+			client.playbackSession.stop()
+			client.playbackSession = nil
+		}
+		response, _ := NewResponse(200, "OK")
+		response.Headers["Session"] = headerGet(request.Headers, "Session")
+		return response
+	case "GET_PARAMETER":
+		response, _ := NewResponse(200, "OK")
+		response.Headers["Session"] = headerGet(request.Headers, "Session")
+		return response
+	}
+	return client.responseBadRequest(request)
+}
+
+// playbackBase is the Content-Base of the recording, with a trailing slash
+// for the relative track controls.
+func (client *Client) playbackBase() string {
+	return fmt.Sprintf("%s://%s/%s/%s/%s%s/", client.urlScheme(), net.JoinHostPort(client.localAddr, client.localPort),
+		playbackPrefix, client.scheme, client.host, strings.TrimSuffix(client.basePath, "/"))
+}
+
+func (client *Client) handlePlaybackDescribe(request *Request) *Response {
+	rec, err := openRecording(client.playbackDir)
+	if err != nil {
+		LogCriticalf("❌ [PLAYBACK] %v", err)
+		return client.responseNotFound(request)
+	}
+	client.recording = rec
+
+	body := rec.sdp(client.localAddr)
+	response, _ := NewResponse(200, "OK")
+	response.Headers["Content-Type"] = "application/sdp"
+	response.Headers["Content-Base"] = client.playbackBase()
+	response.Headers["Content-Length"] = strconv.Itoa(len(body))
+	response.Body = body
+	return response
+}
+
+func (client *Client) handlePlaybackSetup(request *Request) *Response {
+	if client.recording == nil {
+		rec, err := openRecording(client.playbackDir)
+		if err != nil {
+			LogCriticalf("❌ [PLAYBACK] %v", err)
+			return client.responseNotFound(request)
+		}
+		client.recording = rec
+	}
+	ps := client.playbackSession
+	rec := client.recording
+	if ps != nil {
+		rec = ps.rec
+	}
+
+	_, control := path.Split(request.GetURL().Path)
+	id, found := strings.CutPrefix(control, "trackID=")
+	track, err := strconv.Atoi(id)
+	if !found || err != nil || track < 0 || track >= len(rec.tracks) {
+		return client.responseNotFound(request)
+	}
+
+	transport := client.getHeader(request, "Transport")
+	protocol, _, params := (*Remote)(nil).parseTransport(transport)
+	if !strings.EqualFold(protocol, "RTP/AVP/TCP") {
+		LogCriticalf("⚠️ [PLAYBACK] Only interleaved RTP is served for recordings: %s", transport)
+		return client.responseUnsupportedTransport(request)
+	}
+	channel := 2 * track
+	if interleaved := params["interleaved"]; interleaved != "" {
+		first, _, _ := strings.Cut(interleaved, "-")
+		if channel, err = strconv.Atoi(first); err != nil || channel < 0 || channel > 254 {
+			return client.responseBadRequest(request)
+		}
+	}
+
+	if ps == nil {
+		if ps, err = newPlaybackSession(client, rec); err != nil {
+			LogCriticalf("❌ [PLAYBACK] %v", err)
+			return client.responseBadRequest(request)
+		}
+		client.playbackSession = ps
+	}
+	ps.channels[track] = channel
+
+	response, _ := NewResponse(200, "OK")
+	response.Headers["Transport"] = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d;ssrc=%08X", channel, channel+1, ps.packetizers[track].ssrc)
+	response.Headers["Session"] = ps.id + ";timeout=60"
+	response.Headers["Cache-Control"] = "must-revalidate"
+	return response
+}
+
+func (client *Client) handlePlaybackPlay(request *Request) *Response {
+	ps := client.playbackSession
+	if ps == nil {
+		response, _ := NewResponse(454, "Session Not Found")
+		return response
+	}
+
+	scale := 1.0
+	if v := client.getHeader(request, "Scale"); v != "" {
+		var err error
+		if scale, err = strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil || scale <= 0 {
+			LogCriticalf("⚠️ [PLAYBACK] Unsupported Scale %q", v)
+			response, _ := NewResponse(456, "Header Field Not Valid for Resource")
+			return response
+		}
+		scale = min(scale, playbackMaxScale)
+	}
+
+	ps.stop()
+	rangeHeader := client.getHeader(request, "Range")
+	var cursor playbackCursor
+	ok, clock := false, false
+	switch {
+	case rangeHeader != "":
+		var start, end time.Time
+		var err error
+		if start, end, clock, err = parsePlaybackRange(rangeHeader, ps.rec.start); err != nil {
+			LogCriticalf("⚠️ [PLAYBACK] %v", err)
+			response, _ := NewResponse(457, "Invalid Range")
+			return response
+		}
+		if start.IsZero() {
+			start = ps.rec.start
+		}
+		ps.rec.refresh()
+		cursor, ok = ps.rec.seek(start)
+		ps.end = end
+	case ps.cursor != nil && ps.cursor.index < len(ps.cursor.samples):
+		cursor, ok = *ps.cursor, true // resume after PAUSE
+	default:
+		ps.rec.refresh()
+		cursor, ok = ps.rec.seek(ps.position)
+	}
+	if !ok {
+		response, _ := NewResponse(457, "Invalid Range")
+		return response
+	}
+
+	start := cursor.samples[cursor.index].at
+	response, _ := NewResponse(200, "OK")
+	response.Headers["Session"] = ps.id
+	response.Headers["Scale"] = strconv.FormatFloat(scale, 'f', -1, 64)
+	if clock {
+		end := ""
+		if !ps.end.IsZero() {
+			end = ps.end.UTC().Format(recordTimeFormat)
+		}
+		response.Headers["Range"] = fmt.Sprintf("clock=%s-%s", start.UTC().Format(recordTimeFormat), end)
+	} else {
+		end := ""
+		if !ps.end.IsZero() {
+			end = fmt.Sprintf("%.3f", ps.rec.npt(ps.end))
+		}
+		response.Headers["Range"] = fmt.Sprintf("npt=%.3f-%s", ps.rec.npt(start), end)
+	}
+	var info []string
+	for track := range ps.rec.tracks {
+		if _, ok := ps.channels[track]; ok {
+			info = append(info, fmt.Sprintf("url=%strackID=%d;seq=%d;rtptime=%d", client.playbackBase(), track, ps.packetizers[track].seq, ps.rtpTime(track, start)))
+		}
+	}
+	response.Headers["RTP-Info"] = strings.Join(info, ",")
+
+	LogCriticalf("▶️ [PLAYBACK] Session %s playing %s from %s at %gx", ps.id, ps.rec.dir, start.UTC().Format(time.RFC3339), scale)
+	// Packets must not overtake the PLAY response.
+	client.afterResponse = func() { ps.play(cursor, scale) }
+	return response
+}
+
+func (client *Client) handlePlaybackPause(request *Request) *Response {
+	ps := client.playbackSession
+	if ps == nil {
+		response, _ := NewResponse(454, "Session Not Found")
+		return response
+	}
+	ps.stop()
+	response, _ := NewResponse(200, "OK")
+	response.Headers["Session"] = ps.id
+	response.Headers["Range"] = fmt.Sprintf("npt=%.3f-", ps.rec.npt(ps.position))
+	return response
+}
@@ -0,0 +1,319 @@
+package rtspproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPacketizerRoundTrip(t *testing.T) {
+	idr := append([]byte{0x65}, bytes.Repeat([]byte{0xab}, 3000)...)
+	p := &rtpPacketizer{payloadType: 96, ssrc: 0x01020304, seq: 65534, mtu: 1400}
+	packets := p.video(false, 9000, [][]byte{testSPS, testPPS, idr})
+	if len(packets) != 5 || p.seq != 3 {
+		t.Fatalf("%d packets, next seq %d", len(packets), p.seq)
+	}
+
+	var aus []*accessUnit
+	d := newVideoDepacketizer("H264", func(au *accessUnit) { aus = append(aus, au) })
+	for i, b := range packets {
+		pkt, err := parseRTP(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkt.Marker != (i == len(packets)-1) || pkt.SSRC != 0x01020304 || pkt.Timestamp != 9000 {
+			t.Errorf("packet %d: marker %v ssrc %x ts %d", i, pkt.Marker, pkt.SSRC, pkt.Timestamp)
+		}
+		d.push(pkt)
+	}
+	if len(aus) != 1 || !aus[0].Keyframe || len(aus[0].NALUs) != 3 || !bytes.Equal(aus[0].NALUs[2], idr) {
+		t.Fatalf("access unit not restored")
+	}
+
+	media := &sdpMedia{Codec: "MPEG4-GENERIC", ClockRate: 44100, Fmtp: map[string]string{"sizelength": "13", "indexlength": "3", "indexdeltalength": "3"}}
+	var frames []*accessUnit
+	a := newAACDepacketizer(media, func(au *accessUnit) { frames = append(frames, au) })
+	for _, b := range p.aac(1024, []byte{1, 2, 3, 4}) {
+		pkt, _ := parseRTP(b)
+		a.push(pkt)
+	}
+	if len(frames) != 1 || !bytes.Equal(frames[0].Data, []byte{1, 2, 3, 4}) {
+		t.Errorf("AAC frame not restored: %+v", frames)
+	}
+}
+
+func TestParsePlaybackRange(t *testing.T) {
+	origin := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value      string
+		start, end time.Time
+		clock      bool
+	}{
+		{"npt=0-", origin, time.Time{}, false},
+		{"npt=12.5-", origin.Add(12500 * time.Millisecond), time.Time{}, false},
+		{"npt=0:01:02.5-0:02:00", origin.Add(62500 * time.Millisecond), origin.Add(2 * time.Minute), false},
+		{"npt=-30", time.Time{}, origin.Add(30 * time.Second), false},
+		{"clock=20261018T120010Z-;time=20261018T120000Z", origin.Add(10 * time.Second), time.Time{}, true},
+		{"clock=20261018T120010.25Z-20261018T120100Z", origin.Add(10250 * time.Millisecond), origin.Add(time.Minute), true},
+	}
+	for _, tt := range tests {
+		start, end, clock, err := parsePlaybackRange(tt.value, origin)
+		if err != nil || !start.Equal(tt.start) || !end.Equal(tt.end) || clock != tt.clock {
+			t.Errorf("%s: %v %v %v %v", tt.value, start, end, clock, err)
+		}
+	}
+	for _, bad := range []string{"npt=now-", "npt=5-2", "npt=1:99:00-", "smpte=0:00:10-", "npt=abc-", "clock=yesterday-"} {
+		if _, _, _, err := parsePlaybackRange(bad, origin); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
+
+// rtspConn is a minimal interleaved RTSP client for playback tests.
+type rtspConn struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	cseq   int
+	frames [][]byte // interleaved frames read while waiting for a reply
+}
+
+func dialRTSP(t *testing.T, addr string) *rtspConn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &rtspConn{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// frame reads the next interleaved frame.
+func (c *rtspConn) frame(timeout time.Duration) ([]byte, error) {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return nil, err
+	}
+	if header[0] != '$' {
+		c.t.Fatalf("expected interleaved data, got %q", header)
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	_, err := io.ReadFull(c.reader, data)
+	return append(header[:2], data...), err
+}
+
+// do sends a request and returns the status line and headers of the reply,
+// collecting interleaved frames that arrive before it.
+func (c *rtspConn) do(method, url, headers string) (string, map[string]string, string) {
+	c.t.Helper()
+	c.cseq++
+	fmt.Fprintf(c.conn, "%s %s RTSP/1.0\r\nCSeq: %d\r\n%s\r\n", method, url, c.cseq, headers)
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if b, err := c.reader.Peek(1); err == nil && b[0] == '$' {
+			frame, err := c.frame(5 * time.Second)
+			if err != nil {
+				c.t.Fatal(err)
+			}
+			c.frames = append(c.frames, frame)
+			continue
+		}
+		var reply strings.Builder
+		for {
+			line, err := c.reader.ReadString('\n')
+			if err != nil {
+				c.t.Fatalf("%s: %v", method, err)
+			}
+			reply.WriteString(line)
+			if line == "\r\n" {
+				break
+			}
+		}
+		parsed := parseMockHeaders(reply.String())
+		var body []byte
+		if length := headerGet(parsed, "Content-Length"); length != "" {
+			var n int
+			fmt.Sscan(length, &n)
+			body = make([]byte, n)
+			io.ReadFull(c.reader, body)
+		}
+		status, _, _ := strings.Cut(reply.String(), "\r\n")
+		if headerGet(parsed, "CSeq") != fmt.Sprint(c.cseq) {
+			c.t.Fatalf("%s: reply for CSeq %s", method, headerGet(parsed, "CSeq"))
+		}
+		return status, parsed, string(body)
+	}
+}
+
+// rtpInfoSeq returns seq and rtptime of trackID=0 in an RTP-Info header.
+func rtpInfoSeq(t *testing.T, info string) (uint16, uint32) {
+	t.Helper()
+	for _, entry := range strings.Split(info, ",") {
+		var seq uint16
+		var rtptime uint32
+		if strings.Contains(entry, "trackID=0;") {
+			_, err := fmt.Sscanf(entry[strings.Index(entry, ";seq="):], ";seq=%d;rtptime=%d", &seq, &rtptime)
+			if err != nil {
+				t.Fatalf("RTP-Info %q: %v", info, err)
+			}
+			return seq, rtptime
+		}
+	}
+	t.Fatalf("RTP-Info %q has no trackID=0", info)
+	return 0, 0
+}
+
+func TestPlayback(t *testing.T) {
+	cam := startH264Camera(t)
+	dir := t.TempDir()
+
+	oldStreams, oldDir, oldDuration := GlobalConfig.RecordStreams, GlobalConfig.RecordDir, GlobalConfig.RecordSegmentDuration
+	t.Cleanup(func() {
+		GlobalConfig.RecordStreams, GlobalConfig.RecordDir, GlobalConfig.RecordSegmentDuration = oldStreams, oldDir, oldDuration
+	})
+	GlobalConfig.RecordStreams = []string{"rtsp/" + cam.Addr() + "/mock"}
+	GlobalConfig.RecordDir = filepath.Join(dir, "{path}")
+	GlobalConfig.RecordSegmentDuration = 300 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	recorder := NewServer(ctx)
+	if err := recorder.StartRecording(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(listRecordedSegments(filepath.Join(dir, "mock"))) < 5 {
+		if time.Now().After(deadline) {
+			t.Fatal("not enough segments recorded")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	cancel()
+	recorder.stopRecording()
+
+	_, addr := startTunnelServer(t)
+	base := fmt.Sprintf("rtsp://%s/playback/rtsp/%s/mock", addr, cam.Addr())
+	c := dialRTSP(t, addr)
+
+	status, headers, sdp := c.do("DESCRIBE", base, "Accept: application/sdp\r\n")
+	if !strings.HasPrefix(status, "RTSP/1.0 200") || headerGet(headers, "Content-Base") != base+"/" {
+		t.Fatalf("DESCRIBE: %s %v", status, headers)
+	}
+	for _, want := range []string{"H264/90000", "sprop-parameter-sets=", "MPEG4-GENERIC/44100/2", "config=1210", "a=range:npt=0-", "a=control:trackID=1"} {
+		if !strings.Contains(sdp, want) {
+			t.Errorf("SDP lacks %q:\n%s", want, sdp)
+		}
+	}
+
+	if status, _, _ := c.do("SETUP", base+"/trackID=0", "Transport: RTP/AVP;unicast;client_port=5000-5001\r\n"); !strings.HasPrefix(status, "RTSP/1.0 461") {
+		t.Errorf("UDP SETUP: %s", status)
+	}
+	if status, _, _ := c.do("PLAY", base, ""); !strings.HasPrefix(status, "RTSP/1.0 454") {
+		t.Errorf("PLAY without SETUP: %s", status)
+	}
+	_, headers, _ = c.do("SETUP", base+"/trackID=0", "Transport: RTP/AVP/TCP;unicast;interleaved=0-1\r\n")
+	session, _, _ := strings.Cut(headerGet(headers, "Session"), ";")
+	if session == "" || !strings.Contains(headerGet(headers, "Transport"), "ssrc=") {
+		t.Fatalf("SETUP: %v", headers)
+	}
+	c.do("SETUP", base+"/trackID=1", fmt.Sprintf("Transport: RTP/AVP/TCP;unicast;interleaved=2-3\r\nSession: %s\r\n", session))
+
+	// Seek to 0.5s at double speed: playback starts at the preceding
+	// keyframe (one every 0.2s), without audio.
+	status, headers, _ = c.do("PLAY", base, fmt.Sprintf("Session: %s\r\nRange: npt=0.5-\r\nScale: 2\r\n", session))
+	if !strings.HasPrefix(status, "RTSP/1.0 200") || headerGet(headers, "Scale") != "2" {
+		t.Fatalf("PLAY: %s %v", status, headers)
+	}
+	var npt float64
+	if _, err := fmt.Sscanf(headerGet(headers, "Range"), "npt=%f-", &npt); err != nil || npt > 0.5 || npt < 0.25 {
+		t.Errorf("PLAY Range %q", headerGet(headers, "Range"))
+	}
+	seq, rtptime := rtpInfoSeq(t, headerGet(headers, "RTP-Info"))
+	first, err := c.frame(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt, _ := parseRTP(first[2:])
+	if first[1] != 0 || pkt.Seq != seq || pkt.Timestamp != rtptime {
+		t.Errorf("first packet channel %d seq %d ts %d, RTP-Info seq %d rtptime %d", first[1], pkt.Seq, pkt.Timestamp, seq, rtptime)
+	}
+	if nalu := pkt.Payload[0] & 0x1f; nalu != 7 && nalu != 5 && nalu != 28 {
+		t.Errorf("playback does not start at a keyframe (NAL type %d)", nalu)
+	}
+	last := pkt.Seq
+	for i := 0; i < 10; i++ {
+		frame, err := c.frame(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame[1] != 0 {
+			t.Fatalf("channel %d data during fast playback", frame[1])
+		}
+		pkt, _ := parseRTP(frame[2:])
+		if pkt.Seq != last+1 {
+			t.Errorf("seq %d after %d", pkt.Seq, last)
+		}
+		last = pkt.Seq
+	}
+
+	// PAUSE stops the packets; PLAY resumes where it stopped.
+	status, headers, _ = c.do("PAUSE", base, "Session: "+session+"\r\n")
+	if !strings.HasPrefix(status, "RTSP/1.0 200") || !strings.HasPrefix(headerGet(headers, "Range"), "npt=") {
+		t.Fatalf("PAUSE: %s %v", status, headers)
+	}
+	for _, frame := range c.frames {
+		pkt, _ := parseRTP(frame[2:])
+		last = pkt.Seq
+	}
+	if _, err := c.frame(300 * time.Millisecond); err == nil {
+		t.Fatal("packets after PAUSE")
+	}
+	var paused float64
+	fmt.Sscanf(headerGet(headers, "Range"), "npt=%f-", &paused)
+	_, headers, _ = c.do("PLAY", base, "Session: "+session+"\r\n")
+	var resumed float64
+	fmt.Sscanf(headerGet(headers, "Range"), "npt=%f-", &resumed)
+	if resumed != paused {
+		t.Errorf("resumed at %v, paused at %v", resumed, paused)
+	}
+	if seq, _ := rtpInfoSeq(t, headerGet(headers, "RTP-Info")); seq != last+1 {
+		t.Errorf("resumed with seq %d after %d", seq, last)
+	}
+	for audio := false; !audio; {
+		frame, err := c.frame(time.Second)
+		if err != nil {
+			t.Fatal("no audio at normal speed")
+		}
+		audio = frame[1] == 2
+	}
+
+	// Absolute seeking answers in clock units.
+	start := listRecordedSegments(filepath.Join(dir, "mock"))[1].start.Add(50 * time.Millisecond)
+	status, headers, _ = c.do("PLAY", base, fmt.Sprintf("Session: %s\r\nRange: clock=%s-\r\n", session, start.UTC().Format("20060102T150405.000Z")))
+	if !strings.HasPrefix(status, "RTSP/1.0 200") || !strings.HasPrefix(headerGet(headers, "Range"), "clock=") {
+		t.Errorf("clock PLAY: %s %v", status, headers)
+	}
+	if status, _, _ := c.do("PLAY", base, "Session: "+session+"\r\nRange: npt=3600-\r\n"); !strings.HasPrefix(status, "RTSP/1.0 457") {
+		t.Errorf("PLAY past the end: %s", status)
+	}
+	if status, _, _ := c.do("TEARDOWN", base, "Session: "+session+"\r\n"); !strings.HasPrefix(status, "RTSP/1.0 200") {
+		t.Errorf("TEARDOWN: %s", status)
+	}
+
+	// Only recorded streams, with their credentials, can be played back.
+	other := dialRTSP(t, addr)
+	if status, _, _ := other.do("DESCRIBE", fmt.Sprintf("rtsp://%s/playback/rtsp/%s/other", addr, cam.Addr()), ""); !strings.HasPrefix(status, "RTSP/1.0 404") {
+		t.Errorf("unrecorded stream: %s", status)
+	}
+	other = dialRTSP(t, addr)
+	if status, _, _ := other.do("DESCRIBE", fmt.Sprintf("rtsp://%s/playback/rtsp/admin:x@%s/mock", addr, cam.Addr()), ""); !strings.HasPrefix(status, "RTSP/1.0 401") {
+		t.Errorf("wrong credentials: %s", status)
+	}
+}
@@ -0,0 +1,228 @@
+package rtspproxy
+
+import (
+	"context"
+	"maps"
+	"sync"
+	"time"
+)
+
+// Pre-event buffering. With GlobalConfig.PreEventBuffer set, every Stream
+// keeps the RTP packets of its last N seconds in memory while it is
+// connected, so an alarm can export footage from before the event (see
+// clip.go). Trimming keeps the buffer starting at a video keyframe: it
+// always covers at least N seconds and can be decoded from its first
+// packet. Stream.dispatch copies packets in; the live fanout is unaffected.
+
+// preEventPacket is a buffered RTP packet (RTCP is not kept).
+type preEventPacket struct {
+	at      time.Time
+	channel int
+	data    []byte
+}
+
+type preEventBuffer struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	sdp       string
+	channels  map[int]int // SDP media index -> RTP channel, see Stream.mediaChannels
+	video     int         // RTP channel of the first H.264/H.265 track, -1 without
+	hevc      bool
+	packets   []preEventPacket
+	trimmed   int64   // packets trimmed so far: absolute index = trimmed + i
+	keyframes []int64 // absolute indexes of the first packet of keyframe access units
+	auStart   int64   // absolute index of the first packet of the current video access unit
+	auTS      uint32
+	auKey     bool
+	taps      map[*clipTap]struct{}
+}
+
+// clipTap collects packets arriving after a clip request until its end.
+type clipTap struct {
+	until   time.Time
+	packets []preEventPacket
+	done    chan struct{}
+}
+
+func newPreEventBuffer(window time.Duration) *preEventBuffer {
+	return &preEventBuffer{window: window, video: -1, taps: make(map[*clipTap]struct{})}
+}
+
+// setSDP is called on every connection with the description and the
+// channels its media were set up on. Packets of an older layout are dropped
+// when it changed, so a clip never mixes two track layouts.
+func (b *preEventBuffer) setSDP(sdp string, channels map[int]int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if sdp == b.sdp && maps.Equal(channels, b.channels) {
+		return
+	}
+	b.sdp, b.channels = sdp, channels
+	b.video, b.hevc = -1, false
+	for i, media := range parseSDPMedia(sdp) {
+		channel, ok := channels[i]
+		if ok && (media.Codec == "H264" || media.Codec == "H265") {
+			b.video, b.hevc = channel, media.Codec == "H265"
+			break
+		}
+	}
+	b.trimmed += int64(len(b.packets))
+	b.packets, b.keyframes = nil, nil
+	b.auStart, b.auKey = b.trimmed, false
+}
+
+// push buffers an interleaved-framed packet from Stream.dispatch.
+func (b *preEventBuffer) push(now time.Time, channel int, packet []byte) {
+	if channel%2 != 0 || len(packet) <= streamHeaderLength {
+		return
+	}
+	pkt := preEventPacket{at: now, channel: channel, data: append([]byte(nil), packet[streamHeaderLength:]...)}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.sdp == "" {
+		return
+	}
+	index := b.trimmed + int64(len(b.packets))
+	if channel == b.video {
+		if p, err := parseRTP(pkt.data); err == nil {
+			if len(b.packets) == 0 || p.Timestamp != b.auTS {
+				b.auStart, b.auTS, b.auKey = index, p.Timestamp, false
+			}
+			// Parameter sets sent ahead of the IDR share its timestamp, so
+			// the keyframe starts at the first packet of the access unit.
+			if !b.auKey && rtpHasKeyframe(b.hevc, p.Payload) {
+				b.auKey = true
+				b.keyframes = append(b.keyframes, b.auStart)
+			}
+		}
+	}
+	b.packets = append(b.packets, pkt)
+
+	for tap := range b.taps {
+		if now.After(tap.until) {
+			close(tap.done)
+			delete(b.taps, tap)
+			continue
+		}
+		tap.packets = append(tap.packets, pkt)
+	}
+	b.trim(now)
+}
+
+// trim drops packets before the last keyframe that is at least window old.
+// Video without a usable keyframe is bounded at twice the window.
+func (b *preEventBuffer) trim(now time.Time) {
+	cutoff := now.Add(-b.window)
+	drop := 0
+	if b.video >= 0 {
+		k := 0
+		for k < len(b.keyframes) && b.packets[b.keyframes[k]-b.trimmed].at.Before(cutoff) {
+			k++
+		}
+		if k > 0 {
+			drop = int(b.keyframes[k-1] - b.trimmed)
+			b.keyframes = b.keyframes[k-1:]
+		}
+		cutoff = cutoff.Add(-b.window)
+	}
+	for drop < len(b.packets) && b.packets[drop].at.Before(cutoff) {
+		drop++
+	}
+	if drop == 0 {
+		return
+	}
+	clear(b.packets[:drop]) // release the packet data
+	b.packets = b.packets[drop:]
+	b.trimmed += int64(drop)
+	for len(b.keyframes) > 0 && b.keyframes[0] < b.trimmed {
+		b.keyframes = b.keyframes[1:]
+	}
+}
+
+// collect returns the SDP, its media channels and the packets from the last
+// keyframe at or before from up to until, waiting for packets until then. It
+// gives up early, with what it has, when ctx ends or nothing arrives past until.
+func (b *preEventBuffer) collect(ctx context.Context, from, until time.Time) (string, map[int]int, []preEventPacket) {
+	b.mu.Lock()
+	sdp, channels, video, hevc := b.sdp, b.channels, b.video, b.hevc
+	start := 0
+	if video >= 0 {
+		start = -1
+		for _, k := range b.keyframes {
+			i := int(k - b.trimmed)
+			if start >= 0 && b.packets[i].at.After(from) {
+				break
+			}
+			start = i
+		}
+		if start < 0 {
+			start = len(b.packets) // no keyframe buffered yet
+		}
+	} else {
+		for start < len(b.packets) && b.packets[start].at.Before(from) {
+			start++
+		}
+	}
+	var packets []preEventPacket
+	for _, pkt := range b.packets[start:] {
+		if pkt.at.After(until) {
+			break
+		}
+		packets = append(packets, pkt)
+	}
+	var tap *clipTap
+	if now := time.Now(); until.After(now) {
+		tap = &clipTap{until: until, done: make(chan struct{})}
+		b.taps[tap] = struct{}{}
+	}
+	b.mu.Unlock()
+
+	if tap == nil {
+		return sdp, channels, packets
+	}
+	// The stream delivers packets continuously; allow a little slack for
+	// the packet that proves the post-roll is over.
+	timer := time.NewTimer(time.Until(until) + 2*time.Second)
+	defer timer.Stop()
+	select {
+	case <-tap.done:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	b.mu.Lock()
+	delete(b.taps, tap)
+	tail := tap.packets
+	b.mu.Unlock()
+
+	if len(packets) == 0 && video >= 0 {
+		// Nothing was buffered before the event: start at the first
+		// keyframe of the post-roll.
+		tail = skipToKeyframe(hevc, video, tail)
+	}
+	return sdp, channels, append(packets, tail...)
+}
+
+// skipToKeyframe drops packets before the first keyframe access unit.
+func skipToKeyframe(hevc bool, video int, packets []preEventPacket) []preEventPacket {
+	auStart, started := 0, false
+	var auTS uint32
+	for i, pkt := range packets {
+		if pkt.channel != video {
+			continue
+		}
+		p, err := parseRTP(pkt.data)
+		if err != nil {
+			continue
+		}
+		if !started || p.Timestamp != auTS {
+			auStart, auTS, started = i, p.Timestamp, true
+		}
+		if rtpHasKeyframe(hevc, p.Payload) {
+			return packets[auStart:]
+		}
+	}
+	return nil
+}
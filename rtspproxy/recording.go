@@ -0,0 +1,333 @@
+package rtspproxy
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Continuous recording. Every stream listed in GlobalConfig.RecordStreams
+// gets a recorder: a Consumer that writes rolling MPEG-TS segments, cut at
+// keyframes, into the stream's directory, named by their UTC start time:
+//
+//	<dir>/20261018T011500.000Z.ts
+//
+// The segment being written carries a ".part" suffix. After a crash,
+// leftovers are truncated to whole TS packets and published on startup.
+// As a consumer the recorder holds the camera connection open without any
+// RTSP client.
+
+const (
+	recordTimeFormat  = "20060102T150405.000Z"
+	recordSegmentExt  = ".ts"
+	recordPartSuffix  = ".part"
+	defaultRecordDir  = "recordings/{host}/{path}"
+	recordKeepalive   = 5 * time.Second
+	recordRetainEvery = 30 * time.Second
+)
+
+type recorder struct {
+	stream          *Stream
+	dir             string
+	origin          time.Time
+	segmentDuration time.Duration
+
+	mu       sync.Mutex // Consume vs. close at shutdown
+	source   *tsSource
+	buf      bytes.Buffer // muxed samples not yet written
+	file     *os.File     // nil between segments
+	name     string       // final path of the current segment
+	segStart int64
+}
+
+// Consume implements Consumer.
+func (r *recorder) Consume(channel int, packet []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.source == nil {
+		sdp := r.stream.GetSDP()
+		if sdp == "" {
+			return
+		}
+		r.source = newTSSource("💾 [REC]", r.stream.Path, sdp, r.stream.mediaChannels(), r.origin, r.cut)
+	}
+	r.source.push(channel, packet)
+	r.flush()
+}
+
+// cut opens the first segment at a random access point and rolls segments
+// over at random access points once the segment duration is reached.
+func (r *recorder) cut(pts int64, randomAccess bool) *bytes.Buffer {
+	if r.file != nil && randomAccess && pts-r.segStart >= int64(r.segmentDuration*90000/time.Second) {
+		r.finishSegment()
+	}
+	if r.file == nil {
+		if !randomAccess || !r.startSegment(pts) {
+			return nil
+		}
+	}
+	return &r.buf
+}
+
+func (r *recorder) startSegment(pts int64) bool {
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		LogCriticalf("❌ [REC] Stream [%s]: %v", r.stream.Path, err)
+		return false
+	}
+	name := filepath.Join(r.dir, time.Now().UTC().Format(recordTimeFormat)+recordSegmentExt)
+	file, err := os.Create(name + recordPartSuffix)
+	if err != nil {
+		LogCriticalf("❌ [REC] Stream [%s]: %v", r.stream.Path, err)
+		return false
+	}
+	r.file, r.name, r.segStart = file, name, pts
+	r.source.muxer.WriteTables(&r.buf)
+	return true
+}
+
+func (r *recorder) flush() {
+	if r.buf.Len() == 0 {
+		return
+	}
+	if r.file != nil {
+		if _, err := r.file.Write(r.buf.Bytes()); err != nil {
+			LogCriticalf("❌ [REC] Stream [%s] write error: %v", r.stream.Path, err)
+			r.buf.Reset()
+			r.finishSegment()
+		}
+	}
+	r.buf.Reset()
+}
+
+// finishSegment closes the current segment and publishes it.
+func (r *recorder) finishSegment() {
+	r.flush()
+	if r.file == nil {
+		return
+	}
+	r.file.Close()
+	r.file = nil
+	if err := os.Rename(r.name+recordPartSuffix, r.name); err != nil {
+		LogCriticalf("❌ [REC] Stream [%s]: %v", r.stream.Path, err)
+		return
+	}
+	Logf("💾 [REC] Stream [%s] wrote %s", r.stream.Path, r.name)
+}
+
+// close publishes the segment in progress.
+func (r *recorder) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.finishSegment()
+}
+
+// recoverSegments publishes segments left half-written by a crash, cut to
+// whole TS packets.
+func recoverSegments(dir string) {
+	parts, _ := filepath.Glob(filepath.Join(dir, "*"+recordSegmentExt+recordPartSuffix))
+	for _, part := range parts {
+		info, err := os.Stat(part)
+		if err != nil {
+			continue
+		}
+		size := info.Size() / tsPacketSize * tsPacketSize
+		if size == 0 {
+			os.Remove(part)
+			continue
+		}
+		if err := os.Truncate(part, size); err != nil {
+			LogCriticalf("❌ [REC] Failed to recover %s: %v", part, err)
+			continue
+		}
+		if err := os.Rename(part, strings.TrimSuffix(part, recordPartSuffix)); err != nil {
+			LogCriticalf("❌ [REC] Failed to recover %s: %v", part, err)
+			continue
+		}
+		LogCriticalf("💾 [REC] Recovered interrupted segment %s (%d bytes)", strings.TrimSuffix(part, recordPartSuffix), size)
+	}
+}
+
+// recordedSegment is a finished segment on disk.
+type recordedSegment struct {
+	path  string
+	start time.Time
+	mtime time.Time
+	size  int64
+}
+
+// listRecordedSegments returns the finished segments of a directory,
+// oldest first.
+func listRecordedSegments(dir string) []recordedSegment {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var segments []recordedSegment
+	for _, entry := range entries {
+		base, ok := strings.CutSuffix(entry.Name(), recordSegmentExt)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		start, err := time.Parse(recordTimeFormat, base)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		segments = append(segments, recordedSegment{
+			path:  filepath.Join(dir, entry.Name()),
+			start: start,
+			mtime: info.ModTime(),
+			size:  info.Size(),
+		})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].start.Before(segments[j].start) })
+	return segments
+}
+
+// enforceRecordRetention deletes segments last written more than maxAge ago,
+// then the oldest segments across all dirs until they fit in maxBytes.
+// Zero disables either limit.
+func enforceRecordRetention(dirs []string, maxAge time.Duration, maxBytes int64, now time.Time) {
+	var all []recordedSegment
+	var total int64
+	for _, dir := range dirs {
+		for _, s := range listRecordedSegments(dir) {
+			if maxAge > 0 && now.Sub(s.mtime) > maxAge {
+				if err := os.Remove(s.path); err == nil {
+					Logf("💾 [REC] Expired %s", s.path)
+				}
+				continue
+			}
+			all = append(all, s)
+			total += s.size
+		}
+	}
+	if maxBytes <= 0 || total <= maxBytes {
+		return
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].start.Before(all[j].start) })
+	for _, s := range all {
+		if total <= maxBytes {
+			break
+		}
+		if err := os.Remove(s.path); err == nil {
+			total -= s.size
+			Logf("💾 [REC] Removed %s to stay within %d bytes", s.path, maxBytes)
+		}
+	}
+}
+
+// parseRecordSpec splits "<stream>[=<dir template>]". The stream is a proxy
+// path ("rtsp/host/path") or a camera URL ("rtsp://host/path").
+func parseRecordSpec(spec string) (scheme, host, username, password, streamPath, template string, err error) {
+	streamSpec, template, _ := strings.Cut(spec, "=")
+	if scheme, rest, found := strings.Cut(streamSpec, "://"); found {
+		streamSpec = scheme + "/" + rest
+	}
+	var ok bool
+	scheme, host, username, password, streamPath, ok = parseProxyPath(streamSpec)
+	if !ok {
+		return "", "", "", "", "", "", fmt.Errorf("invalid stream %q", streamSpec)
+	}
+	if template == "" {
+		template = GlobalConfig.RecordDir
+	}
+	if template == "" {
+		template = defaultRecordDir
+	}
+	return scheme, host, username, password, streamPath, template, nil
+}
+
+// expandRecordDir fills {scheme}, {host} and {path} in a directory template.
+// Credentials never end up in paths, and the camera path cannot escape the
+// template through "..".
+func expandRecordDir(template, scheme, host, streamPath string) string {
+	cleanPath := strings.TrimPrefix(path.Clean("/"+streamPath), "/")
+	return filepath.Clean(strings.NewReplacer(
+		"{scheme}", scheme,
+		"{host}", strings.ReplaceAll(host, ":", "_"),
+		"{path}", filepath.FromSlash(cleanPath),
+	).Replace(template))
+}
+
+// StartRecording attaches a recorder to every stream in
+// GlobalConfig.RecordStreams and starts retention.
+func (server *Server) StartRecording() error {
+	var recorders []*recorder
+	for _, spec := range GlobalConfig.RecordStreams {
+		scheme, host, username, password, streamPath, template, err := parseRecordSpec(spec)
+		if err != nil {
+			return err
+		}
+		stream := server.LookupStreamScheme(scheme, host, username, password, streamPath)
+		if stream == nil {
+			return fmt.Errorf("cannot record %q: unknown camera host", spec)
+		}
+		dir := expandRecordDir(template, scheme, host, streamPath)
+		recoverSegments(dir)
+		recorders = append(recorders, &recorder{
+			stream:          stream,
+			dir:             dir,
+			origin:          time.Now(),
+			segmentDuration: GlobalConfig.RecordSegmentDuration,
+		})
+	}
+	if len(recorders) == 0 {
+		return nil
+	}
+
+	server.recorders = recorders
+	dirs := make([]string, len(recorders))
+	for i, r := range recorders {
+		dirs[i] = r.dir
+		r.stream.AddConsumer(r)
+		LogCriticalf("💾 [REC] Recording stream [%s] to %s", r.stream.Path, r.dir)
+	}
+	maxAge, maxBytes := GlobalConfig.RecordRetention, GlobalConfig.RecordMaxBytes
+	enforceRecordRetention(dirs, maxAge, maxBytes, time.Now())
+
+	server.recordWG.Add(1)
+	go func() {
+		defer server.recordWG.Done()
+		keepalive := time.NewTicker(recordKeepalive)
+		defer keepalive.Stop()
+		retain := time.NewTicker(recordRetainEvery)
+		defer retain.Stop()
+		for {
+			select {
+			case <-server.ctx.Done():
+				return
+			case <-keepalive.C:
+				// The connect loop gives up when the camera is unreachable
+				// at first; recording keeps retrying.
+				for _, r := range recorders {
+					if r.stream.GetState() == StateDisconnected {
+						r.stream.Start()
+					}
+				}
+			case <-retain.C:
+				enforceRecordRetention(dirs, maxAge, maxBytes, time.Now())
+			}
+		}
+	}()
+	return nil
+}
+
+// stopRecording detaches the recorders and closes their open segments.
+func (server *Server) stopRecording() {
+	for _, r := range server.recorders {
+		r.stream.RemoveConsumer(r)
+		r.close()
+	}
+	server.recorders = nil
+	server.recordWG.Wait()
+}
@@ -0,0 +1,149 @@
+package rtspproxy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRecordSpec(t *testing.T) {
+	oldDir := GlobalConfig.RecordDir
+	t.Cleanup(func() { GlobalConfig.RecordDir = oldDir })
+	GlobalConfig.RecordDir = "/var/rec/{scheme}/{host}/{path}"
+
+	tests := []struct {
+		spec, dir string
+	}{
+		{"rtsp/admin:secret@10.0.0.5:554/Streaming/101", "/var/rec/rtsp/10.0.0.5_554/Streaming/101"},
+		{"rtsps://cam.local/live", "/var/rec/rtsps/cam.local/live"},
+		{"rtsp/cam.local/a/../../../etc=/data/{host}", "/data/cam.local"},
+		{"rtsp/cam.local/../../etc", "/var/rec/rtsp/cam.local/etc"},
+	}
+	for _, tt := range tests {
+		scheme, host, _, _, streamPath, template, err := parseRecordSpec(tt.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tt.spec, err)
+			continue
+		}
+		if dir := expandRecordDir(template, scheme, host, streamPath); dir != filepath.FromSlash(tt.dir) {
+			t.Errorf("%s: dir %s, want %s", tt.spec, dir, tt.dir)
+		}
+	}
+	if _, _, _, _, _, _, err := parseRecordSpec("nonsense"); err == nil {
+		t.Error("invalid spec accepted")
+	}
+}
+
+func TestRecoverSegments(t *testing.T) {
+	dir := t.TempDir()
+	partial := filepath.Join(dir, "20261018T010000.000Z.ts")
+	os.WriteFile(partial+recordPartSuffix, make([]byte, 3*tsPacketSize+50), 0644)
+	empty := filepath.Join(dir, "20261018T010100.000Z.ts")
+	os.WriteFile(empty+recordPartSuffix, make([]byte, 100), 0644)
+
+	recoverSegments(dir)
+
+	if info, err := os.Stat(partial); err != nil || info.Size() != 3*tsPacketSize {
+		t.Errorf("interrupted segment not recovered to whole packets: %v %v", info, err)
+	}
+	for _, name := range []string{partial + recordPartSuffix, empty, empty + recordPartSuffix} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s should not exist", filepath.Base(name))
+		}
+	}
+}
+
+func TestRecordRetention(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	write := func(dir string, start time.Time, size int) string {
+		name := filepath.Join(dir, start.Format(recordTimeFormat)+recordSegmentExt)
+		os.WriteFile(name, make([]byte, size), 0644)
+		end := start.Add(time.Minute)
+		os.Chtimes(name, end, end)
+		return name
+	}
+	expired := write(dirA, now.Add(-3*time.Hour), 1000)
+	oldest := write(dirB, now.Add(-90*time.Minute), 1000)
+	older := write(dirA, now.Add(-60*time.Minute), 1000)
+	recent := write(dirB, now.Add(-30*time.Minute), 1000)
+	latest := write(dirA, now.Add(-2*time.Minute), 1000)
+	unrelated := filepath.Join(dirA, "notes.txt")
+	os.WriteFile(unrelated, make([]byte, 5000), 0644)
+
+	enforceRecordRetention([]string{dirA, dirB}, 2*time.Hour, 2500, now)
+
+	exists := func(name string) bool {
+		_, err := os.Stat(name)
+		return err == nil
+	}
+	if exists(expired) {
+		t.Error("segment past the retention was kept")
+	}
+	if exists(oldest) || exists(older) {
+		t.Error("oldest segments were kept beyond the size limit")
+	}
+	if !exists(recent) || !exists(latest) || !exists(unrelated) {
+		t.Error("retention deleted too much")
+	}
+}
+
+func TestRecording(t *testing.T) {
+	cam := startH264Camera(t)
+	dir := t.TempDir()
+
+	oldStreams, oldDir, oldDuration := GlobalConfig.RecordStreams, GlobalConfig.RecordDir, GlobalConfig.RecordSegmentDuration
+	t.Cleanup(func() {
+		GlobalConfig.RecordStreams, GlobalConfig.RecordDir, GlobalConfig.RecordSegmentDuration = oldStreams, oldDir, oldDuration
+	})
+	GlobalConfig.RecordStreams = []string{"rtsp/" + cam.Addr() + "/mock"}
+	GlobalConfig.RecordDir = filepath.Join(dir, "{path}")
+	GlobalConfig.RecordSegmentDuration = 300 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := NewServer(ctx)
+	if err := server.StartRecording(); err != nil {
+		t.Fatal(err)
+	}
+
+	// No RTSP client: the recorder alone keeps the camera connected.
+	recordDir := filepath.Join(dir, "mock")
+	deadline := time.Now().Add(5 * time.Second)
+	for len(listRecordedSegments(recordDir)) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("no finished segments recorded")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	stream := server.LookupStreamScheme("rtsp", cam.Addr(), "", "", "/mock")
+	if state := stream.GetState(); state != StatePlaying {
+		t.Errorf("stream state %v while recording", state)
+	}
+
+	cancel()
+	server.stopRecording()
+
+	entries, _ := os.ReadDir(recordDir)
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), recordPartSuffix) {
+			t.Errorf("segment %s left unfinished", entry.Name())
+		}
+	}
+	for _, s := range listRecordedSegments(recordDir) {
+		data, err := os.ReadFile(s.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) == 0 || len(data)%tsPacketSize != 0 || data[0] != 0x47 {
+			t.Errorf("%s is not an MPEG-TS file (%d bytes)", filepath.Base(s.path), len(data))
+		}
+		// Every segment opens with PAT/PMT and starts at a keyframe.
+		if pid := int(data[1]&0x1f)<<8 | int(data[2]); pid != 0 {
+			t.Errorf("%s does not start with a PAT (PID %d)", filepath.Base(s.path), pid)
+		}
+	}
+}
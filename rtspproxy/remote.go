@@ -2,6 +2,7 @@ package rtspproxy
 
 import (
 	"container/list"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,23 +20,65 @@ import (
 // It is always owned by a single *Stream (no internal Stream map).
 type Remote struct {
 	Host        string
-	RemoteConn  *net.TCPConn
+	path        string   // stream path on the camera
+	query       string   // raw query sent with path, from a redirect
+	RemoteConn  net.Conn // plain TCP, or TLS for rtsps cameras
 	localPort   string
 	remotePort  string
 	localAddr   string
 	remoteAddr  string
 	currentCSeq int
 	Server      *Server
+	scheme      string  // "rtsp" or "rtsps" in request URLs
+	tunnel      bool    // RTSP-over-HTTP, see dialHTTPTunnel
 	stream      *Stream // parent Stream from StreamManager — sole source of truth
 	connMutex   sync.Mutex
 	addr        *net.TCPAddr
 	requests    *list.List
 	digest      *Digest
+
+	// UDP lower transport: local RTP port -> pending binding, channel -> camera endpoint
+	udpBindings   map[int]*udpBinding
+	udpChannels   map[int]*Substream
+	udpLastPacket atomic.Int64 // unix nanos of the last datagram, 0 if UDP is unused
+}
+
+// udpBinding ties a local RTP/RTCP pair to the interleaved channel numbers
+// its packets are dispatched under, so UDP and TCP tracks share one fanout.
+type udpBinding struct {
+	pair    *UDPPair
+	channel int
 }
 
-// NewRemote creates a new Remote bound to the given Stream.
+// NewRemote creates a new Remote bound to the given Stream, connecting to
+// where the camera last redirected it, if anywhere. The caller holds
+// stream.mu or owns the stream.
 func NewRemote(stream *Stream) *Remote {
-	host := stream.Host
+	host, path, query := stream.Host, stream.Path, ""
+	username, password := stream.Username, stream.Password
+	location := stream.location
+	if location != nil {
+		host, path, query = location.Host, location.Path, location.RawQuery
+		// The credentials belong to the camera; another host only gets
+		// the ones its Location names.
+		if !strings.EqualFold((&url.URL{Host: host}).Hostname(), (&url.URL{Host: stream.Host}).Hostname()) {
+			username, password = "", ""
+		}
+		if location.User != nil {
+			username = location.User.Username()
+			password, _ = location.User.Password()
+		}
+	}
+	scheme, defaultPort := "rtsp", "554"
+	tunnel := stream.httpTunnel()
+	if stream.Scheme == "rtsps" || (location != nil && location.Scheme == "rtsps") {
+		scheme, defaultPort = "rtsps", "322"
+	} else if tunnel {
+		defaultPort = "80"
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), defaultPort)
+	}
 	addr, err := net.ResolveTCPAddr("tcp", host)
 	if err != nil {
 		LogCriticalf("Failed to resolve TCP address for host %q: %s", host, err.Error())
@@ -43,19 +87,36 @@ func NewRemote(stream *Stream) *Remote {
 
 	remote := &Remote{
 		Host:     host,
+		path:     path,
+		query:    query,
+		scheme:   scheme,
+		tunnel:   tunnel,
 		Server:   stream.server,
 		stream:   stream,
 		addr:     addr,
 		requests: list.New(),
 		digest:   NewDigest(),
+
+		udpBindings: make(map[int]*udpBinding),
+		udpChannels: make(map[int]*Substream),
 	}
-	if stream.Username != "" {
-		remote.digest.Username = stream.Username
-		remote.digest.Password = stream.Password
+	if username != "" {
+		remote.digest.Username = username
+		remote.digest.Password = password
 	}
 	return remote
 }
 
+// streamURL returns the camera URL for path, with the redirect's query when
+// path is the stream path.
+func (remote *Remote) streamURL(path string) *url.URL {
+	URL := &url.URL{Scheme: remote.scheme, Host: remote.Host, Path: path}
+	if path == remote.path {
+		URL.RawQuery = remote.query
+	}
+	return URL
+}
+
 // Dial establishes a connection to the remote RTSP server.
 func (remote *Remote) Dial() error {
 	remote.connMutex.Lock()
@@ -68,6 +129,7 @@ func (remote *Remote) Disconnect() {
 	remote.connMutex.Lock()
 	defer remote.connMutex.Unlock()
 
+	remote.closeUDPLocked()
 	if remote.RemoteConn != nil {
 		remote.RemoteConn.Close()
 		remote.RemoteConn = nil
@@ -97,11 +159,13 @@ func (remote *Remote) HandleUpstreamResponse(recv string) {
 		return
 	}
 
+	cseq := headerGet(response.Headers, "CSeq")
 	remote.connMutex.Lock()
-	requestEl := remote.requests.Front()
+	requestEl := remote.pendingRequestLocked(cseq)
 	if requestEl == nil {
 		remote.connMutex.Unlock()
-		LogCriticalf("⚠️ [QUEUE] Received response but queue is empty! Dropping.")
+		// A reply to a request nobody waits for (timed out, TEARDOWN).
+		Logf("⚠️ [QUEUE] Dropping response %d with unknown CSeq %q from [%s]", response.Code, cseq, remote.Host)
 		return
 	}
 	request := requestEl.Value.(*Request)
@@ -110,23 +174,35 @@ func (remote *Remote) HandleUpstreamResponse(recv string) {
 
 	status := "ok"
 
-	if response.Code == 401 && request.Attempts == 0 {
-		wwwAuthenticate := headerGet(response.Headers, "WWW-Authenticate")
-		if wwwAuthenticate != "" {
-			if remote.digest.Username != "" && remote.digest.Password != "" && remote.handleAuthenticationFailure(wwwAuthenticate) {
-				request.Attempts++
-				Logf("🔑 [AUTH] Retrying with Digest auth (CSeq will be updated)...")
-				_ = remote.SendRequest(request)
-				return
-			}
-			LogCriticalf("❌ [AUTH] Auth failed or missing credentials.")
-			GlobalMetrics.AuthFailures.Add(1)
-			status = "unauthorized"
+	if response.Code == 401 {
+		retry, stale := remote.handleAuthenticationFailure(headerGet(response.Headers, "WWW-Authenticate"))
+		if retry && stale && request.staleRetries < maxStaleRetries {
+			// The credentials were right; only the nonce expired.
+			request.staleRetries++
+			Logf("🔑 [AUTH] Nonce stale, retrying %s with the new one...", request.Method)
+			_ = remote.SendRequest(request)
+			return
+		}
+		if retry && request.Attempts == 0 {
+			request.Attempts++
+			Logf("🔑 [AUTH] Retrying with Digest auth (CSeq will be updated)...")
+			_ = remote.SendRequest(request)
+			return
 		}
+		// Anything else not retried, a bare 401 included, is a refusal.
+		LogCriticalf("❌ [AUTH] Auth failed or missing credentials.")
+		GlobalMetrics.AuthFailures.Add(1)
+		status = "unauthorized"
+	} else if location, err := request.URL.Parse(headerGet(response.Headers, "Location")); response.Code >= 300 && response.Code < 400 &&
+		err == nil && isAbsoluteRTSPURL(location.String()) && location.Host != "" {
+		request.redirect = &redirectError{code: response.Code, location: location}
+		status = "redirect"
+		Logf("↪️ [RTSP] Camera redirected %s with %d to %s", request.Method, response.Code, location.Redacted())
 	} else {
-		if response.Code >= 400 {
-			status = fmt.Sprintf("error %d: %s", response.Code, response.Status)
-			LogCriticalf("⚠️ [RTSP] Camera returned error for %s: %s", request.Method, status)
+		if response.Code >= 300 {
+			request.failure = &statusError{code: response.Code, status: response.Status}
+			status = "error"
+			LogCriticalf("⚠️ [RTSP] Camera returned error for %s: %v", request.Method, request.failure)
 		} else {
 			switch request.Method {
 			case "OPTIONS":
@@ -169,6 +245,21 @@ func (remote *Remote) HandleUpstreamResponse(recv string) {
 	}
 }
 
+// pendingRequestLocked returns the outstanding request answered by a
+// response with the given CSeq. Responses without CSeq are taken to answer
+// the oldest request.
+func (remote *Remote) pendingRequestLocked(cseq string) *list.Element {
+	if cseq == "" {
+		return remote.requests.Front()
+	}
+	for e := remote.requests.Front(); e != nil; e = e.Next() {
+		if headerGet(e.Value.(*Request).Headers, "CSeq") == cseq {
+			return e
+		}
+	}
+	return nil
+}
+
 func (remote *Remote) handleTeardown(request *Request, response *Response) {
 	stream := remote.stream
 	if stream == nil {
@@ -203,23 +294,26 @@ func (remote *Remote) handleDescribe(request *Request, response *Response) {
 	stream.mu.Unlock()
 }
 
+// parseTransport splits a Transport header into protocol, delivery type
+// ("unicast" or "multicast", wherever it appears) and key=value parameters
+// such as interleaved, client_port, destination, port and ttl.
 func (remote *Remote) parseTransport(transportStr string) (string, string, map[string]string) {
 	if transportStr == "" {
 		return "", "", make(map[string]string)
 	}
 	transportParts := strings.Split(transportStr, ";")
-	protocol := transportParts[0]
+	protocol := strings.TrimSpace(transportParts[0])
 	comType := "unicast"
-	if len(transportParts) > 1 {
-		comType = transportParts[1]
-	}
 	params := make(map[string]string)
-	if len(transportParts) > 2 {
-		for _, element := range transportParts[2:] {
-			kv := strings.SplitN(element, "=", 2)
-			if len(kv) == 2 {
-				params[kv[0]] = kv[1]
-			}
+	for _, element := range transportParts[1:] {
+		element = strings.TrimSpace(element)
+		if strings.EqualFold(element, "unicast") || strings.EqualFold(element, "multicast") {
+			comType = strings.ToLower(element)
+			continue
+		}
+		kv := strings.SplitN(element, "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = kv[1]
 		}
 	}
 	return protocol, comType, params
@@ -239,7 +333,11 @@ func (remote *Remote) handleSetup(request *Request, response *Response) {
 	transport.mu.Lock()
 	transport.Ssrc = params["ssrc"]
 
-	if interleaved, ok := params["interleaved"]; ok {
+	if comType == "multicast" {
+		remote.describeMulticast(transport, substreamName, params)
+	} else if clientPort, ok := params["client_port"]; ok && !strings.Contains(strings.ToUpper(protocol), "TCP") {
+		remote.attachUDP(transport, substreamName, clientPort, params)
+	} else if interleaved, ok := params["interleaved"]; ok {
 		channels := strings.Split(interleaved, "-")
 		ch1, _ := strconv.Atoi(channels[0])
 		sub1 := NewSubstream(transport, substreamName)
@@ -253,6 +351,7 @@ func (remote *Remote) handleSetup(request *Request, response *Response) {
 		}
 	}
 	transport.mu.Unlock()
+	request.transport = transport
 
 	if len(sessionParams) > 1 {
 		for _, element := range sessionParams[1:] {
@@ -285,7 +384,11 @@ func (remote *Remote) handlePlay(request *Request, response *Response) {
 				params[kv[0]] = kv[1]
 			}
 		}
-		URL, _ := url.Parse(params["url"])
+		URL, err := url.Parse(params["url"])
+		if err != nil {
+			Logf("⚠️ Ignoring RTP-Info entry with bad url %q: %v", params["url"], err)
+			continue
+		}
 		_, substreamName := filepath.Split(URL.Path)
 
 		session.mu.Lock()
@@ -312,7 +415,7 @@ func (remote *Remote) GetOptions(streamName string) (string, error) {
 		return "", errors.New("no stream bound")
 	}
 	if stream.GetOptions() == "" {
-		URL := &url.URL{Scheme: "rtsp", Host: remote.Host, Path: streamName}
+		URL := remote.streamURL(streamName)
 		request, _ := NewRequest("OPTIONS", URL)
 		err := remote.SendRequestSync(request)
 		if err != nil {
@@ -329,64 +432,111 @@ func (remote *Remote) GetSDP(streamName string) (string, error) {
 		return "", errors.New("no stream bound")
 	}
 	if stream.GetSDP() == "" {
-		URL := &url.URL{Scheme: "rtsp", Host: remote.Host, Path: streamName}
-		request, _ := NewRequest("DESCRIBE", URL)
-		err := remote.SendRequestSync(request)
-		if err != nil {
+		if err := remote.Describe(streamName); err != nil {
 			return "", err
 		}
 	}
 	return stream.GetSDP(), nil
 }
 
-// SetupUpstream performs a SETUP request for the upstream connection.
-func (remote *Remote) SetupUpstream(stream *Stream, track, transportStr string) (string, string, error) {
+// Describe sends a DESCRIBE request; the reply replaces the stream's SDP.
+func (remote *Remote) Describe(streamName string) error {
+	URL := remote.streamURL(streamName)
+	request, _ := NewRequest("DESCRIBE", URL)
+	return remote.SendRequestSync(request)
+}
+
+// SetupUpstream performs a SETUP request for the upstream connection and
+// returns the transport the camera's reply set up.
+func (remote *Remote) SetupUpstream(track, transportStr string) (*Transport, error) {
 	var reqURL *url.URL
 
 	if track == "" || track == "*" {
-		reqURL = &url.URL{Scheme: "rtsp", Host: remote.Host, Path: stream.Path}
-	} else if strings.HasPrefix(track, "rtsp://") {
+		reqURL = remote.streamURL(remote.path)
+	} else if isAbsoluteRTSPURL(track) {
 		reqURL, _ = url.Parse(track)
 	} else {
-		basePath := strings.TrimRight(stream.Path, "/")
+		basePath := strings.TrimRight(remote.path, "/")
 		trackPath := strings.TrimLeft(track, "/")
 		fullPath := basePath + "/" + trackPath
-		reqURL = &url.URL{Scheme: "rtsp", Host: remote.Host, Path: fullPath}
+		reqURL = &url.URL{Scheme: remote.scheme, Host: remote.Host, Path: fullPath}
 	}
 
 	request, _ := NewRequest("SETUP", reqURL)
 	request.Headers["Transport"] = transportStr
 	err := remote.SendRequestSync(request)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
+	if request.transport == nil {
+		return nil, errors.New("failed to find transport after SETUP")
+	}
+	return request.transport, nil
+}
 
-	stream.mu.RLock()
-	defer stream.mu.RUnlock()
-	for _, sess := range stream.sessions {
-		sess.mu.RLock()
-		for e := sess.Transports.Front(); e != nil; e = e.Next() {
-			t := e.Value.(*Transport)
-			base := filepath.Base(track)
-			if t.SubstreamName == track ||
-				(track == "" && t.SubstreamName == filepath.Base(stream.Path)) ||
-				(track != "" && (t.SubstreamName == base || t.SubstreamName == track)) {
-				t.mu.RLock()
-				ssrc := t.Ssrc
-				t.mu.RUnlock()
-				sess.mu.RUnlock()
-				return ssrc, sess.Session, nil
+// JoinMulticast joins the groups announced in the multicast SETUP reply t
+// and dispatches their packets under channel (RTP) and channel+1 (RTCP).
+func (remote *Remote) JoinMulticast(t *Transport, channel int) error {
+	t.mu.Lock()
+	subs := make([]*Substream, 0, 2)
+	for idx := 0; idx < 2; idx++ {
+		sub, ok := t.Substreams[idx]
+		if !ok {
+			continue
+		}
+		conn, err := listenMulticast(net.ParseIP(sub.Host), sub.Port, net.ParseIP(sub.Source))
+		if err != nil {
+			t.mu.Unlock()
+			for _, joined := range subs {
+				joined.Conn.Close()
 			}
+			return err
 		}
-		sess.mu.RUnlock()
+		sub.Conn = conn
+		sub.Channel = channel + idx
+		subs = append(subs, sub)
+	}
+	t.mu.Unlock()
+	if len(subs) == 0 {
+		return errors.New("camera reply has no multicast destination")
+	}
+
+	remote.connMutex.Lock()
+	for _, sub := range subs {
+		remote.udpChannels[sub.Channel] = sub
 	}
+	remote.udpLastPacket.Store(time.Now().UnixNano())
+	remote.connMutex.Unlock()
 
-	return "", "", errors.New("failed to find transport after SETUP")
+	for _, sub := range subs {
+		Logf("✅ [MULTICAST] Track %s: joined %s:%d (source %q) as channel %d", t.SubstreamName, sub.Host, sub.Port, sub.Source, sub.Channel)
+		go remote.receiveUDP(sub)
+	}
+	return nil
+}
+
+// describeMulticast records destination=/port=/source= of a multicast SETUP
+// reply; the group is joined by JoinMulticast once the channel is known.
+func (remote *Remote) describeMulticast(transport *Transport, substreamName string, params map[string]string) {
+	group := params["destination"]
+	rtpPort, rtcpPort, err := parsePortRange(params["port"])
+	if group == "" || err != nil {
+		LogCriticalf("⚠️ [MULTICAST] Camera reply lacks destination/port: %v", params)
+		return
+	}
+	Logf("[MULTICAST] Track %s announced at %s:%d-%d ttl=%s", substreamName, group, rtpPort, rtcpPort, params["ttl"])
+	for idx, port := range []int{rtpPort, rtcpPort} {
+		sub := NewSubstream(transport, substreamName)
+		sub.Host = group
+		sub.Port = port
+		sub.Source = params["source"]
+		transport.Substreams[idx] = sub
+	}
 }
 
 // PlayUpstream performs a PLAY request for the upstream connection.
 func (remote *Remote) PlayUpstream(path, sessionID string) (string, error) {
-	URL := &url.URL{Scheme: "rtsp", Host: remote.Host, Path: path}
+	URL := remote.streamURL(path)
 	request, _ := NewRequest("PLAY", URL)
 	request.Headers["Session"] = sessionID
 	request.Headers["Range"] = "npt=0.000-"
@@ -410,6 +560,7 @@ func (remote *Remote) PlayUpstream(path, sessionID string) (string, error) {
 }
 
 // LookupTransport retrieves an existing transport for a substream from the parent Stream.
+// An empty protocol or comType matches any upstream transport.
 func (remote *Remote) LookupTransport(streamName, substreamName, protocol, comType string) *Transport {
 	stream := remote.stream
 	if stream == nil {
@@ -421,7 +572,9 @@ func (remote *Remote) LookupTransport(streamName, substreamName, protocol, comTy
 		session.mu.RLock()
 		for e := session.Transports.Front(); e != nil; e = e.Next() {
 			transport := e.Value.(*Transport)
-			if transport.SubstreamName == substreamName && transport.Protocol == protocol && transport.ComType == comType {
+			if transport.SubstreamName == substreamName &&
+				(protocol == "" || transport.Protocol == protocol) &&
+				(comType == "" || transport.ComType == comType) {
 				session.mu.RUnlock()
 				return transport
 			}
@@ -431,10 +584,16 @@ func (remote *Remote) LookupTransport(streamName, substreamName, protocol, comTy
 	return nil
 }
 
-// SendRequestSync sends an RTSP request and waits for a synchronous response.
+// SendRequestSync sends an RTSP request and waits for its response, at most
+// request.Timeout (defaultRequestTimeout if unset). Other requests may be
+// outstanding at the same time; responses are matched by CSeq.
 func (remote *Remote) SendRequestSync(request *Request) error {
+	timeout := request.Timeout
+	if timeout <= 0 {
+		timeout = defaultRequestTimeout
+	}
 	for attempt := 0; attempt < 2; attempt++ {
-		ipc := NewIPC(10)
+		ipc := NewIPC(timeout)
 
 		if request.Subscriptions == nil {
 			request.Subscriptions = list.New()
@@ -444,6 +603,7 @@ func (remote *Remote) SendRequestSync(request *Request) error {
 		request.Subscriptions.PushBack(ipc.Channel)
 
 		remote.connMutex.Lock()
+		delete(request.Headers, "CSeq") // a late reply to a previous attempt must not match
 		remote.requests.PushBack(request)
 		remote.connMutex.Unlock()
 
@@ -490,6 +650,12 @@ func (remote *Remote) SendRequestSync(request *Request) error {
 			remote.connMutex.Unlock()
 		}
 
+		if result == "redirect" {
+			return request.redirect
+		}
+		if result == "error" {
+			return request.failure
+		}
 		if result != "ok" {
 			return errors.New(result)
 		}
@@ -536,8 +702,22 @@ func (remote *Remote) dialLocked() error {
 	case <-remote.Server.ctx.Done():
 		return fmt.Errorf("server is shutting down")
 	default:
+		var socket net.Conn
+		var err error
 		dialer := net.Dialer{Timeout: GlobalConfig.DialTimeout}
-		socket, err := dialer.DialContext(remote.Server.ctx, "tcp", remote.Host)
+		if remote.scheme == "rtsps" {
+			config, cfgErr := newUpstreamTLSConfig(remote.Host)
+			if cfgErr != nil {
+				GlobalMetrics.ConnectErrors.Add(1)
+				return cfgErr
+			}
+			tlsDialer := tls.Dialer{NetDialer: &dialer, Config: config}
+			socket, err = tlsDialer.DialContext(remote.Server.ctx, "tcp", remote.Host)
+		} else if remote.tunnel {
+			socket, err = dialHTTPTunnel(remote.Server.ctx, &dialer, remote.Host, remote.streamURL(remote.path).RequestURI())
+		} else {
+			socket, err = dialer.DialContext(remote.Server.ctx, "tcp", remote.Host)
+		}
 		if err != nil {
 			GlobalMetrics.ConnectErrors.Add(1)
 			return fmt.Errorf("failed to connect to %q: %w", remote.Host, err)
@@ -549,7 +729,7 @@ func (remote *Remote) dialLocked() error {
 		if remote.RemoteConn != nil {
 			remote.RemoteConn.Close()
 		}
-		remote.RemoteConn, _ = socket.(*net.TCPConn)
+		remote.RemoteConn = socket
 		remote.localAddr = localAddr[0]
 		remote.localPort = localAddr[1]
 		remote.remoteAddr = remoteAddr[0]
@@ -562,60 +742,60 @@ func (remote *Remote) dialLocked() error {
 
 // SendTeardown sends a TEARDOWN request for a specific session.
 func (remote *Remote) SendTeardown(path, sessionID string) error {
-	URL := &url.URL{Scheme: "rtsp", Host: remote.Host, Path: path}
+	URL := remote.streamURL(path)
 	request, _ := NewRequest("TEARDOWN", URL)
 	request.Headers["Session"] = sessionID
 	return remote.SendRequest(request)
 }
 
-// binaryHeaderPool avoids allocation for interleaved data headers.
-var binaryHeaderPool = sync.Pool{
+// binaryFramePool avoids allocation for interleaved data frames.
+var binaryFramePool = sync.Pool{
 	New: func() interface{} {
-		return make([]byte, 4)
+		return make([]byte, 0, streamHeaderLength+GlobalConfig.BufferSize)
 	},
 }
 
 // SendBinary forwards interleaved RTP/RTCP data from client to remote.
-// Enforces strict atomicity to prevent stream corruption.
+// Channels received over UDP are sent back as datagrams to the camera.
+// Header and payload go out in a single Write, so the frame can neither be
+// interleaved with other writes nor split by a tunnelled connection.
 func (remote *Remote) SendBinary(channel int, data []byte) error {
 	remote.connMutex.Lock()
 	defer remote.connMutex.Unlock()
 
+	if sub, ok := remote.udpChannels[channel]; ok {
+		if sub.transport.ComType == "multicast" {
+			return nil // never spray client reports into the group
+		}
+		_, err := sub.Conn.WriteToUDP(data, &net.UDPAddr{IP: net.ParseIP(sub.Host), Port: sub.Port})
+		return err
+	}
+
 	if remote.RemoteConn == nil {
 		LogCriticalf("⚠️ SendBinary failed: remote connection is closed")
 		return errors.New("remote connection is closed")
 	}
 	conn := remote.RemoteConn
 
-	header := binaryHeaderPool.Get().([]byte)
-	defer binaryHeaderPool.Put(header)
-
-	header[0] = '$'
-	header[1] = byte(channel)
-	header[2] = byte((len(data) & 0xFF00) >> 8)
-	header[3] = byte(len(data) & 0xFF)
+	frame := binaryFramePool.Get().([]byte)
+	frame = append(frame[:0], '$', byte(channel), byte(len(data)>>8), byte(len(data)))
+	frame = append(frame, data...)
+	defer binaryFramePool.Put(frame[:0])
 
 	conn.SetWriteDeadline(time.Now().Add(GlobalConfig.WriteTimeout))
-	_, err := conn.Write(header)
-	if err != nil {
-		conn.SetWriteDeadline(time.Time{})
-		LogCriticalf("⚠️ SendBinary header failed: %v", err)
-		remote.disconnectLocked()
-		return fmt.Errorf("failed to write binary header: %w", err)
-	}
-
-	_, err = conn.Write(data)
+	_, err := conn.Write(frame)
 	conn.SetWriteDeadline(time.Time{})
 	if err != nil {
-		LogCriticalf("⚠️ SendBinary data failed: %v", err)
+		LogCriticalf("⚠️ SendBinary failed: %v", err)
 		remote.disconnectLocked()
-		return fmt.Errorf("failed to write binary data: %w", err)
+		return fmt.Errorf("failed to write binary frame: %w", err)
 	}
 	return nil
 }
 
 // disconnectLocked is used internally when connMutex is already held.
 func (remote *Remote) disconnectLocked() {
+	remote.closeUDPLocked()
 	if remote.RemoteConn != nil {
 		remote.RemoteConn.Close()
 		remote.RemoteConn = nil
@@ -629,34 +809,194 @@ func (remote *Remote) disconnectLocked() {
 	}
 }
 
-func (remote *Remote) handleAuthenticationFailure(paramsStr string) bool {
+// BindUDP allocates a local RTP/RTCP pair whose packets will be dispatched
+// under channel (RTP) and channel+1 (RTCP) once the camera accepts the SETUP.
+func (remote *Remote) BindUDP(channel int) (*UDPPair, error) {
+	pair, err := ListenUDPPair("")
+	if err != nil {
+		return nil, err
+	}
+	rtpPort, _ := pair.Ports()
+	remote.connMutex.Lock()
+	remote.udpBindings[rtpPort] = &udpBinding{pair: pair, channel: channel}
+	remote.connMutex.Unlock()
+	return pair, nil
+}
+
+// UnbindUDP releases a pair allocated by BindUDP that the camera refused.
+func (remote *Remote) UnbindUDP(channel int) {
+	remote.connMutex.Lock()
+	defer remote.connMutex.Unlock()
+	for port, binding := range remote.udpBindings {
+		if binding.channel == channel {
+			binding.pair.Close()
+			delete(remote.udpBindings, port)
+		}
+	}
+}
+
+// UDPIdle returns how long no datagram arrived from the camera, or 0 when
+// no track is received over UDP.
+func (remote *Remote) UDPIdle() time.Duration {
+	last := remote.udpLastPacket.Load()
+	if last == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, last))
+}
+
+// attachUDP completes a UDP SETUP: it records the camera's server ports on
+// the transport substreams and starts receiving on the bound pair.
+func (remote *Remote) attachUDP(transport *Transport, substreamName, clientPort string, params map[string]string) {
+	rtpPort, _, err := parsePortRange(clientPort)
+	if err != nil {
+		LogCriticalf("⚠️ [UDP] Camera replied with bad client_port: %v", err)
+		return
+	}
+	remote.connMutex.Lock()
+	binding := remote.udpBindings[rtpPort]
+	cameraHost := remote.remoteAddr
+	remote.connMutex.Unlock()
+	if binding == nil {
+		LogCriticalf("⚠️ [UDP] No local binding for client_port %s", clientPort)
+		return
+	}
+
+	serverRTP, serverRTCP, err := parsePortRange(params["server_port"])
+	if err != nil {
+		LogCriticalf("⚠️ [UDP] Camera replied without usable server_port: %v", err)
+	}
+	if source := params["source"]; source != "" {
+		cameraHost = source
+	}
+
+	sub1 := NewSubstream(transport, substreamName)
+	sub1.Channel = binding.channel
+	sub1.Host = cameraHost
+	sub1.Port = serverRTP
+	sub1.Conn = binding.pair.RTP
+	sub2 := NewSubstream(transport, substreamName)
+	sub2.Channel = binding.channel + 1
+	sub2.Host = cameraHost
+	sub2.Port = serverRTCP
+	sub2.Conn = binding.pair.RTCP
+	transport.Substreams[0] = sub1
+	transport.Substreams[1] = sub2
+
+	remote.connMutex.Lock()
+	remote.udpChannels[sub1.Channel] = sub1
+	remote.udpChannels[sub2.Channel] = sub2
+	remote.udpLastPacket.Store(time.Now().UnixNano())
+	remote.connMutex.Unlock()
+
+	Logf("✅ [UDP] Track %s: local %d-%d <- camera %s:%d-%d", substreamName, rtpPort, rtpPort+1, cameraHost, serverRTP, serverRTCP)
+	go remote.receiveUDP(sub1)
+	go remote.receiveUDP(sub2)
+}
+
+// receiveUDP feeds datagrams from the camera into the stream fanout,
+// framed exactly like interleaved packets. It exits when the socket closes.
+func (remote *Remote) receiveUDP(sub *Substream) {
+	cameraIP := net.ParseIP(sub.Host)
+	if sub.transport.ComType == "multicast" {
+		cameraIP = net.ParseIP(sub.Source) // nil accepts any sender of the group
+	}
+	buf := make([]byte, GlobalConfig.BufferSize)
+	for {
+		n, from, err := sub.Conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if cameraIP != nil && !from.IP.Equal(cameraIP) {
+			Logf("⚠️ [UDP] Ignoring datagram from unexpected source %s", from)
+			continue
+		}
+		remote.udpLastPacket.Store(time.Now().UnixNano())
+
+		packet := make([]byte, streamHeaderLength+n)
+		packet[0] = '$'
+		packet[1] = byte(sub.Channel)
+		packet[2] = byte(n >> 8)
+		packet[3] = byte(n)
+		copy(packet[streamHeaderLength:], buf[:n])
+		remote.stream.dispatch(sub.Channel, packet)
+	}
+}
+
+// closeUDPLocked releases all UDP sockets; receivers exit on the closed socket.
+func (remote *Remote) closeUDPLocked() {
+	for port, binding := range remote.udpBindings {
+		binding.pair.Close()
+		delete(remote.udpBindings, port)
+	}
+	for channel, sub := range remote.udpChannels {
+		if sub.transport.ComType == "multicast" {
+			sub.Conn.Close() // unicast sockets are owned by udpBindings
+		}
+		delete(remote.udpChannels, channel)
+	}
+	remote.udpLastPacket.Store(0)
+}
+
+// redirectError is SendRequestSync's failure for a 3xx response with a
+// usable Location, resolved against the request URL.
+type redirectError struct {
+	code     int
+	location *url.URL
+}
+
+func (e *redirectError) Error() string {
+	return fmt.Sprintf("redirect %d to %s", e.code, e.location.Redacted())
+}
+
+// statusError is SendRequestSync's failure for an RTSP error response.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("error %d: %s", e.code, e.status)
+}
+
+// isStatusError reports whether err is SendRequestSync's failure for the given RTSP status code.
+func isStatusError(err error, code int) bool {
+	var status *statusError
+	return errors.As(err, &status) && status.code == code
+}
+
+// handleAuthenticationFailure takes the challenges of a 401 and reports
+// whether the request can be retried with them; stale means the camera
+// only replaced an expired nonce.
+func (remote *Remote) handleAuthenticationFailure(paramsStr string) (retry, stale bool) {
 	if paramsStr == "" {
-		return false
+		return false, false
 	}
 	remote.connMutex.Lock()
 	defer remote.connMutex.Unlock()
 	if remote.digest.Username == "" || remote.digest.Password == "" {
-		return false
+		return false, false
 	}
 
-	realm, nonce, qop, opaque, algorithm, isDigest := ParseWWWAuthenticate(paramsStr)
-	if isDigest {
-		remote.digest.Realm = realm
-		remote.digest.Nonce = nonce
-		remote.digest.Qop = qop
-		remote.digest.Opaque = opaque
-		remote.digest.Algorithm = algorithm
-		remote.digest.Nc = 0 // reset nonce count on new challenge
-		Logf("✅ [AUTH] Updated Digest: Realm=%q, Nonce=%q, Qop=%q", remote.digest.Realm, remote.digest.Nonce, remote.digest.Qop)
-		return true
+	challenge, ok := ParseWWWAuthenticate(paramsStr)
+	if !ok {
+		return false, false
 	}
-	if realm != "" {
-		// Basic
-		remote.digest.Realm = realm
-		remote.digest.Nonce = ""
-		return true
+	if challenge.IsDigest() {
+		remote.digest.Realm = challenge.Params["realm"]
+		remote.digest.Nonce = challenge.Params["nonce"]
+		remote.digest.Qop = challenge.Qop()
+		remote.digest.Opaque = challenge.Params["opaque"]
+		remote.digest.Algorithm = challenge.Params["algorithm"]
+		remote.digest.Nc = 0 // reset nonce count on new challenge
+		Logf("✅ [AUTH] Updated Digest: Realm=%q, Nonce=%q, Qop=%q, Algorithm=%q, Stale=%v",
+			remote.digest.Realm, remote.digest.Nonce, remote.digest.Qop, remote.digest.Algorithm, challenge.Stale())
+		return true, challenge.Stale()
 	}
-	return false
+	// Basic
+	remote.digest.Realm = challenge.Params["realm"]
+	remote.digest.Nonce = ""
+	return remote.digest.Realm != "", false
 }
 
 func (remote *Remote) createAuthenticatorStr(request *Request) {
@@ -665,12 +1005,14 @@ func (remote *Remote) createAuthenticatorStr(request *Request) {
 	}
 	URL := request.GetURL().String()
 	if remote.digest.Nonce != "" {
-		response, ncStr, cnonce := remote.digest.ComputeResponse(request.Method, URL)
+		response, ncStr, cnonce := remote.digest.ComputeResponse(request.Method, URL, request.Body)
 		var auth strings.Builder
 		auth.WriteString(fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`,
 			remote.digest.Username, remote.digest.Realm, remote.digest.Nonce, URL, response))
 		if remote.digest.Qop != "" {
 			auth.WriteString(fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s"`, remote.digest.Qop, ncStr, cnonce))
+		} else if cnonce != "" {
+			auth.WriteString(fmt.Sprintf(`, cnonce="%s"`, cnonce))
 		}
 		if remote.digest.Opaque != "" {
 			auth.WriteString(fmt.Sprintf(`, opaque="%s"`, remote.digest.Opaque))
@@ -0,0 +1,191 @@
+package rtspproxy
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamResponsesMatchedByCSeq(t *testing.T) {
+	cam := startMockCamera(t)
+	cam.handle = func(method, req string, conn net.Conn) string {
+		if method != "GET_PARAMETER" {
+			return ""
+		}
+		cseq := headerGet(parseMockHeaders(req), "CSeq")
+		switch headerGet(parseMockHeaders(req), "X-Test") {
+		case "slow":
+			time.AfterFunc(200*time.Millisecond, func() {
+				fmt.Fprintf(conn, "RTSP/1.0 200 OK\r\nCSeq: %s\r\n\r\n", cseq)
+			})
+			return "-"
+		case "fast":
+			// A stray reply first, then an error for this request.
+			fmt.Fprintf(conn, "RTSP/1.0 200 OK\r\nCSeq: 999\r\n\r\n")
+			return "RTSP/1.0 451 Parameter Not Understood\r\n\r\n"
+		}
+		return "-" // never answered
+	}
+
+	server, _ := startTunnelServer(t)
+	stream := server.LookupStreamScheme("rtsp", cam.Addr(), "", "", "/mock")
+	stream.AddConsumer(nopConsumer{})
+	t.Cleanup(func() { stream.RemoveConsumer(nopConsumer{}) })
+	select {
+	case <-stream.ReadyCh():
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not start")
+	}
+	stream.mu.RLock()
+	remote := stream.remote
+	stream.mu.RUnlock()
+
+	send := func(test string, timeout time.Duration) chan error {
+		request, _ := NewRequest("GET_PARAMETER", &url.URL{Scheme: "rtsp", Host: cam.Addr(), Path: "/mock"})
+		request.Headers["X-Test"] = test
+		request.Timeout = timeout
+		done := make(chan error, 1)
+		go func() { done <- remote.SendRequestSync(request) }()
+		return done
+	}
+	slow := send("slow", 0)
+	time.Sleep(50 * time.Millisecond)
+	fast := send("fast", 0)
+	start := time.Now()
+	silent := send("silent", 100*time.Millisecond)
+
+	if err := <-fast; !isStatusError(fmt.Errorf("wrapped: %w", err), 451) || isStatusError(errors.New("error 451: text only"), 451) {
+		t.Errorf("fast request: %v, want its own 451", err)
+	}
+	if err := <-slow; err != nil {
+		t.Errorf("slow request: %v", err)
+	}
+	if err := <-silent; err == nil || !strings.Contains(err.Error(), "timeout") || time.Since(start) > time.Second {
+		t.Errorf("silent request: %v after %v", err, time.Since(start))
+	}
+}
+
+func TestFollowRedirects(t *testing.T) {
+	oldBackoff, oldMax := GlobalConfig.ReconnectBackoff, GlobalConfig.MaxRedirects
+	t.Cleanup(func() { GlobalConfig.ReconnectBackoff, GlobalConfig.MaxRedirects = oldBackoff, oldMax })
+	GlobalConfig.ReconnectBackoff = []time.Duration{100 * time.Millisecond}
+	GlobalConfig.MaxRedirects = 2
+
+	// gateway -302-> relay/mock -301-> relay/live?channel=1 (relative Location).
+	node := startMockCamera(t)
+	conns := make(chan net.Conn, 2)
+	node.handle = func(method, req string, conn net.Conn) string {
+		switch {
+		case method == "DESCRIBE" && strings.Contains(req, "/mock "):
+			return "RTSP/1.0 301 Moved Permanently\r\nLocation: /live?channel=1\r\n\r\n"
+		case method == "PLAY":
+			conns <- conn
+		}
+		return ""
+	}
+	gateway := startMockCamera(t)
+	gateway.handle = func(method, req string, conn net.Conn) string {
+		if method == "DESCRIBE" {
+			return fmt.Sprintf("RTSP/1.0 302 Found\r\nLocation: rtsp://%s/mock\r\n\r\n", node.Addr())
+		}
+		return ""
+	}
+
+	server, _ := startTunnelServer(t)
+	stream := server.LookupStreamScheme("rtsp", gateway.Addr(), "", "", "/mock")
+	stream.AddConsumer(nopConsumer{})
+	t.Cleanup(func() { stream.RemoveConsumer(nopConsumer{}) })
+	var conn net.Conn
+	select {
+	case conn = <-conns:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stream did not start; node got %v", node.Methods())
+	}
+	if stream.Host != gateway.Addr() || stream.Path != "/mock" {
+		t.Errorf("stream key changed to %s%s", stream.Host, stream.Path)
+	}
+	node.mu.Lock()
+	last := node.requests[len(node.requests)-1]
+	node.mu.Unlock()
+	if !strings.HasPrefix(last, fmt.Sprintf("PLAY rtsp://%s/live?channel=1 ", node.Addr())) {
+		t.Errorf("node got %q", last)
+	}
+
+	// The reconnect goes straight to the resolved endpoint.
+	gatewayRequests := len(gateway.Methods())
+	conn.Close()
+	select {
+	case <-conns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not reconnect")
+	}
+	if n := len(gateway.Methods()); n != gatewayRequests {
+		t.Errorf("reconnect went through the gateway: %v", gateway.Methods())
+	}
+
+	// Another host gets the credentials its Location names, not the camera's.
+	ln, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := serveMockCamera(t, ln)
+	var leaked atomic.Bool
+	other.handle = func(method, req string, conn net.Conn) string {
+		switch headerGet(parseMockHeaders(req), "Authorization") {
+		case "Basic " + base64.StdEncoding.EncodeToString([]byte("viewer:pw")):
+			return ""
+		case "":
+		default:
+			leaked.Store(true)
+		}
+		return "RTSP/1.0 401 Unauthorized\r\nWWW-Authenticate: Basic realm=\"other\"\r\n\r\n"
+	}
+	moved := startMockCamera(t)
+	moved.handle = func(method, req string, conn net.Conn) string {
+		switch {
+		case method == "DESCRIBE" && strings.Contains(req, "/bare "):
+			return fmt.Sprintf("RTSP/1.0 302 Found\r\nLocation: rtsp://%s/bare\r\n\r\n", other.Addr())
+		case method == "DESCRIBE":
+			return fmt.Sprintf("RTSP/1.0 302 Found\r\nLocation: rtsp://viewer:pw@%s/mock\r\n\r\n", other.Addr())
+		}
+		return ""
+	}
+	bare := server.LookupStreamScheme("rtsp", moved.Addr(), "admin", "secret", "/bare")
+	bare.AddConsumer(nopConsumer{})
+	t.Cleanup(func() { bare.RemoveConsumer(nopConsumer{}) })
+	away := server.LookupStreamScheme("rtsp", moved.Addr(), "admin", "secret", "/mock")
+	away.AddConsumer(nopConsumer{})
+	t.Cleanup(func() { away.RemoveConsumer(nopConsumer{}) })
+	select {
+	case <-away.ReadyCh():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("cross-host stream did not start; other got %v", other.Methods())
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := strings.Count(strings.Join(other.Methods(), " "), "DESCRIBE"); n < 3 || leaked.Load() {
+		t.Errorf("redirect target got %d DESCRIBEs, camera credentials leaked: %v", n, leaked.Load())
+	}
+
+	// A redirect loop stops after MaxRedirects hops and backs off.
+	loop := startMockCamera(t)
+	loop.handle = func(method, req string, conn net.Conn) string {
+		if method == "DESCRIBE" {
+			return "RTSP/1.0 302 Found\r\nLocation: /mock\r\n\r\n"
+		}
+		return ""
+	}
+	GlobalConfig.ReconnectBackoff = []time.Duration{time.Minute}
+	looping := server.LookupStreamScheme("rtsp", loop.Addr(), "", "", "/mock")
+	looping.AddConsumer(nopConsumer{})
+	t.Cleanup(func() { looping.RemoveConsumer(nopConsumer{}) })
+	time.Sleep(500 * time.Millisecond)
+	if n := strings.Count(strings.Join(loop.Methods(), " "), "DESCRIBE"); n != 3 {
+		t.Errorf("redirect loop: %d DESCRIBEs, want 3", n)
+	}
+}
@@ -6,9 +6,36 @@ import (
 	"fmt"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// proxySchemes are the path prefixes accepted in proxy URLs
+// (rtsp://proxy/<scheme>/host/path). The prefix selects how the camera is
+// reached: "rtsp" uses the global default, "rtsp+tcp"/"rtsp+udp"/"rtsp+multicast"
+// force the RTP lower transport, "rtsps" connects over TLS (port 322) and
+// "rtsp+http" tunnels RTSP through HTTP (port 80).
+var proxySchemes = []string{"rtsp", "rtsp+tcp", "rtsp+udp", "rtsp+multicast", "rtsps", "rtsp+http"}
+
+var proxyURLRe = func() *regexp.Regexp {
+	quoted := make([]string, len(proxySchemes))
+	for i, scheme := range proxySchemes {
+		quoted[i] = regexp.QuoteMeta(scheme)
+	}
+	return regexp.MustCompile(`^rtsps?:\/\/[^:\/]+(:?[:]\d+)?\/(` + strings.Join(quoted, "|") + `)\/(.*)`)
+}()
+
+// isProxyScheme reports whether s is one of proxySchemes.
+func isProxyScheme(s string) bool {
+	for _, scheme := range proxySchemes {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
+
 // Request represents an RTSP request.
 type Request struct {
 	Method          string
@@ -19,8 +46,22 @@ type Request struct {
 	Body            []byte
 	Attempts        int
 	Subscriptions   *list.List
+	Timeout         time.Duration // how long SendRequestSync waits for the response
+
+	redirect     *redirectError // set by a 3xx response with a Location
+	failure      *statusError   // set by any other response >= 300
+	staleRetries int            // resends after a stale=true Digest challenge
+	transport    *Transport     // set by a successful SETUP response
 }
 
+const (
+	// defaultRequestTimeout bounds the wait for a camera's response.
+	defaultRequestTimeout = 10 * time.Second
+	// maxStaleRetries bounds resends for a camera that keeps calling
+	// its fresh nonces stale.
+	maxStaleRetries = 3
+)
+
 // NewRequest creates a new RTSP request.
 func NewRequest(method string, URL *url.URL, args ...string) (*Request, error) {
 	protocolVersion := "RTSP/1.0"
@@ -74,9 +115,8 @@ func (request *Request) ParseCommand(buffer string) error {
 		LogCriticalf("Request: %s, length: %d", buffer, len(buffer))
 		return errors.New("Method parse error")
 	}
-	// Proxy URL form: rtsp://proxy/rtsp/host/path  →  rtsp://host/path
-	re := regexp.MustCompile(`^rtsp:\/\/[^:\/]+(:?[:]\d+)?\/(rtsp)\/(.*)`)
-	rawURL := re.ReplaceAllString(request.RawURL, "$2://$3")
+	// Proxy URL form: rtsp[s]://proxy/rtsp/host/path  →  rtsp://host/path
+	rawURL := proxyURLRe.ReplaceAllString(request.RawURL, "$2://$3")
 	Logf("DEBUG: ParseCommand rawURL after regex: %q", rawURL)
 	URL, err := url.Parse(rawURL)
 	if err != nil {
@@ -107,6 +147,9 @@ func (request *Request) ParseRequest(buffer string) error {
 		}
 		request.Headers[key] = value
 	}
+	if contentLength, _ := strconv.Atoi(headerGet(request.Headers, "Content-Length")); contentLength > 0 {
+		request.Body = []byte(next[:min(contentLength, len(next))])
+	}
 	return nil
 }
 
@@ -128,5 +171,5 @@ func (request *Request) String() string {
 		response += fmt.Sprintf("%s: %s\r\n", key, value)
 	}
 	response += "\r\n"
-	return response
+	return response + string(request.Body)
 }
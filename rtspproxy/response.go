@@ -93,6 +93,9 @@ func (response *Response) ParseResponse(buffer string) error {
 		if err != nil {
 			return err
 		}
+		if prev, ok := response.Headers[key]; ok && key == "Www-Authenticate" {
+			value = prev + ", " + value // one challenge per header line (RFC 7235 4.1)
+		}
 		response.Headers[key] = value
 	}
 	if contentLengthRaw := headerGet(response.Headers, "Content-Length"); contentLengthRaw != "" {
@@ -0,0 +1,436 @@
+package rtspproxy
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// rtpPacket is a parsed RTP header with its payload (RFC 3550). Payload
+// aliases the input buffer.
+type rtpPacket struct {
+	Marker      bool
+	PayloadType uint8
+	Seq         uint16
+	Timestamp   uint32
+	SSRC        uint32
+	Payload     []byte
+}
+
+var errShortRTP = errors.New("rtp: packet too short")
+
+func parseRTP(b []byte) (rtpPacket, error) {
+	var p rtpPacket
+	if len(b) < 12 || b[0]>>6 != 2 {
+		return p, errShortRTP
+	}
+	p.Marker = b[1]&0x80 != 0
+	p.PayloadType = b[1] & 0x7f
+	p.Seq = uint16(b[2])<<8 | uint16(b[3])
+	p.Timestamp = uint32(b[4])<<24 | uint32(b[5])<<16 | uint32(b[6])<<8 | uint32(b[7])
+	p.SSRC = uint32(b[8])<<24 | uint32(b[9])<<16 | uint32(b[10])<<8 | uint32(b[11])
+
+	offset := 12 + int(b[0]&0x0f)*4
+	if b[0]&0x10 != 0 { // header extension
+		if len(b) < offset+4 {
+			return p, errShortRTP
+		}
+		offset += 4 + (int(b[offset+2])<<8|int(b[offset+3]))*4
+	}
+	end := len(b)
+	if b[0]&0x20 != 0 && end > 0 { // padding
+		end -= int(b[end-1])
+	}
+	if offset > end {
+		return p, errShortRTP
+	}
+	p.Payload = b[offset:end]
+	return p, nil
+}
+
+// rtpTimeline unwraps the RTP timestamps of one track into a monotonic
+// clock. Tracks start at their arrival time relative to a shared origin, so
+// tracks of one stream stay in sync; jumps of more than 10s (camera
+// restart) are treated as continuous.
+type rtpTimeline struct {
+	clock   int64 // RTP clock rate
+	started bool
+	lastTS  uint32
+	elapsed int64 // clock units since the track's first packet
+	base    int64 // clock units from origin to the track's first packet
+}
+
+// at returns the time of an RTP timestamp in clock units since origin.
+func (t *rtpTimeline) at(ts uint32, origin time.Time) int64 {
+	if !t.started {
+		t.started = true
+		t.lastTS = ts
+		t.base = int64(time.Since(origin)) * t.clock / int64(time.Second)
+	}
+	delta := int64(int32(ts - t.lastTS))
+	if delta > 10*t.clock || delta < -10*t.clock {
+		delta = 0
+	}
+	t.elapsed += delta
+	t.lastTS = ts
+	return t.base + t.elapsed
+}
+
+// accessUnit is one video picture (all NAL units sharing an RTP timestamp)
+// or one audio frame.
+type accessUnit struct {
+	Timestamp uint32
+	NALUs     [][]byte // video only
+	Data      []byte   // audio only
+	Keyframe  bool
+}
+
+// videoDepacketizer reassembles H.264 (RFC 6184) or H.265 (RFC 7798) access
+// units from RTP: single NAL units, STAP-A/AP aggregates and FU-A/FU
+// fragments. Fragments interrupted by packet loss are discarded.
+type videoDepacketizer struct {
+	hevc    bool
+	onAU    func(*accessUnit)
+	au      *accessUnit
+	fu      []byte
+	lastSeq uint16
+	started bool
+}
+
+func newVideoDepacketizer(codec string, onAU func(*accessUnit)) *videoDepacketizer {
+	return &videoDepacketizer{hevc: codec == "H265", onAU: onAU}
+}
+
+func (d *videoDepacketizer) push(p rtpPacket) {
+	if d.started && p.Seq != d.lastSeq+1 {
+		d.fu = nil // a fragment was lost
+	}
+	d.started = true
+	d.lastSeq = p.Seq
+
+	if d.au != nil && d.au.Timestamp != p.Timestamp {
+		d.flush() // the camera did not set the marker bit
+	}
+	if d.au == nil {
+		d.au = &accessUnit{Timestamp: p.Timestamp}
+	}
+
+	if d.hevc {
+		d.pushH265(p.Payload)
+	} else {
+		d.pushH264(p.Payload)
+	}
+	if p.Marker {
+		d.flush()
+	}
+}
+
+func (d *videoDepacketizer) pushH264(payload []byte) {
+	if len(payload) < 1 {
+		return
+	}
+	switch typ := payload[0] & 0x1f; typ {
+	case 24: // STAP-A
+		d.aggregate(payload[1:])
+	case 28: // FU-A
+		if len(payload) < 2 {
+			return
+		}
+		header := payload[1]
+		if header&0x80 != 0 {
+			d.fu = append([]byte{payload[0]&0xe0 | header&0x1f}, payload[2:]...)
+		} else if d.fu != nil {
+			d.fu = append(d.fu, payload[2:]...)
+		}
+		if header&0x40 != 0 && d.fu != nil {
+			d.addNALU(d.fu)
+			d.fu = nil
+		}
+	default:
+		d.addNALU(append([]byte(nil), payload...))
+	}
+}
+
+func (d *videoDepacketizer) pushH265(payload []byte) {
+	if len(payload) < 2 {
+		return
+	}
+	switch typ := (payload[0] >> 1) & 0x3f; typ {
+	case 48: // AP
+		d.aggregate(payload[2:])
+	case 49: // FU
+		if len(payload) < 3 {
+			return
+		}
+		header := payload[2]
+		if header&0x80 != 0 {
+			d.fu = append([]byte{payload[0]&0x81 | (header&0x3f)<<1, payload[1]}, payload[3:]...)
+		} else if d.fu != nil {
+			d.fu = append(d.fu, payload[3:]...)
+		}
+		if header&0x40 != 0 && d.fu != nil {
+			d.addNALU(d.fu)
+			d.fu = nil
+		}
+	default:
+		d.addNALU(append([]byte(nil), payload...))
+	}
+}
+
+// aggregate splits 16-bit length-prefixed NAL units (STAP-A / AP).
+func (d *videoDepacketizer) aggregate(b []byte) {
+	for len(b) >= 2 {
+		size := int(b[0])<<8 | int(b[1])
+		b = b[2:]
+		if size == 0 || size > len(b) {
+			return
+		}
+		d.addNALU(append([]byte(nil), b[:size]...))
+		b = b[size:]
+	}
+}
+
+func (d *videoDepacketizer) addNALU(nalu []byte) {
+	if len(nalu) == 0 {
+		return
+	}
+	d.au.NALUs = append(d.au.NALUs, nalu)
+	if isKeyframeNALU(d.hevc, nalu) {
+		d.au.Keyframe = true
+	}
+}
+
+func (d *videoDepacketizer) flush() {
+	au := d.au
+	d.au = nil
+	if au != nil && len(au.NALUs) > 0 {
+		d.onAU(au)
+	}
+}
+
+// naluType returns the NAL unit type of an H.264 or H.265 NAL unit.
+func naluType(hevc bool, nalu []byte) int {
+	if hevc {
+		return int(nalu[0]>>1) & 0x3f
+	}
+	return int(nalu[0]) & 0x1f
+}
+
+// isKeyframeNALU reports IDR slices (H.264) and IRAP pictures (H.265).
+func isKeyframeNALU(hevc bool, nalu []byte) bool {
+	typ := naluType(hevc, nalu)
+	if hevc {
+		return typ >= 16 && typ <= 21
+	}
+	return typ == 5
+}
+
+// rtpHasKeyframe reports whether an H.264/H.265 RTP payload carries the
+// start of a keyframe: a keyframe NAL unit, an aggregate containing one, or
+// the first fragment of one.
+func rtpHasKeyframe(hevc bool, payload []byte) bool {
+	if hevc {
+		if len(payload) < 3 {
+			return false
+		}
+		switch (payload[0] >> 1) & 0x3f {
+		case 48: // AP
+			return aggregateHasKeyframe(hevc, payload[2:])
+		case 49: // FU
+			typ := payload[2] & 0x3f
+			return payload[2]&0x80 != 0 && typ >= 16 && typ <= 21
+		}
+		return isKeyframeNALU(hevc, payload)
+	}
+	if len(payload) < 2 {
+		return false
+	}
+	switch payload[0] & 0x1f {
+	case 24: // STAP-A
+		return aggregateHasKeyframe(hevc, payload[1:])
+	case 28: // FU-A
+		return payload[1]&0x80 != 0 && payload[1]&0x1f == 5
+	}
+	return isKeyframeNALU(hevc, payload)
+}
+
+func aggregateHasKeyframe(hevc bool, b []byte) bool {
+	for len(b) >= 2 {
+		size := int(b[0])<<8 | int(b[1])
+		b = b[2:]
+		if size == 0 || size > len(b) {
+			return false
+		}
+		if isKeyframeNALU(hevc, b[:size]) {
+			return true
+		}
+		b = b[size:]
+	}
+	return false
+}
+
+// isParameterSetNALU reports SPS/PPS (H.264) and VPS/SPS/PPS (H.265).
+func isParameterSetNALU(hevc bool, nalu []byte) bool {
+	typ := naluType(hevc, nalu)
+	if hevc {
+		return typ >= 32 && typ <= 34
+	}
+	return typ == 7 || typ == 8
+}
+
+// aacDepacketizer extracts AAC frames from mpeg4-generic RTP (RFC 3640,
+// AAC-hbr/AAC-lbr modes), including a single AU fragmented over packets.
+type aacDepacketizer struct {
+	sizeLength  int
+	indexLength int
+	onAU        func(*accessUnit)
+	frag        []byte
+	fragSize    int
+	fragTS      uint32
+}
+
+func newAACDepacketizer(media *sdpMedia, onAU func(*accessUnit)) *aacDepacketizer {
+	d := &aacDepacketizer{sizeLength: 13, indexLength: 3, onAU: onAU}
+	if n, err := strconv.Atoi(media.Fmtp["sizelength"]); err == nil && n > 0 {
+		d.sizeLength = n
+	}
+	if n, err := strconv.Atoi(media.Fmtp["indexlength"]); err == nil && n >= 0 {
+		d.indexLength = n
+	}
+	return d
+}
+
+func (d *aacDepacketizer) push(p rtpPacket) {
+	b := p.Payload
+	if len(b) < 2 {
+		return
+	}
+	headerBits := int(b[0])<<8 | int(b[1])
+	headerBytes := (headerBits + 7) / 8
+	b = b[2:]
+	if len(b) < headerBytes {
+		return
+	}
+	headers, data := b[:headerBytes], b[headerBytes:]
+
+	perHeader := d.sizeLength + d.indexLength
+	if perHeader == 0 {
+		return
+	}
+	var sizes []int
+	for bit := 0; bit+perHeader <= headerBits; bit += perHeader {
+		sizes = append(sizes, readBits(headers, bit, d.sizeLength))
+	}
+
+	// A fragmented AU repeats its full size in every fragment.
+	continuing := d.frag != nil && d.fragTS == p.Timestamp
+	if continuing || len(sizes) == 1 && sizes[0] > len(data) {
+		if !continuing {
+			d.frag = make([]byte, 0, sizes[0])
+			d.fragSize = sizes[0]
+			d.fragTS = p.Timestamp
+		}
+		d.frag = append(d.frag, data...)
+		if len(d.frag) >= d.fragSize {
+			d.onAU(&accessUnit{Timestamp: d.fragTS, Data: d.frag[:d.fragSize]})
+			d.frag = nil
+		}
+		return
+	}
+	d.frag = nil
+
+	for i, size := range sizes {
+		if size > len(data) {
+			return
+		}
+		d.onAU(&accessUnit{Timestamp: p.Timestamp + uint32(i*1024), Data: append([]byte(nil), data[:size]...)})
+		data = data[size:]
+	}
+}
+
+// readBits reads n bits (n <= 32) starting at bit offset off, MSB first.
+func readBits(b []byte, off, n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		byteIdx := (off + i) / 8
+		if byteIdx >= len(b) {
+			return v
+		}
+		v = v<<1 | int(b[byteIdx]>>(7-uint((off+i)%8))&1)
+	}
+	return v
+}
+
+// rtpPacketizer builds RTP packets for one track, the inverse of the
+// depacketizers above: H.264/H.265 NAL units as single packets or FU-A/FU
+// fragments, AAC frames as RFC 3640 AAC-hbr (sizelength=13,
+// indexlength=3), fragmented when larger than the MTU.
+type rtpPacketizer struct {
+	payloadType uint8
+	ssrc        uint32
+	seq         uint16 // of the next packet
+	mtu         int    // maximum RTP payload size
+}
+
+func (p *rtpPacketizer) packet(ts uint32, marker bool, payload ...[]byte) []byte {
+	b := []byte{0x80, p.payloadType, byte(p.seq >> 8), byte(p.seq),
+		byte(ts >> 24), byte(ts >> 16), byte(ts >> 8), byte(ts),
+		byte(p.ssrc >> 24), byte(p.ssrc >> 16), byte(p.ssrc >> 8), byte(p.ssrc)}
+	if marker {
+		b[1] |= 0x80
+	}
+	for _, part := range payload {
+		b = append(b, part...)
+	}
+	p.seq++
+	return b
+}
+
+// video packetizes the NAL units of one access unit; the marker bit is set
+// on its last packet.
+func (p *rtpPacketizer) video(hevc bool, ts uint32, nalus [][]byte) [][]byte {
+	var packets [][]byte
+	for i, nalu := range nalus {
+		last := i == len(nalus)-1
+		if len(nalu) <= p.mtu {
+			packets = append(packets, p.packet(ts, last, nalu))
+			continue
+		}
+		var header []byte // FU indicator/payload header, without the FU header
+		var fuType byte
+		var body []byte
+		if hevc {
+			header = []byte{nalu[0]&0x81 | 49<<1, nalu[1]}
+			fuType, body = nalu[0]>>1&0x3f, nalu[2:]
+		} else {
+			header = []byte{nalu[0]&0xe0 | 28}
+			fuType, body = nalu[0]&0x1f, nalu[1:]
+		}
+		chunk := p.mtu - len(header) - 1
+		for start := true; len(body) > 0; start = false {
+			n := min(chunk, len(body))
+			fu := fuType
+			if start {
+				fu |= 0x80
+			}
+			if n == len(body) {
+				fu |= 0x40
+			}
+			packets = append(packets, p.packet(ts, last && n == len(body), header, []byte{fu}, body[:n]))
+			body = body[n:]
+		}
+	}
+	return packets
+}
+
+// aac packetizes one raw AAC frame.
+func (p *rtpPacketizer) aac(ts uint32, frame []byte) [][]byte {
+	header := []byte{0x00, 0x10, byte(len(frame) >> 5), byte(len(frame) << 3)}
+	var packets [][]byte
+	for len(frame) > 0 {
+		n := min(p.mtu-len(header), len(frame))
+		packets = append(packets, p.packet(ts, n == len(frame), header, frame[:n]))
+		frame = frame[n:]
+	}
+	return packets
+}
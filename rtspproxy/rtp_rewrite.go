@@ -0,0 +1,143 @@
+package rtspproxy
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// RTP continuity across upstream reconnects. A camera starts every RTSP
+// session with a fresh SSRC, sequence number and timestamp base; forwarded
+// as is, players see a new source mid-stream and many of them stall.
+// Stream.dispatch passes each packet through the rewriter of its track,
+// which keeps the SSRC of the first session and shifts sequence numbers and
+// timestamps of later sessions to continue where the previous one stopped
+// (timestamps advance by the wall-clock time of the outage). Packets of the
+// first session keep their values. RTCP sender/receiver reports get the
+// same SSRC and SR timestamps the same shift.
+
+// rtpRewriter holds the mapping of one track; guarded by Stream.mu.
+type rtpRewriter struct {
+	clock    int64 // RTP clock rate from the SDP
+	started  bool
+	resync   bool // a new upstream session starts with the next packet
+	ssrc     uint32
+	inSSRC   uint32
+	seqDelta uint16
+	tsDelta  uint32
+	lastSeq  uint16 // last rewritten values
+	lastTS   uint32
+	lastAt   time.Time
+}
+
+// rtpPosition is the sequence number and timestamp of a rewritten packet.
+type rtpPosition struct {
+	seq uint16
+	ts  uint32
+}
+
+// resyncRTPLocked prepares the rewriters for the session described by sdp,
+// whose media arrive on channels (see Stream.mediaChannels).
+func (s *Stream) resyncRTPLocked(sdp string, channels map[int]int) {
+	if s.rewriters == nil {
+		s.rewriters = make(map[int]*rtpRewriter)
+	}
+	for i, media := range parseSDPMedia(sdp) {
+		channel, ok := channels[i]
+		if !ok {
+			continue
+		}
+		r := s.rewriters[channel]
+		if r == nil {
+			r = &rtpRewriter{}
+			s.rewriters[channel] = r
+		}
+		r.clock = int64(media.ClockRate)
+		r.resync = r.started
+	}
+}
+
+// rewriteLocked rewrites an interleaved-framed packet in place.
+func (s *Stream) rewriteLocked(channel int, packet []byte, now time.Time) {
+	if len(packet) <= streamHeaderLength {
+		return
+	}
+	if r := s.rewriters[channel&^1]; r != nil {
+		if channel%2 == 0 {
+			r.rtp(packet[streamHeaderLength:], now)
+		} else {
+			r.rtcp(packet[streamHeaderLength:])
+		}
+	}
+}
+
+func (r *rtpRewriter) rtp(p []byte, now time.Time) {
+	if len(p) < 12 || p[0]>>6 != 2 {
+		return
+	}
+	ssrc := binary.BigEndian.Uint32(p[8:])
+	seq := binary.BigEndian.Uint16(p[2:])
+	ts := binary.BigEndian.Uint32(p[4:])
+	switch {
+	case !r.started:
+		r.started, r.ssrc = true, ssrc
+	case r.resync || ssrc != r.inSSRC:
+		ticks := uint32(max(int64(now.Sub(r.lastAt))*r.clock/int64(time.Second), 1))
+		r.seqDelta = r.lastSeq + 1 - seq
+		r.tsDelta = r.lastTS + ticks - ts
+		r.resync = false
+	}
+	r.inSSRC = ssrc
+
+	seq += r.seqDelta
+	ts += r.tsDelta
+	binary.BigEndian.PutUint16(p[2:], seq)
+	binary.BigEndian.PutUint32(p[4:], ts)
+	binary.BigEndian.PutUint32(p[8:], r.ssrc)
+	if int16(seq-r.lastSeq) > 0 || r.lastAt.IsZero() {
+		r.lastSeq, r.lastTS = seq, ts
+	}
+	r.lastAt = now
+}
+
+// rtcp rewrites the first report of a compound RTCP packet.
+func (r *rtpRewriter) rtcp(p []byte) {
+	if !r.started || len(p) < 8 || p[0]>>6 != 2 {
+		return
+	}
+	switch p[1] {
+	case 200: // SR
+		binary.BigEndian.PutUint32(p[4:], r.ssrc)
+		if len(p) >= 20 {
+			binary.BigEndian.PutUint32(p[16:], binary.BigEndian.Uint32(p[16:])+r.tsDelta)
+		}
+	case 201: // RR
+		binary.BigEndian.PutUint32(p[4:], r.ssrc)
+	}
+}
+
+// next predicts the position of the next packet of a track.
+func (r *rtpRewriter) next() (rtpPosition, bool) {
+	return rtpPosition{seq: r.lastSeq + 1, ts: r.lastTS}, r.started
+}
+
+// rtpStartLocked returns where a client's delivery of upstream channel
+// starts: its first packet when one was queued, otherwise the next packet
+// of the track.
+func (s *Stream) rtpStartLocked(cs *ClientSession, channel int) (rtpPosition, bool) {
+	if pos, ok := cs.rtpStart[channel]; ok {
+		return pos, true
+	}
+	if r := s.rewriters[channel]; r != nil {
+		return r.next()
+	}
+	return rtpPosition{}, false
+}
+
+// rtpPositionOf reads the position of an interleaved-framed RTP packet.
+func rtpPositionOf(packet []byte) (rtpPosition, bool) {
+	if len(packet) < streamHeaderLength+12 {
+		return rtpPosition{}, false
+	}
+	p := packet[streamHeaderLength:]
+	return rtpPosition{seq: binary.BigEndian.Uint16(p[2:]), ts: binary.BigEndian.Uint32(p[4:])}, true
+}
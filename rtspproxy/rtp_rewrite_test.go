@@ -0,0 +1,81 @@
+package rtspproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRTPRewriteAcrossReconnect(t *testing.T) {
+	s := &Stream{}
+	start := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	send := func(at time.Time, channel int, ssrc uint32, seq uint16, ts uint32) rtpPosition {
+		pkt := rtpPacketBytes(96, seq, ts, true, []byte{0x41})
+		binary.BigEndian.PutUint32(pkt[8:], ssrc)
+		packet := append([]byte{'$', byte(channel), 0, 0}, pkt...)
+		s.rewriteLocked(channel, packet, at)
+		if got := binary.BigEndian.Uint32(packet[streamHeaderLength+8:]); got != 0xaaaa {
+			t.Errorf("SSRC %x, want aaaa", got)
+		}
+		pos, _ := rtpPositionOf(packet)
+		return pos
+	}
+
+	// The first session passes through unchanged.
+	s.resyncRTPLocked(h264SDP, h264Channels)
+	for i := 0; i < 3; i++ {
+		pos := send(start.Add(time.Duration(i)*40*time.Millisecond), 0, 0xaaaa, uint16(65534+i), uint32(1000+i*3600))
+		if pos.seq != uint16(65534+i) || pos.ts != uint32(1000+i*3600) {
+			t.Errorf("first session rewritten: %+v", pos)
+		}
+	}
+
+	// After a 2s outage the camera starts over with a new SSRC and base.
+	s.resyncRTPLocked(h264SDP, h264Channels)
+	pos := send(start.Add(80*time.Millisecond+2*time.Second), 0, 0xbbbb, 100, 555)
+	if pos.seq != 1 || pos.ts != 1000+2*3600+2*90000 {
+		t.Errorf("after reconnect: seq %d ts %d, want 1 and %d", pos.seq, pos.ts, 1000+2*3600+2*90000)
+	}
+	if pos = send(start.Add(120*time.Millisecond+2*time.Second), 0, 0xbbbb, 101, 555+3600); pos.seq != 2 || pos.ts != 1000+3*3600+2*90000 {
+		t.Errorf("second packet after reconnect: %+v", pos)
+	}
+
+	// Sender reports follow the same mapping.
+	sr := make([]byte, 28)
+	sr[0], sr[1] = 0x80, 200
+	binary.BigEndian.PutUint32(sr[4:], 0xbbbb)
+	binary.BigEndian.PutUint32(sr[16:], 555)
+	packet := append([]byte{'$', 1, 0, 0}, sr...)
+	s.rewriteLocked(1, packet, start)
+	if ssrc, ts := binary.BigEndian.Uint32(packet[8:]), binary.BigEndian.Uint32(packet[20:]); ssrc != 0xaaaa || ts != 1000+2*3600+2*90000 {
+		t.Errorf("SR ssrc %x ts %d", ssrc, ts)
+	}
+}
+
+func TestRTPInfo(t *testing.T) {
+	_, addr := startTunnelServer(t)
+	cam := startH264Camera(t)
+	base := fmt.Sprintf("rtsp://%s/rtsp/%s/mock", addr, cam.Addr())
+
+	c := dialRTSP(t, addr)
+	c.do("DESCRIBE", base, "")
+	_, headers, _ := c.do("SETUP", base+"/track1", "Transport: RTP/AVP/TCP;unicast;interleaved=0-1\r\n")
+	time.Sleep(100 * time.Millisecond) // packets flow from SETUP on
+	_, headers, _ = c.do("PLAY", base, "Session: "+headerGet(headers, "Session")+"\r\n")
+
+	info := headerGet(headers, "RTP-Info")
+	var seq uint16
+	var rtptime uint32
+	if _, err := fmt.Sscanf(strings.TrimPrefix(info, "url="+base+"/track1"), ";seq=%d;rtptime=%d", &seq, &rtptime); err != nil {
+		t.Fatalf("RTP-Info %q: %v", info, err)
+	}
+	if len(c.frames) == 0 {
+		t.Fatal("no packets before the PLAY reply")
+	}
+	first, _ := parseRTP(c.frames[0][2:])
+	if first.Seq != seq || first.Timestamp != rtptime {
+		t.Errorf("RTP-Info seq %d rtptime %d, first packet seq %d ts %d", seq, rtptime, first.Seq, first.Timestamp)
+	}
+}
@@ -0,0 +1,78 @@
+package rtspproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// RTSP over WebSocket for JavaScript RTSP players: ws://proxy/ws carries a
+// regular RTSP session (the same rtsp://proxy/rtsp/... URLs). RTSP messages
+// travel in text frames, interleaved '$' packets in binary frames; incoming
+// frames of either kind are read as one byte stream by the usual
+// Client.incomingRequestHandler.
+
+const rtspWebSocketProtocol = "rtsp"
+
+// httpConnKey stores the accepted net.Conn in HTTP request contexts.
+type httpConnKey struct{}
+
+func httpConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, httpConnKey{}, conn)
+}
+
+// rtspWebSocketConn adapts a WebSocket to the net.Conn a Client expects.
+type rtspWebSocketConn struct {
+	*websocket.Conn
+	netConn net.Conn // the HTTP connection, for addresses and TLS detection
+	mu      sync.Mutex
+}
+
+func (c *rtspWebSocketConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(p) > 0 && p[0] == '$' {
+		c.PayloadType = websocket.BinaryFrame
+	} else {
+		c.PayloadType = websocket.TextFrame
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *rtspWebSocketConn) LocalAddr() net.Addr  { return c.netConn.LocalAddr() }
+func (c *rtspWebSocketConn) RemoteAddr() net.Addr { return c.netConn.RemoteAddr() }
+func (c *rtspWebSocketConn) NetConn() net.Conn    { return c.netConn }
+
+// serveRTSPWebSocket upgrades /ws requests and runs an RTSP session on them.
+func (server *Server) serveRTSPWebSocket(w http.ResponseWriter, r *http.Request) {
+	netConn, ok := r.Context().Value(httpConnKey{}).(net.Conn)
+	if !ok {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	websocket.Server{
+		// Accept any origin; select the "rtsp" subprotocol when offered.
+		Handshake: func(config *websocket.Config, _ *http.Request) error {
+			if slices.Contains(config.Protocol, rtspWebSocketProtocol) {
+				config.Protocol = []string{rtspWebSocketProtocol}
+			} else {
+				config.Protocol = nil
+			}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			server.clients.Add(1)
+			defer server.clients.Done()
+
+			LogCriticalf("🔌 [WS] RTSP-over-WebSocket session from [%s]", netConn.RemoteAddr())
+			client := NewClient(server, &rtspWebSocketConn{Conn: ws, netConn: netConn})
+			if client != nil {
+				client.incomingRequestHandler()
+			}
+		},
+	}.ServeHTTP(w, r)
+}
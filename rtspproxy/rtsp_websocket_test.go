@@ -0,0 +1,83 @@
+package rtspproxy
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestRTSPOverWebSocket(t *testing.T) {
+	_, addr := startTunnelServer(t)
+	cam := startMockCamera(t)
+
+	config, err := websocket.NewConfig("ws://"+addr+"/ws", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Protocol = []string{rtspWebSocketProtocol}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	base := fmt.Sprintf("rtsp://%s/rtsp/%s/mock", addr, cam.Addr())
+	request := func(cseq, req string) string {
+		t.Helper()
+		if err := websocket.Message.Send(ws, req); err != nil {
+			t.Fatal(err)
+		}
+		var reply string
+		if err := websocket.Message.Receive(ws, &reply); err != nil {
+			t.Fatalf("reading reply %s: %v", cseq, err)
+		}
+		if !strings.HasPrefix(reply, "RTSP/1.0 200") || headerGet(parseMockHeaders(reply), "CSeq") != cseq {
+			t.Fatalf("unexpected reply to CSeq %s:\n%s", cseq, reply)
+		}
+		return reply
+	}
+
+	request("1", fmt.Sprintf("OPTIONS %s RTSP/1.0\r\nCSeq: 1\r\n\r\n", base))
+	if sdp := request("2", fmt.Sprintf("DESCRIBE %s RTSP/1.0\r\nCSeq: 2\r\nAccept: application/sdp\r\n\r\n", base)); !strings.Contains(sdp, "m=video") {
+		t.Errorf("DESCRIBE reply has no SDP:\n%s", sdp)
+	}
+	setup := request("3", fmt.Sprintf("SETUP %s/track1 RTSP/1.0\r\nCSeq: 3\r\nTransport: RTP/AVP/TCP;unicast;interleaved=0-1\r\n\r\n", base))
+	session := strings.SplitN(headerGet(parseMockHeaders(setup), "Session"), ";", 2)[0]
+	request("4", fmt.Sprintf("PLAY %s RTSP/1.0\r\nCSeq: 4\r\nSession: %s\r\n\r\n", base, session))
+
+	// Interleaved RTP arrives in binary frames, one packet per frame.
+	var frame []byte
+	if err := websocket.Message.Receive(ws, &frame); err != nil {
+		t.Fatal(err)
+	}
+	if len(frame) < 4 || frame[0] != '$' || frame[1] != 0 || int(frame[2])<<8|int(frame[3]) != len(frame)-4 {
+		t.Errorf("unexpected interleaved frame % x", frame[:min(len(frame), 8)])
+	}
+}
+
+func TestRTSPWebSocketSubprotocol(t *testing.T) {
+	_, addr := startTunnelServer(t)
+
+	// Players that do not ask for a subprotocol are accepted too.
+	ws, err := websocket.Dial("ws://"+addr+"/ws", "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if len(ws.Config().Protocol) != 0 {
+		t.Errorf("unexpected subprotocol %v", ws.Config().Protocol)
+	}
+	ws.SetReadDeadline(time.Now().Add(3 * time.Second))
+	websocket.Message.Send(ws, "OPTIONS rtsp://localhost/ RTSP/1.0\r\nCSeq: 7\r\n\r\n")
+	var reply string
+	if err := websocket.Message.Receive(ws, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if headerGet(parseMockHeaders(reply), "CSeq") != "7" {
+		t.Errorf("unexpected reply:\n%s", reply)
+	}
+}
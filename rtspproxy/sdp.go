@@ -0,0 +1,120 @@
+package rtspproxy
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// sdpMedia is one m= section of a camera SDP, reduced to what the
+// depacketizers and muxers need.
+type sdpMedia struct {
+	Type        string // "video", "audio", ...
+	PayloadType int
+	Codec       string // upper-case encoding name: H264, H265, MPEG4-GENERIC, PCMU, OPUS, ...
+	ClockRate   int
+	Channels    int
+	Fmtp        map[string]string // keys lower-cased
+	Control     string
+}
+
+// parseSDPMedia returns the media sections of sdp in order.
+func parseSDPMedia(sdp string) []*sdpMedia {
+	var medias []*sdpMedia
+	var current *sdpMedia
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			fields := strings.Fields(strings.TrimPrefix(line, "m="))
+			current = &sdpMedia{PayloadType: -1, Fmtp: make(map[string]string)}
+			if len(fields) > 0 {
+				current.Type = fields[0]
+			}
+			if len(fields) > 3 {
+				current.PayloadType, _ = strconv.Atoi(fields[3])
+				current.Codec, current.ClockRate, current.Channels = staticPayloadType(current.PayloadType)
+			}
+			medias = append(medias, current)
+		case current == nil:
+			continue
+		case strings.HasPrefix(line, "a=rtpmap:"):
+			pt, rest, ok := strings.Cut(strings.TrimPrefix(line, "a=rtpmap:"), " ")
+			if n, err := strconv.Atoi(pt); !ok || err != nil || n != current.PayloadType {
+				continue
+			}
+			parts := strings.Split(rest, "/")
+			current.Codec = strings.ToUpper(parts[0])
+			if len(parts) > 1 {
+				current.ClockRate, _ = strconv.Atoi(parts[1])
+			}
+			current.Channels = 1
+			if len(parts) > 2 {
+				current.Channels, _ = strconv.Atoi(parts[2])
+			}
+		case strings.HasPrefix(line, "a=fmtp:"):
+			pt, rest, ok := strings.Cut(strings.TrimPrefix(line, "a=fmtp:"), " ")
+			if n, err := strconv.Atoi(pt); !ok || err != nil || n != current.PayloadType {
+				continue
+			}
+			for _, param := range strings.Split(rest, ";") {
+				key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if key != "" {
+					current.Fmtp[strings.ToLower(key)] = value
+				}
+			}
+		case strings.HasPrefix(line, "a=control:"):
+			current.Control = strings.TrimPrefix(line, "a=control:")
+		}
+	}
+	return medias
+}
+
+// staticPayloadType resolves the RFC 3551 payload types cameras use without rtpmap.
+func staticPayloadType(pt int) (string, int, int) {
+	switch pt {
+	case 0:
+		return "PCMU", 8000, 1
+	case 8:
+		return "PCMA", 8000, 1
+	case 14:
+		return "MPA", 90000, 1
+	case 26:
+		return "JPEG", 90000, 0
+	case 32:
+		return "MPV", 90000, 0
+	}
+	return "", 0, 0
+}
+
+// parameterSets decodes the base64 sprop-* parameters of an H.264/H.265
+// media: SPS/PPS for H.264 (sprop-parameter-sets), VPS/SPS/PPS for H.265.
+func (m *sdpMedia) parameterSets() [][]byte {
+	var keys []string
+	switch m.Codec {
+	case "H264":
+		keys = []string{"sprop-parameter-sets"}
+	case "H265":
+		keys = []string{"sprop-vps", "sprop-sps", "sprop-pps"}
+	}
+	var sets [][]byte
+	for _, key := range keys {
+		for _, b64 := range strings.Split(m.Fmtp[key], ",") {
+			if nalu, err := base64.StdEncoding.DecodeString(b64); err == nil && len(nalu) > 0 {
+				sets = append(sets, nalu)
+			}
+		}
+	}
+	return sets
+}
+
+// audioSpecificConfig decodes the hex "config" parameter of an
+// mpeg4-generic AAC media (RFC 3640).
+func (m *sdpMedia) audioSpecificConfig() []byte {
+	config, err := hex.DecodeString(m.Fmtp["config"])
+	if err != nil || len(config) < 2 {
+		return nil
+	}
+	return config
+}
@@ -2,8 +2,10 @@ package rtspproxy
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"net/http"
 	"runtime"
 	"strings"
 	"sync"
@@ -16,6 +18,20 @@ type Server struct {
 	cancel        context.CancelFunc
 	rtspPort      int
 	rtspListener  *net.TCPListener
+	tlsPort       int
+	tlsListener   *net.TCPListener // RTSPS, nil unless ListenTLS was called
+	tlsConfig     *tls.Config
+	users         *userStore // client accounts, nil unless EnableAuth was called
+	httpPort      int
+	httpListener  *net.TCPListener // RTSP-over-HTTP, nil unless ListenHTTP was called
+	tunnels       *tunnelRegistry
+	hls           *hlsRegistry
+	httpOnce      sync.Once
+	httpConns     *connListener // sniffed HTTP connections, see serveHTTP
+	httpServer    *http.Server
+	webrtc        *webrtcServer // WHEP, nil unless ListenWebRTC was called
+	recorders     []*recorder   // see StartRecording
+	recordWG      sync.WaitGroup
 	streamManager *StreamManager
 	clients       sync.WaitGroup // To track active client connections
 }
@@ -26,8 +42,10 @@ func NewServer(ctx context.Context) *Server {
 
 	serverCtx, cancel := context.WithCancel(ctx)
 	s := &Server{
-		ctx:    serverCtx,
-		cancel: cancel,
+		ctx:     serverCtx,
+		cancel:  cancel,
+		tunnels: newTunnelRegistry(),
+		hls:     newHLSRegistry(),
 	}
 	s.streamManager = NewStreamManager(s)
 	return s
@@ -45,8 +63,24 @@ func (server *Server) Listen(portNum int) error {
 	return nil
 }
 
+// ListenHTTP starts an extra plain listener on the specified port, meant for
+// RTSP-over-HTTP tunnels (80/8080). It accepts plain RTSP as well.
+func (server *Server) ListenHTTP(portNum int) error {
+	listener, err := listenTCP(portNum)
+	if err != nil {
+		return fmt.Errorf("failed to setup socket: %w", err)
+	}
+	server.httpPort = portNum
+	server.httpListener = listener
+	return nil
+}
+
 func (server *Server) setupOurSocket() (*net.TCPListener, error) {
-	tcpAddr := fmt.Sprintf("0.0.0.0:%d", server.rtspPort)
+	return listenTCP(server.rtspPort)
+}
+
+func listenTCP(portNum int) (*net.TCPListener, error) {
+	tcpAddr := fmt.Sprintf("0.0.0.0:%d", portNum)
 	addr, err := net.ResolveTCPAddr("tcp", tcpAddr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to resolve TCP address: %w", err)
@@ -69,9 +103,23 @@ func (server *Server) Shutdown(ctx context.Context) error {
 			LogCriticalf("Error closing RTSP listener: %v", err)
 		}
 	}
+	if server.tlsListener != nil {
+		if err := server.tlsListener.Close(); err != nil {
+			LogCriticalf("Error closing RTSPS listener: %v", err)
+		}
+	}
+	if server.httpListener != nil {
+		if err := server.httpListener.Close(); err != nil {
+			LogCriticalf("Error closing HTTP tunnel listener: %v", err)
+		}
+	}
+
+	server.shutdownHTTP()
+	server.shutdownWebRTC()
 
 	// 2. Signal all goroutines to stop
 	server.cancel()
+	server.stopRecording()
 
 	// 3. Wait for all clients to finish
 	done := make(chan struct{})
@@ -100,8 +148,19 @@ func (server *Server) LookupStream(host, username, password, path string) *Strea
 	return server.streamManager.GetStream(host, username, password, path)
 }
 
+// LookupStreamScheme is LookupStream for a specific proxy URL scheme (see proxySchemes).
+func (server *Server) LookupStreamScheme(scheme, host, username, password, path string) *Stream {
+	return server.streamManager.GetStreamScheme(scheme, host, username, password, path)
+}
+
 // Start begins accepting incoming client connections.
 func (server *Server) Start() {
+	if server.tlsListener != nil {
+		go server.tlsConnectionHandler()
+	}
+	if server.httpListener != nil {
+		go server.acceptLoop(server.httpListener)
+	}
 	server.incomingConnectionHandler()
 }
 
@@ -109,24 +168,43 @@ func (server *Server) newClientConnection(conn net.Conn) {
 	server.clients.Add(1)
 	go func() {
 		defer server.clients.Done()
-		client := NewClient(server, conn)
-		if client != nil {
-			client.incomingRequestHandler()
-		}
+		server.serveConn(conn)
 	}()
 }
 
+// serveConn runs a plain RTSP session, or hands the connection to the HTTP
+// server (tunnels, web endpoints) when it opens with an HTTP request.
+func (server *Server) serveConn(conn net.Conn) {
+	sniffed, isHTTP, err := sniffConn(server.ctx, conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if isHTTP {
+		server.serveHTTP(sniffed)
+		return
+	}
+	client := NewClient(server, sniffed)
+	if client != nil {
+		client.incomingRequestHandler()
+	}
+}
+
 func (server *Server) incomingConnectionHandler() {
+	server.acceptLoop(server.rtspListener)
+}
+
+func (server *Server) acceptLoop(listener *net.TCPListener) {
 	for {
 		select {
 		case <-server.ctx.Done():
 			LogCriticalf("Stopping incoming connection handler due to shutdown signal.")
 			return
 		default:
-			if server.rtspListener != nil {
-				server.rtspListener.SetDeadline(time.Now().Add(time.Second))
+			if listener != nil {
+				listener.SetDeadline(time.Now().Add(time.Second))
 			}
-			tcpConn, err := server.rtspListener.AcceptTCP()
+			tcpConn, err := listener.AcceptTCP()
 			if err != nil {
 				// 🔥 ИСПРАВЛЕНИЕ: Тихий выход при закрытии слушателя
 				if server.ctx.Err() != nil || strings.Contains(err.Error(), "closed network connection") {
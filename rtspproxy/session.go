@@ -2,7 +2,6 @@ package rtspproxy
 
 import (
 	"container/list"
-	"net/url"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -101,9 +100,10 @@ func (session *Session) StartUpstream() {
 					return
 				}
 
-				URL := &url.URL{Scheme: "rtsp", Host: remote.Host, Path: s.Path}
+				URL := remote.streamURL(remote.path)
 				request, _ := NewRequest("GET_PARAMETER", URL)
 				request.Headers["Session"] = session.Session
+				request.Timeout = time.Duration(timeout) * time.Second
 
 				// Send synchronously but respect context
 				_ = remote.SendRequestSync(request)
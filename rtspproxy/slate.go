@@ -0,0 +1,242 @@
+package rtspproxy
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fallback slate. With GlobalConfig.FallbackSlate set to an H.264 Annex-B
+// file (one slice per picture, starting with SPS/PPS and an IDR), a Stream
+// that loses its camera keeps its clients fed: from StateReconnecting on, the
+// file is looped at GlobalConfig.FallbackSlateFPS and packetized on the
+// video track's payload type. The packets pass through the RTP rewriter, so
+// clients see one continuous RTP session. Once the camera is back, live
+// video resumes at its first keyframe, preceded by the parameter sets of
+// the camera's SDP (the slate's in-band ones replaced them in the
+// decoders). Audio is not replaced; it pauses during the outage. Only
+// clients get the slate: recordings, HLS, fMP4 and pre-event buffers see
+// the camera alone.
+
+// slateClip is a loaded slate file.
+type slateClip struct {
+	units [][][]byte // access units, the first one an IDR with parameter sets
+}
+
+var (
+	slateMu     sync.Mutex
+	slatePath   string
+	slateLoaded *slateClip
+)
+
+// fallbackSlate returns the clip of GlobalConfig.FallbackSlate, loading it
+// on first use; nil when unset or unusable.
+func fallbackSlate() *slateClip {
+	slateMu.Lock()
+	defer slateMu.Unlock()
+	path := GlobalConfig.FallbackSlate
+	if path == "" {
+		return nil
+	}
+	if path != slatePath {
+		slatePath, slateLoaded = path, nil
+		clip, err := loadSlate(path)
+		if err != nil {
+			LogCriticalf("❌ [SLATE] %v", err)
+		} else {
+			LogCriticalf("🪧 [SLATE] Loaded %s (%d pictures)", path, len(clip.units))
+			slateLoaded = clip
+		}
+	}
+	return slateLoaded
+}
+
+// loadSlate splits an Annex-B file into access units, each ending with a
+// slice NAL unit, and drops everything before the first IDR picture.
+func loadSlate(path string) (*slateClip, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	clip := &slateClip{}
+	var unit [][]byte
+	var sps, pps bool
+	for _, nalu := range splitAnnexB(data) {
+		switch naluType(false, nalu) {
+		case 9: // access unit delimiter
+			continue
+		case 7:
+			sps = true
+		case 8:
+			pps = true
+		}
+		unit = append(unit, nalu)
+		if typ := naluType(false, nalu); typ >= 1 && typ <= 5 {
+			if len(clip.units) > 0 || (typ == 5 && sps && pps) {
+				clip.units = append(clip.units, unit)
+			}
+			unit = nil
+		}
+	}
+	if len(clip.units) == 0 {
+		return nil, fmt.Errorf("%s: no H.264 IDR picture with SPS/PPS", path)
+	}
+	return clip, nil
+}
+
+// slatePlayer feeds the slate into one Stream; guarded by Stream.mu.
+type slatePlayer struct {
+	clip       *slateClip
+	channel    int // upstream RTP channel of the H.264 track
+	params     [][]byte
+	packetizer *rtpPacketizer
+	start      time.Time
+	stop       chan struct{}
+
+	// The live access unit being received, held back until it is known
+	// whether it starts with a keyframe.
+	hold   [][]byte
+	holdTS uint32
+}
+
+// startSlateLocked starts the slate on the stream's H.264 track, if any.
+func (s *Stream) startSlateLocked() {
+	if s.slate != nil || s.SDP == "" {
+		return
+	}
+	clip := fallbackSlate()
+	if clip == nil {
+		return
+	}
+	for i, media := range parseSDPMedia(s.SDP) {
+		if media.Type == "video" && media.Codec != "H264" {
+			break // the slate would not match the description
+		}
+		channel, ok := s.channels[i]
+		if media.Codec != "H264" || !ok {
+			continue
+		}
+		var params [][]byte
+		for _, set := range strings.Split(media.Fmtp["sprop-parameter-sets"], ",") {
+			if ps, err := base64.StdEncoding.DecodeString(set); err == nil && len(ps) > 0 {
+				params = append(params, ps)
+			}
+		}
+		var ssrc [4]byte
+		rand.Read(ssrc[:])
+		s.slate = &slatePlayer{
+			clip:    clip,
+			channel: channel,
+			params:  params,
+			packetizer: &rtpPacketizer{
+				payloadType: uint8(media.PayloadType),
+				ssrc:        binary.BigEndian.Uint32(ssrc[:]),
+				mtu:         1400,
+			},
+			start: time.Now(),
+			stop:  make(chan struct{}),
+		}
+		LogCriticalf("🪧 [SLATE] Stream [%s] camera unreachable, sending the fallback slate", s.Path)
+		s.wg.Add(1)
+		go s.runSlate(s.slate)
+		return
+	}
+	Logf("Stream [%s] has no H.264 track, no fallback slate", s.Path)
+}
+
+// stopSlateLocked ends the slate.
+func (s *Stream) stopSlateLocked() {
+	if s.slate != nil {
+		close(s.slate.stop)
+		s.slate = nil
+	}
+}
+
+func (s *Stream) runSlate(player *slatePlayer) {
+	defer s.wg.Done()
+	interval := time.Duration(float64(time.Second) / GlobalConfig.FallbackSlateFPS)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		if !s.sendSlate(player, player.clip.units[i%len(player.clip.units)]) {
+			return
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-player.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendSlate delivers one slate picture to the clients.
+func (s *Stream) sendSlate(player *slatePlayer, unit [][]byte) bool {
+	s.mu.Lock()
+	if s.slate != player {
+		s.mu.Unlock()
+		return false
+	}
+	now := time.Now()
+	packets := player.packets(unit, now)
+	for _, packet := range packets {
+		s.rewriteLocked(player.channel, packet, now)
+		if s.gop != nil {
+			s.gop.push(player.channel, packet)
+		}
+	}
+	targets := s.targetsLocked(player.channel, packets)
+	publisher := s.publisher
+	s.mu.Unlock()
+
+	s.deliver(player.channel, packets, targets, publisher)
+	return true
+}
+
+// packets packetizes a picture as interleaved-framed RTP on the slate clock.
+func (p *slatePlayer) packets(unit [][]byte, now time.Time) [][]byte {
+	ts := uint32(now.Sub(p.start) * 90000 / time.Second)
+	var packets [][]byte
+	for _, pkt := range p.packetizer.video(false, ts, unit) {
+		packets = append(packets, append([]byte{'$', byte(p.channel), byte(len(pkt) >> 8), byte(len(pkt))}, pkt...))
+	}
+	return packets
+}
+
+// live filters camera packets while the slate runs. Video is held back per
+// access unit until one starts with a keyframe; then the camera's parameter
+// sets and that access unit are returned with done set. Video RTCP is
+// dropped: it describes a session the clients do not see yet.
+func (p *slatePlayer) live(channel int, packet []byte, now time.Time) (packets [][]byte, done bool) {
+	switch channel {
+	case p.channel + 1:
+		return nil, false
+	case p.channel:
+	default:
+		return [][]byte{packet}, false
+	}
+	rtp, err := parseRTP(packet[streamHeaderLength:])
+	if err != nil {
+		return nil, false
+	}
+	if len(p.hold) == 0 || rtp.Timestamp != p.holdTS || len(p.hold) >= GlobalConfig.PacketQueueSize {
+		clear(p.hold)
+		p.hold, p.holdTS = p.hold[:0], rtp.Timestamp
+	}
+	// Held packets outlive the call; keep a copy.
+	p.hold = append(p.hold, slices.Clone(packet))
+	if !rtpHasKeyframe(false, rtp.Payload) {
+		return nil, false
+	}
+	if len(p.params) > 0 {
+		packets = p.packets(p.params, now)
+	}
+	return append(packets, p.hold...), true
+}
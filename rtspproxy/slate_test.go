@@ -0,0 +1,174 @@
+package rtspproxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeSlate writes an Annex-B slate: a leading P picture (dropped), then
+// AUD, SPS, PPS, IDR and two P pictures. Its SPS and slices contain 0xee.
+func writeSlate(t *testing.T) string {
+	var b bytes.Buffer
+	startCode := []byte{0, 0, 0, 1}
+	for _, nalu := range [][]byte{
+		{0x41, 0xee},
+		{0x09, 0xf0}, {0x67, 0x42, 0xc0, 0x1e, 0xee}, testPPS, append([]byte{0x65}, bytes.Repeat([]byte{0xee}, 3000)...),
+		{0x09, 0xf0}, {0x41, 0xee, 0x01},
+		{0x09, 0xf0}, {0x41, 0xee, 0x02},
+	} {
+		b.Write(startCode)
+		b.Write(nalu)
+	}
+	path := filepath.Join(t.TempDir(), "offline.h264")
+	if err := os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadSlate(t *testing.T) {
+	clip, err := loadSlate(writeSlate(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clip.units) != 3 || len(clip.units[0]) != 3 || clip.units[0][0][0] != 0x67 || clip.units[0][2][0] != 0x65 {
+		t.Fatalf("unexpected access units: %d, first has %d NAL units", len(clip.units), len(clip.units[0]))
+	}
+
+	path := filepath.Join(t.TempDir(), "p-only.h264")
+	os.WriteFile(path, []byte{0, 0, 0, 1, 0x41, 0xee}, 0o644)
+	if _, err := loadSlate(path); err == nil {
+		t.Error("slate without IDR accepted")
+	}
+}
+
+// videoRecorder keeps the RTP headers of the video a consumer receives.
+type videoRecorder struct {
+	mu      sync.Mutex
+	packets []rtpPacket
+}
+
+func (r *videoRecorder) Consume(channel int, packet []byte) {
+	if pkt, err := parseRTP(packet); channel == 0 && err == nil {
+		r.mu.Lock()
+		r.packets = append(r.packets, rtpPacket{SSRC: pkt.SSRC, Seq: pkt.Seq, Timestamp: pkt.Timestamp})
+		r.mu.Unlock()
+	}
+}
+
+// checkContinuous fails unless packets keep one SSRC with increasing
+// sequence numbers and timestamps that never go back.
+func checkContinuous(t *testing.T, what string, packets []rtpPacket) {
+	t.Helper()
+	for i := 1; i < len(packets); i++ {
+		last, pkt := packets[i-1], packets[i]
+		if pkt.SSRC != last.SSRC || int16(pkt.Seq-last.Seq) <= 0 || int32(pkt.Timestamp-last.Timestamp) < 0 {
+			t.Fatalf("%s: discontinuity from ssrc %x seq %d ts %d to ssrc %x seq %d ts %d",
+				what, last.SSRC, last.Seq, last.Timestamp, pkt.SSRC, pkt.Seq, pkt.Timestamp)
+		}
+	}
+}
+
+func TestFallbackSlate(t *testing.T) {
+	oldSlate, oldBackoff, oldPreEvent := GlobalConfig.FallbackSlate, GlobalConfig.ReconnectBackoff, GlobalConfig.PreEventBuffer
+	t.Cleanup(func() {
+		GlobalConfig.FallbackSlate, GlobalConfig.ReconnectBackoff, GlobalConfig.PreEventBuffer = oldSlate, oldBackoff, oldPreEvent
+	})
+	GlobalConfig.FallbackSlate = writeSlate(t)
+	GlobalConfig.ReconnectBackoff = []time.Duration{500 * time.Millisecond}
+	GlobalConfig.PreEventBuffer = 10 * time.Second
+
+	// The camera drops its first session after 400ms.
+	cam := startH264Camera(t)
+	live := cam.handle
+	var plays atomic.Int32
+	cam.handle = func(method, req string, conn net.Conn) string {
+		if method == "PLAY" && plays.Add(1) == 1 {
+			time.AfterFunc(400*time.Millisecond, func() { conn.Close() })
+		}
+		return live(method, req, conn)
+	}
+
+	server, addr := startTunnelServer(t)
+	base := fmt.Sprintf("rtsp://%s/rtsp/%s/mock", addr, cam.Addr())
+	c := dialRTSP(t, addr)
+	c.do("DESCRIBE", base, "")
+	recorder := &videoRecorder{}
+	stream := server.LookupStream(cam.Addr(), "", "", "/mock")
+	stream.AddConsumer(recorder)
+	_, headers, _ := c.do("SETUP", base+"/track1", "Transport: RTP/AVP/TCP;unicast;interleaved=0-1\r\n")
+	c.do("PLAY", base, "Session: "+headerGet(headers, "Session")+"\r\n")
+
+	// live, slate, then parameter sets from the SDP and a live IDR.
+	var phase string
+	var last rtpPacket
+	frames := c.frames
+	deadline := time.Now().Add(5 * time.Second)
+	for phase != "resumed" {
+		if len(frames) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("stuck in phase %q", phase)
+			}
+			frame, err := c.frame(time.Second)
+			if err != nil {
+				t.Fatalf("phase %q: %v", phase, err)
+			}
+			frames = append(frames, frame)
+		}
+		frame := frames[0]
+		frames = frames[1:]
+		if frame[1] != 0 {
+			continue
+		}
+		pkt, err := parseRTP(frame[2:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last.SSRC != 0 {
+			if pkt.SSRC != last.SSRC || pkt.Seq != last.Seq+1 || int32(pkt.Timestamp-last.Timestamp) < 0 {
+				t.Fatalf("phase %q: discontinuity from ssrc %x seq %d ts %d to ssrc %x seq %d ts %d",
+					phase, last.SSRC, last.Seq, last.Timestamp, pkt.SSRC, pkt.Seq, pkt.Timestamp)
+			}
+		}
+		last = pkt
+
+		slate := bytes.Contains(pkt.Payload, []byte{0xee})
+		switch {
+		case phase == "" && !slate:
+			phase = "live"
+		case phase == "live" && slate:
+			phase = "slate"
+		case phase == "slate" && bytes.Equal(pkt.Payload, testSPS):
+			phase = "parameter sets"
+		case phase == "parameter sets" && !slate && pkt.Payload[0] == 0x7c:
+			if pkt.Payload[1] != 0x85 {
+				t.Fatalf("live video resumed with % x, not an IDR", pkt.Payload[:2])
+			}
+			phase = "resumed"
+		case phase == "parameter sets" && !bytes.Equal(pkt.Payload, testPPS):
+			t.Fatalf("unexpected packet % x after the SPS", pkt.Payload[:2])
+		}
+	}
+
+	// Consumers and the pre-event buffer get the same rewritten packets.
+	time.Sleep(200 * time.Millisecond)
+	recorder.mu.Lock()
+	checkContinuous(t, "consumer", recorder.packets)
+	recorder.mu.Unlock()
+	var buffered []rtpPacket
+	stream.preEvent.mu.Lock()
+	for _, p := range stream.preEvent.packets {
+		if pkt, err := parseRTP(p.data); p.channel == 0 && err == nil {
+			buffered = append(buffered, pkt)
+		}
+	}
+	stream.preEvent.mu.Unlock()
+	checkContinuous(t, "pre-event buffer", buffered)
+}
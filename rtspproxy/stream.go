@@ -1,10 +1,13 @@
 package rtspproxy
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"maps"
 	"net"
+	"net/url"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -60,21 +63,35 @@ type Stream struct {
 	Username string
 	Password string
 	Path     string
+	Scheme   string // proxy URL prefix, see proxySchemes
 
 	SDP     string
 	Options string
 	Server  string
 
+	// Where the camera moved the stream with REDIRECT; nil until then.
+	// sdpStale makes the next connection DESCRIBE it again.
+	location *url.URL
+	sdpStale bool
+
 	state     StreamState
 	remote    *Remote
 	server    *Server
 	onDestroy func()
 
 	clients     map[*Client]*ClientSession
+	consumers   map[Consumer]*consumerSession
 	sessions    map[string]*Session
+	publisher   *MulticastPublisher  // non-nil while multicast viewers exist
+	preEvent    *preEventBuffer      // nil unless GlobalConfig.PreEventBuffer is set
+	gop         *gopCache            // nil unless GlobalConfig.GOPCache is set; guarded by mu
+	rewriters   map[int]*rtpRewriter // upstream RTP channel -> rewriter; guarded by mu
+	channels    map[int]int          // SDP media index -> upstream RTP channel, from the SETUP replies
+	slate       *slatePlayer         // non-nil while the fallback slate replaces the camera
 	lastClient  time.Time
 	idleTimer   *time.Timer
 	loopStarted atomic.Bool
+	udpRejected atomic.Bool // camera answered 461 to a UDP SETUP
 
 	// Metrics
 	PacketsForwarded      uint64
@@ -107,9 +124,11 @@ func NewStream(server *Server, host, username, password, path string) *Stream {
 		Username:    username,
 		Password:    password,
 		Path:        path,
+		Scheme:      "rtsp",
 		server:      server,
 		state:       StateDisconnected,
 		clients:     make(map[*Client]*ClientSession),
+		consumers:   make(map[Consumer]*consumerSession),
 		sessions:    make(map[string]*Session),
 		ctx:         ctx,
 		cancel:      cancel,
@@ -118,6 +137,12 @@ func NewStream(server *Server, host, username, password, path string) *Stream {
 		readyCh:     make(chan struct{}),
 		sdpReadyCh:  make(chan struct{}),
 	}
+	if GlobalConfig.PreEventBuffer > 0 {
+		s.preEvent = newPreEventBuffer(GlobalConfig.PreEventBuffer)
+	}
+	if GlobalConfig.GOPCache {
+		s.gop = newGOPCache(GlobalConfig.PacketQueueSize)
+	}
 	return s
 }
 
@@ -178,6 +203,13 @@ func (s *Stream) unsafeSetState(state StreamState) {
 	Logf("Stream [%s] state change: %s -> %s", s.Path, s.state, state)
 	s.state = state
 
+	switch state {
+	case StateReconnecting:
+		s.startSlateLocked()
+	case StateStopping, StateDisconnected, StateDestroyed:
+		s.stopSlateLocked()
+	}
+
 	// If destroyed, close everything one last time
 	if state == StateDestroyed {
 		if s.readyCh != nil {
@@ -253,14 +285,21 @@ func (s *Stream) AddClient(client *Client, sessionID string) *ClientSession {
 // RemoveClient unregisters a client from the stream.
 func (s *Stream) RemoveClient(client *Client) {
 	s.mu.Lock()
+	cs, ok := s.clients[client]
+	if ok {
+		delete(s.clients, client)
+		// Stop waits for the UDP readers, which take s.mu to reach the
+		// camera; stop the session once the lock is released.
+		defer cs.Stop()
+	}
 	defer s.mu.Unlock()
 
-	if cs, ok := s.clients[client]; ok {
-		cs.Stop()
-		delete(s.clients, client)
+	if s.publisher != nil && s.publisher.HasMember(client) && s.publisher.RemoveMember(client) == 0 {
+		s.publisher.Close()
+		s.publisher = nil
 	}
 
-	if len(s.clients) == 0 && s.state != StateDestroyed {
+	if s.viewersLocked() == 0 && s.state != StateDestroyed {
 		s.lastClient = time.Now()
 		s.resetIdleTimer()
 	}
@@ -275,7 +314,7 @@ func (s *Stream) Start() {
 		return
 	}
 
-	if len(s.clients) == 0 {
+	if s.viewersLocked() == 0 {
 		s.resetIdleTimer()
 	}
 
@@ -299,7 +338,7 @@ func (s *Stream) resetIdleTimer() {
 	if s.idleTimer == nil {
 		s.idleTimer = time.AfterFunc(s.IdleTimeout, func() {
 			s.mu.Lock()
-			if len(s.clients) == 0 && s.state != StateDestroyed {
+			if s.viewersLocked() == 0 && s.state != StateDestroyed {
 				Logf("Stream [%s] idle for %v, stopping.", s.Path, s.IdleTimeout)
 				s.mu.Unlock()
 				s.Stop()
@@ -331,7 +370,7 @@ func (s *Stream) Stop() {
 
 	if remote != nil {
 		for id := range sessions {
-			_ = remote.SendTeardown(s.Path, id)
+			_ = remote.SendTeardown(remote.path, id)
 		}
 		remote.Disconnect()
 	}
@@ -355,12 +394,24 @@ func (s *Stream) Destroy() {
 	s.clients = make(map[*Client]*ClientSession)
 	sessions := s.sessions
 	s.sessions = make(map[string]*Session)
+	publisher := s.publisher
+	s.publisher = nil
+	consumers := s.consumers
+	s.consumers = make(map[Consumer]*consumerSession)
 	s.stopIdleTimer()
 	s.mu.Unlock()
 
+	for _, cs := range consumers {
+		cs.Stop()
+	}
+
+	if publisher != nil {
+		publisher.Close()
+	}
+
 	if remote != nil {
 		for id := range sessions {
-			_ = remote.SendTeardown(s.Path, id)
+			_ = remote.SendTeardown(remote.path, id)
 		}
 		remote.Disconnect()
 	}
@@ -382,6 +433,7 @@ func (s *Stream) Destroy() {
 func (s *Stream) connectLoop() {
 	backoff := GlobalConfig.ReconnectBackoff
 	idx := 0
+	hops := 0 // redirects followed in this connection attempt
 
 	for {
 		select {
@@ -472,11 +524,21 @@ func (s *Stream) connectLoop() {
 					return
 				}
 			} else {
+				remote.Disconnect() // unblocks readLoop without waiting out ReadTimeout
 				readCancel()
 				<-readDone
 
+				// A 3xx from a gateway names the node serving the stream:
+				// connect there at once, up to MaxRedirects hops.
+				var redirect *redirectError
+				if errors.As(err, &redirect) && hops < GlobalConfig.MaxRedirects {
+					hops++
+					s.redirectTo(redirect.location)
+					continue
+				}
+
 				s.mu.RLock()
-				numClients := len(s.clients)
+				numClients := s.viewersLocked()
 				s.mu.RUnlock()
 
 				// If reconnect failed and no clients, stop trying to avoid infinite logs
@@ -491,7 +553,7 @@ func (s *Stream) connectLoop() {
 			}
 		} else {
 			s.mu.RLock()
-			numClients := len(s.clients)
+			numClients := s.viewersLocked()
 			s.mu.RUnlock()
 
 			if numClients == 0 {
@@ -504,6 +566,7 @@ func (s *Stream) connectLoop() {
 			s.transition(StateReconnecting)
 		}
 
+		hops = 0
 		select {
 		case <-s.ctx.Done():
 			return
@@ -517,10 +580,15 @@ func (s *Stream) connectLoop() {
 }
 
 func (s *Stream) doConnectSequence() error {
+	s.mu.RLock()
 	remote := s.remote
+	s.mu.RUnlock()
+	if remote == nil {
+		return errors.New("stream destroyed")
+	}
 
 	// 1. OPTIONS
-	_, err := remote.GetOptions(s.Path)
+	_, err := remote.GetOptions(remote.path)
 	if err != nil {
 		return fmt.Errorf("OPTIONS failed: %w", err)
 	}
@@ -528,7 +596,18 @@ func (s *Stream) doConnectSequence() error {
 	// Options/Server are written by remote.handleOptions into this same Stream.
 
 	// 2. DESCRIBE
-	sdp, err := remote.GetSDP(s.Path)
+	s.mu.RLock()
+	stale := s.sdpStale
+	s.mu.RUnlock()
+	if stale {
+		if err := remote.Describe(remote.path); err != nil {
+			return fmt.Errorf("DESCRIBE failed: %w", err)
+		}
+		s.mu.Lock()
+		s.sdpStale = false
+		s.mu.Unlock()
+	}
+	sdp, err := remote.GetSDP(remote.path)
 	if err != nil {
 		return fmt.Errorf("DESCRIBE failed: %w", err)
 	}
@@ -548,18 +627,53 @@ func (s *Stream) doConnectSequence() error {
 	}
 
 	sessionID := ""
+	lower := s.lowerTransport()
+	channels := make(map[int]int, len(tracks))
 	for i, track := range tracks {
 		transportStr := fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", i*2, i*2+1)
-		ssrc, sess, err := remote.SetupUpstream(s, track, transportStr)
+		useUDP := lower != "tcp"
+		if lower == "multicast" {
+			transportStr = "RTP/AVP;multicast"
+		} else if useUDP {
+			pair, err := remote.BindUDP(i * 2)
+			if err != nil {
+				LogCriticalf("Stream [%s] UDP port allocation failed, using TCP: %v", s.Path, err)
+				useUDP = false
+				lower = "tcp"
+			} else {
+				rtpPort, rtcpPort := pair.Ports()
+				transportStr = fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d", rtpPort, rtcpPort)
+			}
+		}
+		transport, err := remote.SetupUpstream(track.control, transportStr)
+		if err != nil && useUDP && isStatusError(err, 461) {
+			LogCriticalf("Stream [%s] camera rejected %s transport, falling back to TCP interleaved", s.Path, lower)
+			s.udpRejected.Store(true)
+			remote.UnbindUDP(i * 2)
+			lower = "tcp"
+			transportStr = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", i*2, i*2+1)
+			transport, err = remote.SetupUpstream(track.control, transportStr)
+		}
 		if err != nil {
-			return fmt.Errorf("SETUP failed for track %s: %w", track, err)
+			return fmt.Errorf("SETUP failed for track %s: %w", track.control, err)
+		}
+		if lower == "multicast" {
+			if err := remote.JoinMulticast(transport, i*2); err != nil {
+				return fmt.Errorf("multicast join failed for track %s: %w", track.control, err)
+			}
+		}
+		// The camera may answer with interleaved channels of its own choosing.
+		channels[track.media] = transport.RTPChannel()
+		if channels[track.media] < 0 {
+			return fmt.Errorf("SETUP of track %s set up no channel: %s", track.control, transportStr)
 		}
-		sessionID = sess
-		Logf("Stream [%s] track %s setup with SSRC %s", s.Path, track, ssrc)
+		sessionID = transport.Session.Session
+		Logf("Stream [%s] track %s setup with SSRC %s on channel %d", s.Path, track.control, transport.Ssrc, channels[track.media])
 	}
+	s.setChannels(sdp, channels)
 
 	// 4. PLAY
-	_, err = remote.PlayUpstream(s.Path, sessionID)
+	_, err = remote.PlayUpstream(remote.path, sessionID)
 	if err != nil {
 		return fmt.Errorf("PLAY failed: %w", err)
 	}
@@ -567,6 +681,52 @@ func (s *Stream) doConnectSequence() error {
 	return nil
 }
 
+// setChannels records the upstream RTP channel of each set up media of sdp,
+// by index, and prepares the buffers that follow the stream's tracks.
+func (s *Stream) setChannels(sdp string, channels map[int]int) {
+	if s.preEvent != nil {
+		s.preEvent.setSDP(sdp, channels)
+	}
+	s.mu.Lock()
+	s.channels = channels
+	if s.gop != nil {
+		s.gop.reset(sdp, channels) // a new RTP session: cached packets no longer continue
+	}
+	s.resyncRTPLocked(sdp, channels)
+	s.mu.Unlock()
+}
+
+// mediaChannels returns the upstream RTP channel of each set up media of
+// the SDP, by index. The map is replaced on every connection, never changed.
+func (s *Stream) mediaChannels() map[int]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.channels
+}
+
+// lowerTransport returns how tracks are requested from the camera:
+// "tcp" (interleaved), "udp" (client_port pairs) or "multicast".
+func (s *Stream) lowerTransport() string {
+	if s.udpRejected.Load() || s.httpTunnel() {
+		return "tcp"
+	}
+	switch s.Scheme {
+	case "rtsp+udp":
+		return "udp"
+	case "rtsp+multicast":
+		return "multicast"
+	case "rtsp+tcp":
+		return "tcp"
+	}
+	return GlobalConfig.UpstreamTransport
+}
+
+// httpTunnel reports whether the camera is reached through RTSP-over-HTTP,
+// either by the rtsp+http proxy scheme or by GlobalConfig.UpstreamHTTPTunnelHosts.
+func (s *Stream) httpTunnel() bool {
+	return s.Scheme == "rtsp+http" || (s.Scheme != "rtsps" && upstreamTunnelled(s.Host))
+}
+
 // GetSDP returns the current SDP description.
 func (s *Stream) GetSDP() string {
 	s.mu.RLock()
@@ -612,8 +772,7 @@ func (s *Stream) readLoop(ctx context.Context) error {
 		return fmt.Errorf("remote connection is nil")
 	}
 
-	buffer := make([]byte, GlobalConfig.BufferSize)
-	length := 0
+	reader := newRTSPReader(conn, GlobalConfig.BufferSize)
 
 	for {
 		select {
@@ -622,71 +781,34 @@ func (s *Stream) readLoop(ctx context.Context) error {
 		default:
 		}
 
-		// Process everything we currently have in the buffer
-		for length > 0 {
-			if buffer[0] == '$' {
-				if length < 4 {
-					break // Need more data for header
-				}
-				pktLen := (int(buffer[2]) << 8) | int(buffer[3])
-				if length < 4+pktLen {
-					break // Need more data for payload
-				}
-
-				packet := make([]byte, 4+pktLen)
-				copy(packet, buffer[:4+pktLen])
-
-				if verbose.Load() && (buffer[1] == 0 || buffer[1] == 2) {
-					Logf("📦 [MEDIA] Received RTP packet from camera, channel %d, len: %d", buffer[1], pktLen)
-				}
-
-				s.dispatch(int(buffer[1]), packet)
-
-				// Shift buffer
-				copy(buffer[0:], buffer[4+pktLen:length])
-				length -= (4 + pktLen)
-				continue // Try to process next item
-			} else {
-				// RTSP message
-				eol := bytes.Index(buffer[:length], []byte("\r\n\r\n"))
-				if eol == -1 {
-					break // Need more data for headers
-				}
-
-				headerPart := buffer[:eol]
-				contentLength := sharedParseContentLength(headerPart)
-
-				totalMsgLen := eol + 4 + contentLength
-				if length < totalMsgLen {
-					break // Need more data for body
-				}
-
-				msg := string(buffer[:totalMsgLen])
-				s.remote.HandleUpstreamResponse(msg)
-
-				copy(buffer[0:], buffer[totalMsgLen:length])
-				length -= totalMsgLen
-				continue // Try to process next item
-			}
-		}
-
-		if length == len(buffer) {
-			LogCriticalf("Stream [%s] buffer full, clearing", s.Path)
-			length = 0
-		}
-
-		// Read more data
 		conn.SetReadDeadline(time.Now().Add(GlobalConfig.ReadTimeout))
-		n, err := conn.Read(buffer[length:])
+		frame, err := reader.next()
 		conn.SetReadDeadline(time.Time{})
 
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if idle := remote.UDPIdle(); idle > GlobalConfig.UDPTimeout {
+					return fmt.Errorf("no UDP packets from camera for %v", idle.Truncate(time.Second))
+				}
 				continue
 			}
 			return err
 		}
-		length += n
+
+		if frame.channel < 0 {
+			if !strings.HasPrefix(string(frame.data), "RTSP/") {
+				if err := remote.HandleUpstreamRequest(string(frame.data)); err != nil {
+					return err
+				}
+				continue
+			}
+			remote.HandleUpstreamResponse(string(frame.data))
+			continue
+		}
+		if verbose.Load() && (frame.channel == 0 || frame.channel == 2) {
+			Logf("📦 [MEDIA] Received RTP packet from camera, channel %d, len: %d", frame.channel, len(frame.data)-streamHeaderLength)
+		}
+		s.dispatch(frame.channel, frame.data)
 	}
 }
 
@@ -704,6 +826,13 @@ var targetPool = sync.Pool{
 	},
 }
 
+// consumerPool avoids allocation for consumer snapshots.
+var consumerPool = sync.Pool{
+	New: func() interface{} {
+		return make([]*consumerSession, 0, 4)
+	},
+}
+
 func (s *Stream) dispatch(channel int, packet []byte) {
 	now := time.Now()
 	atomic.AddUint64(&s.PacketsForwarded, 1)
@@ -714,31 +843,92 @@ func (s *Stream) dispatch(channel int, packet []byte) {
 
 	s.mu.Lock()
 	s.LastPktTime = now
+	// Packets for clients and consumers: the camera's, unless the fallback
+	// slate is still covering for it. All of them see the same rewritten
+	// packets, so sequence numbers and timestamps stay continuous.
+	packets := [][]byte{packet}
+	if s.slate != nil {
+		var done bool
+		if packets, done = s.slate.live(channel, packet, now); done {
+			LogCriticalf("🪧 [SLATE] Stream [%s] camera is back, resuming live video", s.Path)
+			s.stopSlateLocked()
+		}
+	}
+	for _, p := range packets {
+		s.rewriteLocked(channel, p, now)
+		if s.gop != nil {
+			s.gop.push(channel, p)
+		}
+	}
+	targets := s.targetsLocked(channel, packets)
+	publisher := s.publisher
+	consumers := consumerPool.Get().([]*consumerSession)[:0]
+	for _, cs := range s.consumers {
+		consumers = append(consumers, cs)
+	}
+	s.mu.Unlock()
 
+	for _, p := range packets {
+		if s.preEvent != nil {
+			s.preEvent.push(now, channel, p)
+		}
+		for _, cs := range consumers {
+			if !cs.Push(p) {
+				atomic.AddUint64(&s.PacketsDropped, 1)
+				GlobalMetrics.PacketsDropped.Add(1)
+			}
+		}
+	}
+	clear(consumers)
+	consumerPool.Put(consumers)
+
+	s.deliver(channel, packets, targets, publisher)
+}
+
+// targetsLocked snapshots the clients receiving an upstream channel and
+// records where their RTP starts.
+func (s *Stream) targetsLocked(channel int, packets [][]byte) []targetSnapshot {
 	targets := targetPool.Get().([]targetSnapshot)[:0]
+	if len(packets) == 0 {
+		return targets
+	}
 	for client, cs := range s.clients {
 		clientChannel, ok := cs.channels[channel]
 		if !ok {
 			continue
 		}
+		if _, ok := cs.rtpStart[channel]; !ok && channel%2 == 0 {
+			if pos, ok := rtpPositionOf(packets[0]); ok {
+				cs.rtpStart[channel] = pos
+			}
+		}
 		targets = append(targets, targetSnapshot{cs: cs, clientChannel: clientChannel, remoteAddr: client.remoteAddr})
 	}
-	s.mu.Unlock()
-
-	for _, t := range targets {
-		buf := packetPool.Get().([]byte)
-		clientPacket := buf[:len(packet)]
-		copy(clientPacket, packet)
-		clientPacket[1] = byte(t.clientChannel)
+	return targets
+}
 
-		if !t.cs.Push(clientPacket) {
-			atomic.AddUint64(&s.PacketsDropped, 1)
-			GlobalMetrics.PacketsDropped.Add(1)
-			LogCriticalf("Stream [%s] dropping packet for slow client %s", s.Path, t.remoteAddr)
-			packetPool.Put(buf)
+// deliver sends packets of an upstream channel to the multicast publisher
+// and to a targetsLocked snapshot, which it releases.
+func (s *Stream) deliver(channel int, packets [][]byte, targets []targetSnapshot, publisher *MulticastPublisher) {
+	for _, packet := range packets {
+		if publisher != nil {
+			publisher.Send(channel, packet)
+		}
+		for _, t := range targets {
+			buf := packetPool.Get().([]byte)
+			clientPacket := buf[:len(packet)]
+			copy(clientPacket, packet)
+			clientPacket[1] = byte(t.clientChannel)
+
+			if !t.cs.Push(clientPacket) {
+				atomic.AddUint64(&s.PacketsDropped, 1)
+				GlobalMetrics.PacketsDropped.Add(1)
+				LogCriticalf("Stream [%s] dropping packet for slow client %s", s.Path, t.remoteAddr)
+				packetPool.Put(buf)
+			}
 		}
 	}
-
+	clear(targets)
 	targetPool.Put(targets)
 }
 
@@ -789,10 +979,16 @@ func (s *Stream) ReportMetrics() {
 	}
 }
 
-func (s *Stream) parseTracks(sdp string) []string {
-	var tracks []string
+// sdpTrack is a media section of the camera SDP that is set up on its own.
+type sdpTrack struct {
+	media   int    // index of the m= section, as in parseSDPMedia
+	control string // SETUP URL, relative path or "" for the stream URL
+}
+
+func (s *Stream) parseTracks(sdp string) []sdpTrack {
+	var tracks []sdpTrack
 	lines := strings.Split(sdp, "\n")
-	inMedia := false
+	media := -1
 	baseURL := ""
 
 	// Collect session-level control (for resolving relative tracks)
@@ -812,10 +1008,10 @@ func (s *Stream) parseTracks(sdp string) []string {
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
 		if strings.HasPrefix(line, "m=") {
-			inMedia = true
+			media++
 			continue
 		}
-		if !inMedia {
+		if media < 0 {
 			continue
 		}
 		// New media section resets relative context but we keep collecting all tracks
@@ -824,33 +1020,157 @@ func (s *Stream) parseTracks(sdp string) []string {
 			if control == "*" {
 				continue // session-level wildcard, skip
 			}
-			if strings.HasPrefix(control, "rtsp://") {
+			if isAbsoluteRTSPURL(control) {
 				// Absolute control URL — keep as-is (SetupUpstream handles it)
-				tracks = append(tracks, control)
-			} else if baseURL != "" && strings.HasPrefix(baseURL, "rtsp://") {
+				tracks = append(tracks, sdpTrack{media, control})
+			} else if baseURL != "" && isAbsoluteRTSPURL(baseURL) {
 				// Resolve relative track against session control base
 				base := strings.TrimRight(baseURL, "/")
-				tracks = append(tracks, base+"/"+strings.TrimLeft(control, "/"))
+				tracks = append(tracks, sdpTrack{media, base + "/" + strings.TrimLeft(control, "/")})
 			} else {
-				tracks = append(tracks, control)
+				tracks = append(tracks, sdpTrack{media, control})
 			}
 		}
 	}
 
 	if len(tracks) == 0 {
 		// Fallback: no explicit tracks — use base path
-		tracks = append(tracks, "")
+		tracks = append(tracks, sdpTrack{media: 0})
 	}
 	return tracks
 }
 
+// isAbsoluteRTSPURL reports whether an SDP control attribute is a full URL.
+func isAbsoluteRTSPURL(control string) bool {
+	return strings.HasPrefix(control, "rtsp://") || strings.HasPrefix(control, "rtsps://")
+}
+
 // MapChannel records a mapping from upstream channel to client channel.
 func (s *Stream) MapChannel(client *Client, upstreamChan, clientChan int) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if cs, ok := s.clients[client]; ok {
 		cs.channels[upstreamChan] = clientChan
+		s.replayGOPLocked(cs, upstreamChan, clientChan)
+	}
+}
+
+// setTrackURL records the URL a client set up an upstream RTP channel with,
+// for RTP-Info.
+func (s *Stream) setTrackURL(cs *ClientSession, upstreamChan int, trackURL string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cs.trackURLs[upstreamChan] = trackURL
+}
+
+// rtpInfo returns the RTP-Info entries of a client's tracks: the sequence
+// number and timestamp of the first packet it receives on each.
+func (s *Stream) rtpInfo(client *Client) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cs, ok := s.clients[client]
+	if !ok {
+		return nil
+	}
+	channels := slices.Sorted(maps.Keys(cs.trackURLs))
+	var entries []string
+	for _, channel := range channels {
+		if pos, ok := s.rtpStartLocked(cs, channel); ok {
+			entries = append(entries, fmt.Sprintf("url=%s;seq=%d;rtptime=%d", cs.trackURLs[channel], pos.seq, pos.ts))
+		}
+	}
+	return entries
+}
+
+// downstreamSSRC returns the SSRC clients receive on an upstream RTP
+// channel, or fallback before the first packet.
+func (s *Stream) downstreamSSRC(upstreamChan int, fallback string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if r := s.rewriters[upstreamChan]; r != nil && r.started {
+		return fmt.Sprintf("%08X", r.ssrc)
+	}
+	return fallback
+}
+
+// replayGOPLocked queues the cached packets of upstreamChan for a newly
+// mapped client channel. A GOP that does not fit the free queue space is
+// skipped: the client then starts at the next keyframe.
+func (s *Stream) replayGOPLocked(cs *ClientSession, upstreamChan, clientChan int) {
+	if s.gop == nil {
+		return
+	}
+	packets := s.gop.replay(upstreamChan)
+	if len(packets) == 0 {
+		return
+	}
+	if free := cap(cs.queue) - len(cs.queue); len(packets) > free {
+		Logf("Stream [%s] GOP of %d packets does not fit the client queue (%d free), not replayed", s.Path, len(packets), free)
+		return
+	}
+	if _, ok := cs.rtpStart[upstreamChan]; !ok {
+		if pos, ok := rtpPositionOf(packets[0]); ok {
+			cs.rtpStart[upstreamChan] = pos
+		}
+	}
+	for _, packet := range packets {
+		clientPacket := append([]byte(nil), packet...)
+		clientPacket[1] = byte(clientChan)
+		cs.Push(clientPacket)
+	}
+	Logf("Stream [%s] replayed %d cached packets on channel %d to %s", s.Path, len(packets), clientChan, cs.client.remoteAddr)
+}
+
+// MapUDP binds a client's UDP ports to an upstream RTP/RTCP channel pair.
+// The pair's RTP socket is then used as the client channel upstreamRTP, RTCP
+// as upstreamRTP+1; receiver reports from the client are relayed upstream.
+func (s *Stream) MapUDP(client *Client, upstreamRTP, upstreamRTCP int, pair *UDPPair, rtpAddr, rtcpAddr *net.UDPAddr) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cs, ok := s.clients[client]
+	if !ok {
+		return false
+	}
+	cs.channels[upstreamRTP] = upstreamRTP
+	cs.channels[upstreamRTCP] = upstreamRTP + 1
+
+	// The sink is bound before the GOP replay so it is sent as datagrams.
+	cs.AddUDP(pair, upstreamRTP, rtpAddr, rtcpAddr, func(channel int, data []byte) {
+		upstreamChannel := upstreamRTP
+		if channel != upstreamRTP {
+			upstreamChannel = upstreamRTCP
+		}
+		s.mu.RLock()
+		remote := s.remote
+		s.mu.RUnlock()
+		if remote != nil {
+			_ = remote.SendBinary(upstreamChannel, data)
+		}
+	})
+	s.replayGOPLocked(cs, upstreamRTP, upstreamRTP)
+	return true
+}
+
+// PublishMulticast registers client as a multicast viewer of the track carried
+// by upstream, starting the stream's publisher on first use. The client counts
+// towards the idle timeout like any unicast client.
+func (s *Stream) PublishMulticast(client *Client, sessionID string, upstream *Transport) (*Transport, error) {
+	s.AddClient(client, sessionID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.publisher == nil {
+		publisher, err := NewMulticastPublisher()
+		if err != nil {
+			return nil, err
+		}
+		s.publisher = publisher
+	}
+	transport := s.publisher.AddTrack(client, upstream)
+	if transport == nil {
+		return nil, errors.New("upstream track has no channels")
 	}
+	return transport, nil
 }
 
 // LookupTransport retrieves an existing transport for a substream.
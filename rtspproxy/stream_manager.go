@@ -53,16 +53,30 @@ func (sm *StreamManager) metricsLoop() {
 
 // GetStream returns an existing Stream or creates a new one for the given URL.
 func (sm *StreamManager) GetStream(host, username, password, path string) *Stream {
+	return sm.GetStreamScheme("rtsp", host, username, password, path)
+}
+
+// GetStreamScheme is GetStream for a specific proxy URL scheme. Streams reached
+// through different schemes never share an upstream connection.
+func (sm *StreamManager) GetStreamScheme(scheme, host, username, password, path string) *Stream {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
+	if scheme == "" {
+		scheme = "rtsp"
+	}
+
 	// Authentication context participates in stream identity to ensure isolation
 	key := fmt.Sprintf("%s:%s@%s%s", username, password, host, path)
+	if scheme != "rtsp" {
+		key = scheme + "://" + key
+	}
 	if stream, ok := sm.streams[key]; ok {
 		return stream
 	}
 
 	stream := NewStream(sm.server, host, username, password, path)
+	stream.Scheme = scheme
 	// Set cleanup callback
 	stream.onDestroy = func() {
 		sm.RemoveStream(key)
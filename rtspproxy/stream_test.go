@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"maps"
 	"net"
+	"slices"
 	"strings"
 	"testing"
 	"time"
@@ -49,16 +51,17 @@ func TestStreamLifecycle(t *testing.T) {
 						}
 						req := string(data[:eol+4])
 						data = data[eol+4:]
+						cseq := headerGet(parseMockHeaders(req), "CSeq")
 
 						if strings.Contains(req, "OPTIONS") {
-							c.Write([]byte("RTSP/1.0 200 OK\r\nPublic: OPTIONS, DESCRIBE, SETUP, PLAY\r\nCSeq: 1\r\n\r\n"))
+							c.Write([]byte("RTSP/1.0 200 OK\r\nPublic: OPTIONS, DESCRIBE, SETUP, PLAY\r\nCSeq: " + cseq + "\r\n\r\n"))
 						} else if strings.Contains(req, "DESCRIBE") {
 							sdp := "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=Mock\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\nm=video 0 RTP/AVP 96\r\na=control:track1\r\n"
-							c.Write([]byte(fmt.Sprintf("RTSP/1.0 200 OK\r\nContent-Type: application/sdp\r\nContent-Length: %d\r\nCSeq: 2\r\n\r\n%s", len(sdp), sdp)))
+							c.Write([]byte(fmt.Sprintf("RTSP/1.0 200 OK\r\nContent-Type: application/sdp\r\nContent-Length: %d\r\nCSeq: %s\r\n\r\n%s", len(sdp), cseq, sdp)))
 						} else if strings.Contains(req, "SETUP") {
-							c.Write([]byte("RTSP/1.0 200 OK\r\nTransport: RTP/AVP/TCP;unicast;interleaved=0-1;ssrc=12345678\r\nSession: 1234\r\nCSeq: 3\r\n\r\n"))
+							c.Write([]byte("RTSP/1.0 200 OK\r\nTransport: RTP/AVP/TCP;unicast;interleaved=0-1;ssrc=12345678\r\nSession: 1234\r\nCSeq: " + cseq + "\r\n\r\n"))
 						} else if strings.Contains(req, "PLAY") {
-							c.Write([]byte("RTSP/1.0 200 OK\r\nRTP-Info: url=rtsp://127.0.0.1/mock/track1;seq=1;rtptime=1\r\nSession: 1234\r\nCSeq: 4\r\n\r\n"))
+							c.Write([]byte("RTSP/1.0 200 OK\r\nRTP-Info: url=rtsp://127.0.0.1/mock/track1;seq=1;rtptime=1\r\nSession: 1234\r\nCSeq: " + cseq + "\r\n\r\n"))
 							go func() {
 								for {
 									_, err := c.Write([]byte{'$', 0, 0, 4, 1, 2, 3, 4})
@@ -177,15 +180,16 @@ L:
 					if req == "" {
 						continue
 					}
+					cseq := headerGet(parseMockHeaders(req), "CSeq")
 					if req[:7] == "OPTIONS" {
-						c.Write([]byte("RTSP/1.0 200 OK\r\nPublic: OPTIONS, DESCRIBE, SETUP, PLAY\r\nCSeq: 1\r\n\r\n"))
+						c.Write([]byte("RTSP/1.0 200 OK\r\nPublic: OPTIONS, DESCRIBE, SETUP, PLAY\r\nCSeq: " + cseq + "\r\n\r\n"))
 					} else if req[:8] == "DESCRIBE" {
 						sdp := "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=Mock\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\nm=video 0 RTP/AVP 96\r\na=control:track1\r\n"
-						c.Write([]byte(fmt.Sprintf("RTSP/1.0 200 OK\r\nContent-Type: application/sdp\r\nContent-Length: %d\r\nCSeq: 2\r\n\r\n%s", len(sdp), sdp)))
+						c.Write([]byte(fmt.Sprintf("RTSP/1.0 200 OK\r\nContent-Type: application/sdp\r\nContent-Length: %d\r\nCSeq: %s\r\n\r\n%s", len(sdp), cseq, sdp)))
 					} else if req[:5] == "SETUP" {
-						c.Write([]byte("RTSP/1.0 200 OK\r\nTransport: RTP/AVP/TCP;unicast;interleaved=0-1;ssrc=12345678\r\nSession: 1234\r\nCSeq: 3\r\n\r\n"))
+						c.Write([]byte("RTSP/1.0 200 OK\r\nTransport: RTP/AVP/TCP;unicast;interleaved=0-1;ssrc=12345678\r\nSession: 1234\r\nCSeq: " + cseq + "\r\n\r\n"))
 					} else if req[:4] == "PLAY" {
-						c.Write([]byte("RTSP/1.0 200 OK\r\nRTP-Info: url=rtsp://127.0.0.1/mock/track1;seq=1;rtptime=1\r\nSession: 1234\r\nCSeq: 4\r\n\r\n"))
+						c.Write([]byte("RTSP/1.0 200 OK\r\nRTP-Info: url=rtsp://127.0.0.1/mock/track1;seq=1;rtptime=1\r\nSession: 1234\r\nCSeq: " + cseq + "\r\n\r\n"))
 						go func() {
 							for {
 								_, err := c.Write([]byte{'$', 0, 0, 4, 1, 2, 3, 4})
@@ -250,11 +254,12 @@ func TestDescribeOnDemand(t *testing.T) {
 					if req == "" {
 						continue
 					}
+					cseq := headerGet(parseMockHeaders(req), "CSeq")
 					if req[:7] == "OPTIONS" {
-						c.Write([]byte("RTSP/1.0 200 OK\r\nPublic: OPTIONS, DESCRIBE, SETUP, PLAY\r\nCSeq: 1\r\n\r\n"))
+						c.Write([]byte("RTSP/1.0 200 OK\r\nPublic: OPTIONS, DESCRIBE, SETUP, PLAY\r\nCSeq: " + cseq + "\r\n\r\n"))
 					} else if req[:8] == "DESCRIBE" {
 						sdp := "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=Mock\r\nc=IN IP4 127.0.0.1\r\nt=0 0\r\nm=video 0 RTP/AVP 96\r\na=control:track1\r\n"
-						c.Write([]byte(fmt.Sprintf("RTSP/1.0 200 OK\r\nContent-Type: application/sdp\r\nContent-Length: %d\r\nCSeq: 2\r\n\r\n%s", len(sdp), sdp)))
+						c.Write([]byte(fmt.Sprintf("RTSP/1.0 200 OK\r\nContent-Type: application/sdp\r\nContent-Length: %d\r\nCSeq: %s\r\n\r\n%s", len(sdp), cseq, sdp)))
 					}
 				}
 			}(conn)
@@ -288,3 +293,41 @@ func TestDescribeOnDemand(t *testing.T) {
 		t.Error("SDP should not be empty")
 	}
 }
+
+func TestMediaChannelsFromSetup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := NewServer(ctx)
+	cam := startMockCamera(t)
+
+	// The first media has no control and is not set up; the camera puts the
+	// video on channels of its own choosing.
+	sdp := "v=0\r\ns=Mock\r\nt=0 0\r\nm=application 0 RTP/AVP 107\r\n" +
+		"m=video 0 RTP/AVP 96\r\na=rtpmap:96 H264/90000\r\na=control:track1\r\n"
+	cam.handle = func(method, req string, conn net.Conn) string {
+		switch method {
+		case "DESCRIBE":
+			return fmt.Sprintf("RTSP/1.0 200 OK\r\nContent-Type: application/sdp\r\nContent-Length: %d\r\n\r\n%s", len(sdp), sdp)
+		case "SETUP":
+			return "RTSP/1.0 200 OK\r\nTransport: RTP/AVP/TCP;unicast;interleaved=6-7\r\nSession: 1234\r\n\r\n"
+		}
+		return ""
+	}
+
+	stream := server.LookupStream(cam.Addr(), "", "", "/mock")
+	stream.Start()
+	deadline := time.Now().Add(5 * time.Second)
+	for stream.GetState() != StatePlaying {
+		if time.Now().After(deadline) {
+			t.Fatalf("stream not playing: %s", stream.GetState())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if channels := stream.mediaChannels(); !maps.Equal(channels, map[int]int{1: 6}) {
+		t.Errorf("media channels %v, want the video on 6", channels)
+	}
+	src := newTSSource("test", stream.Path, stream.GetSDP(), stream.mediaChannels(), time.Now(), nil)
+	if _, ok := src.tracks[6]; !ok || len(src.tracks) != 1 {
+		t.Errorf("TS tracks on %v, want channel 6", slices.Collect(maps.Keys(src.tracks)))
+	}
+}
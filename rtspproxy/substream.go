@@ -12,6 +12,8 @@ type Substream struct {
 	Channel       int
 	Host          string
 	Listener      *net.TCPConn
+	Conn          *net.UDPConn // local socket when the track is received over UDP
+	Source        string       // multicast sender for source-specific joins
 	Seq           int
 	RTPTime       int
 }
@@ -0,0 +1,230 @@
+package rtspproxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certReloadInterval throttles how often certificate files are stat'ed.
+const certReloadInterval = time.Second
+
+// certReloader serves a certificate/key pair and transparently reloads it
+// when either file changes on disk (e.g. after a certbot renewal).
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate %s: %w", r.certFile, err)
+	}
+	r.cert = &cert
+	r.certMod = certInfo.ModTime()
+	r.keyMod = keyInfo.ModTime()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. A failed reload keeps
+// serving the previous certificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.lastCheck) >= certReloadInterval {
+		r.lastCheck = time.Now()
+		certInfo, certErr := os.Stat(r.certFile)
+		keyInfo, keyErr := os.Stat(r.keyFile)
+		if certErr == nil && keyErr == nil && (!certInfo.ModTime().Equal(r.certMod) || !keyInfo.ModTime().Equal(r.keyMod)) {
+			if err := r.reload(); err != nil {
+				LogCriticalf("⚠️ [TLS] Certificate reload failed, keeping previous: %v", err)
+			} else {
+				LogCriticalf("🔐 [TLS] Reloaded certificate %s", r.certFile)
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+// newServerTLSConfig builds the RTSPS listener configuration from GlobalConfig.
+func newServerTLSConfig() (*tls.Config, error) {
+	if GlobalConfig.TLSCert == "" || GlobalConfig.TLSKey == "" {
+		return nil, errors.New("RTSPS requires both a certificate and a key")
+	}
+	reloader, err := newCertReloader(GlobalConfig.TLSCert, GlobalConfig.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if GlobalConfig.TLSClientCA != "" {
+		pem, err := os.ReadFile(GlobalConfig.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in client CA %s", GlobalConfig.TLSClientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ListenTLS starts the RTSPS listener on the specified port.
+func (server *Server) ListenTLS(portNum int) error {
+	config, err := newServerTLSConfig()
+	if err != nil {
+		return fmt.Errorf("failed to setup TLS: %w", err)
+	}
+	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("0.0.0.0:%d", portNum))
+	if err != nil {
+		return fmt.Errorf("failed to resolve TCP address: %w", err)
+	}
+	listener, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on TCP: %w", err)
+	}
+	server.tlsPort = portNum
+	server.tlsListener = listener
+	server.tlsConfig = config
+	return nil
+}
+
+func (server *Server) tlsConnectionHandler() {
+	for {
+		select {
+		case <-server.ctx.Done():
+			return
+		default:
+			server.tlsListener.SetDeadline(time.Now().Add(time.Second))
+			tcpConn, err := server.tlsListener.AcceptTCP()
+			if err != nil {
+				if server.ctx.Err() != nil || strings.Contains(err.Error(), "closed network connection") {
+					return
+				}
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					continue
+				}
+				LogCriticalf("Failed to accept RTSPS client: %s", err.Error())
+				continue
+			}
+
+			tcpConn.SetReadBuffer(50 * 1024)
+			server.clients.Add(1)
+			go func() {
+				defer server.clients.Done()
+				// Handshake up front: a handshake interrupted by the client reader's
+				// short poll deadline would fail permanently.
+				conn := tls.Server(tcpConn, server.tlsConfig)
+				conn.SetDeadline(time.Now().Add(GlobalConfig.DialTimeout))
+				if err := conn.HandshakeContext(server.ctx); err != nil {
+					LogCriticalf("RTSPS handshake with [%s] failed: %v", tcpConn.RemoteAddr(), err)
+					conn.Close()
+					return
+				}
+				conn.SetDeadline(time.Time{})
+
+				server.serveConn(conn)
+			}()
+		}
+	}
+}
+
+// upstreamPin returns the configured certificate fingerprint for a camera,
+// matching host:port first and then the bare host.
+func upstreamPin(hostPort string) string {
+	if pin, ok := GlobalConfig.UpstreamPins[hostPort]; ok {
+		return pin
+	}
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return ""
+	}
+	return GlobalConfig.UpstreamPins[host]
+}
+
+// normalizeFingerprint lowercases a hex fingerprint and drops ':' separators,
+// so pins can be pasted from `openssl x509 -fingerprint -sha256`.
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fp), ":", ""))
+}
+
+// newUpstreamTLSConfig builds the client configuration for an rtsps camera.
+// A pinned camera is trusted by fingerprint alone, which also covers
+// self-signed devices without disabling verification globally.
+func newUpstreamTLSConfig(hostPort string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = hostPort
+	}
+	config := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if GlobalConfig.UpstreamCA != "" {
+		pem, err := os.ReadFile(GlobalConfig.UpstreamCA)
+		if err != nil {
+			return nil, fmt.Errorf("read upstream CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in upstream CA %s", GlobalConfig.UpstreamCA)
+		}
+		config.RootCAs = pool
+	}
+
+	if pin := upstreamPin(hostPort); pin != "" {
+		want := normalizeFingerprint(pin)
+		config.InsecureSkipVerify = true // replaced by the pin check below
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("camera presented no certificate")
+			}
+			sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+			if got := hex.EncodeToString(sum[:]); got != want {
+				return fmt.Errorf("certificate fingerprint %s does not match pin for %s", got, hostPort)
+			}
+			return nil
+		}
+	} else if GlobalConfig.UpstreamInsecureSkipVerify {
+		config.InsecureSkipVerify = true
+	}
+	return config, nil
+}
@@ -0,0 +1,255 @@
+package rtspproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a leaf certificate and key signed by the CA and returns their paths.
+func (ca *testCA) issue(t *testing.T, dir, name string, serial int64) (string, string) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// startTLSServer runs a proxy with an RTSPS listener and returns its address.
+func startTLSServer(t *testing.T, certFile, keyFile, clientCA string) string {
+	t.Helper()
+	oldCert, oldKey, oldCA := GlobalConfig.TLSCert, GlobalConfig.TLSKey, GlobalConfig.TLSClientCA
+	GlobalConfig.TLSCert, GlobalConfig.TLSKey, GlobalConfig.TLSClientCA = certFile, keyFile, clientCA
+	t.Cleanup(func() { GlobalConfig.TLSCert, GlobalConfig.TLSKey, GlobalConfig.TLSClientCA = oldCert, oldKey, oldCA })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server := NewServer(ctx)
+	if err := server.Listen(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ListenTLS(0); err != nil {
+		t.Fatal(err)
+	}
+	go server.Start()
+	t.Cleanup(func() {
+		cancel()
+		shutdownCtx, done := context.WithTimeout(context.Background(), 5*time.Second)
+		defer done()
+		server.Shutdown(shutdownCtx)
+	})
+	return server.tlsListener.Addr().String()
+}
+
+func rtspsOptions(addr string, config *tls.Config) (string, *tls.ConnectionState, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 2 * time.Second}, "tcp", addr, config)
+	if err != nil {
+		return "", nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("OPTIONS * RTSP/1.0\r\nCSeq: 1\r\n\r\n")); err != nil {
+		return "", nil, err
+	}
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	state := conn.ConnectionState()
+	return status, &state, err
+}
+
+func TestRTSPSListener(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, dir, "server", 100)
+	addr := startTLSServer(t, certFile, keyFile, "")
+
+	status, state, err := rtspsOptions(addr, &tls.Config{RootCAs: ca.pool(), ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(status, "RTSP/1.0 200") {
+		t.Errorf("unexpected status over RTSPS: %q", status)
+	}
+	if serial := state.PeerCertificates[0].SerialNumber.Int64(); serial != 100 {
+		t.Errorf("expected serial 100, got %d", serial)
+	}
+
+	// Renew the certificate in place; new connections must see it.
+	ca.issue(t, dir, "server", 200)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	time.Sleep(certReloadInterval + 100*time.Millisecond)
+
+	_, state, err = rtspsOptions(addr, &tls.Config{RootCAs: ca.pool(), ServerName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial := state.PeerCertificates[0].SerialNumber.Int64(); serial != 200 {
+		t.Errorf("certificate not reloaded: serial %d", serial)
+	}
+}
+
+func TestRTSPSClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, dir, "server", 1)
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, ca.pem, 0600)
+	addr := startTLSServer(t, certFile, keyFile, caFile)
+
+	if _, _, err := rtspsOptions(addr, &tls.Config{RootCAs: ca.pool(), ServerName: "localhost"}); err == nil {
+		t.Error("expected RTSPS to reject a client without certificate")
+	}
+
+	clientCert, clientKey := ca.issue(t, dir, "viewer", 2)
+	pair, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, _, err := rtspsOptions(addr, &tls.Config{RootCAs: ca.pool(), ServerName: "localhost", Certificates: []tls.Certificate{pair}})
+	if err != nil || !strings.HasPrefix(status, "RTSP/1.0 200") {
+		t.Errorf("client with valid certificate rejected: %q %v", status, err)
+	}
+}
+
+func startTLSMockCamera(t *testing.T, certFile, keyFile string) *mockCamera {
+	t.Helper()
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{pair}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveMockCamera(t, ln)
+}
+
+func TestRTSPSUpstream(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, dir, "camera", 7)
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, ca.pem, 0600)
+	certPEM, _ := os.ReadFile(certFile)
+	block, _ := pem.Decode(certPEM)
+	sum := sha256.Sum256(block.Bytes)
+	fingerprint := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	cases := []struct {
+		name   string
+		setup  func(c *Config)
+		expect bool
+	}{
+		{"system roots reject private CA", func(c *Config) {}, false},
+		{"configured CA", func(c *Config) { c.UpstreamCA = caFile }, true},
+		{"pinned fingerprint", func(c *Config) { c.UpstreamPins = map[string]string{"127.0.0.1": fingerprint} }, true},
+		{"wrong pin", func(c *Config) { c.UpstreamPins = map[string]string{"127.0.0.1": strings.Repeat("00", 32)} }, false},
+		{"insecure skip verify", func(c *Config) { c.UpstreamInsecureSkipVerify = true }, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			oldCA, oldPins, oldSkip := GlobalConfig.UpstreamCA, GlobalConfig.UpstreamPins, GlobalConfig.UpstreamInsecureSkipVerify
+			defer func() {
+				GlobalConfig.UpstreamCA, GlobalConfig.UpstreamPins, GlobalConfig.UpstreamInsecureSkipVerify = oldCA, oldPins, oldSkip
+			}()
+			tc.setup(GlobalConfig)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			server := NewServer(ctx)
+			cam := startTLSMockCamera(t, certFile, keyFile)
+
+			stream := server.LookupStreamScheme("rtsps", cam.Addr(), "", "", "/mock")
+			client, _ := newTestClient(t, server)
+			defer client.Destroy()
+			stream.AddClient(client, "1234")
+
+			deadline := time.Now().Add(1500 * time.Millisecond)
+			for stream.GetState() != StatePlaying && time.Now().Before(deadline) {
+				time.Sleep(20 * time.Millisecond)
+			}
+			playing := stream.GetState() == StatePlaying
+			if playing != tc.expect {
+				t.Errorf("expected playing=%v, state %s", tc.expect, stream.GetState())
+			}
+			stream.Destroy()
+		})
+	}
+}
+
+func TestNewRemoteDefaultPorts(t *testing.T) {
+	server := &Server{ctx: context.Background()}
+	plain := NewStream(server, "127.0.0.1", "", "", "/a")
+	if remote := NewRemote(plain); remote == nil || remote.Host != "127.0.0.1:554" || remote.scheme != "rtsp" {
+		t.Errorf("rtsp default port not applied: %+v", remote)
+	}
+	secure := NewStream(server, "127.0.0.1", "", "", "/a")
+	secure.Scheme = "rtsps"
+	if remote := NewRemote(secure); remote == nil || remote.Host != "127.0.0.1:322" || remote.scheme != "rtsps" {
+		t.Errorf("rtsps default port not applied: %+v", remote)
+	}
+}
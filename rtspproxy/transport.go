@@ -24,3 +24,14 @@ func NewTransport(session *Session, substreamName, protocol, comType string) *Tr
 	}
 	return transport
 }
+
+// RTPChannel returns the channel the transport's RTP is dispatched on, or -1
+// when the camera's reply did not assign one.
+func (transport *Transport) RTPChannel() int {
+	transport.mu.RLock()
+	defer transport.mu.RUnlock()
+	if sub, ok := transport.Substreams[0]; ok {
+		return sub.Channel
+	}
+	return -1
+}
@@ -0,0 +1,87 @@
+package rtspproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// UDPPair is an RTP/RTCP socket pair bound to consecutive local ports
+// (RTP on the even port, RTCP on the next odd one, RFC 3550 §11).
+type UDPPair struct {
+	RTP  *net.UDPConn
+	RTCP *net.UDPConn
+}
+
+// udpPortMu serialises port allocation so concurrent SETUPs never race for the same pair.
+var (
+	udpPortMu   sync.Mutex
+	udpNextPort int
+)
+
+// ListenUDPPair binds a fresh RTP/RTCP pair on host within
+// GlobalConfig.RTPPortMin..RTPPortMax. An empty host binds all interfaces.
+func ListenUDPPair(host string) (*UDPPair, error) {
+	udpPortMu.Lock()
+	defer udpPortMu.Unlock()
+
+	minPort := GlobalConfig.RTPPortMin &^ 1
+	maxPort := GlobalConfig.RTPPortMax
+	if minPort <= 0 || maxPort <= minPort {
+		return nil, errors.New("invalid RTP port range")
+	}
+	if udpNextPort < minPort || udpNextPort+1 > maxPort {
+		udpNextPort = minPort
+	}
+
+	span := (maxPort - minPort + 1) / 2
+	for i := 0; i < span; i++ {
+		port := udpNextPort
+		udpNextPort += 2
+		if udpNextPort+1 > maxPort {
+			udpNextPort = minPort
+		}
+
+		rtp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(host), Port: port})
+		if err != nil {
+			continue
+		}
+		rtcp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(host), Port: port + 1})
+		if err != nil {
+			rtp.Close()
+			continue
+		}
+		rtp.SetWriteBuffer(GlobalConfig.BufferSize * 4)
+		return &UDPPair{RTP: rtp, RTCP: rtcp}, nil
+	}
+	return nil, fmt.Errorf("no free RTP/RTCP port pair in %d-%d", minPort, maxPort)
+}
+
+// Ports returns the local RTP and RTCP port numbers.
+func (pair *UDPPair) Ports() (int, int) {
+	return pair.RTP.LocalAddr().(*net.UDPAddr).Port, pair.RTCP.LocalAddr().(*net.UDPAddr).Port
+}
+
+// Close releases both sockets.
+func (pair *UDPPair) Close() {
+	pair.RTP.Close()
+	pair.RTCP.Close()
+}
+
+// parsePortRange parses "a-b" (or a single "a", meaning a-(a+1)) as used by
+// client_port=, server_port= and port= transport parameters.
+func parsePortRange(value string) (int, int, error) {
+	var first, second int
+	n, err := fmt.Sscanf(value, "%d-%d", &first, &second)
+	if n == 0 {
+		return 0, 0, fmt.Errorf("bad port range %q: %v", value, err)
+	}
+	if n == 1 {
+		second = first + 1
+	}
+	if first <= 0 || first > 65535 || second <= 0 || second > 65535 {
+		return 0, 0, fmt.Errorf("bad port range %q", value)
+	}
+	return first, second, nil
+}
@@ -0,0 +1,312 @@
+package rtspproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenUDPPairEvenPorts(t *testing.T) {
+	pair, err := ListenUDPPair("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pair.Close()
+
+	rtp, rtcp := pair.Ports()
+	if rtp%2 != 0 || rtcp != rtp+1 {
+		t.Errorf("expected even/odd pair, got %d-%d", rtp, rtcp)
+	}
+	if rtp < GlobalConfig.RTPPortMin || rtcp > GlobalConfig.RTPPortMax {
+		t.Errorf("pair %d-%d outside configured range", rtp, rtcp)
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	cases := map[string][2]int{
+		"5000-5001": {5000, 5001},
+		"6000":      {6000, 6001},
+	}
+	for in, want := range cases {
+		a, b, err := parsePortRange(in)
+		if err != nil || a != want[0] || b != want[1] {
+			t.Errorf("parsePortRange(%q) = %d, %d, %v", in, a, b, err)
+		}
+	}
+	if _, _, err := parsePortRange("x-y"); err == nil {
+		t.Error("expected error for malformed range")
+	}
+}
+
+func TestUDPClientDelivery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := NewServer(ctx)
+	cam := startMockCamera(t)
+
+	stream := server.LookupStream(cam.Addr(), "", "", "/mock")
+	client, _ := newTestClient(t, server)
+	defer client.Destroy()
+
+	clientRTP, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientRTP.Close()
+	port := clientRTP.LocalAddr().(*net.UDPAddr).Port
+
+	request, _ := NewRequest("SETUP", &url.URL{Scheme: "rtsp", Host: cam.Addr(), Path: "/mock/track1"})
+	request.Headers["Transport"] = "RTP/AVP;unicast;client_port=" + itoaPair(port)
+	response := client.handleSetup(stream, request)
+	if response.Code != 200 {
+		t.Fatalf("expected 200, got %d", response.Code)
+	}
+	transport := response.Headers["Transport"]
+	if !strings.Contains(transport, "server_port=") || !strings.HasPrefix(transport, "RTP/AVP;unicast") {
+		t.Errorf("unexpected Transport reply: %s", transport)
+	}
+
+	clientRTP.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 1500)
+	n, from, err := clientRTP.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("no RTP datagram received: %v", err)
+	}
+	if n != 4 || buf[0] != 0x80 {
+		t.Errorf("expected bare RTP payload without interleaved header, got % x", buf[:n])
+	}
+	if !strings.Contains(transport, "server_port="+itoaPair(from.Port)) {
+		t.Errorf("datagram from %d does not match %s", from.Port, transport)
+	}
+}
+
+// A datagram from the client while it leaves must not deadlock the stream:
+// its reader needs the stream lock that RemoveClient holds.
+func TestUDPClientRemovedWhileSending(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := NewServer(ctx)
+	cam := startMockCamera(t)
+
+	stream := server.LookupStream(cam.Addr(), "", "", "/mock")
+	client, _ := newTestClient(t, server)
+	defer client.Destroy()
+
+	clientRTP, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientRTP.Close()
+	request, _ := NewRequest("SETUP", &url.URL{Scheme: "rtsp", Host: cam.Addr(), Path: "/mock/track1"})
+	request.Headers["Transport"] = "RTP/AVP;unicast;client_port=" + itoaPair(clientRTP.LocalAddr().(*net.UDPAddr).Port)
+	response := client.handleSetup(stream, request)
+	var serverRTP, serverRTCP int
+	if _, err := fmt.Sscanf(response.Headers["Transport"][strings.Index(response.Headers["Transport"], "server_port="):], "server_port=%d-%d", &serverRTP, &serverRTCP); err != nil {
+		t.Fatalf("%d %q: %v", response.Code, response.Headers["Transport"], err)
+	}
+
+	// With a reader lock held, RemoveClient queues for the lock and the
+	// datagram's reader queues behind it.
+	stream.mu.RLock()
+	done := make(chan struct{})
+	go func() {
+		stream.RemoveClient(client)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	clientRTP.WriteToUDP([]byte{0x81, 203, 0, 1, 0, 0, 0, 1}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: serverRTCP})
+	time.Sleep(50 * time.Millisecond)
+	stream.mu.RUnlock()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("RemoveClient deadlocked with the UDP reader")
+	}
+}
+
+// A camera reply that sets up no channel fails the connection instead of
+// leaving a track nobody can map, and a client SETUP of such a track is
+// refused.
+func TestSetupWithoutUpstreamChannel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := NewServer(ctx)
+
+	portless := startMockCamera(t)
+	portless.handle = func(method, req string, conn net.Conn) string {
+		if method == "SETUP" {
+			return "RTSP/1.0 200 OK\r\nTransport: RTP/AVP;unicast;server_port=6970-6971\r\nSession: 1234\r\n\r\n"
+		}
+		return ""
+	}
+	failing := server.LookupStreamScheme("rtsp+udp", portless.Addr(), "", "", "/mock")
+	failing.AddConsumer(nopConsumer{})
+	t.Cleanup(func() { failing.RemoveConsumer(nopConsumer{}) })
+	time.Sleep(500 * time.Millisecond)
+	if methods := strings.Join(portless.Methods(), " "); !strings.Contains(methods, "SETUP") || strings.Contains(methods, "PLAY") {
+		t.Errorf("camera got %s", methods)
+	}
+
+	cam := startMockCamera(t)
+	stream := server.LookupStream(cam.Addr(), "", "", "/mock")
+	stream.AddConsumer(nopConsumer{})
+	t.Cleanup(func() { stream.RemoveConsumer(nopConsumer{}) })
+	deadline := time.Now().Add(5 * time.Second)
+	for stream.GetState() != StatePlaying {
+		if time.Now().After(deadline) {
+			t.Fatal("stream did not start")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	upstream := stream.LookupTransport("track1", "", "")
+	if upstream == nil {
+		t.Fatal("no upstream transport for track1")
+	}
+	upstream.mu.Lock()
+	delete(upstream.Substreams, 0)
+	upstream.mu.Unlock()
+	client, _ := newTestClient(t, server)
+	defer client.Destroy()
+	for _, transport := range []string{"RTP/AVP/TCP;unicast;interleaved=0-1", "RTP/AVP;multicast"} {
+		request, _ := NewRequest("SETUP", &url.URL{Scheme: "rtsp", Host: cam.Addr(), Path: "/mock/track1"})
+		request.Headers["Transport"] = transport
+		if response := client.handleSetup(stream, request); response.Code != 461 {
+			t.Errorf("%s: %d", transport, response.Code)
+		}
+	}
+}
+
+func itoaPair(port int) string {
+	return fmt.Sprintf("%d-%d", port, port+1)
+}
+
+func TestUDPUpstream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := NewServer(ctx)
+	cam := startMockCamera(t)
+
+	sender, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	senderPort := sender.LocalAddr().(*net.UDPAddr).Port
+
+	var clientPort int
+	cam.handle = func(method, req string, conn net.Conn) string {
+		switch method {
+		case "SETUP":
+			transport := headerGet(parseMockHeaders(req), "Transport")
+			if !strings.HasPrefix(transport, "RTP/AVP;unicast;client_port=") {
+				t.Errorf("expected UDP SETUP, got %s", transport)
+			}
+			clientPort, _, _ = parsePortRange(strings.TrimPrefix(transport, "RTP/AVP;unicast;client_port="))
+			return fmt.Sprintf("RTSP/1.0 200 OK\r\nTransport: RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d;ssrc=01020304\r\nSession: 1234\r\n\r\n",
+				clientPort, clientPort+1, senderPort, senderPort+1)
+		case "PLAY":
+			go func() {
+				for i := 0; i < 100; i++ {
+					sender.WriteToUDP([]byte{0x80, 96, 0, byte(i)}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: clientPort})
+					time.Sleep(20 * time.Millisecond)
+				}
+			}()
+			return "RTSP/1.0 200 OK\r\nSession: 1234\r\n\r\n"
+		}
+		return ""
+	}
+
+	stream := server.LookupStreamScheme("rtsp+udp", cam.Addr(), "", "", "/mock")
+	client, peer := newTestClient(t, server)
+	defer client.Destroy()
+	stream.AddClient(client, "1234")
+	stream.MapChannel(client, 0, 0)
+
+	peer.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 64)
+	n, err := peer.Read(buf)
+	if err != nil {
+		t.Fatalf("no packet relayed from UDP upstream: %v", err)
+	}
+	if n < 8 || buf[0] != '$' || buf[1] != 0 || buf[4] != 0x80 {
+		t.Errorf("unexpected interleaved packet: % x", buf[:n])
+	}
+}
+
+func TestUDPUpstreamFallbackToTCP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := NewServer(ctx)
+	cam := startMockCamera(t)
+
+	cam.handle = func(method, req string, conn net.Conn) string {
+		if method == "SETUP" && !strings.Contains(req, "RTP/AVP/TCP") {
+			return "RTSP/1.0 461 Unsupported Transport\r\n\r\n"
+		}
+		return ""
+	}
+
+	stream := server.LookupStreamScheme("rtsp+udp", cam.Addr(), "", "", "/mock")
+	stream.Start()
+
+	select {
+	case <-stream.ReadyCh():
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not start after 461 fallback")
+	}
+	if stream.GetState() != StatePlaying {
+		t.Errorf("expected Playing, got %s", stream.GetState())
+	}
+	setups := 0
+	for _, m := range cam.Methods() {
+		if m == "SETUP" {
+			setups++
+		}
+	}
+	if setups != 2 {
+		t.Errorf("expected UDP SETUP followed by TCP SETUP, got %d SETUPs", setups)
+	}
+	if stream.lowerTransport() != "tcp" {
+		t.Error("stream should remember that the camera rejected UDP")
+	}
+}
+
+func TestUDPClientSourceFilter(t *testing.T) {
+	pair, err := ListenUDPPair("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := NewClientSession(nil, nil, "1")
+	cs.active = true
+	received := make(chan string, 4)
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	cs.AddUDP(pair, 0, client, client, func(channel int, data []byte) { received <- string(data) })
+	defer cs.Stop()
+
+	rtp, rtcp := pair.Ports()
+	for _, sender := range []net.IP{net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 1)} {
+		conn, err := net.DialUDP("udp", &net.UDPAddr{IP: sender}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: rtcp})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("from " + sender.String()))
+		conn.Close()
+	}
+	select {
+	case data := <-received:
+		if data != "from 127.0.0.1" {
+			t.Errorf("relayed %q", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("nothing relayed from the client on port %d", rtp+1)
+	}
+	select {
+	case data := <-received:
+		t.Errorf("relayed %q", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,342 @@
+package rtspproxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+)
+
+// WebRTC output over WHEP (WebRTC-HTTP Egress Protocol):
+//
+//	POST   /whep/<scheme>/[user:pass@]host[:port]/path   SDP offer -> 201 + SDP answer
+//	DELETE /whep/session/<id>                           (the Location of the 201)
+//
+// The proxy is ICE-lite on a single UDP port (ListenWebRTC). Camera RTP
+// packets are forwarded as they come out of Stream.dispatch, without
+// transcoding, so only tracks browsers decode natively are offered:
+// H.264, Opus, PCMU and PCMA.
+
+const whepSessionPrefix = "/whep/session/"
+
+// webrtcServer holds the WebRTC API bound to the ICE UDP port and the live
+// WHEP sessions.
+type webrtcServer struct {
+	api      *webrtc.API
+	udp      *net.UDPConn
+	mu       sync.Mutex
+	sessions map[string]*whepSession
+}
+
+// ListenWebRTC opens the UDP port used for ICE and DTLS-SRTP by WHEP
+// sessions. WHEP requests are refused until it is called.
+func (server *Server) ListenWebRTC(portNum int) error {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{Port: portNum})
+	if err != nil {
+		return fmt.Errorf("failed to listen on UDP: %w", err)
+	}
+
+	settings := webrtc.SettingEngine{}
+	settings.SetLite(true)
+	settings.SetICEUDPMux(webrtc.NewICEUDPMux(nil, udp))
+	settings.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6})
+	settings.SetIncludeLoopbackCandidate(true)
+	if len(GlobalConfig.WebRTCPublicIPs) > 0 {
+		settings.SetNAT1To1IPs(GlobalConfig.WebRTCPublicIPs, webrtc.ICECandidateTypeHost)
+	}
+
+	media := &webrtc.MediaEngine{}
+	if err := media.RegisterDefaultCodecs(); err != nil {
+		udp.Close()
+		return fmt.Errorf("failed to register codecs: %w", err)
+	}
+	interceptors := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(media, interceptors); err != nil {
+		udp.Close()
+		return fmt.Errorf("failed to register interceptors: %w", err)
+	}
+
+	server.webrtc = &webrtcServer{
+		api: webrtc.NewAPI(
+			webrtc.WithSettingEngine(settings),
+			webrtc.WithMediaEngine(media),
+			webrtc.WithInterceptorRegistry(interceptors),
+		),
+		udp:      udp,
+		sessions: make(map[string]*whepSession),
+	}
+	return nil
+}
+
+// shutdownWebRTC ends all WHEP sessions and closes the ICE port.
+func (server *Server) shutdownWebRTC() {
+	w := server.webrtc
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	sessions := make([]*whepSession, 0, len(w.sessions))
+	for _, ws := range w.sessions {
+		sessions = append(sessions, ws)
+	}
+	w.mu.Unlock()
+	for _, ws := range sessions {
+		ws.close("server shutdown")
+	}
+	w.udp.Close()
+}
+
+// whepSession is one browser peer. It is attached to the Stream as a
+// Consumer, so it counts as a viewer and is isolated from the upstream
+// reader by its own packet queue.
+type whepSession struct {
+	id        string
+	owner     *webrtcServer
+	stream    *Stream
+	pc        *webrtc.PeerConnection
+	tracks    map[int]*webrtc.TrackLocalStaticRTP // upstream channel -> track
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Consume implements Consumer.
+func (ws *whepSession) Consume(channel int, packet []byte) {
+	track, ok := ws.tracks[channel]
+	if !ok {
+		return // RTCP and tracks WebRTC cannot carry; pion sends its own reports
+	}
+	if _, err := track.Write(packet); err != nil && err != io.ErrClosedPipe {
+		Logf("🌐 [WHEP] Session %s write error: %v", ws.id, err)
+	}
+}
+
+func (ws *whepSession) close(reason string) {
+	ws.closeOnce.Do(func() {
+		close(ws.done)
+		ws.owner.mu.Lock()
+		delete(ws.owner.sessions, ws.id)
+		ws.owner.mu.Unlock()
+
+		ws.stream.RemoveConsumer(ws)
+		ws.pc.Close()
+		GlobalMetrics.ActiveClients.Add(-1)
+		LogCriticalf("🌐 [WHEP] Session %s for stream [%s] closed: %s", ws.id, ws.stream.Path, reason)
+	})
+}
+
+// webrtcCodec maps an SDP media of the camera to a WebRTC codec, or returns
+// false for codecs browsers cannot play without transcoding.
+func webrtcCodec(media *sdpMedia) (webrtc.RTPCodecCapability, bool) {
+	switch media.Codec {
+	case "H264":
+		profile := media.Fmtp["profile-level-id"]
+		if profile == "" {
+			profile = "42e01f"
+		}
+		return webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeH264,
+			ClockRate:   90000,
+			SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + profile,
+		}, true
+	case "OPUS":
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, true
+	case "PCMU":
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}, true
+	case "PCMA":
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000}, true
+	}
+	return webrtc.RTPCodecCapability{}, false
+}
+
+// serveWHEP handles /whep/<scheme>/<host>/<path> offers and session teardown.
+func (server *Server) serveWHEP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "Location")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if server.webrtc == nil {
+		http.Error(w, "WebRTC is disabled", http.StatusNotFound)
+		return
+	}
+
+	if id, ok := strings.CutPrefix(r.URL.Path, whepSessionPrefix); ok {
+		if r.Method != http.MethodDelete {
+			// ICE-lite with all candidates in the answer: no trickle ICE or restarts.
+			w.Header().Set("Allow", "DELETE, OPTIONS")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		server.webrtc.mu.Lock()
+		ws := server.webrtc.sessions[id]
+		server.webrtc.mu.Unlock()
+		if ws == nil {
+			http.NotFound(w, r)
+			return
+		}
+		ws.close("deleted by client")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/sdp") {
+		http.Error(w, "expected application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+	scheme, host, username, password, streamPath, ok := parseProxyPath(strings.TrimPrefix(r.URL.Path, "/whep"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	offer, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		http.Error(w, "failed to read offer", http.StatusBadRequest)
+		return
+	}
+	stream := server.LookupStreamScheme(scheme, host, username, password, streamPath)
+	if stream == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	stream.Start()
+	select {
+	case <-server.ctx.Done():
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	case <-stream.ReadyCh(): // tracks have channels once the camera set them up
+	case <-time.After(10 * time.Second):
+	}
+	sdp, channels := stream.GetSDP(), stream.mediaChannels()
+	if sdp == "" || channels == nil || stream.GetState() == StateDestroyed {
+		LogCriticalf("❌ [WHEP] Failed to get SDP for %s (timeout or error)", stream.Path)
+		http.Error(w, "stream not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	ws, answer, err := server.webrtc.newSession(stream, sdp, channels, string(offer))
+	if err != nil {
+		LogCriticalf("❌ [WHEP] Stream [%s]: %v", stream.Path, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", whepSessionPrefix+ws.id)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer)
+}
+
+// newSession negotiates a send-only peer for the stream's WebRTC-capable
+// tracks, set up on channels, and attaches it to the stream.
+func (w *webrtcServer) newSession(stream *Stream, streamSDP string, channels map[int]int, offer string) (*whepSession, string, error) {
+	var raw [16]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return nil, "", err
+	}
+	ws := &whepSession{
+		id:     hex.EncodeToString(raw[:]),
+		owner:  w,
+		stream: stream,
+		tracks: make(map[int]*webrtc.TrackLocalStaticRTP),
+		done:   make(chan struct{}),
+	}
+
+	pc, err := w.api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create peer connection: %w", err)
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		pc.Close()
+		return nil, "", fmt.Errorf("invalid offer: %w", err)
+	}
+
+	for i, media := range parseSDPMedia(streamSDP) {
+		channel, ok := channels[i]
+		if !ok {
+			continue // not set up
+		}
+		codec, ok := webrtcCodec(media)
+		if !ok {
+			Logf("🌐 [WHEP] Stream [%s] skipping %s track %q", stream.Path, media.Type, media.Codec)
+			continue
+		}
+		track, err := webrtc.NewTrackLocalStaticRTP(codec, fmt.Sprintf("%s%d", media.Type, i), "rtsp-proxy")
+		if err != nil {
+			pc.Close()
+			return nil, "", err
+		}
+		sender, err := pc.AddTrack(track)
+		if err != nil {
+			pc.Close()
+			return nil, "", fmt.Errorf("failed to add %s track: %w", media.Codec, err)
+		}
+		// Drain RTCP so the interceptors (NACK, reports) keep running.
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				if _, _, err := sender.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+		ws.tracks[channel] = track
+	}
+	if len(ws.tracks) == 0 {
+		pc.Close()
+		return nil, "", fmt.Errorf("no H.264, Opus, PCMU or PCMA track to send")
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		pc.Close()
+		return nil, "", fmt.Errorf("failed to create answer: %w", err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		pc.Close()
+		return nil, "", fmt.Errorf("failed to set answer: %w", err)
+	}
+	<-gathered
+
+	ws.pc = pc
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		Logf("🌐 [WHEP] Session %s state %s", ws.id, state)
+		switch state {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed, webrtc.PeerConnectionStateDisconnected:
+			go ws.close("peer " + state.String())
+		}
+	})
+
+	w.mu.Lock()
+	w.sessions[ws.id] = ws
+	w.mu.Unlock()
+	GlobalMetrics.ActiveClients.Add(1)
+	stream.AddConsumer(ws)
+	go func() {
+		select {
+		case <-stream.ctx.Done():
+			ws.close("stream destroyed")
+		case <-ws.done:
+		}
+	}()
+
+	LogCriticalf("🌐 [WHEP] Session %s started for stream [%s] (%d tracks)", ws.id, stream.Path, len(ws.tracks))
+	return ws, pc.LocalDescription().SDP, nil
+}
@@ -0,0 +1,151 @@
+package rtspproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// whepOffer builds a receive-only offer the way a browser WHEP player does.
+func whepOffer(t *testing.T) *webrtc.PeerConnection {
+	t.Helper()
+	settings := webrtc.SettingEngine{}
+	settings.SetIncludeLoopbackCandidate(true)
+	settings.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	pc, err := webrtc.NewAPI(webrtc.WithSettingEngine(settings)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if _, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	return pc
+}
+
+func TestWHEPPlayback(t *testing.T) {
+	server, addr := startTunnelServer(t)
+	if err := server.ListenWebRTC(0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.shutdownWebRTC)
+	cam := startH264Camera(t)
+
+	pc := whepOffer(t)
+	tracks := make(chan *webrtc.TrackRemote, 2)
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) { tracks <- track })
+
+	url := fmt.Sprintf("http://%s/whep/rtsp/%s/mock", addr, cam.Addr())
+	resp, err := http.Post(url, "application/sdp", strings.NewReader(pc.LocalDescription().SDP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("WHEP offer rejected: %d %s", resp.StatusCode, answer)
+	}
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, whepSessionPrefix) || !strings.Contains(string(answer), "a=ice-lite") {
+		t.Fatalf("unexpected answer (Location %q):\n%s", location, answer)
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(answer)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The H.264 packets of the camera arrive over DTLS-SRTP unchanged; the
+	// AAC track is not offered.
+	select {
+	case track := <-tracks:
+		if track.Codec().MimeType != webrtc.MimeTypeH264 {
+			t.Fatalf("unexpected codec %s", track.Codec().MimeType)
+		}
+		track.SetReadDeadline(time.Now().Add(5 * time.Second))
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pkt.Payload) == 0 || (pkt.Payload[0]&0x1f != 28 && pkt.Payload[0]&0x1f != 1) {
+			t.Errorf("unexpected H.264 payload % x", pkt.Payload[:min(len(pkt.Payload), 4)])
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no track received (state %s)", pc.ConnectionState())
+	}
+
+	stream := server.LookupStreamScheme("rtsp", cam.Addr(), "", "", "/mock")
+	stream.mu.RLock()
+	consumers := len(stream.consumers)
+	stream.mu.RUnlock()
+	if consumers != 1 {
+		t.Errorf("expected the peer to be attached as a consumer, got %d", consumers)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, "http://"+addr+location, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE session: %d", resp.StatusCode)
+	}
+	stream.mu.RLock()
+	consumers = len(stream.consumers)
+	stream.mu.RUnlock()
+	if consumers != 0 {
+		t.Errorf("session still attached after DELETE")
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second DELETE: expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestWHEPRejectsUnsupportedTracks(t *testing.T) {
+	server, addr := startTunnelServer(t)
+	if err := server.ListenWebRTC(0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.shutdownWebRTC)
+	cam := startMockCamera(t) // video without a known codec
+
+	pc := whepOffer(t)
+	url := fmt.Sprintf("http://%s/whep/rtsp/%s/mock", addr, cam.Addr())
+	resp, err := http.Post(url, "application/sdp", strings.NewReader(pc.LocalDescription().SDP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 without WebRTC-capable tracks, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post(url, "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("expected 415 for a non-SDP body, got %d", resp.StatusCode)
+	}
+}